@@ -0,0 +1,425 @@
+package broker
+
+// An MQTT 3.1.1 broker, so that the Plantcube can connect straight to
+// plantprism without a separate Mosquitto. It's only as much of a
+// broker as the Plantcube needs: sessions are always clean, retained
+// messages are only kept until plantprism stops, and QoS 2 is treated
+// as QoS 1. Messages from clients are handed to a Handler, and to any
+// other client that's subscribed.
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/logs"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	// PUBLISH_TIMEOUT is how long Publish waits for a client to
+	// acknowledge a message.
+	PUBLISH_TIMEOUT = 30 * time.Second
+
+	// CONNECT_TIMEOUT is how long a new connection has to send
+	// CONNECT.
+	CONNECT_TIMEOUT = 10 * time.Second
+
+	// WRITE_TIMEOUT is how long a write to a client can take
+	// before the client's regarded as gone.
+	WRITE_TIMEOUT = 10 * time.Second
+)
+
+var ErrNoSubscribers = errors.New("no client is subscribed to the topic")
+
+type embeddedFlags struct {
+	listen   string
+	cert     string
+	key      string
+	clientCA string
+	username string
+	password string
+}
+
+var ef embeddedFlags
+
+func InitFlags() {
+	flag.StringVar(&ef.listen, "broker_embedded_listen", "", "If set, run an MQTT broker listening with TLS on this host:port (e.g. ':8883') instead of connecting to -broker_url")
+	flag.StringVar(&ef.cert, "broker_embedded_cert", "", "Filename of the embedded broker's TLS certificate")
+	flag.StringVar(&ef.key, "broker_embedded_key", "", "Filename of the embedded broker's TLS key")
+	flag.StringVar(&ef.clientCA, "broker_embedded_client_ca", "", "Filename of a CA cert. Clients with a cert it signed are accepted.")
+	flag.StringVar(&ef.username, "broker_embedded_username", "", "Username clients can log into the embedded broker with")
+	flag.StringVar(&ef.password, "broker_embedded_password", "", "Password for -broker_embedded_username")
+}
+
+// Enabled says whether the embedded broker's been asked for.
+func Enabled() bool {
+	return ef.listen != ""
+}
+
+// Handler is given every message published by a client.
+type Handler func(topic string, payload []byte)
+
+// ConnectInfo is what a client says about itself when connecting.
+type ConnectInfo struct {
+	ClientID   string
+	Username   string
+	Password   []byte
+	RemoteAddr net.Addr
+	// Certificates are the client's verified TLS certificate
+	// chain, leaf first. It's empty if the client didn't present
+	// a certificate, or isn't using TLS.
+	Certificates []*x509.Certificate
+}
+
+// Authenticator decides whether a client may connect.
+type Authenticator func(ci *ConnectInfo) error
+
+type Options struct {
+	Handler      Handler
+	Authenticate Authenticator
+	// OnSubscribe, if set, is called after a client subscribes.
+	OnSubscribe func(clientID string)
+}
+
+type Broker struct {
+	log  *logs.Loggers
+	opts Options
+
+	mu       sync.Mutex
+	clients  map[string]*client
+	retained map[string][]byte // Topic to payload
+	ln       net.Listener
+	closed   bool
+}
+
+// New creates a broker. It doesn't listen until Serve is called.
+func New(l *logs.Loggers, opts Options) *Broker {
+	return &Broker{
+		log:      l,
+		opts:     opts,
+		clients:  make(map[string]*client),
+		retained: make(map[string][]byte),
+	}
+}
+
+// NewFromFlags creates a broker configured by the broker_embedded_*
+// flags, and the TLS listener it should Serve.
+func NewFromFlags(l *logs.Loggers, h Handler, onSubscribe func(clientID string)) (*Broker, net.Listener, error) {
+	config, err := tlsConfigFromFlags()
+	if err != nil {
+		return nil, nil, err
+	}
+	ln, err := tls.Listen("tcp", ef.listen, config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("embedded broker failed to listen: %w", err)
+	}
+	b := New(l, Options{
+		Handler:      h,
+		Authenticate: authenticateFlags,
+		OnSubscribe:  onSubscribe,
+	})
+	return b, ln, nil
+}
+
+// CheckFlags checks the broker_embedded_* flags, including that the
+// files they name load, without listening.
+func CheckFlags() error {
+	_, err := tlsConfigFromFlags()
+	return err
+}
+
+// tlsConfigFromFlags builds the TLS config the broker_embedded_*
+// flags describe. A broker that would accept any client is refused:
+// it'd let anyone on the network control the Plantcube.
+func tlsConfigFromFlags() (*tls.Config, error) {
+	if ef.cert == "" || ef.key == "" {
+		return nil, errors.New("the embedded broker needs a cert and key")
+	}
+	if ef.clientCA == "" && ef.username == "" {
+		return nil, errors.New("the embedded broker needs a client CA or a username, otherwise it accepts any client")
+	}
+	if ef.username != "" && ef.password == "" {
+		return nil, fmt.Errorf("the embedded broker needs a password for username '%s'", ef.username)
+	}
+	cert, err := tls.LoadX509KeyPair(ef.cert, ef.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load embedded broker cert: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	if ef.clientCA != "" {
+		pem, err := os.ReadFile(ef.clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certs found in client CA '%s'", ef.clientCA)
+		}
+	}
+	return config, nil
+}
+
+// authenticateFlags accepts a client with a cert signed by the client
+// CA, or with the configured username and password.
+func authenticateFlags(ci *ConnectInfo) error {
+	if len(ci.Certificates) > 0 {
+		// The TLS handshake has already checked it against the
+		// client CA.
+		return nil
+	}
+	if ef.username != "" {
+		if ci.Username == ef.username && subtle.ConstantTimeCompare(ci.Password, []byte(ef.password)) == 1 {
+			return nil
+		}
+		return errors.New("bad username or password")
+	}
+	return errors.New("no client certificate")
+}
+
+// Serve accepts connections on ln until Close is called.
+func (b *Broker) Serve(ln net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return errors.New("broker closed")
+	}
+	b.ln = ln
+	b.mu.Unlock()
+	b.log.Info.Printf("Embedded broker listening on %v", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			b.mu.Lock()
+			closed := b.closed
+			b.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return fmt.Errorf("accept failed: %w", err)
+		}
+		go b.handle(conn)
+	}
+}
+
+// Close stops listening and disconnects every client.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	ln := b.ln
+	var l []*client
+	for _, c := range b.clients {
+		l = append(l, c)
+	}
+	b.mu.Unlock()
+	for _, c := range l {
+		c.close()
+	}
+	if ln == nil {
+		return nil
+	}
+	return ln.Close()
+}
+
+// Publish sends a message to every client that's subscribed to its
+// topic, waiting for them to acknowledge it. It fails if no client's
+// subscribed, so that the caller can try again once one is.
+func (b *Broker) Publish(topic string, payload []byte) error {
+	var errs []error
+	sent := 0
+	for _, c := range b.subscribers(topic) {
+		err := c.publish(topic, payload, false, PUBLISH_TIMEOUT)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("client '%s': %w", c.id, err))
+			continue
+		}
+		sent++
+	}
+	if sent == 0 && len(errs) == 0 {
+		return ErrNoSubscribers
+	}
+	return errors.Join(errs...)
+}
+
+// PublishRetained keeps a message for clients that subscribe later,
+// replacing any earlier one with the same topic, and sends it to every
+// client that's subscribed now. An empty payload removes the kept
+// message. Having no subscribers isn't an error.
+func (b *Broker) PublishRetained(topic string, payload []byte) error {
+	b.retain(topic, payload)
+	var errs []error
+	for _, c := range b.subscribers(topic) {
+		err := c.publish(topic, payload, false, 0)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("client '%s': %w", c.id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *Broker) retain(topic string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(payload) == 0 {
+		delete(b.retained, topic)
+		return
+	}
+	b.retained[topic] = payload
+}
+
+// retainedFor returns the kept messages matching a topic filter.
+func (b *Broker) retainedFor(filter string) map[string][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m := make(map[string][]byte)
+	for topic, payload := range b.retained {
+		if matches(filter, topic) {
+			m[topic] = payload
+		}
+	}
+	return m
+}
+
+// subscribers returns every client with a subscription matching
+// topic.
+func (b *Broker) subscribers(topic string) []*client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var l []*client
+	for _, c := range b.clients {
+		if c.subscribed(topic) {
+			l = append(l, c)
+		}
+	}
+	return l
+}
+
+// register makes c the connected client with its ID, disconnecting
+// any previous one.
+func (b *Broker) register(c *client) {
+	b.mu.Lock()
+	old := b.clients[c.id]
+	b.clients[c.id] = c
+	b.mu.Unlock()
+	if old != nil {
+		b.log.Warn.Printf("Embedded broker client '%s' connected again, dropping its old connection", c.id)
+		old.close()
+	}
+}
+
+func (b *Broker) unregister(c *client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients[c.id] == c {
+		delete(b.clients, c.id)
+	}
+}
+
+// handle runs one client's connection.
+func (b *Broker) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(CONNECT_TIMEOUT))
+	if tc, ok := conn.(*tls.Conn); ok {
+		err := tc.Handshake()
+		if err != nil {
+			b.log.Warn.Printf("Embedded broker TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	cp, err := packets.ReadPacket(conn)
+	if err != nil {
+		b.log.Warn.Printf("Embedded broker failed reading CONNECT from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	connect, ok := cp.(*packets.ConnectPacket)
+	if !ok {
+		b.log.Warn.Printf("Embedded broker got %s from %v, wanted CONNECT", cp.String(), conn.RemoteAddr())
+		return
+	}
+	c := newClient(b, conn, connect)
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ack.ReturnCode = connect.Validate()
+	if ack.ReturnCode == packets.Accepted && b.opts.Authenticate != nil {
+		ci := ConnectInfo{
+			ClientID:   c.id,
+			Username:   connect.Username,
+			Password:   connect.Password,
+			RemoteAddr: conn.RemoteAddr(),
+		}
+		if tc, ok := conn.(*tls.Conn); ok {
+			if chains := tc.ConnectionState().VerifiedChains; len(chains) > 0 {
+				ci.Certificates = chains[0]
+			}
+		}
+		err = b.opts.Authenticate(&ci)
+		if err != nil {
+			b.log.Warn.Printf("Embedded broker refused client '%s' from %v: %v", c.id, conn.RemoteAddr(), err)
+			ack.ReturnCode = packets.ErrRefusedNotAuthorised
+		}
+	}
+	err = c.write(ack)
+	if err != nil || ack.ReturnCode != packets.Accepted {
+		return
+	}
+	b.register(c)
+	defer b.unregister(c)
+	b.log.Info.Printf("Embedded broker client '%s' connected from %v", c.id, conn.RemoteAddr())
+	err = c.run()
+	b.log.Info.Printf("Embedded broker client '%s' disconnected: %v", c.id, err)
+}
+
+// deliver passes on a message a client published.
+func (b *Broker) deliver(from *client, topic string, payload []byte) {
+	if b.opts.Handler != nil {
+		b.opts.Handler(topic, payload)
+	}
+	for _, c := range b.subscribers(topic) {
+		if c == from {
+			continue
+		}
+		// Clients other than the device layer are just
+		// watching, so don't get to hold anyone up.
+		err := c.publish(topic, payload, false, 0)
+		if err != nil {
+			b.log.Warn.Printf("Embedded broker failed forwarding '%s' to client '%s': %v", topic, c.id, err)
+		}
+	}
+}
+
+// matches says whether an MQTT topic filter matches a topic.
+// Wildcards don't match topics starting with '$' at the first level.
+func matches(filter, topic string) bool {
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (fl[0] == "+" || fl[0] == "#") {
+		return false
+	}
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		if f != "+" && f != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
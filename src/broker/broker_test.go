@@ -0,0 +1,418 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/logs"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"#", "a/b", true},
+		{"#", "$aws/things/x/shadow/update", false},
+		{"+/things/x/shadow/update", "$aws/things/x/shadow/update", false},
+		{"$aws/things/+/shadow/update", "$aws/things/x/shadow/update", true},
+	}
+	for _, tc := range tests {
+		if got := matches(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("matches('%s', '%s') got %v, want %v", tc.filter, tc.topic, got, tc.want)
+		}
+	}
+}
+
+// testCA can issue certs for a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %v", err)
+	}
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a cert and key, PEM-encoded.
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+}
+
+func writeFile(t *testing.T, dir, name string, b []byte) string {
+	fn := filepath.Join(dir, name)
+	err := os.WriteFile(fn, b, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return fn
+}
+
+type testMsg struct {
+	topic   string
+	payload string
+}
+
+func TestCheckFlags(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "broker", x509.ExtKeyUsageServerAuth)
+	certFile := writeFile(t, dir, "server.pem", cert)
+	keyFile := writeFile(t, dir, "server.key", key)
+	caFile := writeFile(t, dir, "client-ca.pem", ca.pem)
+	prevFlags := ef
+	defer func() {
+		ef = prevFlags
+	}()
+
+	tests := []struct {
+		flags   embeddedFlags
+		wantErr bool
+	}{
+		{embeddedFlags{cert: certFile, key: keyFile, clientCA: caFile}, false},
+		{embeddedFlags{cert: certFile, key: keyFile, username: "plantcube", password: "secret"}, false},
+		{embeddedFlags{cert: certFile, key: keyFile}, true},                                    // Any client
+		{embeddedFlags{cert: certFile, key: keyFile, username: "plantcube"}, true},             // No password
+		{embeddedFlags{key: keyFile, clientCA: caFile}, true},                                  // No cert
+		{embeddedFlags{cert: certFile, key: caFile, clientCA: caFile}, true},                   // Not a key
+		{embeddedFlags{cert: certFile, key: keyFile, clientCA: filepath.Join(dir, "x")}, true}, // No CA
+		{embeddedFlags{cert: certFile, key: keyFile, clientCA: keyFile}, true},                 // Not a CA
+	}
+	for i, tc := range tests {
+		ef = tc.flags
+		err := CheckFlags()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("case %d: got error %v, want error %v", i, err, tc.wantErr)
+		}
+	}
+}
+
+func TestBroker(t *testing.T) {
+	l := logs.Discard()
+
+	dir := t.TempDir()
+	serverCA, clientCA := newTestCA(t), newTestCA(t)
+	cert, key := serverCA.issue(t, "broker", x509.ExtKeyUsageServerAuth)
+	prevFlags := ef
+	defer func() {
+		ef = prevFlags
+	}()
+	ef = embeddedFlags{
+		listen:   "127.0.0.1:0",
+		cert:     writeFile(t, dir, "server.pem", cert),
+		key:      writeFile(t, dir, "server.key", key),
+		clientCA: writeFile(t, dir, "client-ca.pem", clientCA.pem),
+		username: "plantcube",
+		password: "secret",
+	}
+
+	received := make(chan testMsg, 10)
+	subscribed := make(chan string, 10)
+	b, ln, err := NewFromFlags(l, func(topic string, payload []byte) {
+		received <- testMsg{topic, string(payload)}
+	}, func(clientID string) {
+		subscribed <- clientID
+	})
+	if err != nil {
+		t.Fatalf("NewFromFlags failed: %v", err)
+	}
+	go b.Serve(ln)
+	defer b.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverCA.pem)
+	connect := func(id string, tc *tls.Config, username, password string) (paho.Client, error) {
+		tc.RootCAs = roots
+		opts := paho.NewClientOptions().
+			AddBroker("ssl://" + ln.Addr().String()).
+			SetClientID(id).
+			SetTLSConfig(tc).
+			SetUsername(username).
+			SetPassword(password).
+			SetAutoReconnect(false).
+			SetConnectRetry(false)
+		c := paho.NewClient(opts)
+		tok := c.Connect()
+		if !tok.WaitTimeout(5 * time.Second) {
+			return nil, errors.New("timeout connecting")
+		}
+		return c, tok.Error()
+	}
+
+	// With a client cert
+	ccert, ckey := clientCA.issue(t, "cube", x509.ExtKeyUsageClientAuth)
+	kp, err := tls.X509KeyPair(ccert, ckey)
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %v", err)
+	}
+	cube, err := connect("cube", &tls.Config{Certificates: []tls.Certificate{kp}}, "", "")
+	if err != nil {
+		t.Fatalf("Connect with client cert failed: %v", err)
+	}
+	defer cube.Disconnect(0)
+
+	err = b.Publish("agl/prod/things/x/recipe", []byte("too early"))
+	if !errors.Is(err, ErrNoSubscribers) {
+		t.Errorf("Publish with no subscribers got %v, want %v", err, ErrNoSubscribers)
+	}
+
+	toCube := make(chan testMsg, 10)
+	tok := cube.Subscribe("agl/prod/things/x/recipe", 1, func(c paho.Client, m paho.Message) {
+		toCube <- testMsg{m.Topic(), string(m.Payload())}
+	})
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("Subscribe failed: %v", tok.Error())
+	}
+	select {
+	case id := <-subscribed:
+		if id != "cube" {
+			t.Errorf("got subscription from '%s', want 'cube'", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OnSubscribe not called")
+	}
+
+	tok = cube.Publish("$aws/things/x/shadow/update", 1, false, "reported")
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("Publish failed: %v", tok.Error())
+	}
+	select {
+	case m := <-received:
+		if m != (testMsg{"$aws/things/x/shadow/update", "reported"}) {
+			t.Errorf("handler got %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handler not called")
+	}
+
+	err = b.Publish("agl/prod/things/x/recipe", []byte("recipe"))
+	if err != nil {
+		t.Errorf("Publish failed: %v", err)
+	}
+	select {
+	case m := <-toCube:
+		if m != (testMsg{"agl/prod/things/x/recipe", "recipe"}) {
+			t.Errorf("cube got %+v", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("cube didn't get message")
+	}
+
+	// With a username and password
+	c, err := connect("password", &tls.Config{}, "plantcube", "secret")
+	if err != nil {
+		t.Errorf("Connect with password failed: %v", err)
+	} else {
+		c.Disconnect(0)
+	}
+
+	// With neither
+	_, err = connect("wrong", &tls.Config{}, "plantcube", "wrong")
+	if err == nil {
+		t.Errorf("Connect with wrong password succeeded")
+	}
+	_, err = connect("nothing", &tls.Config{}, "", "")
+	if err == nil {
+		t.Errorf("Connect with no credentials succeeded")
+	}
+}
+
+func TestRetained(t *testing.T) {
+	l := logs.Discard()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	b := New(l, Options{})
+	go b.Serve(ln)
+	defer b.Close()
+
+	connect := func(id string) paho.Client {
+		opts := paho.NewClientOptions().
+			AddBroker("tcp://" + ln.Addr().String()).
+			SetClientID(id).
+			SetAutoReconnect(false)
+		c := paho.NewClient(opts)
+		tok := c.Connect()
+		if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("Connect failed: %v", tok.Error())
+		}
+		return c
+	}
+	// subscribe returns what a new client gets on subscribing.
+	subscribe := func(id string) map[string]string {
+		c := connect(id)
+		defer c.Disconnect(0)
+		got := make(chan paho.Message, 10)
+		tok := c.Subscribe("plantprism/#", 1, func(c paho.Client, m paho.Message) {
+			got <- m
+		})
+		if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+			t.Fatalf("Subscribe failed: %v", tok.Error())
+		}
+		m := make(map[string]string)
+		for {
+			select {
+			case msg := <-got:
+				if !msg.Retained() {
+					t.Errorf("message to '%s' not flagged as retained", msg.Topic())
+				}
+				m[msg.Topic()] = string(msg.Payload())
+			case <-time.After(200 * time.Millisecond):
+				return m
+			}
+		}
+	}
+
+	err = b.PublishRetained("plantprism/x/state", []byte("one"))
+	if err != nil {
+		t.Fatalf("PublishRetained with no subscribers failed: %v", err)
+	}
+	b.PublishRetained("plantprism/x/state", []byte("two"))
+	b.PublishRetained("plantprism/y/state", []byte("other"))
+	b.PublishRetained("elsewhere", []byte("elsewhere"))
+	pub := connect("publisher")
+	defer pub.Disconnect(0)
+	tok := pub.Publish("plantprism/z/state", 1, true, "from client")
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("Publish failed: %v", tok.Error())
+	}
+	got := subscribe("first")
+	want := map[string]string{
+		"plantprism/x/state": "two",
+		"plantprism/y/state": "other",
+		"plantprism/z/state": "from client",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got retained %v, want %v", got, want)
+	}
+
+	b.PublishRetained("plantprism/y/state", nil)
+	got = subscribe("second")
+	delete(want, "plantprism/y/state")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got retained %v after removal, want %v", got, want)
+	}
+}
+
+func TestHandlerReply(t *testing.T) {
+	l := logs.Discard()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	// The handler answers a command from the same client that sent
+	// it, which has to acknowledge the answer.
+	var b *Broker
+	replied := make(chan error, 1)
+	b = New(l, Options{Handler: func(topic string, payload []byte) {
+		if topic == "plantprism/x/cmd/watering" {
+			replied <- b.Publish("plantprism/x/response", []byte("ok"))
+		}
+	}})
+	go b.Serve(ln)
+	defer b.Close()
+
+	opts := paho.NewClientOptions().
+		AddBroker("tcp://" + ln.Addr().String()).
+		SetClientID("node-red").
+		SetAutoReconnect(false)
+	c := paho.NewClient(opts)
+	tok := c.Connect()
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("Connect failed: %v", tok.Error())
+	}
+	defer c.Disconnect(0)
+	got := make(chan string, 1)
+	tok = c.Subscribe("plantprism/x/response", 1, func(c paho.Client, m paho.Message) {
+		got <- string(m.Payload())
+	})
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("Subscribe failed: %v", tok.Error())
+	}
+	tok = c.Publish("plantprism/x/cmd/watering", 1, false, "{}")
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("Publish failed: %v", tok.Error())
+	}
+	select {
+	case m := <-got:
+		if m != "ok" {
+			t.Errorf("got response '%s', want 'ok'", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no response")
+	}
+	select {
+	case err := <-replied:
+		if err != nil {
+			t.Errorf("handler's Publish failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handler's Publish didn't return")
+	}
+}
@@ -0,0 +1,302 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// message is one a client published, waiting to be delivered.
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// client is one connected MQTT client.
+type client struct {
+	b         *Broker
+	conn      net.Conn
+	id        string
+	keepAlive time.Duration
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	subs     map[string]byte // Topic filter to QoS
+	nextID   uint16
+	inflight map[uint16]chan struct{}
+	gone     chan struct{}
+	closed   bool
+	queue    []message
+	queued   chan struct{}
+}
+
+func newClient(b *Broker, conn net.Conn, cp *packets.ConnectPacket) *client {
+	id := cp.ClientIdentifier
+	if id == "" {
+		id = "anonymous-" + conn.RemoteAddr().String()
+	}
+	return &client{
+		b:         b,
+		conn:      conn,
+		id:        id,
+		keepAlive: time.Duration(cp.Keepalive) * time.Second,
+		subs:      make(map[string]byte),
+		inflight:  make(map[uint16]chan struct{}),
+		gone:      make(chan struct{}),
+		queued:    make(chan struct{}, 1),
+	}
+}
+
+func (c *client) write(cp packets.ControlPacket) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	return cp.Write(c.conn)
+}
+
+func (c *client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.gone)
+	c.conn.Close()
+}
+
+func (c *client) subscribed(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for f := range c.subs {
+		if matches(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// qos returns the highest QoS the client subscribed to topic with,
+// capped at 1.
+func (c *client) qos(topic string) byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var q byte
+	for f, fq := range c.subs {
+		if matches(f, topic) && fq > q {
+			q = fq
+		}
+	}
+	if q > 1 {
+		q = 1
+	}
+	return q
+}
+
+// publish sends the client a message. At QoS 1, it waits up to
+// timeout for the acknowledgement, and a timeout of zero means not
+// waiting at all. retained says the message was kept from before the
+// client subscribed.
+func (c *client) publish(topic string, payload []byte, retained bool, timeout time.Duration) error {
+	pp := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pp.TopicName = topic
+	pp.Payload = payload
+	pp.Retain = retained
+	pp.Qos = c.qos(topic)
+	if timeout == 0 {
+		pp.Qos = 0
+	}
+	var acked chan struct{}
+	if pp.Qos > 0 {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return errors.New("disconnected")
+		}
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID++
+		}
+		pp.MessageID = c.nextID
+		acked = make(chan struct{})
+		c.inflight[pp.MessageID] = acked
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.inflight, pp.MessageID)
+			c.mu.Unlock()
+		}()
+	}
+	err := c.write(pp)
+	if err != nil {
+		c.close()
+		return fmt.Errorf("write failed: %w", err)
+	}
+	if acked == nil {
+		return nil
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-acked:
+		return nil
+	case <-c.gone:
+		return errors.New("disconnected before acknowledging")
+	case <-t.C:
+		return errors.New("timeout waiting for acknowledgement")
+	}
+}
+
+// run reads packets from the client until it disconnects.
+func (c *client) run() error {
+	defer c.close()
+	go c.deliverQueued()
+	for {
+		if c.keepAlive > 0 {
+			// The spec allows one and a half keep-alive
+			// periods of silence.
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		cp, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			return err
+		}
+		switch p := cp.(type) {
+		case *packets.PublishPacket:
+			err = c.handlePublish(p)
+		case *packets.PubackPacket:
+			c.acked(p.MessageID)
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			err = c.write(comp)
+		case *packets.SubscribePacket:
+			err = c.handleSubscribe(p)
+		case *packets.UnsubscribePacket:
+			c.mu.Lock()
+			for _, f := range p.Topics {
+				delete(c.subs, f)
+			}
+			c.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			err = c.write(ack)
+		case *packets.PingreqPacket:
+			err = c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return errors.New("client disconnected")
+		default:
+			return fmt.Errorf("unexpected %s", cp.String())
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *client) handlePublish(p *packets.PublishPacket) error {
+	// A QoS 2 message is delivered straight away, rather than on
+	// PUBREL. The client might send it again, but the Plantcube
+	// doesn't use QoS 2.
+	if p.Retain {
+		c.b.retain(p.TopicName, p.Payload)
+	}
+	c.mu.Lock()
+	c.queue = append(c.queue, message{p.TopicName, p.Payload})
+	c.mu.Unlock()
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+	switch p.Qos {
+	case 1:
+		ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		ack.MessageID = p.MessageID
+		return c.write(ack)
+	case 2:
+		rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		rec.MessageID = p.MessageID
+		return c.write(rec)
+	}
+	return nil
+}
+
+// deliverQueued delivers the client's messages in the order they were
+// published. It's not done by run: the Handler might publish to this
+// client and wait for the acknowledgement, which only run can read.
+// Messages queued before the client disconnects are still delivered.
+func (c *client) deliverQueued() {
+	for {
+		closed := false
+		select {
+		case <-c.queued:
+		case <-c.gone:
+			closed = true
+		}
+		for {
+			c.mu.Lock()
+			if len(c.queue) == 0 {
+				c.mu.Unlock()
+				break
+			}
+			m := c.queue[0]
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+			c.b.deliver(c, m.topic, m.payload)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+func (c *client) handleSubscribe(p *packets.SubscribePacket) error {
+	ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	ack.MessageID = p.MessageID
+	c.mu.Lock()
+	for i, f := range p.Topics {
+		q := p.Qoss[i]
+		if q > 1 {
+			q = 1
+		}
+		c.subs[f] = q
+		ack.ReturnCodes = append(ack.ReturnCodes, q)
+	}
+	c.mu.Unlock()
+	err := c.write(ack)
+	if err != nil {
+		return err
+	}
+	c.b.log.Info.Printf("Embedded broker client '%s' subscribed to %v", c.id, p.Topics)
+	for _, f := range p.Topics {
+		for topic, payload := range c.b.retainedFor(f) {
+			err = c.publish(topic, payload, true, 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if c.b.opts.OnSubscribe != nil {
+		// Not on this goroutine: OnSubscribe might want to
+		// publish to this client, and wait for it to
+		// acknowledge.
+		go c.b.opts.OnSubscribe(c.id)
+	}
+	return nil
+}
+
+func (c *client) acked(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.inflight[id]; ok {
+		close(ch)
+		delete(c.inflight, id)
+	}
+}
@@ -0,0 +1,384 @@
+package config
+
+// A YAML configuration file. Every setting in it corresponds to a
+// command-line flag, and a flag given on the command line overrides
+// the file. The exception is the per-device settings, which have no
+// flags.
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/logs"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// Embedded is the broker plantprism can run itself, instead of
+// connecting to one.
+type Embedded struct {
+	Listen   string `yaml:"listen" flag:"broker_embedded_listen"`
+	Cert     string `yaml:"cert" flag:"broker_embedded_cert"`
+	Key      string `yaml:"key" flag:"broker_embedded_key"`
+	ClientCA string `yaml:"client_ca" flag:"broker_embedded_client_ca"`
+	Username string `yaml:"username" flag:"broker_embedded_username"`
+	Password string `yaml:"password" flag:"broker_embedded_password"`
+}
+
+type Broker struct {
+	URL           string   `yaml:"url" flag:"broker_url"`
+	FailoverURLs  []string `yaml:"failover_urls" flag:"broker_failover_url"`
+	Username      string   `yaml:"username" flag:"broker_username"`
+	Password      string   `yaml:"password" flag:"broker_password"`
+	PasswordFile  string   `yaml:"password_file" flag:"broker_password_file"`
+	ClientID      string   `yaml:"client_id" flag:"broker_client_id"`
+	CACert        string   `yaml:"ca_cert" flag:"broker_ca_cert"`
+	ClientCert    string   `yaml:"client_cert" flag:"broker_client_cert"`
+	ClientKey     string   `yaml:"client_key" flag:"broker_client_key"`
+	TLSMinVersion string   `yaml:"tls_min_version" flag:"broker_tls_min_version"`
+	TLSCiphers    string   `yaml:"tls_ciphers" flag:"broker_tls_ciphers"`
+	KeepAlive     string   `yaml:"keep_alive" flag:"broker_keep_alive"`
+	PingTimeout   string   `yaml:"ping_timeout" flag:"broker_ping_timeout"`
+	MaxReconnect  string   `yaml:"max_reconnect_interval" flag:"broker_max_reconnect_interval"`
+	Insecure      *bool    `yaml:"insecure" flag:"broker_insecure"`
+	Embedded      Embedded `yaml:"embedded"`
+}
+
+// Defaults are the settings for every device. Timezone and sunrise
+// can be overridden per device.
+type Defaults struct {
+	Timezone       string   `yaml:"timezone" flag:"timezone"`
+	Sunrise        string   `yaml:"sunrise" flag:"sunrise"`
+	OfflineAfter   string   `yaml:"offline_after" flag:"offline_after"`
+	DoorAlertAfter string   `yaml:"door_alert_after" flag:"door_alert_after"`
+	CommandTimeout string   `yaml:"command_timeout" flag:"command_timeout"`
+	CommandRetries *int     `yaml:"command_retries" flag:"command_retries"`
+	StaleFactor    *float64 `yaml:"stale_factor" flag:"stale_factor"`
+	Lenient        *bool    `yaml:"lenient" flag:"lenient"`
+}
+
+// Device is an allowed device and its own settings.
+type Device struct {
+	ID       string `yaml:"id"`
+	Name     string `yaml:"name"`
+	Timezone string `yaml:"timezone"`
+	Sunrise  string `yaml:"sunrise"`
+}
+
+type SMTP struct {
+	Addr     string `yaml:"addr" flag:"notify_smtp_addr"`
+	From     string `yaml:"from" flag:"notify_smtp_from"`
+	To       string `yaml:"to" flag:"notify_smtp_to"`
+	Username string `yaml:"username" flag:"notify_smtp_username"`
+	Password string `yaml:"password" flag:"notify_smtp_password"`
+}
+
+type Push struct {
+	URL   string `yaml:"url" flag:"notify_push_url"`
+	Style string `yaml:"style" flag:"notify_push_style"`
+	Token string `yaml:"token" flag:"notify_push_token"`
+}
+
+type Notify struct {
+	Routes      []string `yaml:"routes" flag:"notify_route"`
+	RateLimit   string   `yaml:"rate_limit" flag:"notify_rate_limit"`
+	Quiet       string   `yaml:"quiet" flag:"notify_quiet"`
+	QuietExcept string   `yaml:"quiet_except" flag:"notify_quiet_except"`
+	WebhookURL  string   `yaml:"webhook_url" flag:"notify_webhook_url"`
+	SMTP        SMTP     `yaml:"smtp"`
+	Push        Push     `yaml:"push"`
+}
+
+type HomeAssistant struct {
+	Discovery       *bool  `yaml:"discovery" flag:"ha_discovery"`
+	DiscoveryPrefix string `yaml:"discovery_prefix" flag:"ha_discovery_prefix"`
+	TopicPrefix     string `yaml:"topic_prefix" flag:"ha_topic_prefix"`
+}
+
+type MQTTAPI struct {
+	Enabled  *bool  `yaml:"enabled" flag:"mqtt_api"`
+	Prefix   string `yaml:"prefix" flag:"mqtt_api_prefix"`
+	Commands string `yaml:"commands" flag:"mqtt_api_commands"`
+}
+
+type Log struct {
+	File  string `yaml:"file" flag:"logfile"`
+	Level string `yaml:"level" flag:"log_level"`
+}
+
+type HTTP struct {
+	Listen string `yaml:"listen" flag:"http_listen"`
+}
+
+type Config struct {
+	DataDir       string        `yaml:"data_dir" flag:"data_dir"`
+	Log           Log           `yaml:"log"`
+	HTTP          HTTP          `yaml:"http"`
+	Broker        Broker        `yaml:"broker"`
+	Defaults      Defaults      `yaml:"device_defaults"`
+	Devices       []Device      `yaml:"devices"`
+	Notify        Notify        `yaml:"notify"`
+	HomeAssistant HomeAssistant `yaml:"home_assistant"`
+	MQTTAPI       MQTTAPI       `yaml:"mqtt_api"`
+}
+
+// Load reads a configuration file.
+func Load(name string) (*Config, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config: %w", err)
+	}
+	defer f.Close()
+	c, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("config '%s': %w", name, err)
+	}
+	return c, nil
+}
+
+// Parse reads a configuration. Only its syntax is checked: unknown
+// settings are errors, but values aren't checked until Validate and
+// Apply.
+func Parse(r io.Reader) (*Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err = dec.Decode(&c)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate checks the settings that have no flag to check them. It
+// returns every problem it finds.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Log.Level != "" && !slices.Contains(logs.Levels, c.Log.Level) {
+		errs = append(errs, fmt.Errorf("log.level: invalid level '%s', want one of %v", c.Log.Level, logs.Levels))
+	}
+	if c.Defaults.Sunrise != "" {
+		if _, err := time.Parse("15:04", c.Defaults.Sunrise); err != nil {
+			errs = append(errs, fmt.Errorf("device_defaults.sunrise: invalid sunrise '%s', want HH:MM", c.Defaults.Sunrise))
+		}
+	}
+	seen := make(map[string]bool)
+	for i, d := range c.Devices {
+		what := fmt.Sprintf("devices[%d]", i)
+		if d.ID == "" {
+			errs = append(errs, fmt.Errorf("%s: no id", what))
+			continue
+		}
+		what = fmt.Sprintf("device '%s'", d.ID)
+		if seen[d.ID] {
+			errs = append(errs, fmt.Errorf("%s: listed more than once", what))
+		}
+		seen[d.ID] = true
+		if d.Timezone != "" {
+			if _, err := time.LoadLocation(d.Timezone); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid timezone: %w", what, err))
+			}
+		}
+		if d.Sunrise != "" {
+			if _, err := time.Parse("15:04", d.Sunrise); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid sunrise '%s', want HH:MM", what, d.Sunrise))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReloadReport says what reloading a configuration did.
+type ReloadReport struct {
+	Applied     []string
+	NeedRestart []string // Changed, but only take effect at startup
+	Devices     []string // Running devices that were reconfigured
+}
+
+// ListValue is a flag that can be given several times, each time
+// adding to a list. A configuration's list replaces the whole list.
+type ListValue interface {
+	flag.Value
+	Reset()
+}
+
+// Change is a flag whose value the configuration changes.
+type Change struct {
+	Path string // Where it is in the file, e.g. broker.url
+	Flag string
+	Old  string
+	New  string
+	// What to pass to the flag's Set. More than one for a list.
+	Values []string
+}
+
+func (ch Change) String() string {
+	return fmt.Sprintf("%s: '%s' -> '%s'", ch.Path, ch.Old, ch.New)
+}
+
+// Apply sets every flag the configuration has a value for, unless
+// it was given on the command line. It returns every problem it
+// finds.
+func (c *Config) Apply(fs *flag.FlagSet) error {
+	fixed := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		fixed[f.Name] = true
+	})
+	changes, err := c.Changes(fs, fixed)
+	for _, ch := range changes {
+		err = errors.Join(err, SetFlag(fs, ch))
+	}
+	return err
+}
+
+// Changes returns what needs to be set to bring the flags in line
+// with the configuration. Every flag the configuration can set is
+// considered, except those in fixed: a flag the configuration
+// doesn't have a value for goes back to its default. It returns
+// every problem it finds, along with the changes that can be made.
+func (c *Config) Changes(fs *flag.FlagSet, fixed map[string]bool) ([]Change, error) {
+	var changes []Change
+	var errs []error
+	for _, ft := range c.flagTargets() {
+		if fixed[ft.name] {
+			continue
+		}
+		fl := fs.Lookup(ft.name)
+		if fl == nil && ft.values == nil {
+			continue
+		} else if fl == nil {
+			errs = append(errs, fmt.Errorf("%s: no flag '%s'", ft.path, ft.name))
+			continue
+		}
+		_, isList := fl.Value.(ListValue)
+		values := ft.values
+		if values == nil && !isList {
+			values = []string{fl.DefValue}
+		}
+		// A fresh value of the flag's type tells us what the
+		// flag would say after being set, so that '1m' and
+		// '60s' aren't regarded as different.
+		scratch := reflect.New(reflect.TypeOf(fl.Value).Elem()).Interface().(flag.Value)
+		var err error
+		for _, v := range values {
+			err = scratch.Set(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid value '%s': %w", ft.path, v, err))
+				break
+			}
+		}
+		if err != nil || scratch.String() == fl.Value.String() {
+			continue
+		}
+		changes = append(changes, Change{
+			Path:   ft.path,
+			Flag:   ft.name,
+			Old:    fl.Value.String(),
+			New:    scratch.String(),
+			Values: values,
+		})
+	}
+	return changes, errors.Join(errs...)
+}
+
+// SetFlag makes a change to a flag.
+func SetFlag(fs *flag.FlagSet, ch Change) error {
+	fl := fs.Lookup(ch.Flag)
+	if fl == nil {
+		return fmt.Errorf("%s: no flag '%s'", ch.Path, ch.Flag)
+	}
+	if lv, ok := fl.Value.(ListValue); ok {
+		lv.Reset()
+	}
+	for _, v := range ch.Values {
+		err := fs.Set(ch.Flag, v)
+		if err != nil {
+			return fmt.Errorf("%s: invalid value '%s': %w", ch.Path, v, err)
+		}
+	}
+	return nil
+}
+
+type flagTarget struct {
+	path   string
+	name   string
+	values []string // nil if the configuration hasn't got the flag
+}
+
+// flagTargets returns every flag the configuration can set, with
+// its value, if any.
+func (c *Config) flagTargets() []flagTarget {
+	var fts []flagTarget
+	var walk func(v reflect.Value, path string)
+	walk = func(v reflect.Value, path string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			p := name
+			if path != "" {
+				p = path + "." + name
+			}
+			fv := v.Field(i)
+			if f.Type.Kind() == reflect.Struct {
+				walk(fv, p)
+				continue
+			}
+			flagName := f.Tag.Get("flag")
+			if flagName == "" {
+				continue
+			}
+			fts = append(fts, flagTarget{p, flagName, flagStrings(fv)})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	var ids []string
+	for _, d := range c.Devices {
+		ids = append(ids, d.ID)
+	}
+	fts = append(fts, flagTarget{"devices", "device", ids})
+	return fts
+}
+
+// flagStrings returns what to pass to a flag's Set for a
+// configuration value: nothing if it's unset, and one string per
+// element for a list.
+func flagStrings(v reflect.Value) []string {
+	switch v.Kind() {
+	case reflect.String:
+		if v.String() == "" {
+			return nil
+		}
+		return []string{v.String()}
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		return flagStrings(v.Elem())
+	case reflect.Bool:
+		return []string{strconv.FormatBool(v.Bool())}
+	case reflect.Int:
+		return []string{strconv.FormatInt(v.Int(), 10)}
+	case reflect.Float64:
+		return []string{strconv.FormatFloat(v.Float(), 'g', -1, 64)}
+	case reflect.Slice:
+		var l []string
+		for i := 0; i < v.Len(); i++ {
+			l = append(l, flagStrings(v.Index(i))...)
+		}
+		return l
+	}
+	panic(fmt.Sprintf("config value of unsupported kind %v", v.Kind()))
+}
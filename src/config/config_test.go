@@ -0,0 +1,254 @@
+package config
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/broker"
+	"github.com/Jon-Bright/plantprism/device"
+	"github.com/Jon-Bright/plantprism/homeassistant"
+	"github.com/Jon-Bright/plantprism/mqtt"
+	"github.com/Jon-Bright/plantprism/mqttapi"
+	"github.com/Jon-Bright/plantprism/notify"
+	"github.com/Jon-Bright/plantprism/ui"
+)
+
+const full = `
+data_dir: /var/lib/plantprism
+log:
+  file: /var/log/plantprism.log
+  level: warn
+http:
+  listen: 127.0.0.1:3000
+broker:
+  url: ssl://broker:8883
+  failover_urls: ["ssl://broker2:8883", "tcp://localhost:1883"]
+  username: plantprism
+  password: secret
+  password_file: /etc/plantprism/broker-password
+  client_id: plantprism
+  ca_cert: /etc/plantprism/ca.pem
+  client_cert: /etc/plantprism/client.pem
+  client_key: /etc/plantprism/client.key
+  tls_min_version: "1.3"
+  tls_ciphers: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+  keep_alive: 30s
+  ping_timeout: 1m
+  max_reconnect_interval: 5m
+  insecure: false
+  embedded:
+    listen: ":8883"
+    cert: /etc/plantprism/server.pem
+    key: /etc/plantprism/server.key
+    client_ca: /etc/plantprism/cube-ca.pem
+    username: plantcube
+    password: cubesecret
+device_defaults:
+  timezone: Europe/Berlin
+  sunrise: "07:00"
+  offline_after: 2h
+  door_alert_after: 5m
+  command_timeout: 10m
+  command_retries: 2
+  stale_factor: 2.5
+  lenient: true
+devices:
+  - id: 01234567-89ab-cdef-0123-456789abcdef
+    name: Kitchen
+    timezone: Europe/London
+    sunrise: "06:30"
+  - id: 11234567-89ab-cdef-0123-456789abcdef
+notify:
+  routes: ["door_open:push", "offline:smtp,push"]
+  rate_limit: 1h
+  quiet: 22:00-07:00
+  quiet_except: offline
+  webhook_url: http://hooks/plantprism
+  smtp:
+    addr: mail:25
+    from: plantcube@example.com
+    to: me@example.com
+    username: me
+    password: secret
+  push:
+    url: https://ntfy.sh/plantcube
+    style: ntfy
+    token: abc
+home_assistant:
+  discovery: true
+  discovery_prefix: ha
+  topic_prefix: cube/ha
+mqtt_api:
+  enabled: true
+  commands: watering,sunrise
+`
+
+func TestApply(t *testing.T) {
+	// The packages register their flags on flag.CommandLine, so
+	// it's a fresh one for every run
+	prev := flag.CommandLine
+	defer func() {
+		flag.CommandLine = prev
+	}()
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	device.InitFlags()
+	mqtt.InitFlags()
+	broker.InitFlags()
+	notify.InitFlags()
+	homeassistant.InitFlags()
+	mqttapi.InitFlags()
+	ui.InitFlags()
+	flag.String("logfile", "plantprism.log", "")
+	flag.String("log_level", "info", "")
+	flag.String("data_dir", ".", "")
+	fs := flag.CommandLine
+	// Given on the command line, so the file's value is ignored
+	err := fs.Parse([]string{"-broker_keep_alive", "45s", "-notify_route", "offline:webhook"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	c, err := Parse(strings.NewReader(full))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	err = c.Validate()
+	if err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+	err = c.Apply(fs)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	want := map[string]string{
+		"data_dir":                      "/var/lib/plantprism",
+		"logfile":                       "/var/log/plantprism.log",
+		"log_level":                     "warn",
+		"http_listen":                   "127.0.0.1:3000",
+		"broker_password":               "secret",
+		"broker_keep_alive":             "45s",
+		"broker_ping_timeout":           "1m0s",
+		"broker_failover_url":           "ssl://broker2:8883 tcp://localhost:1883",
+		"broker_max_reconnect_interval": "5m0s",
+		"broker_insecure":               "false",
+		"broker_embedded_listen":        ":8883",
+		"broker_embedded_password":      "cubesecret",
+		"command_retries":               "2",
+		"stale_factor":                  "2.5",
+		"lenient":                       "true",
+		"notify_route":                  "offline:webhook",
+		"notify_smtp_password":          "secret",
+		"mqtt_api":                      "true",
+		"mqtt_api_prefix":               "plantprism",
+		"mqtt_api_commands":             "watering,sunrise",
+		"device":                        "01234567-89ab-cdef-0123-456789abcdef,11234567-89ab-cdef-0123-456789abcdef",
+	}
+	for name, v := range want {
+		if got := fs.Lookup(name).Value.String(); got != v {
+			t.Errorf("flag %s, got '%s', want '%s'", name, got, v)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("broker_keep_alive", time.Minute, "")
+	fs.String("broker_url", "ssl://localhost:8883", "")
+	fs.String("notify_quiet", "", "")
+	fs.Var(&stringList{}, "device", "")
+	c, err := Parse(strings.NewReader("broker:\n  url: ssl://broker:8883\nnotify:\n  quiet: 22:00-07:00\ndevices:\n  - id: a\n  - id: b\n"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	err = c.Apply(fs)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	// The same keep-alive, written differently, the URL removed,
+	// the quiet hours fixed on the command line and a device
+	// removed.
+	c, err = Parse(strings.NewReader("broker:\n  keep_alive: 60s\nnotify:\n  quiet: 23:00-07:00\ndevices:\n  - id: b\n"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	changes, err := c.Changes(fs, map[string]bool{"notify_quiet": true})
+	if err != nil {
+		t.Fatalf("Changes failed: %v", err)
+	}
+	var got []string
+	for _, ch := range changes {
+		got = append(got, ch.String())
+		err = SetFlag(fs, ch)
+		if err != nil {
+			t.Errorf("SetFlag(%v) failed: %v", ch, err)
+		}
+	}
+	want := "broker.url: 'ssl://broker:8883' -> 'ssl://localhost:8883'|devices: 'a,b' -> 'b'"
+	if strings.Join(got, "|") != want {
+		t.Errorf("got changes %s, want %s", strings.Join(got, "|"), want)
+	}
+	if got := fs.Lookup("device").Value.String(); got != "b" {
+		t.Errorf("devices after change, got '%s', want 'b'", got)
+	}
+	changes, err = c.Changes(fs, nil)
+	if err != nil || len(changes) != 1 || changes[0].Flag != "notify_quiet" {
+		t.Errorf("changes after applying, got %v, %v, want only notify_quiet", changes, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, err := Parse(strings.NewReader("broker:\n  url: x\n  pasword: secret\n"))
+	if err == nil || !strings.Contains(err.Error(), "pasword") {
+		t.Errorf("unknown setting, got error %v", err)
+	}
+
+	c, err := Parse(strings.NewReader(`
+devices:
+  - name: No ID
+  - id: a
+    timezone: Mars/Olympus_Mons
+  - id: a
+    sunrise: "7am"
+`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	err = c.Validate()
+	for _, want := range []string{"devices[0]: no id", "device 'a': invalid timezone", "device 'a': listed more than once", "device 'a': invalid sunrise '7am'"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want it to include '%s'", err, want)
+		}
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("broker_keep_alive", time.Minute, "")
+	fs.Var(&stringList{}, "device", "")
+	c, err = Parse(strings.NewReader("broker:\n  keep_alive: soon\n  url: ssl://broker:8883\n"))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	err = c.Apply(fs)
+	for _, want := range []string{"broker.keep_alive: invalid value 'soon'", "broker.url: no flag 'broker_url'"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want it to include '%s'", err, want)
+		}
+	}
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func (l *stringList) Reset() {
+	*l = nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	golog "log"
+	"os"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/broker"
+	"github.com/Jon-Bright/plantprism/device"
+	"github.com/Jon-Bright/plantprism/logs"
+	"github.com/Jon-Bright/plantprism/mqtt"
+	"github.com/Jon-Bright/plantprism/mqttapi"
+	"github.com/Jon-Bright/plantprism/notify"
+)
+
+// configMain implements "plantprism config check", which reports
+// whether a config file, together with any flags given, is valid,
+// without starting the server.
+func configMain(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "Usage: plantprism config check -config file [flags]\n")
+		return 2
+	}
+	registerFlags()
+	fs := flag.CommandLine
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
+	if *configName == "" {
+		fmt.Fprintf(os.Stderr, "config check: -config is required\n")
+		return 2
+	}
+	err = loadConfig(fs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	// The packages check their own settings when they're
+	// initialized. Nothing is connected to, or logged.
+	dl := golog.New(io.Discard, "", 0)
+	l := &logs.Loggers{Info: dl, Warn: dl, Error: dl, Critical: dl}
+	var errs []error
+	if len(device.AllowedDevices()) == 0 {
+		errs = append(errs, errors.New("no devices allowed"))
+	}
+	if err := device.Init(l, clock.New()); err != nil {
+		errs = append(errs, fmt.Errorf("device settings: %w", err))
+	}
+	if _, err := notify.Init(l, clock.New()); err != nil {
+		errs = append(errs, fmt.Errorf("notification settings: %w", err))
+	}
+	// Not Init: it follows the devices, which would save any
+	// that aren't yet.
+	if err := mqttapi.CheckFlags(); err != nil {
+		errs = append(errs, fmt.Errorf("MQTT API settings: %w", err))
+	}
+	// As in main, the embedded broker's settings replace the
+	// external broker's.
+	if broker.Enabled() {
+		if err := broker.CheckFlags(); err != nil {
+			errs = append(errs, fmt.Errorf("embedded broker settings: %w", err))
+		}
+	} else if _, err := mqtt.New(l, nil); err != nil {
+		errs = append(errs, fmt.Errorf("broker settings: %w", err))
+	}
+	if st, err := os.Stat(*dataDir); err != nil || !st.IsDir() {
+		errs = append(errs, fmt.Errorf("data_dir '%s' is not a directory", *dataDir))
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "config '%s': %v\n", *configName, errors.Join(errs...))
+		return 1
+	}
+	fmt.Printf("config '%s' is valid\n", *configName)
+	return 0
+}
@@ -0,0 +1,50 @@
+package device
+
+// A Device's state belongs to its processing loop. Anything else that
+// wants to read or change it, whether a UI handler or a timer, hands
+// the loop a function to run. Exported methods do this themselves;
+// unexported ones assume they're already running on the loop, and
+// must never call an exported method that does, or the loop waits on
+// itself.
+
+// ACTION_QUEUE_BUFFER is how many actions can be waiting for the
+// processing loop before anyone handing it another has to wait.
+const ACTION_QUEUE_BUFFER = 10
+
+// do runs f on the device's processing loop and waits for it to
+// finish. A device that has no processing loop (because it wasn't
+// created by Get, as in tests or the Replayer) belongs to whoever has
+// it, so f is run directly. Once the device has been stopped, f isn't
+// run at all.
+func (d *Device) do(f func()) {
+	if d.actions == nil {
+		f()
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case d.actions <- func() {
+		defer close(done)
+		f()
+	}:
+	case <-d.stopped:
+		return
+	}
+	select {
+	case <-done:
+	case <-d.stopped:
+	}
+}
+
+// post runs f on the device's processing loop without waiting for it.
+// Like do, it drops f once the device has been stopped.
+func (d *Device) post(f func()) {
+	if d.actions == nil {
+		f()
+		return
+	}
+	select {
+	case d.actions <- f:
+	case <-d.stopped:
+	}
+}
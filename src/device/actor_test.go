@@ -0,0 +1,118 @@
+package device
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+// TestConcurrentAccess has MQTT messages, UI actions, UI streams and
+// timers all at a device at once. It's most useful with -race.
+func TestConcurrentAccess(t *testing.T) {
+	log = logs.Discard()
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1691777930, 0))
+	prevClk, prevMap, prevAllowed, prevTestMode := clk, deviceMap, allowedDevices, testMode
+	defer func() {
+		clk, deviceMap, allowedDevices, testMode = prevClk, prevMap, prevAllowed, prevTestMode
+	}()
+	clk = mock
+	testMode = true
+	deviceMap = nil
+	const id = "concurrency-test"
+	allowedDevices = deviceList{id}
+
+	d, err := Get(id, &countingPublisher{})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	d.do(func() {
+		d.ClientToken = "12345678"
+	})
+
+	const rounds = 200
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				f(i)
+			}
+		}()
+	}
+	// MQTT
+	run(func(i int) {
+		d.ProcessMessage("$aws", "shadow/update", []byte(fmt.Sprintf(`{"clientToken":"12345678","state":{"reported":{"temp_a":2%d.5,"humid_a":5%d,"tank_level":%d}}}`, i%10, i%10, i%3)))
+		d.ProcessMessage("agl/prod", "mode", []byte(`{"prev_mode": 0,"mode": 0, "trigger": 1}`))
+	})
+	// UI actions
+	run(func(i int) {
+		s := slotID(i%9 + 1)
+		d.do(func() {
+			d.Slots[layerA][s] = slot{Plant: 104, PlantingTime: d.clock.Now()}
+		})
+		d.HarvestPlant(fmt.Sprintf("a%d", s))
+		d.AddPlant(fmt.Sprintf("b%d", s), 104)
+		mode := ModeDefault
+		if i%2 == 1 {
+			mode = ModeSilent
+		}
+		d.SetMode(mode, true)
+		d.ResetNutrient()
+		d.SetSunrise(time.Duration(6+i%3) * time.Hour)
+		d.SetFieldRange("humid_a", FieldRange{Min: 20, Max: 100})
+		d.TriggerManualWatering()
+		d.FinishCleaning()
+		d.SetName(fmt.Sprintf("Cube %d", i))
+	})
+	// UI reads and streams
+	run(func(i int) {
+		sub := d.Subscribe(0)
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-sub.Ready():
+					sub.Take()
+				case <-stop:
+					return
+				}
+			}
+		}()
+		d.Summary()
+		d.Liveness()
+		d.Rejections()
+		d.SuspiciousReadings()
+		d.FieldRanges()
+		d.DisplayName()
+		d.Unsubscribe(sub)
+		close(stop)
+	})
+	// Timers
+	run(func(i int) {
+		d.QueueSave()
+		d.QueueRecipe()
+		d.QueueWatering(i%2 == 0)
+		mock.Add(time.Minute)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatalf("not finished after a minute, deadlocked?")
+	}
+	if got, want := d.DisplayName(), fmt.Sprintf("Cube %d", rounds-1); got != want {
+		t.Errorf("got name '%s', want '%s'", got, want)
+	}
+}
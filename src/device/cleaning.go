@@ -0,0 +1,246 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CleaningStage is how far through the cleaning procedure a device
+// is. The procedure is driven by the Plantcube's mode changes:
+// Cleaning (rinsing) → RinseEnd (waiting for the user to clean the
+// drawers and attach the drain hose) → TankDrainCleaning → Default,
+// after which the user still has some work to do before we regard
+// the cleaning as finished.
+type CleaningStage int
+
+const (
+	CleaningIdle CleaningStage = iota
+	CleaningRinsing
+	CleaningRinseDone
+	CleaningDraining
+	CleaningFinished
+	CleaningOutOfRange
+)
+
+func (s CleaningStage) String() string {
+	switch s {
+	case CleaningIdle:
+		return "idle"
+	case CleaningRinsing:
+		return "rinsing"
+	case CleaningRinseDone:
+		return "rinse_done"
+	case CleaningDraining:
+		return "draining"
+	case CleaningFinished:
+		return "finished"
+	default:
+		return fmt.Sprintf("UnknownCleaningStage%d", int(s))
+	}
+}
+
+type cleaningStep struct {
+	instructions []string
+
+	// How long the stage can last before we regard it as stuck,
+	// zero if it can't be stuck.
+	timeout  time.Duration
+	stuckMsg string // Formatted with how long the stage has lasted
+}
+
+var cleaningSteps = map[CleaningStage]cleaningStep{
+	CleaningRinsing: {
+		instructions: []string{
+			"Keep the door closed",
+			"Wait while the Plantcube rinses itself",
+		},
+		timeout:  3 * time.Hour,
+		stuckMsg: "Rinsing has been running for %v, longer than expected",
+	},
+	CleaningRinseDone: {
+		instructions: []string{
+			"Remove and wash the drawers",
+			"Attach the drain hose",
+		},
+		timeout:  2 * time.Hour,
+		stuckMsg: "Rinsing finished %v ago, the drawers need cleaning and draining needs starting",
+	},
+	CleaningDraining: {
+		instructions: []string{
+			"Place the end of the drain hose in a bucket",
+			"Press the button to start and stop draining as needed",
+		},
+		timeout:  2 * time.Hour,
+		stuckMsg: "Draining has been running for %v, is the tank empty?",
+	},
+	CleaningFinished: {
+		instructions: []string{
+			"Empty and clean the tank",
+			"Do any final cleaning",
+			"Replace and refill the tank",
+			"Add 120ml nutrient solution",
+			"Replace the drawers, plants and seed trays",
+		},
+	},
+}
+
+var ErrCleaningNotFinished = errors.New("cleaning isn't finished")
+
+type cleaningState struct {
+	Stage        CleaningStage
+	Started      time.Time
+	StageStarted time.Time
+	Stuck        bool `json:",omitempty"`
+}
+
+// CleaningStatus is what we tell the frontend about the cleaning
+// procedure.
+type CleaningStatus struct {
+	Stage        CleaningStage
+	Instructions []string
+	Started      time.Time
+	StageStarted time.Time
+	Stuck        bool
+}
+
+func (d *Device) getCleaningStatus() *CleaningStatus {
+	if d.Cleaning == nil {
+		return nil
+	}
+	return &CleaningStatus{
+		Stage:        d.Cleaning.Stage,
+		Instructions: cleaningSteps[d.Cleaning.Stage].instructions,
+		Started:      d.Cleaning.Started,
+		StageStarted: d.Cleaning.StageStarted,
+		Stuck:        d.Cleaning.Stuck,
+	}
+}
+
+// initCleaning restarts the stuck timer for a device restored in the
+// middle of cleaning.
+func (d *Device) initCleaning() {
+	if d.Cleaning != nil {
+		d.armCleaningTimer()
+	}
+}
+
+// updateCleaning moves the cleaning procedure on after the device
+// changed mode.
+func (d *Device) updateCleaning(prev DeviceMode, mode DeviceMode, trigger ModeTrigger, t time.Time) {
+	stage := CleaningIdle
+	if d.Cleaning != nil {
+		stage = d.Cleaning.Stage
+	}
+	switch mode {
+	case ModeCleaning:
+		if stage != CleaningRinsing {
+			d.Cleaning = &cleaningState{Started: t}
+			d.setCleaningStage(CleaningRinsing, trigger, t)
+		}
+	case ModeRinseEnd:
+		d.setCleaningStage(CleaningRinseDone, trigger, t)
+	case ModeTankDrainCleaning:
+		d.setCleaningStage(CleaningDraining, trigger, t)
+	case ModeDefault:
+		if stage == CleaningDraining {
+			d.setCleaningStage(CleaningFinished, trigger, t)
+		} else if stage != CleaningIdle && stage != CleaningFinished {
+			d.abortCleaning(prev, mode, trigger)
+		}
+	default:
+		if stage == CleaningFinished {
+			// The user's evidently moved on
+			d.endCleaning()
+		} else if stage != CleaningIdle {
+			d.abortCleaning(prev, mode, trigger)
+		}
+	}
+}
+
+func (d *Device) setCleaningStage(stage CleaningStage, trigger ModeTrigger, t time.Time) {
+	if d.Cleaning == nil {
+		// We didn't see the start, e.g. because we were
+		// restarted.
+		d.Cleaning = &cleaningState{Started: t}
+	}
+	if d.Cleaning.Stuck {
+		d.notify(NoticeCleaningStuck, "", false, fmt.Sprintf("Cleaning has moved on to %s", stage))
+	}
+	d.Cleaning.Stage = stage
+	d.Cleaning.StageStarted = t
+	d.Cleaning.Stuck = false
+	log.Info.Printf("Device '%s' cleaning stage now %s (trigger %v)", d.ID, stage, trigger)
+	d.armCleaningTimer()
+	d.streamStatusUpdate()
+}
+
+func (d *Device) abortCleaning(prev DeviceMode, mode DeviceMode, trigger ModeTrigger) {
+	log.Warn.Printf("Device '%s' cleaning aborted in stage %s, mode changed from %v to %v, trigger %v", d.ID, d.Cleaning.Stage, prev, mode, trigger)
+	d.endCleaning()
+}
+
+func (d *Device) endCleaning() {
+	if d.Cleaning.Stuck {
+		d.notify(NoticeCleaningStuck, "", false, "Cleaning has ended")
+	}
+	d.Cleaning = nil
+	d.cleaningTimer.Stop()
+	d.streamStatusUpdate()
+}
+
+// FinishCleaning is called when the user has done the final steps of
+// cleaning.
+func (d *Device) FinishCleaning() error {
+	var err error
+	d.do(func() {
+		err = d.finishCleaning()
+	})
+	return err
+}
+
+func (d *Device) finishCleaning() error {
+	if d.Cleaning == nil || d.Cleaning.Stage != CleaningFinished {
+		return ErrCleaningNotFinished
+	}
+	log.Info.Printf("Device '%s' cleaning finished, took %v", d.ID, d.clock.Since(d.Cleaning.Started).Round(time.Minute))
+	d.endCleaning()
+	d.QueueSave()
+	return nil
+}
+
+func (d *Device) armCleaningTimer() {
+	step := cleaningSteps[d.Cleaning.Stage]
+	if step.timeout == 0 || d.Cleaning.Stuck {
+		d.cleaningTimer.Stop()
+		return
+	}
+	d.cleaningTimer.Reset(step.timeout - d.clock.Since(d.Cleaning.StageStarted))
+}
+
+// cleaningTimerFired is called from the cleaning timer's own
+// goroutine and hands over to the processing loop, like
+// livenessTimerFired.
+func (d *Device) cleaningTimerFired() {
+	select {
+	case d.cleaningChan <- struct{}{}:
+	default:
+		// A check is already pending
+	}
+}
+
+func (d *Device) checkCleaning() {
+	if d.Cleaning == nil || d.Cleaning.Stuck {
+		return
+	}
+	step := cleaningSteps[d.Cleaning.Stage]
+	lasted := d.clock.Since(d.Cleaning.StageStarted)
+	if step.timeout == 0 || lasted < step.timeout {
+		return
+	}
+	d.Cleaning.Stuck = true
+	msg := fmt.Sprintf(step.stuckMsg, lasted.Round(time.Minute))
+	log.Warn.Printf("Device '%s' cleaning stuck: %s", d.ID, msg)
+	d.notify(NoticeCleaningStuck, "", true, msg)
+	d.streamStatusUpdate()
+}
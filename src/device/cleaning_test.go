@@ -0,0 +1,97 @@
+package device
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestCleaning(t *testing.T) {
+	log = logs.Discard()
+	var notices []Notice
+	SetNoticeHandler(func(n Notice) { notices = append(notices, n) })
+	defer SetNoticeHandler(nil)
+
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1687685000, 0))
+	d := Device{ID: "test", clock: mock, cleaningChan: make(chan struct{}, 1)}
+	d.cleaningTimer = mock.AfterFunc(time.Hour, d.cleaningTimerFired)
+	d.cleaningTimer.Stop()
+	d.saveTimer = mock.AfterFunc(time.Hour, func() {})
+	d.saveTimer.Stop()
+
+	stage := func() CleaningStage {
+		if d.Cleaning == nil {
+			return CleaningIdle
+		}
+		return d.Cleaning.Stage
+	}
+	tests := []struct {
+		prev    DeviceMode
+		mode    DeviceMode
+		trigger ModeTrigger
+		advance time.Duration
+		want    CleaningStage
+	}{
+		// Not cleaning, nothing happens
+		{ModeDefault, ModeCinema, ModeTriggerApp, 0, CleaningIdle},
+		{ModeCinema, ModeDefault, ModeTriggerApp, 0, CleaningIdle},
+		// The full procedure
+		{ModeDefault, ModeCleaning, ModeTriggerApp, time.Hour, CleaningRinsing},
+		{ModeCleaning, ModeRinseEnd, ModeTriggerDevice, 10 * time.Minute, CleaningRinseDone},
+		{ModeRinseEnd, ModeTankDrainCleaning, ModeTriggerApp, 20 * time.Minute, CleaningDraining},
+		{ModeTankDrainCleaning, ModeDefault, ModeTriggerDevice, 0, CleaningFinished},
+		// Switching mode after finishing ends it
+		{ModeDefault, ModeSilent, ModeTriggerApp, 0, CleaningIdle},
+		// Aborted
+		{ModeSilent, ModeCleaning, ModeTriggerApp, 0, CleaningRinsing},
+		{ModeCleaning, ModeDefault, ModeTriggerApp, 0, CleaningIdle},
+		// Joined part-way through
+		{ModeDefault, ModeTankDrainCleaning, ModeTriggerApp, 0, CleaningDraining},
+	}
+	for i, tc := range tests {
+		d.updateCleaning(tc.prev, tc.mode, tc.trigger, mock.Now())
+		if stage() != tc.want {
+			t.Errorf("case %d: %v→%v, got stage %v, want %v", i, tc.prev, tc.mode, stage(), tc.want)
+		}
+		mock.Add(tc.advance)
+	}
+	if len(notices) != 0 {
+		t.Errorf("got notices %+v, want none", notices)
+	}
+
+	err := d.FinishCleaning()
+	if !errors.Is(err, ErrCleaningNotFinished) {
+		t.Errorf("FinishCleaning while draining, got error %v, want %v", err, ErrCleaningNotFinished)
+	}
+
+	// Draining takes too long
+	mock.Add(2*time.Hour + time.Minute)
+	select {
+	case <-d.cleaningChan:
+		d.checkCleaning()
+	case <-time.After(time.Second):
+		t.Fatalf("cleaning timer didn't fire")
+	}
+	cs := d.getCleaningStatus()
+	if cs == nil || cs.Stage != CleaningDraining || !cs.Stuck || len(cs.Instructions) == 0 {
+		t.Errorf("after 2 hours draining, got status %+v, want stuck draining", cs)
+	}
+	d.updateCleaning(ModeTankDrainCleaning, ModeDefault, ModeTriggerDevice, mock.Now())
+	err = d.FinishCleaning()
+	if err != nil {
+		t.Errorf("FinishCleaning failed: %v", err)
+	}
+	if d.Cleaning != nil {
+		t.Errorf("after FinishCleaning, got %+v, want nil", d.Cleaning)
+	}
+
+	if len(notices) != 2 || notices[0].Type != NoticeCleaningStuck || !notices[0].Active ||
+		notices[1].Type != NoticeCleaningStuck || notices[1].Active {
+		t.Errorf("got notices %+v, want cleaning stuck, then resolved", notices)
+	}
+}
@@ -0,0 +1,197 @@
+package device
+
+import (
+	"fmt"
+	"time"
+)
+
+// CommandKind is what sort of change we've asked the device to make.
+// There's only ever one command of each kind outstanding: a newer one
+// supersedes an older one.
+type CommandKind int
+
+const (
+	CommandMode CommandKind = iota
+	CommandRecipe
+	CommandSunrise
+	CommandWatering
+	CommandOutOfRange
+)
+
+func (k CommandKind) String() string {
+	switch k {
+	case CommandMode:
+		return "mode"
+	case CommandRecipe:
+		return "recipe"
+	case CommandSunrise:
+		return "sunrise"
+	case CommandWatering:
+		return "watering"
+	default:
+		return fmt.Sprintf("UnknownCommandKind%d", int(k))
+	}
+}
+
+// command is something we've sent to the device and are waiting to
+// see it act on. If it doesn't within commandTimeout, we send it
+// again, doubling the timeout each time, until we've retried
+// commandRetries times. After that, it's failed, but we keep looking
+// for an acknowledgement in case the device was just slow.
+type command struct {
+	kind     CommandKind
+	desc     string
+	sent     time.Time
+	lastSent time.Time
+	attempts int
+	failed   bool
+
+	send func() error
+	// acked is called after every message from the device, with
+	// the time the command was first sent.
+	acked func(msg *msgUnparsed, sent time.Time) bool
+}
+
+func (c *command) deadline() time.Time {
+	return c.lastSent.Add(current().commandTimeout << (c.attempts - 1))
+}
+
+// CommandStatus is what we tell the frontend about a command that
+// hasn't been acknowledged.
+type CommandStatus struct {
+	Kind        CommandKind
+	Description string
+	Sent        time.Time
+	Attempts    int
+	Failed      bool
+}
+
+func (d *Device) getCommandStatus() []CommandStatus {
+	var cs []CommandStatus
+	for _, c := range d.commands {
+		if c == nil {
+			continue
+		}
+		cs = append(cs, CommandStatus{
+			Kind:        c.kind,
+			Description: c.desc,
+			Sent:        c.sent,
+			Attempts:    c.attempts,
+			Failed:      c.failed,
+		})
+	}
+	return cs
+}
+
+// sendCommand sends a command to the device and keeps track of it
+// until acked says the device has acted on it.
+func (d *Device) sendCommand(kind CommandKind, desc string, send func() error, acked func(*msgUnparsed, time.Time) bool) error {
+	err := send()
+	if err != nil {
+		return err
+	}
+	if old := d.commands[kind]; old != nil {
+		log.Info.Printf("Device '%s' %s command '%s' superseded by '%s'", d.ID, kind, old.desc, desc)
+		d.dropCommand(old)
+	}
+	t := d.clock.Now()
+	d.commands[kind] = &command{
+		kind:     kind,
+		desc:     desc,
+		sent:     t,
+		lastSent: t,
+		attempts: 1,
+		send:     send,
+		acked:    acked,
+	}
+	d.armCommandTimer()
+	d.streamStatusUpdate()
+	return nil
+}
+
+func (d *Device) dropCommand(c *command) {
+	if c.failed {
+		d.notify(NoticeCommandFailed, c.kind.String(), false, fmt.Sprintf("The %s command '%s' is no longer outstanding", c.kind, c.desc))
+	}
+	d.commands[c.kind] = nil
+}
+
+// checkCommandAcks is called from the processing loop after every
+// message from the device.
+func (d *Device) checkCommandAcks(msg *msgUnparsed) {
+	changed := false
+	for _, c := range d.commands {
+		if c == nil || !c.acked(msg, c.sent) {
+			continue
+		}
+		log.Info.Printf("Device '%s' acknowledged %s command '%s' after %v, %d attempt(s)", d.ID, c.kind, c.desc, msg.t.Sub(c.sent), c.attempts)
+		if c.failed {
+			d.notify(NoticeCommandFailed, c.kind.String(), false, fmt.Sprintf("The %s command '%s' was acknowledged late", c.kind, c.desc))
+		}
+		d.commands[c.kind] = nil
+		changed = true
+	}
+	if changed {
+		d.armCommandTimer()
+		d.streamStatusUpdate()
+	}
+}
+
+func (d *Device) armCommandTimer() {
+	var next time.Time
+	for _, c := range d.commands {
+		if c == nil || c.failed {
+			continue
+		}
+		if next.IsZero() || c.deadline().Before(next) {
+			next = c.deadline()
+		}
+	}
+	if next.IsZero() {
+		d.commandTimer.Stop()
+		return
+	}
+	d.commandTimer.Reset(next.Sub(d.clock.Now()))
+}
+
+// commandTimerFired is called from the command timer's own
+// goroutine and hands over to the processing loop, like
+// livenessTimerFired.
+func (d *Device) commandTimerFired() {
+	select {
+	case d.commandChan <- struct{}{}:
+	default:
+		// A check is already pending
+	}
+}
+
+// checkCommands retries or fails any commands that have passed their
+// deadline.
+func (d *Device) checkCommands() {
+	now := d.clock.Now()
+	changed := false
+	for _, c := range d.commands {
+		if c == nil || c.failed || now.Before(c.deadline()) {
+			continue
+		}
+		changed = true
+		if c.attempts > current().commandRetries {
+			c.failed = true
+			msg := fmt.Sprintf("The Plantcube didn't act on the %s command '%s' after %d attempts", c.kind, c.desc, c.attempts)
+			log.Warn.Printf("Device '%s': %s", d.ID, msg)
+			d.notify(NoticeCommandFailed, c.kind.String(), true, msg)
+			continue
+		}
+		log.Warn.Printf("Device '%s' didn't acknowledge %s command '%s' within %v, retrying", d.ID, c.kind, c.desc, now.Sub(c.lastSent))
+		c.attempts++
+		c.lastSent = now
+		err := c.send()
+		if err != nil {
+			log.Error.Printf("Device '%s' failed resending %s command '%s': %v", d.ID, c.kind, c.desc, err)
+		}
+	}
+	if changed {
+		d.armCommandTimer()
+		d.streamStatusUpdate()
+	}
+}
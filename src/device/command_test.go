@@ -0,0 +1,100 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestCommandRetries(t *testing.T) {
+	log = logs.Discard()
+	setSettings(func(s *deviceSettings) {
+		s.commandTimeout = 5 * time.Minute
+		s.commandRetries = 2
+	})
+	var notices []Notice
+	SetNoticeHandler(func(n Notice) { notices = append(notices, n) })
+	defer SetNoticeHandler(nil)
+
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1687685000, 0))
+	p := &countingPublisher{}
+	d := Device{ID: "test", clock: mock, publisher: p, commandChan: make(chan struct{}, 1)}
+	d.commandTimer = mock.AfterFunc(time.Hour, d.commandTimerFired)
+	d.commandTimer.Stop()
+	d.saveTimer = mock.AfterFunc(time.Hour, func() {})
+	d.saveTimer.Stop()
+	d.Reported.Mode.update(ModeDefault, mock.Now())
+
+	waitCheck := func(advance time.Duration) {
+		t.Helper()
+		mock.Add(advance)
+		select {
+		case <-d.commandChan:
+			d.checkCommands()
+		case <-time.After(time.Second):
+			t.Fatalf("command timer didn't fire after %v", advance)
+		}
+	}
+	modeMsg := func(mode DeviceMode) *msgUnparsed {
+		d.Reported.Mode.update(mode, mock.Now())
+		// The shadow hears about it, as with processAglMode
+		_, err := d.getAWSShadowUpdateReplies(mock.Now(), true)
+		if err != nil {
+			t.Fatalf("shadow update failed: %v", err)
+		}
+		return &msgUnparsed{prefix: "agl/prod", event: "mode", t: mock.Now()}
+	}
+
+	err := d.SetMode(ModeCinema, false)
+	if err != nil {
+		t.Fatalf("SetMode failed: %v", err)
+	}
+	// Acknowledged before the timeout: nothing more is sent
+	mock.Add(time.Minute)
+	d.checkCommandAcks(modeMsg(ModeCinema))
+	if d.commands[CommandMode] != nil || p.published != 1 {
+		t.Fatalf("after ack, got command %+v and %d messages, want none and 1", d.commands[CommandMode], p.published)
+	}
+
+	// Not acknowledged: retried after 5m, then 10m, then fails
+	// after a further 20m
+	err = d.SetMode(ModeDefault, false)
+	if err != nil {
+		t.Fatalf("SetMode failed: %v", err)
+	}
+	waitCheck(5 * time.Minute)
+	waitCheck(10 * time.Minute)
+	if p.published != 4 {
+		t.Errorf("after two retries, got %d messages, want 4", p.published)
+	}
+	se := d.getStatusUpdate()
+	if len(se.Commands) != 1 || se.Commands[0].Attempts != 3 || se.Commands[0].Failed {
+		t.Errorf("after two retries, got commands %+v, want one pending with 3 attempts", se.Commands)
+	}
+	waitCheck(20 * time.Minute)
+	se = d.getStatusUpdate()
+	if p.published != 4 || len(se.Commands) != 1 || !se.Commands[0].Failed {
+		t.Errorf("after timeout, got %d messages, commands %+v, want 4 messages, one failed command", p.published, se.Commands)
+	}
+	if len(notices) != 1 || notices[0].Type != NoticeCommandFailed || !notices[0].Active {
+		t.Errorf("after timeout, got notices %+v, want one active command_failed", notices)
+	}
+
+	// A mode message for a different mode isn't an ack, but the
+	// right one, however late, is
+	d.checkCommandAcks(modeMsg(ModeSilent))
+	if d.commands[CommandMode] == nil {
+		t.Errorf("ack for the wrong mode cleared the command")
+	}
+	d.checkCommandAcks(modeMsg(ModeDefault))
+	if d.commands[CommandMode] != nil {
+		t.Errorf("late ack didn't clear the command")
+	}
+	if len(notices) != 2 || notices[1].Type != NoticeCommandFailed || notices[1].Active {
+		t.Errorf("after late ack, got notices %+v, want command_failed cleared", notices)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"time"
@@ -14,8 +15,11 @@ import (
 	"github.com/benbjohnson/clock"
 	"github.com/lupguo/go-render/render"
 	"go.einride.tech/pid"
+	"golang.org/x/exp/slices"
 
+	"github.com/Jon-Bright/plantprism/history"
 	"github.com/Jon-Bright/plantprism/plant"
+	"github.com/Jon-Bright/plantprism/shadow"
 )
 
 const (
@@ -34,6 +38,7 @@ const (
 	MQTT_TOPIC_AGL_RPC_PUT         = "agl/all/things/" + MQTT_ID_TOKEN + "/rpc/put"
 	MQTT_TOPIC_AWS_UPDATE_ACCEPTED = "$aws/things/" + MQTT_ID_TOKEN + "/shadow/update/accepted"
 	MQTT_TOPIC_AWS_UPDATE_DELTA    = "$aws/things/" + MQTT_ID_TOKEN + "/shadow/update/delta"
+	MQTT_TOPIC_AWS_UPDATE_REJECTED = "$aws/things/" + MQTT_ID_TOKEN + "/shadow/update/rejected"
 
 	KeepBackups           = 20
 	SaveDelay             = 20 * time.Second
@@ -107,12 +112,30 @@ type Device struct {
 
 	clock         clock.Clock
 	msgQueue      chan *msgUnparsed
+	stats         *loopStats
 	publisher     Publisher
-	slotChans     []chan *SlotEvent
-	statusChans   []chan *StatusEvent
+	hub           *hub
 	saveTimer     *clock.Timer
 	recipeTimer   *clock.Timer
 	wateringTimer *clock.Timer
+	livenessTimer *clock.Timer
+	livenessChan  chan struct{}
+	live          liveness
+	doorTimer     *clock.Timer
+	doorChan      chan struct{}
+	door          doorState
+	cleaningTimer *clock.Timer
+	cleaningChan  chan struct{}
+	commandTimer  *clock.Timer
+	commandChan   chan struct{}
+	outboxTimer   *clock.Timer
+	outboxStuck   bool
+	actions       chan func()
+	stopped       chan struct{}
+	commands      [CommandOutOfRange]*command
+	conditions    map[string]bool
+	rejections    map[RejectReason]RejectionStats
+	suspicious    []SuspiciousReading
 
 	// Stuff we maintain
 	SmoothedEC   float64                     `json:",omitempty"`
@@ -120,12 +143,20 @@ type Device struct {
 	WantNutrient int                         `json:",omitempty"`
 	Slots        map[layerID]map[slotID]slot `json:",omitempty"`
 	Recipe       *recipe                     `json:",omitempty"`
+	Cleaning     *cleaningState              `json:",omitempty"`
+	Outbox       []*outboundMsg              `json:",omitempty"`
 
 	// Configuration
-	Timezone   string `json:",omitempty"`
-	UserOffset int    `json:",omitempty"`
-
-	// Monotonically increasing ID sent out with update messages
+	Name       string                `json:",omitempty"`
+	Timezone   string                `json:",omitempty"`
+	UserOffset int                   `json:",omitempty"`
+	Ranges     map[string]FieldRange `json:",omitempty"`
+
+	// The AWS shadow: what we want the Plantcube to have, what it
+	// reported, and the monotonically increasing version sent out
+	// with update messages
+	Shadow *shadow.Document `json:",omitempty"`
+	// Only in saves from before Shadow, which took it over
 	AWSVersion int `json:",omitempty"`
 
 	// Values reported by the device
@@ -140,10 +171,6 @@ type msgUnparsed struct {
 	t       time.Time
 }
 
-type msgUpdTS struct {
-	Timestamp int `json:"timestamp"`
-}
-
 type msgReply interface {
 	topic() string
 }
@@ -163,11 +190,11 @@ func (d *Device) saveName() string {
 	if testMode {
 		return fmt.Sprintf("test-plantcube-%s.json", d.ID)
 	}
-	return fmt.Sprintf("plantcube-%s.json", d.ID)
+	return filepath.Join(dataDir, fmt.Sprintf("plantcube-%s.json", d.ID))
 }
 
 func (d *Device) backupName(gen int) string {
-	return fmt.Sprintf("plantcube-%s-backup-%d.json", d.ID, gen)
+	return filepath.Join(dataDir, fmt.Sprintf("plantcube-%s-backup-%d.json", d.ID, gen))
 }
 
 // IsSaved returns whether a file exists with saved metadata for the
@@ -254,37 +281,31 @@ func (d *Device) QueueSave() {
 	d.saveTimer.Reset(SaveDelay)
 }
 
+// SlotEvent is a slot's contents, sent whenever they change. Plant is
+// zero for an empty slot.
 type SlotEvent struct {
-	Layer layerID
-	Slot  slotID
-}
-
-func (d *Device) GetSlotChan() chan *SlotEvent {
-	c := make(chan *SlotEvent, 20)
-	d.slotChans = append(d.slotChans, c)
-	for _, l := range []layerID{layerA, layerB} {
-		for s := slot1; s <= slot9; s++ {
-			se := SlotEvent{l, s}
-			c <- &se
-		}
-	}
-	return c
+	Layer        layerID
+	Slot         slotID
+	Plant        plant.PlantID
+	PlantingTime time.Time
+	HarvestFrom  time.Time
+	HarvestBy    time.Time
 }
 
-func (d *Device) DropSlotChan(drop chan *SlotEvent) {
-	for i, c := range d.slotChans {
-		if c == drop {
-			d.slotChans = append(d.slotChans[:i], d.slotChans[i+1:]...)
-			return
-		}
+func (d *Device) slotEvent(l layerID, s slotID) *SlotEvent {
+	sl := d.Slots[l][s]
+	return &SlotEvent{
+		Layer:        l,
+		Slot:         s,
+		Plant:        sl.Plant,
+		PlantingTime: sl.PlantingTime,
+		HarvestFrom:  sl.HarvestFrom,
+		HarvestBy:    sl.HarvestBy,
 	}
 }
 
 func (d *Device) streamSlotUpdate(l layerID, s slotID) {
-	se := SlotEvent{l, s}
-	for _, c := range d.slotChans {
-		c <- &se
-	}
+	d.hub.publish(Update{Slot: d.slotEvent(l, s)})
 }
 
 type StatusEvent struct {
@@ -299,25 +320,22 @@ type StatusEvent struct {
 	Valve        ValveState
 	Mode         DeviceMode
 	Door         bool
+	Cooling      bool
+	Connected    bool
+	WifiLevel    int
 	EC           int
 	SmoothedEC   float64
 	WantNutrient int
-}
-
-func (d *Device) GetStatusChan() chan *StatusEvent {
-	c := make(chan *StatusEvent, 5)
-	d.statusChans = append(d.statusChans, c)
-	c <- d.getStatusUpdate()
-	return c
-}
-
-func (d *Device) DropStatusChan(drop chan *StatusEvent) {
-	for i, c := range d.statusChans {
-		if c == drop {
-			d.statusChans = append(d.statusChans[:i], d.statusChans[i+1:]...)
-			return
-		}
-	}
+	Sunrise      int // Seconds after midnight
+	Online       bool
+	LastMessage  time.Time
+	StaleFields  []string
+	DoorAlert    bool
+	DoorOpenTime time.Time
+	Cleaning     *CleaningStatus
+	Commands     []CommandStatus
+	Outbox       *OutboxStatus
+	Suspicious   []SuspiciousReading
 }
 
 func (d *Device) getStatusUpdate() *StatusEvent {
@@ -336,39 +354,60 @@ func (d *Device) getStatusUpdate() *StatusEvent {
 		Valve:        d.Reported.Valve.Value,
 		Mode:         d.Reported.Mode.Value,
 		Door:         d.Reported.Door.Value,
+		Cooling:      d.Reported.Cooling.Value,
+		Connected:    d.Reported.Connected.Value,
+		WifiLevel:    d.Reported.WifiLevel.Value,
 		EC:           d.Reported.EC.Value,
 		SmoothedEC:   d.SmoothedEC,
 		WantNutrient: d.WantNutrient,
+		Sunrise:      d.UserOffset,
+		Online:       !d.live.offline,
+		LastMessage:  d.live.lastMessage,
+		StaleFields:  d.staleFields(),
+		DoorAlert:    d.door.alert,
+		DoorOpenTime: d.doorOpenSince(),
+		Cleaning:     d.getCleaningStatus(),
+		Commands:     d.getCommandStatus(),
+		Outbox:       d.getOutboxStatus(),
+		Suspicious:   slices.Clone(d.suspicious),
 	}
 	return &se
 }
 
 func (d *Device) streamStatusUpdate() {
-	se := d.getStatusUpdate()
-	for _, c := range d.statusChans {
-		c <- se
-	}
+	d.hub.publish(Update{Status: d.getStatusUpdate()})
 }
 
 func (d *Device) SetSunrise(s time.Duration) error {
+	var err error
+	d.do(func() {
+		err = d.setSunrise(s)
+	})
+	return err
+}
+
+func (d *Device) setSunrise(s time.Duration) error {
 	t := d.clock.Now()
 	to, err := calcTotalOffset(d.Timezone, t, s)
 	if err != nil {
 		return fmt.Errorf("failed calculating total offset for sunrise %v: %w", s, err)
 	}
 	d.UserOffset = int(s / time.Second)
-	d.AWSVersion++
-	deltaD := Device{
-		AWSVersion: d.AWSVersion,
-	}
-	deltaD.Reported.TotalOffset.update(to, t)
-	delta := deltaD.getAWSShadowUpdateDeltaReply(t, t)
-	err = d.sendReplies([]msgReply{delta})
-	if err != nil {
-		return fmt.Errorf("failed sending delta for new sunrise: %w", err)
+	if to == d.Reported.TotalOffset.Value {
+		// Nothing for the Plantcube to do
+		d.dropDesired("total_offset")
+		d.streamStatusUpdate()
+		return nil
 	}
-
-	return nil
+	return d.sendCommand(CommandSunrise, fmt.Sprintf("sunrise %v", s), func() error {
+		err := d.sendDesired("total_offset", to)
+		if err != nil {
+			return fmt.Errorf("failed sending delta for new sunrise: %w", err)
+		}
+		return nil
+	}, func(msg *msgUnparsed, sent time.Time) bool {
+		return d.Reported.TotalOffset.Value == to && !d.Reported.TotalOffset.Time.Before(sent)
+	})
 }
 
 func parseSlot(slot string) (layerID, slotID, error) {
@@ -403,6 +442,14 @@ func (d *Device) QueueWatering(harvest bool) {
 }
 
 func (d *Device) AddPlant(slotStr string, plantID plant.PlantID) error {
+	var err error
+	d.do(func() {
+		err = d.addPlant(slotStr, plantID)
+	})
+	return err
+}
+
+func (d *Device) addPlant(slotStr string, plantID plant.PlantID) error {
 	l, s, err := parseSlot(slotStr)
 	if err != nil {
 		return err
@@ -422,6 +469,13 @@ func (d *Device) AddPlant(slotStr string, plantID plant.PlantID) error {
 		HarvestFrom:  t.Add(time.Duration(p.HarvestFrom)),
 		HarvestBy:    t.Add(time.Duration(p.HarvestBy)),
 	}
+	d.record(history.Record{
+		Time:   t,
+		Kind:   history.KindPlanting,
+		Field:  slotStr,
+		Value:  jsonValue(int(plantID)),
+		Detail: p.Names["de"], // TODO: language
+	})
 	d.streamSlotUpdate(l, s)
 	d.QueueRecipe()
 	d.QueueWatering(false)
@@ -430,6 +484,14 @@ func (d *Device) AddPlant(slotStr string, plantID plant.PlantID) error {
 }
 
 func (d *Device) HarvestPlant(slotStr string) error {
+	var err error
+	d.do(func() {
+		err = d.harvestPlant(slotStr)
+	})
+	return err
+}
+
+func (d *Device) harvestPlant(slotStr string) error {
 	l, s, err := parseSlot(slotStr)
 	if err != nil {
 		return err
@@ -437,8 +499,16 @@ func (d *Device) HarvestPlant(slotStr string) error {
 	if d.Slots[l][s].Plant == 0 {
 		return fmt.Errorf("can't harvest in slot '%s', it's already empty", slotStr)
 	}
+	d.record(history.Record{
+		Time:   d.clock.Now(),
+		Kind:   history.KindHarvest,
+		Field:  slotStr,
+		Value:  jsonValue(int(d.Slots[l][s].Plant)),
+		Detail: fmt.Sprintf("planted %s", d.Slots[l][s].PlantingTime.Format(time.RFC3339)),
+	})
 	d.Slots[l][s] = slot{}
 	d.streamSlotUpdate(l, s)
+	d.checkConditions()
 	d.QueueRecipe()
 	d.QueueWatering(true)
 	d.QueueSave()
@@ -446,8 +516,10 @@ func (d *Device) HarvestPlant(slotStr string) error {
 }
 
 func (d *Device) TriggerManualWatering() {
-	d.wateringTimer.Stop()
-	d.sendWateringRPC()
+	d.do(func() {
+		d.wateringTimer.Stop()
+		d.sendWateringRPC()
+	})
 }
 
 func (d *Device) sendWateringRPC() {
@@ -455,11 +527,23 @@ func (d *Device) sendWateringRPC() {
 	if d.layerHasPlants(layerB) {
 		l = layerB
 	}
-	msg := getAglRPCPutWatering(l)
-	err := d.sendReplies([]msgReply{msg})
+	err := d.sendCommand(CommandWatering, "water layer "+string(l), func() error {
+		return d.sendReplies([]msgReply{getAglRPCPutWatering(l)})
+	}, func(msg *msgUnparsed, sent time.Time) bool {
+		// Like processAWSShadowUpdate, we take any open valve
+		// as a sign that watering's underway.
+		return d.Reported.Valve.Value != ValveClosed && !d.Reported.Valve.Time.Before(sent)
+	})
 	if err != nil {
 		log.Error.Printf("failed sending watering RPC: %v", err)
+		return
 	}
+	d.record(history.Record{
+		Time:   d.clock.Now(),
+		Kind:   history.KindWatering,
+		Field:  "layer_" + string(l),
+		Detail: "watering triggered",
+	})
 
 }
 
@@ -517,48 +601,99 @@ func (d *Device) makeNewRecipe() error {
 	log.Info.Printf("New recipe generated at %v, equal %v, age difference %v, layerAActive %v, layerBActive %v", t.Local(), eq, ad, layerAActive, layerBActive)
 
 	d.Recipe = r
-	d.AWSVersion++
-	deltaD := Device{
-		AWSVersion: d.AWSVersion,
-	}
-	deltaD.Reported.RecipeID.update(int(d.Recipe.ID), t)
-	delta := deltaD.getAWSShadowUpdateDeltaReply(t, t)
-	err = d.sendReplies([]msgReply{delta})
-	if err != nil {
-		return fmt.Errorf("failed sending delta for new recipe: %w", err)
-	}
+	id := int(r.ID)
+	return d.sendCommand(CommandRecipe, fmt.Sprintf("recipe %d", id), func() error {
+		err := d.sendDesired("recipe_id", id)
+		if err != nil {
+			return fmt.Errorf("failed sending delta for new recipe: %w", err)
+		}
+		return nil
+	}, func(msg *msgUnparsed, sent time.Time) bool {
+		return d.Reported.RecipeID.Value == id && !d.Reported.RecipeID.Time.Before(sent)
+	})
+}
 
-	return nil
+// SetMode asks the device to change mode. If the change isn't
+// possible from the current mode, a *ModeChangeError is returned. If
+// it needs confirming and confirmed is false, a
+// *ModeConfirmationError is returned.
+func (d *Device) SetMode(mode DeviceMode, confirmed bool) error {
+	var err error
+	d.do(func() {
+		err = d.setMode(mode, confirmed)
+	})
+	return err
 }
 
-func (d *Device) SetMode(mode DeviceMode) error {
-	// TODO: we should check if this is a valid mode change. Can't change to
-	// e.g. cinema if we're in the middle of cleaning.
-	d.AWSVersion++
-	deltaD := Device{
-		AWSVersion: d.AWSVersion,
-	}
-	t := d.clock.Now()
-	deltaD.Reported.Mode.update(mode, t)
-	delta := deltaD.getAWSShadowUpdateDeltaReply(t, t)
-	err := d.sendReplies([]msgReply{delta})
+func (d *Device) setMode(mode DeviceMode, confirmed bool) error {
+	err := d.checkModeChange(mode, confirmed)
 	if err != nil {
-		return fmt.Errorf("failed sending delta for mode change: %w", err)
+		return err
 	}
-
-	return nil
+	if mode == d.Reported.Mode.Value {
+		// Nothing for the Plantcube to do
+		d.dropDesired("mode")
+		return nil
+	}
+	return d.sendCommand(CommandMode, "mode "+mode.String(), func() error {
+		err := d.sendDesired("mode", mode)
+		if err != nil {
+			return fmt.Errorf("failed sending delta for mode change: %w", err)
+		}
+		return nil
+	}, func(msg *msgUnparsed, sent time.Time) bool {
+		return msg.prefix == "agl/prod" && msg.event == "mode" && d.Reported.Mode.Value == mode && !d.Reported.Mode.Time.Before(sent)
+	})
 }
 
-func (d *Device) ProcessMessage(prefix string, event string, content []byte) {
-	d.msgQueue <- &msgUnparsed{prefix, event, content, d.clock.Now()}
+// UpdateAWSVersion replaces the device's shadow version with what f
+// returns, unless f returns an error. It's for replaying captures,
+// where the version sometimes changes outside our control.
+func (d *Device) UpdateAWSVersion(f func(v int) (int, error)) error {
+	var err error
+	d.do(func() {
+		var v int
+		doc := d.shadowDocument()
+		v, err = f(doc.Version)
+		if err == nil {
+			doc.Version = v
+		}
+	})
+	return err
 }
 
 func (d *Device) processingLoop() {
 	for {
-		msg := <-d.msgQueue
-		err := d.processMessage(msg)
-		if err != nil {
-			log.Error.Printf(err.Error())
+		select {
+		case <-d.stopped:
+			return
+		default:
+		}
+		select {
+		case msg := <-d.msgQueue:
+			before := d.Reported.fieldTimes()
+			prevDoor := d.Reported.Door
+			err := d.processMessage(msg)
+			if err != nil {
+				log.Error.Printf(err.Error())
+			}
+			// Even a message we couldn't handle shows the
+			// device is alive.
+			d.noteMessage(msg, before)
+			d.noteDoor(prevDoor)
+			d.checkCommandAcks(msg)
+			d.checkConditions()
+			d.stats.processed(d.clock.Since(msg.t))
+		case <-d.livenessChan:
+			d.checkLiveness()
+		case <-d.doorChan:
+			d.checkDoor()
+		case <-d.cleaningChan:
+			d.checkCleaning()
+		case <-d.commandChan:
+			d.checkCommands()
+		case f := <-d.actions:
+			f()
 		}
 	}
 }
@@ -603,6 +738,9 @@ func (d *Device) processMessage(msg *msgUnparsed) error {
 	return nil
 }
 
+// sendReplies queues replies in the outbox and publishes everything
+// that's waiting there. A reply that can't be published yet isn't an
+// error: it'll be retried.
 func (d *Device) sendReplies(replies []msgReply) error {
 	for _, r := range replies {
 		var (
@@ -619,11 +757,13 @@ func (d *Device) sendReplies(replies []msgReply) error {
 			return fmt.Errorf("failed marshalling '%s': %w", render.Render(r), err)
 		}
 		topic := strings.ReplaceAll(r.topic(), MQTT_ID_TOKEN, d.ID)
-		err = d.publisher.Publish(topic, b)
-		if err != nil {
-			return fmt.Errorf("failed publishing reply: %w", err)
+		var key string
+		if rs, ok := r.(msgReplySuperseding); ok {
+			key = rs.supersedes()
 		}
+		d.enqueue(topic, b, key)
 	}
+	d.flushOutbox()
 	return nil
 }
 
@@ -2,12 +2,24 @@ package device
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/lupguo/go-render/render"
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
 )
 
+// setSettings changes the settings every device uses.
+func setSettings(f func(s *deviceSettings)) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	f(&settings)
+}
+
 func TestParseSlot(t *testing.T) {
 	tests := []struct {
 		in        string
@@ -238,6 +250,7 @@ func TestCalcTotalOffset(t *testing.T) {
 }
 
 func TestProcessAWSShadowUpdate(t *testing.T) {
+	log = logs.Discard()
 	ts := time.Unix(1691777926, 0)
 	tsNew := time.Unix(1691777930, 0)
 	recipe, err := CreateRecipe(ts, defaultLEDVals, defaultTempDay, defaultTempNight,
@@ -249,6 +262,7 @@ func TestProcessAWSShadowUpdate(t *testing.T) {
 		d           Device
 		msgContent  string
 		wantReplies []string
+		wantVersion int
 		wantDevice  Device
 	}{
 		{
@@ -276,9 +290,9 @@ func TestProcessAWSShadowUpdate(t *testing.T) {
 					`"temp_a":{"timestamp":1691777930}}},` +
 					`"version":9877,"timestamp":1691777930,"clientToken":"12345678"}`,
 			},
+			wantVersion: 9877,
 			wantDevice: Device{
 				ClientToken: "12345678",
-				AWSVersion:  9877,
 				Reported: deviceReported{
 					Cooling:  valueWithTimestamp[bool]{false, tsNew},
 					Door:     valueWithTimestamp[bool]{true, ts},
@@ -312,15 +326,64 @@ func TestProcessAWSShadowUpdate(t *testing.T) {
 					`"metadata":{` +
 					`"recipe_id":{"timestamp":1691777926}}}`,
 			},
+			wantVersion: 9877,
 			wantDevice: Device{
 				ClientToken: "12345678",
-				AWSVersion:  9877,
 				Recipe:      recipe,
 				Reported: deviceReported{
 					RecipeID: valueWithTimestamp[int]{1, tsNew},
 					Valve:    valueWithTimestamp[ValveState]{ValveClosed, ts},
 				},
 			},
+		}, {
+			// Invalid update, rejected, device unchanged
+			d: Device{
+				ClientToken: "12345678",
+				AWSVersion:  9876,
+				Reported: deviceReported{
+					HumidA: valueWithTimestamp[int]{75, ts},
+				},
+			},
+			msgContent: `{"clientToken":"12345678",` +
+				`"state":{"reported":` +
+				`{"humid_a":120}}}`,
+			wantReplies: []string{
+				`{"code":400,"message":"humidity A out of range: 120",` +
+					`"timestamp":1691777930,"clientToken":"12345678"}`,
+			},
+			wantVersion: 9876,
+			wantDevice: Device{
+				ClientToken: "12345678",
+				Reported: deviceReported{
+					HumidA: valueWithTimestamp[int]{75, ts},
+				},
+				rejections: map[RejectReason]RejectionStats{
+					"invalid_value:humid_a": {1, tsNew, tsNew, "humidity A out of range: 120"},
+				},
+				suspicious: []SuspiciousReading{
+					{"humid_a", "120", tsNew, "humidity A out of range: 120"},
+				},
+			},
+		}, {
+			// Wrong client token, rejected, device unchanged
+			d: Device{
+				ClientToken: "12345678",
+				AWSVersion:  9876,
+			},
+			msgContent: `{"clientToken":"87654321",` +
+				`"state":{"reported":` +
+				`{"humid_a":75}}}`,
+			wantReplies: []string{
+				`{"code":400,"message":"clientToken '87654321' received, but device clientToken is '12345678'",` +
+					`"timestamp":1691777930,"clientToken":"87654321"}`,
+			},
+			wantVersion: 9876,
+			wantDevice: Device{
+				ClientToken: "12345678",
+				rejections: map[RejectReason]RejectionStats{
+					"client_token": {1, tsNew, tsNew, "clientToken '87654321' received, but device clientToken is '12345678'"},
+				},
+			},
 		},
 	}
 	for i, tc := range tests {
@@ -346,12 +409,77 @@ func TestProcessAWSShadowUpdate(t *testing.T) {
 				t.Errorf("case %d, reply %d doesn't match, got '%s', want '%s'", i, j, string(b), wr)
 			}
 		}
+		// The version's in the shadow once the device has one
+		version := tc.d.AWSVersion
+		if tc.d.Shadow != nil {
+			version = tc.d.Shadow.Version
+		}
+		if version != tc.wantVersion {
+			t.Errorf("case %d, got version %d, want %d", i, version, tc.wantVersion)
+		}
+		tc.d.AWSVersion, tc.d.Shadow = 0, nil
 		if !reflect.DeepEqual(tc.d, tc.wantDevice) {
 			t.Errorf("case %d, device doesn't match\ngot:\n%s\nwant:\n%s", i, render.Render(tc.d), render.Render(tc.wantDevice))
 		}
 	}
 }
 
+func TestDesiredPersists(t *testing.T) {
+	log = logs.Discard()
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1691777926, 0))
+	p := &countingPublisher{}
+	d := Device{ID: "test", ClientToken: "12345678", clock: mock, publisher: p, AWSVersion: 9876}
+	d.saveTimer = mock.AfterFunc(time.Hour, func() {})
+	d.saveTimer.Stop()
+	report := func(offset int) []msgReply {
+		t.Helper()
+		mock.Add(time.Second)
+		content := fmt.Sprintf(`{"clientToken":"12345678","state":{"reported":{"total_offset":%d}}}`, offset)
+		replies, err := d.processAWSShadowUpdate(&msgUnparsed{content: []byte(content), t: mock.Now()})
+		if err != nil {
+			t.Fatalf("processAWSShadowUpdate failed: %v", err)
+		}
+		return replies
+	}
+
+	err := d.sendDesired("total_offset", 69299)
+	if err != nil || p.published != 1 || d.Shadow.Version != 9877 {
+		t.Fatalf("sendDesired got error %v, %d messages, version %d, want none, 1, 9877", err, p.published, d.Shadow.Version)
+	}
+
+	// The desired value survives a save, and a report that doesn't
+	// match it gets a delta
+	b, err := json.Marshal(&d)
+	if err != nil {
+		t.Fatalf("failed to marshal device: %v", err)
+	}
+	var restored Device
+	err = pickyUnmarshal(b, &restored)
+	if err != nil {
+		t.Fatalf("failed to unmarshal device: %v", err)
+	}
+	d.Shadow = restored.Shadow
+	replies := report(70000)
+	if len(replies) != 2 {
+		t.Fatalf("mismatching report got %d replies, want accepted and delta", len(replies))
+	}
+	delta, err := json.Marshal(replies[1])
+	want := `{"version":9878,"timestamp":1691777927,"state":{"total_offset":69299},"metadata":{"total_offset":{"timestamp":1691777926}}}`
+	if err != nil || string(delta) != want {
+		t.Errorf("got delta '%s', error %v, want '%s'", delta, err, want)
+	}
+
+	// Once it's reported, it's no longer desired, so the
+	// Plantcube's free to change it
+	if replies = report(69299); len(replies) != 1 {
+		t.Errorf("matching report got %d replies, want only accepted", len(replies))
+	}
+	if replies = report(70000); len(replies) != 1 || len(d.Shadow.Desired) != 0 {
+		t.Errorf("later report got %d replies, desired %v, want only accepted and nothing desired", len(replies), d.Shadow.Desired)
+	}
+}
+
 func TestGetAWSUpdateAcceptedReply(t *testing.T) {
 	ts := time.Unix(1691777926, 0)
 	tsOld := time.Unix(1691777920, 0)
@@ -472,8 +600,11 @@ func TestGetAWSUpdateAcceptedReply(t *testing.T) {
 		},
 	}
 	for _, tc := range tests {
-		reply := tc.d.getAWSShadowUpdateAcceptedReply(ts, tc.omitClientToken)
-		b, err := json.Marshal(reply)
+		replies, err := tc.d.getAWSShadowUpdateReplies(ts, tc.omitClientToken)
+		if err != nil || len(replies) != 1 {
+			t.Fatalf("shadow update replies for device '%s',\nts %d, got %d replies, error %v, want 1 reply", render.Render(tc.d), ts.Unix(), len(replies), err)
+		}
+		b, err := json.Marshal(replies[0])
 		if err != nil {
 			t.Fatalf("shadow update accepted reply for device '%s',\nts %d, error %v", render.Render(tc.d), ts.Unix(), err)
 		}
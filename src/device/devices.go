@@ -8,13 +8,15 @@ import (
 	"github.com/thlib/go-timezone-local/tzlocal"
 	"golang.org/x/exp/slices"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	// We sometimes see sprees of 3 or 4 messages. This should be
-	// enough buffer to prevent blocking in those situations.
-	MSG_QUEUE_BUFFER = 5
+	// We sometimes see sprees of 3 or 4 messages. A device that
+	// falls further behind than this starts losing its oldest
+	// messages.
+	MSG_QUEUE_BUFFER = 50
 
 	defaultTempDay     = 23.0
 	defaultTempNight   = 20.0
@@ -25,16 +27,49 @@ const (
 
 type deviceList []string
 
+// deviceFlags are the flags' values. Only ReloadFlags reads them:
+// devices use the settings it makes from them.
+type deviceFlags struct {
+	timezone       string
+	sunrise        string
+	offlineAfter   time.Duration
+	doorAlertAfter time.Duration
+	commandTimeout time.Duration
+	commandRetries int
+	lenient        bool
+	staleFactor    float64
+}
+
+// deviceSettings are what every device uses, unless it's configured
+// otherwise. A configuration reload can change them while devices are
+// running, so they're read with current.
+type deviceSettings struct {
+	timezone       string
+	sunrise        time.Duration
+	offlineAfter   time.Duration
+	doorAlertAfter time.Duration
+	commandTimeout time.Duration
+	commandRetries int
+	lenient        bool
+	staleFactor    float64
+}
+
 var (
+	// devicesMu guards deviceMap, allowedDevices and deviceConfigs,
+	// which a configuration reload can change at any time.
+	devicesMu      sync.Mutex
 	deviceMap      map[string]*Device
 	allowedDevices deviceList
 	log            *logs.Loggers
 	clk            clock.Clock
 
-	timezone       string
-	sunriseTimeStr string
+	df deviceFlags
+
+	settingsMu sync.RWMutex
+	settings   deviceSettings
 
-	sunriseD time.Duration
+	dataDir       string
+	deviceConfigs map[string]deviceConfig
 
 	defaultLEDVals = []byte{0x3d, 0x27, 0x21, 0x0a}
 )
@@ -48,11 +83,49 @@ func (l *deviceList) Set(value string) error {
 	return nil
 }
 
+func (l *deviceList) Reset() {
+	*l = nil
+}
+
+// AllowedDevices returns the IDs of the devices given with -device.
+func AllowedDevices() []string {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	return slices.Clone(allowedDevices)
+}
+
+// SetAllowedDevices replaces the allowed devices. A loaded device
+// that's no longer allowed is stopped and forgotten: if it's allowed
+// again, Get loads it afresh from its saved file.
+func SetAllowedDevices(ids []string) {
+	devicesMu.Lock()
+	allowedDevices = slices.Clone(ids)
+	var removed []*Device
+	for id, d := range deviceMap {
+		if !slices.Contains(allowedDevices, id) {
+			removed = append(removed, d)
+			delete(deviceMap, id)
+		}
+	}
+	devicesMu.Unlock()
+	// Not under devicesMu: the processing loop might be waiting
+	// for it.
+	for _, d := range removed {
+		log.Info.Printf("Device '%s' is no longer allowed, stopping it", d.ID)
+		d.stop()
+	}
+}
+
 func Get(id string, p Publisher) (*Device, error) {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
 	d, ok := deviceMap[id]
 	if !ok {
 		return instantiateDevice(id, p)
 	}
+	if !slices.Contains(allowedDevices, id) {
+		return nil, fmt.Errorf("device ID '%s' is no longer an allowed device", id)
+	}
 	return d, nil
 }
 
@@ -62,25 +135,187 @@ func InitFlags() {
 	if err != nil {
 		panic(fmt.Sprintf("Failed to get timezone: %v", err))
 	}
-	flag.StringVar(&timezone, "timezone", defaultTZ, "Timezone to be sent to Plantcube. Default is this machine's timezone.")
+	flag.StringVar(&df.timezone, "timezone", defaultTZ, "Timezone to be sent to Plantcube. Default is this machine's timezone.")
 	// TODO: we should base this on the saved totalOffset for the Plantcube
-	flag.StringVar(&sunriseTimeStr, "sunrise", "07:00", "The time at which the Plantcube's sun rises.")
+	flag.StringVar(&df.sunrise, "sunrise", "07:00", "The time at which the Plantcube's sun rises.")
+	flag.DurationVar(&df.offlineAfter, "offline_after", time.Hour, "How long without any message before a Plantcube is regarded as offline.")
+	flag.DurationVar(&df.doorAlertAfter, "door_alert_after", 10*time.Minute, "How long the door can be open before we raise an alert.")
+	flag.DurationVar(&df.commandTimeout, "command_timeout", 5*time.Minute, "How long to wait for a Plantcube to act on a command before sending it again. Doubles with each retry.")
+	flag.IntVar(&df.commandRetries, "command_retries", 3, "How many times to resend a command the Plantcube hasn't acted on before regarding it as failed.")
+	flag.BoolVar(&df.lenient, "lenient", false, "Process what we understand of messages with unknown fields or values, cataloguing the unknowns, rather than rejecting the messages.")
+	flag.Float64Var(&df.staleFactor, "stale_factor", 3, "A sensor is regarded as stale when it hasn't reported for this many times its usual reporting interval.")
 }
 
 func Init(l *logs.Loggers, c clock.Clock) error {
 	log = l
 	clk = c
+	return ReloadFlags()
+}
 
-	var err error
-	sunriseD, err = parseSunriseToDuration(sunriseTimeStr)
+// ReloadFlags takes account of changes to the flags since Init. It
+// mustn't be called at the same time as the flags are changed. Only
+// devices created afterwards get the new default timezone and sunrise.
+func ReloadFlags() error {
+	s, err := parseSunriseToDuration(df.sunrise)
 	if err != nil {
 		return err
 	}
-	log.Info.Printf("Sunrise at %02d:%02d", sunriseD/time.Hour, (sunriseD%time.Hour)/time.Minute)
+	settingsMu.Lock()
+	settings = deviceSettings{
+		timezone:       df.timezone,
+		sunrise:        s,
+		offlineAfter:   df.offlineAfter,
+		doorAlertAfter: df.doorAlertAfter,
+		commandTimeout: df.commandTimeout,
+		commandRetries: df.commandRetries,
+		lenient:        df.lenient,
+		staleFactor:    df.staleFactor,
+	}
+	settingsMu.Unlock()
+	log.Info.Printf("Sunrise at %02d:%02d", s/time.Hour, (s%time.Hour)/time.Minute)
+	return nil
+}
+
+// current returns the settings devices use.
+func current() deviceSettings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return settings
+}
+
+// loadedDevices returns every device that's been loaded.
+func loadedDevices() []*Device {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	l := make([]*Device, 0, len(deviceMap))
+	for _, d := range deviceMap {
+		l = append(l, d)
+	}
+	return l
+}
 
+// SetDataDir sets the directory devices are saved in. By default,
+// it's the current directory.
+func SetDataDir(dir string) {
+	dataDir = dir
+}
+
+// DeviceConfig is the configuration for a single device. Any setting
+// that's set overrides the device's saved value whenever it's loaded.
+type DeviceConfig struct {
+	Name     string
+	Timezone string
+	Sunrise  string // HH:MM
+}
+
+type deviceConfig struct {
+	name     string
+	timezone string
+	sunrise  time.Duration // 0 if not set
+}
+
+// Configure sets the configuration for a device. It must be called
+// before the device is first used. Use Reconfigure to change the
+// configuration of running devices.
+func Configure(id string, c DeviceConfig) error {
+	dc, err := c.parse(id)
+	if err != nil {
+		return err
+	}
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	if deviceConfigs == nil {
+		deviceConfigs = make(map[string]deviceConfig)
+	}
+	deviceConfigs[id] = dc
 	return nil
 }
 
+// CheckConfigs returns an error if any configuration is invalid, so
+// that Reconfigure would refuse it.
+func CheckConfigs(configs map[string]DeviceConfig) error {
+	_, err := parseConfigs(configs)
+	return err
+}
+
+// Reconfigure replaces the configuration for every device. Running
+// devices whose configuration changed apply it as soon as they're
+// free to, and are returned. If any configuration is invalid,
+// nothing changes.
+func Reconfigure(configs map[string]DeviceConfig) ([]string, error) {
+	dcs, err := parseConfigs(configs)
+	if err != nil {
+		return nil, err
+	}
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+	var changed []string
+	for id, d := range deviceMap {
+		if dcs[id] == deviceConfigs[id] {
+			continue
+		}
+		changed = append(changed, id)
+		dc := dcs[id]
+		d.post(func() {
+			d.reconfigure(dc)
+		})
+	}
+	deviceConfigs = dcs
+	slices.Sort(changed)
+	return changed, nil
+}
+
+func parseConfigs(configs map[string]DeviceConfig) (map[string]deviceConfig, error) {
+	dcs := make(map[string]deviceConfig)
+	for id, c := range configs {
+		dc, err := c.parse(id)
+		if err != nil {
+			return nil, err
+		}
+		dcs[id] = dc
+	}
+	return dcs, nil
+}
+
+func (c DeviceConfig) parse(id string) (deviceConfig, error) {
+	dc := deviceConfig{name: c.Name, timezone: c.Timezone}
+	if c.Timezone != "" {
+		_, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return dc, fmt.Errorf("device '%s' timezone: %w", id, err)
+		}
+	}
+	if c.Sunrise != "" {
+		var err error
+		dc.sunrise, err = parseSunriseToDuration(c.Sunrise)
+		if err != nil {
+			return dc, fmt.Errorf("device '%s' sunrise: %w", id, err)
+		}
+	}
+	return dc, nil
+}
+
+// applyConfig applies the configuration to a device being loaded.
+func (d *Device) applyConfig() {
+	dc, ok := deviceConfigs[d.ID]
+	if !ok {
+		return
+	}
+	d.setConfig(dc)
+}
+
+func (d *Device) setConfig(dc deviceConfig) {
+	if dc.name != "" {
+		d.Name = dc.name
+	}
+	if dc.timezone != "" {
+		d.Timezone = dc.timezone
+	}
+	if dc.sunrise != 0 {
+		d.UserOffset = int(dc.sunrise / time.Second)
+	}
+}
+
 func parseSunriseToDuration(sunrise string) (time.Duration, error) {
 	t, err := time.Parse("15:04", sunrise)
 	if err != nil {
@@ -98,8 +333,9 @@ func instantiateDevice(id string, p Publisher) (*Device, error) {
 	d.ID = id
 	d.clock = clk
 	d.msgQueue = make(chan *msgUnparsed, MSG_QUEUE_BUFFER)
+	d.stats = &loopStats{}
 	d.publisher = p
-	d.slotChans = []chan *SlotEvent{}
+	d.hub = newHub(clk.Now())
 
 	// Go is happy to let us reset a Timer later, but refuses to
 	// create an unstarted timer. We could create the Timer when
@@ -110,13 +346,32 @@ func instantiateDevice(id string, p Publisher) (*Device, error) {
 	// lifetime, so the risk is minimal. So, we create Timers for
 	// (a long time away), then stop them. They can now be reset
 	// later without worry.
+	//
+	// Timers fire on their own goroutines, so they hand their
+	// work to the processing loop.
 	aLongTime := 365 * 24 * time.Hour
-	d.saveTimer = d.clock.AfterFunc(aLongTime, d.queuedSave)
+	d.saveTimer = d.clock.AfterFunc(aLongTime, func() { d.post(d.queuedSave) })
 	d.saveTimer.Stop()
-	d.recipeTimer = d.clock.AfterFunc(aLongTime, d.sendRecipe)
+	d.recipeTimer = d.clock.AfterFunc(aLongTime, func() { d.post(d.sendRecipe) })
 	d.recipeTimer.Stop()
-	d.wateringTimer = d.clock.AfterFunc(aLongTime, d.sendWateringRPC)
+	d.wateringTimer = d.clock.AfterFunc(aLongTime, func() { d.post(d.sendWateringRPC) })
 	d.wateringTimer.Stop()
+	d.livenessTimer = d.clock.AfterFunc(aLongTime, d.livenessTimerFired)
+	d.livenessTimer.Stop()
+	d.livenessChan = make(chan struct{}, 1)
+	d.doorTimer = d.clock.AfterFunc(aLongTime, d.doorTimerFired)
+	d.doorTimer.Stop()
+	d.doorChan = make(chan struct{}, 1)
+	d.cleaningTimer = d.clock.AfterFunc(aLongTime, d.cleaningTimerFired)
+	d.cleaningTimer.Stop()
+	d.cleaningChan = make(chan struct{}, 1)
+	d.commandTimer = d.clock.AfterFunc(aLongTime, d.commandTimerFired)
+	d.commandTimer.Stop()
+	d.outboxTimer = d.clock.AfterFunc(aLongTime, func() { d.post(d.flushOutbox) })
+	d.outboxTimer.Stop()
+	d.commandChan = make(chan struct{}, 1)
+	d.actions = make(chan func(), ACTION_QUEUE_BUFFER)
+	d.stopped = make(chan struct{})
 
 	if d.IsSaved() {
 		err := d.RestoreFromFile()
@@ -130,6 +385,7 @@ func instantiateDevice(id string, p Publisher) (*Device, error) {
 			log.Info.Printf("Saved file has no PID controller, upgrading")
 			d.NutrientPID = newPIDController()
 		}
+		d.applyConfig()
 	} else {
 		d.NutrientPID = newPIDController()
 		d.Slots = map[layerID]map[slotID]slot{
@@ -157,8 +413,9 @@ func instantiateDevice(id string, p Publisher) (*Device, error) {
 			},
 		}
 		t := clk.Now()
-		d.UserOffset = int(sunriseD / time.Second)
-		d.Timezone = timezone
+		s := current()
+		d.UserOffset = int(s.sunrise / time.Second)
+		d.Timezone = s.timezone
 		var err error
 		d.Recipe, err = CreateRecipe(t, defaultLEDVals, defaultTempDay, defaultTempNight, defaultWaterTarget, defaultWaterDelay, defaultDayLength, false, false)
 		if err != nil {
@@ -166,6 +423,7 @@ func instantiateDevice(id string, p Publisher) (*Device, error) {
 		}
 		d.Reported.Mode.update(ModeDefault, t)
 		d.Reported.RecipeID.update(int(d.Recipe.ID), t)
+		d.applyConfig()
 		err = d.Save()
 		if err != nil {
 			return nil, fmt.Errorf("device id '%s', failed to save defaults: %v", id, err)
@@ -178,6 +436,25 @@ func instantiateDevice(id string, p Publisher) (*Device, error) {
 
 	deviceMap[id] = &d
 
-	go d.processingLoop()
+	d.initLiveness()
+	d.initDoor()
+	d.initCleaning()
+	d.initOutbox()
+	go d.supervise()
 	return &d, nil
 }
+
+// reconfigure applies a changed configuration to a running device. A
+// changed timezone or sunrise is sent to the Plantcube.
+func (d *Device) reconfigure(dc deviceConfig) {
+	prevTZ, prevOffset := d.Timezone, d.UserOffset
+	d.setConfig(dc)
+	log.Info.Printf("Device '%s' reconfigured", d.ID)
+	if d.Timezone != prevTZ || d.UserOffset != prevOffset {
+		err := d.setSunrise(time.Duration(d.UserOffset) * time.Second)
+		if err != nil {
+			log.Error.Printf("Device '%s', failed to apply new sunrise: %v", d.ID, err)
+		}
+	}
+	d.QueueSave()
+}
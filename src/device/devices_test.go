@@ -0,0 +1,150 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestReconfigure(t *testing.T) {
+	log = logs.Discard()
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1687685000, 0))
+	p := &countingPublisher{}
+	d := &Device{ID: "test", clock: mock, publisher: p, Timezone: "Europe/Berlin", UserOffset: 7 * 3600}
+	d.commandChan = make(chan struct{}, 1)
+	d.commandTimer = mock.AfterFunc(time.Hour, d.commandTimerFired)
+	d.commandTimer.Stop()
+	d.saveTimer = mock.AfterFunc(time.Hour, func() {})
+	d.saveTimer.Stop()
+	d.Reported.Mode.update(ModeDefault, mock.Now())
+
+	prevMap, prevAllowed, prevConfigs := deviceMap, allowedDevices, deviceConfigs
+	defer func() {
+		deviceMap, allowedDevices, deviceConfigs = prevMap, prevAllowed, prevConfigs
+	}()
+	deviceMap = map[string]*Device{"test": d}
+	allowedDevices = deviceList{"test"}
+	deviceConfigs = nil
+
+	if CheckConfigs(map[string]DeviceConfig{"test": {Timezone: "Mars/Olympus_Mons"}}) == nil {
+		t.Errorf("invalid timezone, CheckConfigs found nothing wrong")
+	}
+	_, err := Reconfigure(map[string]DeviceConfig{"test": {Timezone: "Mars/Olympus_Mons"}})
+	if err == nil || d.Timezone != "Europe/Berlin" {
+		t.Errorf("invalid timezone, got error %v and timezone %s, want an error and no change", err, d.Timezone)
+	}
+
+	changed, err := Reconfigure(map[string]DeviceConfig{"test": {Name: "Kitchen", Sunrise: "06:30"}, "other": {Name: "Hall"}})
+	if err != nil || len(changed) != 1 || changed[0] != "test" {
+		t.Fatalf("got changed %v, error %v, want [test]", changed, err)
+	}
+	// d has no processing loop, so it's already been reconfigured
+	if d.Name != "Kitchen" || d.UserOffset != 6*3600+30*60 || p.published != 1 {
+		t.Errorf("after reconfigure, got name '%s', offset %d, %d messages, want Kitchen, 23400, 1", d.Name, d.UserOffset, p.published)
+	}
+
+	changed, err = Reconfigure(map[string]DeviceConfig{"test": {Name: "Kitchen", Sunrise: "06:30"}})
+	if err != nil || len(changed) != 0 {
+		t.Errorf("unchanged config, got changed %v, error %v, want none", changed, err)
+	}
+
+	if got, err := Get("test", p); got != d || err != nil {
+		t.Errorf("allowed device, got %v, %v", got, err)
+	}
+	SetAllowedDevices(nil)
+	if _, err := Get("test", p); err == nil {
+		t.Errorf("no longer allowed device, got no error")
+	}
+}
+
+func TestSetAllowedDevicesStopsRemoved(t *testing.T) {
+	log = logs.Discard()
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1691777930, 0))
+	prevClk, prevMap, prevAllowed, prevTestMode, prevSettings := clk, deviceMap, allowedDevices, testMode, current()
+	defer func() {
+		clk, deviceMap, allowedDevices, testMode = prevClk, prevMap, prevAllowed, prevTestMode
+		setSettings(func(s *deviceSettings) { *s = prevSettings })
+	}()
+	clk = mock
+	testMode = true
+	deviceMap = nil
+	setSettings(func(s *deviceSettings) {
+		s.commandTimeout = 5 * time.Minute
+		s.commandRetries = 3
+	})
+	const id = "stop-test"
+	allowedDevices = deviceList{id}
+
+	p := &countingPublisher{}
+	d, err := Get(id, p)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	err = d.SetMode(ModeSilent, false)
+	if err != nil {
+		t.Fatalf("SetMode failed: %v", err)
+	}
+	var published int
+	d.do(func() {
+		published = p.published
+	})
+
+	SetAllowedDevices(nil)
+	// The unacknowledged command would be retried, and the device
+	// would go offline.
+	mock.Add(time.Hour)
+	if p.published != published {
+		t.Errorf("stopped device published %d messages, want none", p.published-published)
+	}
+	// Handing the stopped device anything doesn't wait forever
+	d.SetName("Stopped")
+
+	SetAllowedDevices([]string{id})
+	again, err := Get(id, p)
+	if err != nil || again == d {
+		t.Errorf("allowed again, got %p, %v, want a newly loaded device", again, err)
+	}
+}
+
+func TestReloadFlags(t *testing.T) {
+	log = logs.Discard()
+	prevFlags, prevSettings := df, current()
+	defer func() {
+		df = prevFlags
+		setSettings(func(s *deviceSettings) { *s = prevSettings })
+	}()
+
+	// Readers, like a running device's loop
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			_ = current().offlineAfter
+		}
+	}()
+	df = deviceFlags{timezone: "Europe/Berlin", sunrise: "06:30", offlineAfter: 2 * time.Hour, lenient: true}
+	err := ReloadFlags()
+	if err != nil {
+		t.Fatalf("ReloadFlags failed: %v", err)
+	}
+	<-done
+	s := current()
+	if s.sunrise != 6*time.Hour+30*time.Minute || s.offlineAfter != 2*time.Hour || !s.lenient || !Lenient() {
+		t.Errorf("got settings %+v", s)
+	}
+
+	// An invalid sunrise changes nothing
+	df.sunrise = "25:00"
+	df.offlineAfter = time.Hour
+	if ReloadFlags() == nil {
+		t.Errorf("invalid sunrise, got no error")
+	}
+	if current().offlineAfter != 2*time.Hour {
+		t.Errorf("invalid sunrise, settings changed to %+v", current())
+	}
+}
@@ -0,0 +1,208 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// The Plantcube's firmware can change under us. In lenient mode, we
+// process what we understand of a message and catalogue what we
+// don't, rather than dropping the message. Some things (topics and
+// warning labels) never cause a message to be dropped, so they're
+// catalogued in both modes.
+
+// maxDiscoverySamples is how many different payloads we keep for each
+// discovery.
+const maxDiscoverySamples = 3
+
+type DiscoveryKind string
+
+const (
+	DiscoveryTopic DiscoveryKind = "topic"
+	DiscoveryField DiscoveryKind = "field"
+	DiscoveryLabel DiscoveryKind = "warning_label"
+	DiscoveryEnum  DiscoveryKind = "enum"
+)
+
+// Discovery is something a Plantcube sent that we didn't expect.
+type Discovery struct {
+	Kind DiscoveryKind
+	// Where it was seen: the message's prefix and event. Empty
+	// for topics.
+	Where     string
+	Key       string
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Samples   []string
+}
+
+var (
+	discoveriesMu sync.Mutex
+	discoveries   map[string]*Discovery
+)
+
+// Lenient says whether unknown fields and values are catalogued
+// rather than rejected.
+func Lenient() bool {
+	return current().lenient
+}
+
+func discover(kind DiscoveryKind, where, key string, sample []byte, t time.Time) {
+	discoveriesMu.Lock()
+	defer discoveriesMu.Unlock()
+	if discoveries == nil {
+		discoveries = make(map[string]*Discovery)
+	}
+	id := string(kind) + "|" + where + "|" + key
+	dc, ok := discoveries[id]
+	if !ok {
+		log.Warn.Printf("Discovered unknown %s '%s' in %s", kind, key, where)
+		dc = &Discovery{Kind: kind, Where: where, Key: key, FirstSeen: t}
+		discoveries[id] = dc
+	}
+	dc.Count++
+	dc.LastSeen = t
+	s := string(sample)
+	if len(dc.Samples) < maxDiscoverySamples && !slices.Contains(dc.Samples, s) {
+		dc.Samples = append(dc.Samples, s)
+	}
+}
+
+// NoteUnknownTopic catalogues a message on a topic we don't handle.
+func NoteUnknownTopic(topic string, payload []byte) {
+	discover(DiscoveryTopic, "", topic, payload, clk.Now())
+}
+
+// Discoveries returns everything catalogued so far, sorted by kind,
+// where and key.
+func Discoveries() []Discovery {
+	discoveriesMu.Lock()
+	defer discoveriesMu.Unlock()
+	l := make([]Discovery, 0, len(discoveries))
+	for _, dc := range discoveries {
+		c := *dc
+		c.Samples = slices.Clone(dc.Samples)
+		l = append(l, c)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Kind != l[j].Kind {
+			return l[i].Kind < l[j].Kind
+		}
+		if l[i].Where != l[j].Where {
+			return l[i].Where < l[j].Where
+		}
+		return l[i].Key < l[j].Key
+	})
+	return l
+}
+
+func (msg *msgUnparsed) where() string {
+	return msg.prefix + "/" + msg.event
+}
+
+// unmarshalMsg unmarshals data from msg into v. Outside lenient mode,
+// that's pickyUnmarshal. In lenient mode, unknown fields are
+// catalogued instead of causing an error.
+func unmarshalMsg(msg *msgUnparsed, data []byte, v any) error {
+	if !current().lenient {
+		return pickyUnmarshal(data, v)
+	}
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return err
+	}
+	discoverFields(msg, data, v)
+	return nil
+}
+
+// discoverFields catalogues any fields in data that v doesn't have.
+func discoverFields(msg *msgUnparsed, data []byte, v any) {
+	for _, f := range unknownFields(data, reflect.TypeOf(v)) {
+		discover(DiscoveryField, msg.where(), f, msg.content, msg.t)
+	}
+}
+
+// unknownFields returns the keys in a JSON object that unmarshalling
+// into t would ignore, with nested keys separated by dots.
+func unknownFields(data []byte, t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(data, &obj) != nil {
+		return nil
+	}
+	var unknown []string
+	for k, v := range obj {
+		f, ok := jsonField(t, k)
+		if !ok {
+			unknown = append(unknown, k)
+			continue
+		}
+		for _, sub := range unknownFields(v, f.Type) {
+			unknown = append(unknown, k+"."+sub)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// jsonField finds the field encoding/json would unmarshal key into.
+// As with encoding/json, the fields of an embedded struct without a
+// name in its tag count as the outer struct's, unless the outer
+// struct has a field of the same name.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		// An embedded struct can have exported fields even if
+		// its type isn't exported
+		isEmbeddedStruct := f.Anonymous && ft.Kind() == reflect.Struct
+		if !f.IsExported() && !isEmbeddedStruct {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		} else if name == "" && isEmbeddedStruct {
+			embedded = append(embedded, ft)
+			continue
+		} else if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	for _, et := range embedded {
+		if f, ok := jsonField(et, key); ok {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// unknownEnum handles an enum value we don't know. Outside lenient
+// mode, it's an error. In lenient mode, it's catalogued and accepted.
+func unknownEnum(msg *msgUnparsed, field string, v int, format string) error {
+	if !current().lenient {
+		return fmt.Errorf(format, v)
+	}
+	discover(DiscoveryEnum, msg.where(), fmt.Sprintf("%s=%d", field, v), msg.content, msg.t)
+	return nil
+}
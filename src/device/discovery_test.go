@@ -0,0 +1,127 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestUnknownFields(t *testing.T) {
+	got := unknownFields([]byte(`{"clientToken":"5975bc44","extra":1,"state":{"reported":{"temp_a":22.5,"co2":400},"desired":{}}}`),
+		reflect.TypeOf(&msgAWSShadowUpdate{}))
+	want := []string{"extra", "state.desired", "state.reported.co2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got unknown fields %v, want %v", got, want)
+	}
+
+	// Embedded structs' fields are known, as they are to
+	// encoding/json, but not if the embedded struct's named
+	type inner struct {
+		TempA *floatDP `json:"temp_a"`
+		Door  *bool
+	}
+	type named struct {
+		Mode *DeviceMode `json:"mode"`
+	}
+	type outer struct {
+		inner
+		*named  `json:"named"`
+		Cooling *bool `json:"cooling"`
+	}
+	got = unknownFields([]byte(`{"temp_a":22.5,"door":true,"cooling":false,"mode":8,"named":{"mode":8,"co2":400}}`),
+		reflect.TypeOf(&outer{}))
+	want = []string{"mode", "named.co2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("embedded, got unknown fields %v, want %v", got, want)
+	}
+}
+
+func TestLenient(t *testing.T) {
+	log = logs.Discard()
+	defer func() {
+		setSettings(func(s *deviceSettings) { s.lenient = false })
+		discoveries = nil
+	}()
+	t1 := time.Unix(1691777930, 0)
+	t2 := t1.Add(time.Minute)
+	modeMsg := func(content string, t time.Time) *msgUnparsed {
+		return &msgUnparsed{"agl/prod", "mode", []byte(content), t}
+	}
+
+	// Strict: unknown fields and values are errors, and nothing's
+	// catalogued
+	setSettings(func(s *deviceSettings) { s.lenient = false })
+	discoveries = nil
+	for _, c := range []string{
+		`{"prev_mode": 0,"mode": 8, "trigger": 1, "reason": "button"}`,
+		`{"prev_mode": 0,"mode": 12, "trigger": 1}`,
+		`{"prev_mode": 0,"mode": 8, "trigger": 3}`,
+	} {
+		_, err := parseAglMode(modeMsg(c, t1))
+		if err == nil {
+			t.Errorf("strict, '%s': got no error", c)
+		}
+	}
+	if len(Discoveries()) != 0 {
+		t.Errorf("strict, got discoveries %+v, want none", Discoveries())
+	}
+
+	// Lenient: the same messages are parsed, and the unknowns
+	// catalogued
+	setSettings(func(s *deviceSettings) { s.lenient = true })
+	for _, c := range []struct {
+		content string
+		t       time.Time
+	}{
+		{`{"prev_mode": 0,"mode": 8, "trigger": 1, "reason": "button"}`, t1},
+		{`{"prev_mode": 0,"mode": 12, "trigger": 1}`, t1},
+		{`{"prev_mode": 12,"mode": 8, "trigger": 3, "reason": "app"}`, t2},
+	} {
+		m, err := parseAglMode(modeMsg(c.content, c.t))
+		if err != nil || m == nil {
+			t.Errorf("lenient, '%s': got error %v", c.content, err)
+		}
+	}
+	want := []Discovery{{
+		Kind: DiscoveryEnum, Where: "agl/prod/mode", Key: "mode=12", Count: 1, FirstSeen: t1, LastSeen: t1,
+		Samples: []string{`{"prev_mode": 0,"mode": 12, "trigger": 1}`},
+	}, {
+		Kind: DiscoveryEnum, Where: "agl/prod/mode", Key: "prev_mode=12", Count: 1, FirstSeen: t2, LastSeen: t2,
+		Samples: []string{`{"prev_mode": 12,"mode": 8, "trigger": 3, "reason": "app"}`},
+	}, {
+		Kind: DiscoveryEnum, Where: "agl/prod/mode", Key: "trigger=3", Count: 1, FirstSeen: t2, LastSeen: t2,
+		Samples: []string{`{"prev_mode": 12,"mode": 8, "trigger": 3, "reason": "app"}`},
+	}, {
+		Kind: DiscoveryField, Where: "agl/prod/mode", Key: "reason", Count: 2, FirstSeen: t1, LastSeen: t2,
+		Samples: []string{`{"prev_mode": 0,"mode": 8, "trigger": 1, "reason": "button"}`, `{"prev_mode": 12,"mode": 8, "trigger": 3, "reason": "app"}`},
+	}}
+	if got := Discoveries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("lenient, got discoveries %+v, want %+v", got, want)
+	}
+
+	// An unknown mode is catalogued, but the device keeps the mode
+	// it had
+	discoveries = nil
+	d := Device{}
+	d.Reported.Mode.update(ModeSilent, t1)
+	replies, err := d.processAglMode(modeMsg(`{"prev_mode": 1,"mode": 12, "trigger": 1}`, t2))
+	if err != nil || replies != nil || d.Reported.Mode.Value != ModeSilent || len(Discoveries()) != 1 {
+		t.Errorf("unknown mode, got replies %v, error %v, mode %v, discoveries %+v, want none, none, silent and mode=12", replies, err, d.Reported.Mode.Value, Discoveries())
+	}
+
+	// An unknown valve state is quarantined, and catalogued, but
+	// doesn't lose the rest of the update
+	discoveries = nil
+	d = Device{ClientToken: "12345678"}
+	_, err = d.processAWSShadowUpdate(&msgUnparsed{"$aws", "shadow/update",
+		[]byte(`{"clientToken":"12345678","state":{"reported":{"valve":2,"temp_a":22.5}}}`), t1})
+	if err != nil {
+		t.Fatalf("processAWSShadowUpdate failed: %v", err)
+	}
+	dcs := Discoveries()
+	if d.Reported.TempA.Value != 22.5 || len(dcs) != 1 || dcs[0].Key != "valve=2" {
+		t.Errorf("got temp_a %v, discoveries %+v, want 22.5 and valve=2", d.Reported.TempA.Value, dcs)
+	}
+}
@@ -0,0 +1,115 @@
+package device
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/history"
+)
+
+const (
+	doorAlertSourceDoor = "door"
+	doorAlertSourceMCU  = "mcu"
+)
+
+// doorState tracks how long the door's been open and whether we've
+// raised an alert about it. There are two ways the alert can be
+// raised: the Plantcube itself complains (with an MCU_MODE_STATE
+// ECO_MODE warning) or we see the door's been reported open for
+// longer than doorAlertAfter.
+type doorState struct {
+	openedAt    time.Time // Zero if closed or unknown
+	alert       bool
+	alertRaised time.Time
+	alertSource string
+}
+
+func (d *Device) initDoor() {
+	if d.Reported.Door.Value {
+		d.door.openedAt = d.Reported.Door.Time
+		d.doorTimer.Reset(current().doorAlertAfter - d.clock.Since(d.door.openedAt))
+	}
+}
+
+// noteDoor is called after each message with the Door value from
+// before the message was processed.
+func (d *Device) noteDoor(prev valueWithTimestamp[bool]) {
+	cur := d.Reported.Door
+	if cur.Value == prev.Value && cur.Time.Equal(prev.Time) {
+		// Not reported in this message
+		return
+	}
+	if cur.Value && (!prev.Value || d.door.openedAt.IsZero()) {
+		d.door.openedAt = cur.Time
+		d.doorTimer.Reset(current().doorAlertAfter - d.clock.Since(cur.Time))
+		d.streamStatusUpdate()
+	} else if !cur.Value && prev.Value {
+		d.doorTimer.Stop()
+		d.clearDoorAlert(cur.Time)
+		d.door.openedAt = time.Time{}
+		d.streamStatusUpdate()
+	}
+}
+
+// doorTimerFired is called from the door timer's own goroutine and
+// hands over to the processing loop, like livenessTimerFired.
+func (d *Device) doorTimerFired() {
+	select {
+	case d.doorChan <- struct{}{}:
+	default:
+		// A check is already pending
+	}
+}
+
+func (d *Device) checkDoor() {
+	if d.door.openedAt.IsZero() || d.clock.Since(d.door.openedAt) < current().doorAlertAfter {
+		return
+	}
+	d.raiseDoorAlert(doorAlertSourceDoor, d.clock.Now())
+}
+
+func (d *Device) raiseDoorAlert(source string, t time.Time) {
+	if d.door.alert {
+		return
+	}
+	d.door.alert = true
+	d.door.alertRaised = t
+	d.door.alertSource = source
+	since := d.doorOpenSince()
+	log.Warn.Printf("Device '%s' door open too long (since %s, seen by %s)", d.ID, since.Local().Format(time.RFC1123), source)
+	d.notify(NoticeDoorOpen, "", true, fmt.Sprintf("The door has been open since %s", since.Local().Format("15:04")))
+	d.streamStatusUpdate()
+}
+
+func (d *Device) clearDoorAlert(t time.Time) {
+	if !d.door.alert {
+		return
+	}
+	since := d.doorOpenSince()
+	dur := t.Sub(since).Round(time.Second)
+	log.Info.Printf("Device '%s' door closed after %v", d.ID, dur)
+	d.record(history.Record{
+		Time:   t,
+		Kind:   history.KindAlert,
+		Field:  string(NoticeDoorOpen),
+		Value:  jsonValue(int(dur / time.Second)),
+		Detail: fmt.Sprintf("open from %s, raised by %s", since.Format(time.RFC3339), d.door.alertSource),
+	})
+	d.notify(NoticeDoorOpen, "", false, fmt.Sprintf("The door has been closed after %v", dur))
+	d.door = doorState{openedAt: d.door.openedAt}
+	d.streamStatusUpdate()
+}
+
+// doorOpenSince returns our best guess for when the door was opened,
+// or zero if it's closed.
+func (d *Device) doorOpenSince() time.Time {
+	if !d.door.openedAt.IsZero() {
+		return d.door.openedAt
+	}
+	if d.door.alert {
+		// The Plantcube told us, but we didn't see the door
+		// open.
+		return d.door.alertRaised
+	}
+	return time.Time{}
+}
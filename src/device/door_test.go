@@ -0,0 +1,88 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestDoorAlert(t *testing.T) {
+	log = logs.Discard()
+	setSettings(func(s *deviceSettings) {
+		s.doorAlertAfter = 10 * time.Minute
+	})
+	var notices []Notice
+	SetNoticeHandler(func(n Notice) { notices = append(notices, n) })
+	defer SetNoticeHandler(nil)
+
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1687685000, 0))
+	d := Device{ID: "test", clock: mock, doorChan: make(chan struct{}, 1)}
+	d.doorTimer = mock.AfterFunc(time.Hour, d.doorTimerFired)
+	d.doorTimer.Stop()
+	d.initDoor()
+
+	setDoor := func(open bool) {
+		prev := d.Reported.Door
+		d.Reported.Door.update(open, mock.Now())
+		d.noteDoor(prev)
+	}
+
+	// Door opened and closed quickly: nothing
+	setDoor(true)
+	mock.Add(5 * time.Minute)
+	setDoor(false)
+	if d.door.alert || len(notices) != 0 {
+		t.Fatalf("door open 5 minutes, got alert %v, notices %+v, want nothing", d.door.alert, notices)
+	}
+
+	// Door opened for too long: timer fires and the check
+	// raises the alert
+	setDoor(true)
+	opened := mock.Now()
+	mock.Add(11 * time.Minute)
+	select {
+	case <-d.doorChan:
+		d.checkDoor()
+	case <-time.After(time.Second):
+		t.Fatalf("door timer didn't fire")
+	}
+	se := d.getStatusUpdate()
+	if !se.DoorAlert || !se.DoorOpenTime.Equal(opened) {
+		t.Errorf("door open 11 minutes, got alert %v since %v, want alert since %v", se.DoorAlert, se.DoorOpenTime, opened)
+	}
+	// The Plantcube complaining too doesn't raise it again
+	d.raiseDoorAlert(doorAlertSourceMCU, mock.Now())
+	mock.Add(4 * time.Minute)
+	setDoor(false)
+	if d.door.alert {
+		t.Errorf("door closed, alert still active")
+	}
+
+	// The Plantcube complains, without us seeing the door open,
+	// then says it's closed
+	d.raiseDoorAlert(doorAlertSourceMCU, mock.Now())
+	mock.Add(2 * time.Minute)
+	d.clearDoorAlert(mock.Now())
+
+	want := []struct {
+		active bool
+		msg    string
+	}{
+		{true, "The door has been open since " + opened.Local().Format("15:04")},
+		{false, "The door has been closed after 15m0s"},
+		{true, "The door has been open since " + mock.Now().Add(-2*time.Minute).Local().Format("15:04")},
+		{false, "The door has been closed after 2m0s"},
+	}
+	if len(notices) != len(want) {
+		t.Fatalf("got %d notices, want %d: %+v", len(notices), len(want), notices)
+	}
+	for i, w := range want {
+		if notices[i].Type != NoticeDoorOpen || notices[i].Active != w.active || notices[i].Message != w.msg {
+			t.Errorf("notice %d, got %+v, want active %v, message '%s'", i, notices[i], w.active, w.msg)
+		}
+	}
+}
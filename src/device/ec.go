@@ -1,9 +1,12 @@
 package device
 
 import (
+	"fmt"
 	"time"
 
 	"go.einride.tech/pid"
+
+	"github.com/Jon-Bright/plantprism/history"
 )
 
 const (
@@ -39,6 +42,18 @@ func newPIDController() *pid.Controller {
 }
 
 func (d *Device) ResetNutrient() {
+	d.do(d.resetNutrient)
+}
+
+func (d *Device) resetNutrient() {
+	d.record(history.Record{
+		Time:   d.clock.Now(),
+		Kind:   history.KindNutrient,
+		Field:  "ml",
+		Value:  jsonValue(d.WantNutrient),
+		Detail: fmt.Sprintf("nutrient added, EC %d, smoothed EC %.1f", d.Reported.EC.Value, d.SmoothedEC),
+	})
+
 	// We no longer want nutrient
 	d.WantNutrient = 0
 
@@ -50,6 +65,7 @@ func (d *Device) ResetNutrient() {
 	// Finally, reset the PID controller
 	d.NutrientPID.Reset()
 
+	d.checkConditions()
 	d.streamStatusUpdate()
 }
 
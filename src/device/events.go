@@ -0,0 +1,55 @@
+package device
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/eventlog"
+)
+
+var events *eventlog.Store
+
+// SetEventLog sets the store that devices log the events they send
+// to. If it's never called (as in tests), events are only streamed.
+func SetEventLog(s *eventlog.Store) {
+	events = s
+}
+
+// Events returns the device's logged events matching the filter,
+// newest first.
+func (d *Device) Events(f eventlog.Filter, limit int) ([]eventlog.Entry, error) {
+	if events == nil {
+		return nil, errors.New("no event log configured")
+	}
+	return events.Query(d.ID, f, limit)
+}
+
+// setField adds a field to an event's fields, if the device sent it.
+func setField(fields map[string]string, name string, v *string) {
+	if v != nil {
+		fields[name] = *v
+	}
+}
+
+// logEvent logs an event sent by the Plantcube and streams it to
+// anyone watching.
+func (d *Device) logEvent(category string, label string, timestamp *int, fields map[string]string, raw string, received time.Time) {
+	e := eventlog.Entry{
+		Received: received,
+		Category: category,
+		Label:    label,
+		Severity: eventlog.Classify(category, label, fields),
+		Fields:   fields,
+		Raw:      raw,
+	}
+	if timestamp != nil {
+		e.DeviceTime = time.Unix(int64(*timestamp), 0)
+	}
+	if events != nil {
+		err := events.Append(d.ID, &e)
+		if err != nil {
+			log.Error.Printf("Failed logging event for device '%s': %v", d.ID, err)
+		}
+	}
+	d.hub.publish(Update{Event: &e})
+}
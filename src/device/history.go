@@ -0,0 +1,105 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"github.com/Jon-Bright/plantprism/history"
+)
+
+var hist *history.Store
+
+// SetHistory sets the store that devices record their history
+// to. If it's never called (as in tests), no history is recorded.
+func SetHistory(h *history.Store) {
+	hist = h
+}
+
+// History returns the device's recorded history matching the
+// filter.
+func (d *Device) History(f history.Filter) ([]history.Record, error) {
+	if hist == nil {
+		return nil, errors.New("no history store configured")
+	}
+	return hist.Query(d.ID, f)
+}
+
+func jsonValue(v any) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		// Everything we record is a basic type, this
+		// shouldn't happen.
+		return nil
+	}
+	return b
+}
+
+func (d *Device) record(recs ...history.Record) {
+	if hist == nil {
+		return
+	}
+	err := hist.Append(d.ID, recs...)
+	if err != nil {
+		log.Error.Printf("Failed recording history for device '%s': %v", d.ID, err)
+	}
+}
+
+// recordTelemetry records every reported value that was updated at
+// the given time.
+func (d *Device) recordTelemetry(t time.Time) {
+	if hist == nil {
+		return
+	}
+	d.record(d.telemetryRecords(t)...)
+}
+
+func (d *Device) telemetryRecords(t time.Time) []history.Record {
+	// The shadow already knows which fields were updated and
+	// what they're called.
+	fields, _ := d.reportedAt(t)
+	keys := maps.Keys(fields)
+	slices.Sort(keys)
+	recs := make([]history.Record, 0, len(keys))
+	for _, f := range keys {
+		recs = append(recs, history.Record{
+			Time:  t,
+			Kind:  history.KindTelemetry,
+			Field: f,
+			Value: fields[f],
+		})
+	}
+	return recs
+}
+
+func (d *Device) valveChangeRecords(prev ValveState, t time.Time) []history.Record {
+	v := d.Reported.Valve.Value
+	if v == prev {
+		return nil
+	}
+	detail := "valve open"
+	if v == ValveClosed {
+		detail = "valve closed"
+	}
+	return []history.Record{{
+		Time:   t,
+		Kind:   history.KindWatering,
+		Field:  v.String(),
+		Value:  jsonValue(int(v)),
+		Detail: detail,
+	}}
+}
+
+func modeRecord(m *msgAglMode, t time.Time) history.Record {
+	return history.Record{
+		Time:   t,
+		Kind:   history.KindMode,
+		Field:  m.Mode.String(),
+		Value:  jsonValue(int(*m.Mode)),
+		Detail: fmt.Sprintf("from %v, trigger %v", *m.PrevMode, *m.Trigger),
+	}
+}
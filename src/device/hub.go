@@ -0,0 +1,215 @@
+package device
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/eventlog"
+	"golang.org/x/exp/slices"
+)
+
+// The processing loop publishes updates to a hub, which queues them
+// for each subscriber. Publishing never blocks: a subscriber that
+// falls too far behind is evicted, and can resubscribe from the last
+// update it got.
+
+const (
+	// SUBSCRIBER_QUEUE is how many slot and event updates can be
+	// waiting for a subscriber before it's evicted. It must hold
+	// at least a full set of slots. Status updates don't count:
+	// only the latest is kept.
+	SUBSCRIBER_QUEUE = 64
+
+	// RESUME_BUFFER is how many slot and event updates are kept
+	// for subscribers resuming after a disconnection. Any more
+	// than SUBSCRIBER_QUEUE and a resuming subscriber could be
+	// evicted straight away.
+	RESUME_BUFFER = SUBSCRIBER_QUEUE
+)
+
+// Update is a single streamed update. Exactly one of Slot, Status
+// and Event is set.
+type Update struct {
+	ID     uint64
+	Slot   *SlotEvent
+	Status *StatusEvent
+	Event  *eventlog.Entry
+}
+
+// Subscription is one subscriber's queue of updates.
+type Subscription struct {
+	mu      sync.Mutex
+	queue   []Update
+	status  *Update
+	evicted bool
+
+	ready   chan struct{}
+	gone    chan struct{}
+	resumed bool
+}
+
+// Ready is signalled when there are updates to Take.
+func (sub *Subscription) Ready() <-chan struct{} {
+	return sub.ready
+}
+
+// Evicted is closed when the subscriber has fallen too far behind.
+// Nothing more is queued for it.
+func (sub *Subscription) Evicted() <-chan struct{} {
+	return sub.gone
+}
+
+// Resumed says whether the subscription carried on from the update
+// it was asked to, rather than starting afresh with every slot and
+// the current status.
+func (sub *Subscription) Resumed() bool {
+	return sub.resumed
+}
+
+// Take returns the queued updates, oldest first, and empties the
+// queue. The latest status update, if there is one, comes last.
+func (sub *Subscription) Take() []Update {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	l := sub.queue
+	sub.queue = nil
+	if sub.status != nil {
+		l = append(l, *sub.status)
+		sub.status = nil
+	}
+	return l
+}
+
+// push queues an update, returning false if the subscriber had to be
+// evicted.
+func (sub *Subscription) push(u Update) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.evicted {
+		return false
+	}
+	if u.Status != nil {
+		sub.status = &u
+	} else if len(sub.queue) >= SUBSCRIBER_QUEUE {
+		sub.evicted = true
+		sub.queue = nil
+		sub.status = nil
+		close(sub.gone)
+		return false
+	} else {
+		sub.queue = append(sub.queue, u)
+	}
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+		// Already signalled
+	}
+	return true
+}
+
+// hub belongs to the processing loop, like the rest of the Device. A
+// device without one (as in tests) publishes nothing.
+type hub struct {
+	lastID uint64
+	subs   []*Subscription
+	// recent are the latest slot and event updates. Every one
+	// after resumeFrom is there.
+	recent     []Update
+	resumeFrom uint64
+}
+
+// newHub creates a hub whose update IDs start from t. Update IDs
+// from before a restart are lower, so nobody tries to resume from
+// them.
+func newHub(t time.Time) *hub {
+	id := uint64(t.UnixNano())
+	return &hub{lastID: id, resumeFrom: id}
+}
+
+func (h *hub) publish(u Update) {
+	if h == nil {
+		return
+	}
+	h.lastID++
+	u.ID = h.lastID
+	if u.Status == nil {
+		h.recent = append(h.recent, u)
+		if len(h.recent) > RESUME_BUFFER {
+			h.resumeFrom = h.recent[0].ID
+			h.recent = h.recent[1:]
+		}
+	}
+	h.subs = slices.DeleteFunc(h.subs, func(sub *Subscription) bool {
+		if sub.push(u) {
+			return false
+		}
+		log.Warn.Printf("Evicted a subscriber that fell %d updates behind", SUBSCRIBER_QUEUE)
+		return true
+	})
+}
+
+// canResume says whether everything after lastID can be replayed.
+func (h *hub) canResume(lastID uint64) bool {
+	return lastID != 0 && lastID >= h.resumeFrom && lastID <= h.lastID
+}
+
+// Subscribe starts streaming updates. If everything after lastID can
+// be replayed, it is. Otherwise, every slot's contents are sent,
+// tagged with the latest update's ID. The current status is sent
+// either way.
+func (d *Device) Subscribe(lastID uint64) *Subscription {
+	sub := Subscription{
+		ready: make(chan struct{}, 1),
+		gone:  make(chan struct{}),
+	}
+	d.do(func() {
+		h := d.hub
+		if h.canResume(lastID) {
+			sub.resumed = true
+			for _, u := range h.recent {
+				if u.ID > lastID {
+					sub.push(u)
+				}
+			}
+		} else {
+			for _, l := range []layerID{layerA, layerB} {
+				for s := slot1; s <= slot9; s++ {
+					sub.push(Update{ID: h.lastID, Slot: d.slotEvent(l, s)})
+				}
+			}
+		}
+		sub.push(Update{ID: h.lastID, Status: d.getStatusUpdate()})
+		h.subs = append(h.subs, &sub)
+	})
+	return &sub
+}
+
+// Unsubscribe stops streaming updates.
+func (d *Device) Unsubscribe(sub *Subscription) {
+	d.do(func() {
+		d.hub.subs = slices.DeleteFunc(d.hub.subs, func(s *Subscription) bool {
+			return s == sub
+		})
+	})
+}
+
+// Follow calls f with each batch of updates for as long as the
+// process runs, starting with every slot and the current status. A
+// follower that falls behind is resubscribed, starting afresh.
+func (d *Device) Follow(f func([]Update)) {
+	for {
+		sub := d.Subscribe(0)
+		func() {
+			defer d.Unsubscribe(sub)
+			for {
+				select {
+				case <-sub.Ready():
+					f(sub.Take())
+				case <-sub.Evicted():
+					log.Warn.Printf("Device '%s' follower fell behind, resubscribing", d.ID)
+					return
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,76 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestHub(t *testing.T) {
+	log = logs.Discard()
+	d := Device{ID: "test"}
+	d.hub = newHub(time.Unix(1691777930, 0))
+	first := d.hub.lastID
+
+	// A new subscriber gets every slot, then the status
+	sub := d.Subscribe(0)
+	got := sub.Take()
+	if len(got) != 19 || got[0].Slot == nil || got[18].Status == nil || got[18].ID != first || sub.Resumed() {
+		t.Fatalf("new subscriber, got %d updates, last %+v, resumed %v, want 18 slots and a status", len(got), got[len(got)-1], sub.Resumed())
+	}
+
+	// Only the latest status is kept
+	d.streamStatusUpdate()
+	d.logEvent("c", "l", nil, nil, "", time.Unix(1691777940, 0))
+	d.streamStatusUpdate()
+	select {
+	case <-sub.Ready():
+	default:
+		t.Fatalf("not ready after updates")
+	}
+	got = sub.Take()
+	if len(got) != 2 || got[0].Event == nil || got[0].ID != first+2 || got[1].Status == nil || got[1].ID != first+3 {
+		t.Errorf("after two statuses and an event, got %+v, want the event, then the second status", got)
+	}
+
+	// Resuming replays what was missed
+	d.streamSlotUpdate(layerA, slot1)
+	resumed := d.Subscribe(first + 1)
+	got = resumed.Take()
+	if !resumed.Resumed() || len(got) != 3 || got[0].ID != first+2 || got[1].Slot == nil || got[2].Status == nil {
+		t.Errorf("resuming from %d, got %+v, resumed %v, want the event, the slot and a status", first+1, got, resumed.Resumed())
+	}
+	// IDs from before a restart, or the future, start afresh
+	for _, id := range []uint64{first - 1, first + 100} {
+		if s := d.Subscribe(id); s.Resumed() {
+			t.Errorf("resuming from unknown ID %d, resumed", id)
+		}
+	}
+
+	// A subscriber that falls behind is evicted, and nothing's
+	// queued for it after that
+	d.Unsubscribe(resumed)
+	sub.Take()
+	for i := 0; i < SUBSCRIBER_QUEUE; i++ {
+		d.logEvent("c", "l", nil, nil, "", time.Unix(1691777950, 0))
+	}
+	select {
+	case <-sub.Evicted():
+		t.Fatalf("evicted with a full queue")
+	default:
+	}
+	d.logEvent("c", "l", nil, nil, "", time.Unix(1691777950, 0))
+	select {
+	case <-sub.Evicted():
+	default:
+		t.Fatalf("not evicted with an overfull queue")
+	}
+	if got = sub.Take(); len(got) != 0 {
+		t.Errorf("after eviction, got %d updates, want none", len(got))
+	}
+	// It's too far behind to resume
+	if s := d.Subscribe(first + 4); s.Resumed() {
+		t.Errorf("resuming from an update that's been dropped, resumed")
+	}
+}
@@ -0,0 +1,177 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/history"
+)
+
+// Replayer turns previously-captured Plantcube messages into history
+// records, using the same parsers as live message processing. It
+// keeps a scratch copy of each device's reported state so that
+// changes (e.g. the valve opening) can be recognised, but it doesn't
+// touch real devices, send replies or save anything.
+type Replayer struct {
+	devices map[string]*Device
+
+	// The device that log lines are currently being attributed to
+	logDevice string
+}
+
+var (
+	logLineRe     = regexp.MustCompile(`^(?:INFO|WARN|ERROR|CRIT): (\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) (.*)$`)
+	logReceivedRe = regexp.MustCompile(`^Received message for device '([^']+)'`)
+	logECRe       = regexp.MustCompile(`^EC "(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})","(\d+)"$`)
+	logModeRe     = regexp.MustCompile(`^Device mode changed from (\w+) to (\w+), trigger (\w+)$`)
+)
+
+func NewReplayer() *Replayer {
+	return &Replayer{
+		devices: make(map[string]*Device),
+	}
+}
+
+func (r *Replayer) device(deviceID string) *Device {
+	d, ok := r.devices[deviceID]
+	if !ok {
+		d = &Device{ID: deviceID}
+		r.devices[deviceID] = d
+	}
+	return d
+}
+
+// Replay parses a single message sent by a Plantcube at the given
+// time and returns the history records it would have produced. Messages
+// that don't produce history (e.g. recipe requests) return no
+// records and no error.
+func (r *Replayer) Replay(deviceID, prefix, event string, content []byte, t time.Time) ([]history.Record, error) {
+	d := r.device(deviceID)
+	msg := msgUnparsed{prefix, event, content, t}
+	if prefix == "$aws" && event == "shadow/update" {
+		m, _, err := parseAWSShadowUpdate(&msg, d.Ranges)
+		if err != nil {
+			return nil, err
+		}
+		prevValve := d.Reported.Valve.Value
+		d.Reported.applyAWSUpdate(&m.State.Reported, t)
+		recs := d.telemetryRecords(t)
+		if m.State.Reported.Valve != nil {
+			recs = append(recs, d.valveChangeRecords(prevValve, t)...)
+		}
+		return recs, nil
+	} else if prefix == "agl/prod" && event == "shadow/update" {
+		m, err := parseAglShadowUpdate(&msg)
+		if err != nil {
+			return nil, err
+		}
+		rep := m.State.Reported
+		if rep.Connected != nil {
+			d.Reported.Connected.update(*rep.Connected, t)
+		}
+		if rep.EC != nil {
+			d.Reported.EC.update(*rep.EC, t)
+		}
+		if rep.TankLevel != nil {
+			d.Reported.TankLevel.update(*rep.TankLevel, t)
+		}
+		return d.telemetryRecords(t), nil
+	} else if prefix == "agl/prod" && event == "mode" {
+		m, err := parseAglMode(&msg)
+		if err != nil {
+			return nil, err
+		}
+		d.Reported.Mode.update(*m.Mode, t)
+		return []history.Record{modeRecord(m, t)}, nil
+	}
+	return nil, nil
+}
+
+func parseModeName(s string) (DeviceMode, error) {
+	for m := ModeDefault; m < ModeOutOfRange; m++ {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown mode '%s'", s)
+}
+
+func parseModeTriggerName(s string) (ModeTrigger, error) {
+	for t := ModeTriggerApp; t < ModeTriggerOutOfRange; t++ {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown mode trigger '%s'", s)
+}
+
+// ReplayLogLine parses a single line from plantprism's own log and
+// returns the device it's about and any history records it
+// contains. Only a few lines contain anything worth recording (EC
+// readings and mode changes). Log lines don't say which device
+// they're about, so they're attributed to the device from the most
+// recent "Received message" line, or defaultDeviceID if there hasn't
+// been one yet. Log timestamps are interpreted in the given
+// location.
+func (r *Replayer) ReplayLogLine(defaultDeviceID string, line string, loc *time.Location) (string, []history.Record, error) {
+	m := logLineRe.FindStringSubmatch(line)
+	if m == nil {
+		// Continuation lines from multi-line messages, for
+		// example
+		return "", nil, nil
+	}
+	logT, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], loc)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid log timestamp '%s': %w", m[1], err)
+	}
+	text := m[2]
+
+	if rm := logReceivedRe.FindStringSubmatch(text); rm != nil {
+		r.logDevice = rm[1]
+		return "", nil, nil
+	}
+	deviceID := r.logDevice
+	if deviceID == "" {
+		deviceID = defaultDeviceID
+	}
+
+	if em := logECRe.FindStringSubmatch(text); em != nil {
+		if deviceID == "" {
+			return "", nil, errors.New("EC line, but no device known")
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", em[1], loc)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid EC timestamp '%s': %w", em[1], err)
+		}
+		ec, err := strconv.Atoi(em[2])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid EC value '%s': %w", em[2], err)
+		}
+		d := r.device(deviceID)
+		d.Reported.EC.update(ec, t)
+		return deviceID, d.telemetryRecords(t), nil
+	}
+	if mm := logModeRe.FindStringSubmatch(text); mm != nil {
+		if deviceID == "" {
+			return "", nil, errors.New("mode line, but no device known")
+		}
+		prev, err := parseModeName(mm[1])
+		if err != nil {
+			return "", nil, err
+		}
+		mode, err := parseModeName(mm[2])
+		if err != nil {
+			return "", nil, err
+		}
+		trigger, err := parseModeTriggerName(mm[3])
+		if err != nil {
+			return "", nil, err
+		}
+		r.device(deviceID).Reported.Mode.update(mode, logT)
+		return deviceID, []history.Record{modeRecord(&msgAglMode{&prev, &mode, &trigger}, logT)}, nil
+	}
+	return "", nil, nil
+}
@@ -0,0 +1,101 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/history"
+)
+
+func TestReplayLogLine(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("failed loading location: %v", err)
+	}
+	const (
+		defDev   = "a8d39911-7955-47d3-981b-fbd9d52f9221"
+		otherDev = "0a8d3991-7955-47d3-981b-fbd9d52f9221"
+	)
+	tests := []struct {
+		line       string
+		wantDevice string
+		wantRecs   []history.Record
+		wantError  bool
+	}{
+		{
+			line:       `INFO: 2023/06/18 07:01:20 EC "2023-06-18 07:01:19","1408"`,
+			wantDevice: defDev,
+			wantRecs: []history.Record{{
+				Time:  time.Date(2023, 6, 18, 7, 1, 19, 0, loc),
+				Kind:  history.KindTelemetry,
+				Field: "ec",
+				Value: []byte("1408"),
+			}},
+		}, {
+			line: `INFO: 2023/06/18 07:02:00 Got EC 1408, Temp-Corrected 1446.1, Smoothed 1420.0, ControlSignal 10.00, wantNutrient 10, prev 0`,
+		}, {
+			line: `INFO: 2023/06/18 07:03:00 Received message for device '` + otherDev + `', prefix 'agl/prod', event 'mode'`,
+		}, {
+			line:       `INFO: 2023/06/18 07:03:00 Device mode changed from Default to Cinema, trigger App`,
+			wantDevice: otherDev,
+			wantRecs: []history.Record{{
+				Time:   time.Date(2023, 6, 18, 7, 3, 0, 0, loc),
+				Kind:   history.KindMode,
+				Field:  "Cinema",
+				Value:  []byte("8"),
+				Detail: "from Default, trigger App",
+			}},
+		}, {
+			line:      `INFO: 2023/06/18 07:04:00 Device mode changed from Default to Disco, trigger App`,
+			wantError: true,
+		}, {
+			line: `   timer: 0; retries: 0; buff: {'clientToken':'5975bc44','state':{'reported':`,
+		},
+	}
+	r := NewReplayer()
+	for _, tc := range tests {
+		dev, recs, err := r.ReplayLogLine(defDev, tc.line, loc)
+		if tc.wantError != (err != nil) {
+			t.Fatalf("line '%s', wanted error %v, got %v", tc.line, tc.wantError, err)
+		}
+		if dev != tc.wantDevice {
+			t.Errorf("line '%s', got device '%s', want '%s'", tc.line, dev, tc.wantDevice)
+		}
+		if len(recs) != len(tc.wantRecs) {
+			t.Fatalf("line '%s', got %d records, want %d: %+v", tc.line, len(recs), len(tc.wantRecs), recs)
+		}
+		for i := range recs {
+			g, w := recs[i], tc.wantRecs[i]
+			if !g.Time.Equal(w.Time) || g.Kind != w.Kind || g.Field != w.Field || string(g.Value) != string(w.Value) || g.Detail != w.Detail {
+				t.Errorf("line '%s', record %d, got %+v, want %+v", tc.line, i, g, w)
+			}
+		}
+	}
+}
+
+func TestReplayValveChange(t *testing.T) {
+	r := NewReplayer()
+	t1 := time.Unix(1687014310, 0)
+	t2 := time.Unix(1687014380, 0)
+	recs, err := r.Replay("a8d39911-7955-47d3-981b-fbd9d52f9221", "$aws", "shadow/update",
+		[]byte(`{"clientToken":"5975bc44","state":{"reported":{"valve":1}}}`), t1)
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if len(recs) != 2 || recs[0].Field != "valve" || recs[1].Kind != history.KindWatering || recs[1].Detail != "valve open" {
+		t.Errorf("valve opening, got %+v", recs)
+	}
+	recs, err = r.Replay("a8d39911-7955-47d3-981b-fbd9d52f9221", "$aws", "shadow/update",
+		[]byte(`{"clientToken":"5975bc44","state":{"reported":{"valve":4}}}`), t2)
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if len(recs) != 2 || recs[1].Kind != history.KindWatering || recs[1].Detail != "valve closed" {
+		t.Errorf("valve closing, got %+v", recs)
+	}
+	recs, err = r.Replay("a8d39911-7955-47d3-981b-fbd9d52f9221", "agl/prod", "recipe/get",
+		[]byte(`{"version":7, "format": "binary" }`), t2)
+	if err != nil || recs != nil {
+		t.Errorf("recipe get, got %+v, %v, want nothing", recs, err)
+	}
+}
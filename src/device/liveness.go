@@ -0,0 +1,310 @@
+package device
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// How many of the most recent gaps between reports we keep
+	// per field, and how many we need before we'll regard a field
+	// as stale.
+	LivenessGapSamples    = 20
+	LivenessMinGapSamples = 10
+
+	// A field is never stale before this, however regularly it
+	// normally reports.
+	StaleMinimum = 10 * time.Minute
+)
+
+var (
+	// Fields that are only reported when they change (or when
+	// something else happens to be reported), so going a long
+	// time without a report tells us nothing.
+	eventFields = []string{
+		"Connected",
+		"Cooling",
+		"Door",
+		"FirmwareNCU",
+		"LightA",
+		"LightB",
+		"Mode",
+		"RecipeID",
+		"TotalOffset",
+		"Valve",
+	}
+)
+
+type timestamped interface {
+	updatedAt() time.Time
+}
+
+// fieldTimes returns the time each reported field was last updated,
+// indexed by field name.
+func (dr *deviceReported) fieldTimes() map[string]time.Time {
+	v := reflect.ValueOf(dr).Elem()
+	t := v.Type()
+	ft := make(map[string]time.Time, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		ts, ok := v.Field(i).Interface().(timestamped)
+		if !ok {
+			panic(fmt.Sprintf("reported field %s has no timestamp", t.Field(i).Name))
+		}
+		ft[t.Field(i).Name] = ts.updatedAt()
+	}
+	return ft
+}
+
+// lastUpdate returns the most recent time any reported field was
+// updated.
+func (dr *deviceReported) lastUpdate() time.Time {
+	var last time.Time
+	for _, t := range dr.fieldTimes() {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+type liveness struct {
+	// When we last received any message, and when we last
+	// received each kind of message (indexed by "prefix event")
+	lastMessage time.Time
+	lastSeen    map[string]time.Time
+
+	// Most recent gaps between updates for each reported field,
+	// oldest first
+	gaps map[string][]time.Duration
+
+	offline bool
+	stale   []string
+
+	// Whether we told anyone about the device being offline. We
+	// don't when we start up and haven't heard from it yet.
+	offlineNotified bool
+}
+
+// LivenessStatus is a snapshot of what we know about whether a
+// device is still talking to us.
+type LivenessStatus struct {
+	Online      bool
+	LastMessage time.Time
+	LastSeen    map[string]time.Time
+	Expected    map[string]time.Duration
+	StaleFields []string
+}
+
+func (d *Device) initLiveness() {
+	d.live.lastSeen = make(map[string]time.Time)
+	d.live.gaps = make(map[string][]time.Duration)
+	// We don't know when the last message was before we were
+	// started, but the last reported value is a decent
+	// approximation.
+	d.live.lastMessage = d.Reported.lastUpdate()
+	d.live.offline = d.live.lastMessage.IsZero() || d.clock.Since(d.live.lastMessage) > current().offlineAfter
+	d.armLivenessTimer()
+}
+
+// noteMessage updates the liveness information after a message was
+// received. before is the result of fieldTimes() from before the
+// message was processed.
+func (d *Device) noteMessage(msg *msgUnparsed, before map[string]time.Time) {
+	d.live.lastMessage = msg.t
+	d.live.lastSeen[msg.prefix+" "+msg.event] = msg.t
+	for f, t := range d.Reported.fieldTimes() {
+		if slices.Contains(eventFields, f) {
+			continue
+		}
+		prev := before[f]
+		if prev.IsZero() || !t.After(prev) {
+			continue
+		}
+		g := append(d.live.gaps[f], t.Sub(prev))
+		if len(g) > LivenessGapSamples {
+			g = g[len(g)-LivenessGapSamples:]
+		}
+		d.live.gaps[f] = g
+	}
+	d.checkLiveness()
+}
+
+// expectedInterval returns the interval we expect between reports of
+// a field, or zero if we haven't seen enough reports to know. Some
+// fields report regularly, others only on change, so we're
+// deliberately generous and take the longest recent gap.
+func (d *Device) expectedInterval(field string) time.Duration {
+	g := d.live.gaps[field]
+	if len(g) < LivenessMinGapSamples {
+		return 0
+	}
+	return slices.Max(g)
+}
+
+func (d *Device) staleAfter(field string) time.Duration {
+	e := d.expectedInterval(field)
+	if e == 0 {
+		return 0
+	}
+	s := time.Duration(float64(e) * current().staleFactor)
+	if s < StaleMinimum {
+		s = StaleMinimum
+	}
+	return s
+}
+
+// checkLiveness works out whether the device is offline or has stale
+// sensors, tells anyone interested about changes and sets the timer
+// for the next check.
+func (d *Device) checkLiveness() {
+	now := d.clock.Now()
+	changed := false
+
+	offline := d.live.lastMessage.IsZero() || now.Sub(d.live.lastMessage) > current().offlineAfter
+	if offline != d.live.offline {
+		d.live.offline = offline
+		changed = true
+		if offline {
+			msg := fmt.Sprintf("No message from Plantcube since %s", d.live.lastMessage.Local().Format(time.RFC1123))
+			log.Warn.Printf("Device '%s' offline: %s", d.ID, msg)
+			d.notify(NoticeOffline, "", true, msg)
+			d.live.offlineNotified = true
+		} else {
+			log.Info.Printf("Device '%s' online", d.ID)
+			if d.live.offlineNotified {
+				d.notify(NoticeOffline, "", false, "Plantcube is talking to us again")
+				d.live.offlineNotified = false
+			}
+		}
+	}
+
+	if offline {
+		// When the device is offline, everything's stale and
+		// there's no point in saying so separately. We leave
+		// the stale fields as they were, so that they're
+		// resolved once the device is back.
+		if changed {
+			d.streamStatusUpdate()
+		}
+		d.armLivenessTimer()
+		return
+	}
+	ft := d.Reported.fieldTimes()
+	var stale []string
+	for _, f := range maps.Keys(d.live.gaps) {
+		sa := d.staleAfter(f)
+		if sa != 0 && now.Sub(ft[f]) > sa {
+			stale = append(stale, f)
+		}
+	}
+	slices.Sort(stale)
+	for _, f := range stale {
+		if !slices.Contains(d.live.stale, f) {
+			msg := fmt.Sprintf("Sensor %s hasn't reported since %s, normally reports at least every %v", f, ft[f].Local().Format(time.RFC1123), d.expectedInterval(f))
+			log.Warn.Printf("Device '%s' stale: %s", d.ID, msg)
+			d.notify(NoticeSensorStale, f, true, msg)
+			changed = true
+		}
+	}
+	for _, f := range d.live.stale {
+		if !slices.Contains(stale, f) {
+			d.notify(NoticeSensorStale, f, false, fmt.Sprintf("Sensor %s is reporting again", f))
+			changed = true
+		}
+	}
+	d.live.stale = stale
+
+	if changed {
+		d.streamStatusUpdate()
+	}
+	d.armLivenessTimer()
+}
+
+// armLivenessTimer sets the liveness timer for the next time
+// something could change: either the device going offline or a
+// field becoming stale.
+func (d *Device) armLivenessTimer() {
+	if d.live.lastMessage.IsZero() || d.live.offline {
+		// Nothing will change until we get a message
+		d.livenessTimer.Stop()
+		return
+	}
+	next := d.live.lastMessage.Add(current().offlineAfter)
+	ft := d.Reported.fieldTimes()
+	for f := range d.live.gaps {
+		sa := d.staleAfter(f)
+		if sa == 0 || slices.Contains(d.live.stale, f) {
+			continue
+		}
+		if t := ft[f].Add(sa); t.Before(next) {
+			next = t
+		}
+	}
+	// Add a second so we're definitely past the threshold when
+	// we check.
+	wait := next.Sub(d.clock.Now()) + time.Second
+	if wait < time.Second {
+		wait = time.Second
+	}
+	d.livenessTimer.Reset(wait)
+}
+
+// livenessTimerFired is called from the liveness timer's own
+// goroutine. It hands over to the processing loop so that the check
+// doesn't race with message processing.
+func (d *Device) livenessTimerFired() {
+	select {
+	case d.livenessChan <- struct{}{}:
+	default:
+		// A check is already pending
+	}
+}
+
+// staleFields returns the fields that are currently stale. While the
+// device is offline, that's none of them.
+func (d *Device) staleFields() []string {
+	if d.live.offline {
+		return nil
+	}
+	return slices.Clone(d.live.stale)
+}
+
+// Liveness returns a snapshot of the device's liveness.
+func (d *Device) Liveness() LivenessStatus {
+	var ls LivenessStatus
+	d.do(func() {
+		ls = d.liveness()
+	})
+	return ls
+}
+
+func (d *Device) liveness() LivenessStatus {
+	ls := LivenessStatus{
+		Online:      !d.live.offline,
+		LastMessage: d.live.lastMessage,
+		LastSeen:    maps.Clone(d.live.lastSeen),
+		Expected:    make(map[string]time.Duration),
+		StaleFields: d.staleFields(),
+	}
+	for f := range d.live.gaps {
+		if e := d.expectedInterval(f); e != 0 {
+			ls.Expected[f] = e
+		}
+	}
+	return ls
+}
+
+func (ls *LivenessStatus) String() string {
+	if !ls.Online {
+		return "offline"
+	}
+	if len(ls.StaleFields) > 0 {
+		return "stale: " + strings.Join(ls.StaleFields, ",")
+	}
+	return "online"
+}
@@ -0,0 +1,104 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"golang.org/x/exp/slices"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestLiveness(t *testing.T) {
+	log = logs.Discard()
+	setSettings(func(s *deviceSettings) {
+		s.offlineAfter = time.Hour
+		s.staleFactor = 3
+	})
+	var notices []Notice
+	SetNoticeHandler(func(n Notice) { notices = append(notices, n) })
+	defer SetNoticeHandler(nil)
+
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1687013649, 0))
+	d := Device{ID: "test", clock: mock, livenessChan: make(chan struct{}, 1)}
+	d.livenessTimer = mock.AfterFunc(time.Hour, d.livenessTimerFired)
+	d.livenessTimer.Stop()
+	d.initLiveness()
+	if ls := d.Liveness(); ls.Online {
+		t.Errorf("device with no messages is online")
+	}
+
+	// TempA reports every 5 minutes, the door once
+	for i := 0; i < LivenessMinGapSamples+1; i++ {
+		before := d.Reported.fieldTimes()
+		now := mock.Now()
+		d.Reported.TempA.update(23.5, now)
+		if i == 0 {
+			d.Reported.Door.update(false, now)
+		}
+		d.noteMessage(&msgUnparsed{"$aws", "shadow/update", nil, now}, before)
+		mock.Add(5 * time.Minute)
+	}
+	if len(notices) != 0 {
+		t.Errorf("coming online for the first time, got notices %+v, want none", notices)
+	}
+	ls := d.Liveness()
+	if !ls.Online || len(ls.StaleFields) != 0 {
+		t.Errorf("after regular messages, got %s, want online", ls.String())
+	}
+	if ls.Expected["TempA"] != 5*time.Minute {
+		t.Errorf("expected TempA interval, got %v, want %v", ls.Expected["TempA"], 5*time.Minute)
+	}
+	if _, ok := ls.Expected["Door"]; ok {
+		t.Errorf("door has an expected interval, but is event-driven")
+	}
+
+	// Something else keeps reporting, but TempA doesn't
+	for i := 0; i < 3; i++ {
+		before := d.Reported.fieldTimes()
+		d.Reported.HumidA.update(60, mock.Now())
+		d.noteMessage(&msgUnparsed{"$aws", "shadow/update", nil, mock.Now()}, before)
+		mock.Add(5 * time.Minute)
+	}
+	d.checkLiveness()
+	ls = d.Liveness()
+	if !ls.Online || !slices.Equal(ls.StaleFields, []string{"TempA"}) {
+		t.Errorf("after TempA stopped, got %s, want stale: TempA", ls.String())
+	}
+
+	mock.Add(time.Hour)
+	d.checkLiveness()
+	ls = d.Liveness()
+	if ls.Online || len(ls.StaleFields) != 0 {
+		t.Errorf("after an hour of silence, got %s, want offline", ls.String())
+	}
+
+	before := d.Reported.fieldTimes()
+	d.Reported.TempA.update(23.5, mock.Now())
+	d.noteMessage(&msgUnparsed{"$aws", "shadow/update", nil, mock.Now()}, before)
+	ls = d.Liveness()
+	if !ls.Online || len(ls.StaleFields) != 0 {
+		t.Errorf("after a new message, got %s, want online", ls.String())
+	}
+
+	want := []struct {
+		typ     NoticeType
+		subject string
+		active  bool
+	}{
+		{NoticeSensorStale, "TempA", true},
+		{NoticeOffline, "", true},
+		{NoticeOffline, "", false},
+		{NoticeSensorStale, "TempA", false},
+	}
+	if len(notices) != len(want) {
+		t.Fatalf("got %d notices, want %d: %+v", len(notices), len(want), notices)
+	}
+	for i, w := range want {
+		if notices[i].Type != w.typ || notices[i].Subject != w.subject || notices[i].Active != w.active || notices[i].DeviceID != "test" {
+			t.Errorf("notice %d, got %+v, want type %s, subject '%s', active %v", i, notices[i], w.typ, w.subject, w.active)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package device
+
+import (
+	"fmt"
+)
+
+// modeRule says whether a mode can be requested and, if it needs
+// confirming, why. confirm is nil if no confirmation is needed.
+type modeRule struct {
+	confirm func(d *Device) string
+}
+
+// confirmIfPlants asks for confirmation if plants are still
+// registered in the device, since they won't survive the new mode.
+func confirmIfPlants(what string) func(d *Device) string {
+	return func(d *Device) string {
+		if d.layerHasPlants(layerA) || d.layerHasPlants(layerB) {
+			return fmt.Sprintf("There are still plants in the device, they should be removed before %s", what)
+		}
+		return ""
+	}
+}
+
+var normalModeRules = map[DeviceMode]modeRule{
+	ModeDefault:           {},
+	ModeSilent:            {},
+	ModeCinema:            {},
+	ModeCleaning:          {confirm: confirmIfPlants("cleaning")},
+	ModeTankDrainCleaning: {confirm: confirmIfPlants("draining")},
+	ModeTankDrainExplicit: {confirm: confirmIfPlants("draining")},
+}
+
+// modeTransitions lists, for each mode the device can report, the
+// modes that can be requested from it. Modes the device only enters
+// by itself (Debug, RinseEnd, Unknown) can never be requested. From
+// anything other than the normal modes, Default is the way out.
+var modeTransitions = map[DeviceMode]map[DeviceMode]modeRule{
+	ModeDefault: normalModeRules,
+	ModeSilent:  normalModeRules,
+	ModeCinema:  normalModeRules,
+	ModeDebug: {
+		ModeDefault: {},
+	},
+	ModeRinseEnd: {
+		ModeDefault:           {},
+		ModeTankDrainCleaning: {},
+	},
+	ModeTankDrainCleaning: {
+		ModeDefault: {},
+	},
+	ModeTankDrainExplicit: {
+		ModeDefault: {},
+	},
+	ModeCleaning: {
+		ModeDefault: {},
+	},
+	ModeUnknown: {
+		ModeDefault: {},
+	},
+}
+
+// ModeChangeError is returned by SetMode when the requested mode
+// can't be reached from the device's current mode.
+type ModeChangeError struct {
+	From DeviceMode
+	To   DeviceMode
+}
+
+func (e *ModeChangeError) Error() string {
+	return fmt.Sprintf("can't change mode from %v to %v", e.From, e.To)
+}
+
+// ModeConfirmationError is returned by SetMode when the mode change
+// is possible, but needs confirming by the user first.
+type ModeConfirmationError struct {
+	From   DeviceMode
+	To     DeviceMode
+	Reason string
+}
+
+func (e *ModeConfirmationError) Error() string {
+	return fmt.Sprintf("changing mode from %v to %v needs confirmation: %s", e.From, e.To, e.Reason)
+}
+
+func (d *Device) checkModeChange(mode DeviceMode, confirmed bool) error {
+	from := d.Reported.Mode.Value
+	rule, ok := modeTransitions[from][mode]
+	if !ok {
+		return &ModeChangeError{from, mode}
+	}
+	if rule.confirm == nil || confirmed {
+		return nil
+	}
+	reason := rule.confirm(d)
+	if reason != "" {
+		return &ModeConfirmationError{from, mode, reason}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package device
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+type countingPublisher struct {
+	published int
+}
+
+func (p *countingPublisher) Publish(topic string, payload []byte) error {
+	p.published++
+	return nil
+}
+
+func TestSetMode(t *testing.T) {
+	log = logs.Discard()
+	type result int
+	const (
+		no result = iota
+		yes
+		confirm // Only needs confirming with plants
+	)
+	normal := map[DeviceMode]result{
+		ModeDefault:           yes,
+		ModeSilent:            yes,
+		ModeCinema:            yes,
+		ModeCleaning:          confirm,
+		ModeTankDrainCleaning: confirm,
+		ModeTankDrainExplicit: confirm,
+	}
+	allowed := map[DeviceMode]map[DeviceMode]result{
+		ModeDefault:           normal,
+		ModeDebug:             {ModeDefault: yes},
+		ModeRinseEnd:          {ModeDefault: yes, ModeTankDrainCleaning: yes},
+		ModeTankDrainCleaning: {ModeDefault: yes},
+		ModeTankDrainExplicit: {ModeDefault: yes},
+		ModeCleaning:          {ModeDefault: yes},
+		ModeUnknown:           {ModeDefault: yes},
+		ModeSilent:            normal,
+		ModeCinema:            normal,
+	}
+
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1687685000, 0))
+	for from := ModeDefault; from <= ModeOutOfRange; from++ {
+		for to := ModeDefault; to <= ModeOutOfRange; to++ {
+			for _, plants := range []bool{false, true} {
+				for _, confirmed := range []bool{false, true} {
+					p := &countingPublisher{}
+					d := Device{ID: "test", clock: mock, publisher: p}
+					d.commandTimer = mock.AfterFunc(time.Hour, func() {})
+					d.commandTimer.Stop()
+					d.saveTimer = mock.AfterFunc(time.Hour, func() {})
+					d.saveTimer.Stop()
+					d.Reported.Mode.update(from, mock.Now())
+					if plants {
+						d.Slots = map[layerID]map[slotID]slot{
+							layerB: {slot5: {Plant: 104}},
+						}
+					}
+					err := d.SetMode(to, confirmed)
+
+					want := allowed[from][to]
+					var changeErr *ModeChangeError
+					var confirmErr *ModeConfirmationError
+					switch {
+					case want == no:
+						if !errors.As(err, &changeErr) || changeErr.From != from || changeErr.To != to {
+							t.Errorf("%v->%v, plants %v, confirmed %v: got error %v, want ModeChangeError", from, to, plants, confirmed, err)
+						}
+					case want == confirm && plants && !confirmed:
+						if !errors.As(err, &confirmErr) || confirmErr.From != from || confirmErr.To != to || confirmErr.Reason == "" {
+							t.Errorf("%v->%v, plants %v, confirmed %v: got error %v, want ModeConfirmationError", from, to, plants, confirmed, err)
+						}
+					default:
+						if err != nil {
+							t.Errorf("%v->%v, plants %v, confirmed %v: got error %v, want none", from, to, plants, confirmed, err)
+						}
+					}
+					// Asking for the mode the device is
+					// already in sends nothing: the shadow
+					// has no delta
+					wantPublished := 0
+					if err == nil && from != to {
+						wantPublished = 1
+					}
+					if p.published != wantPublished {
+						t.Errorf("%v->%v, plants %v, confirmed %v: published %d messages, want %d", from, to, plants, confirmed, p.published, wantPublished)
+					}
+				}
+			}
+		}
+	}
+}
@@ -20,7 +20,7 @@ type msgAglEventInfo struct {
 
 func parseAglEventInfo(msg *msgUnparsed) (*msgAglEventInfo, error) {
 	var m msgAglEventInfo
-	err := pickyUnmarshal(msg.content, &m)
+	err := unmarshalMsg(msg, msg.content, &m)
 	if err != nil {
 		return nil, err
 	}
@@ -35,11 +35,18 @@ func (d *Device) processAglEventInfo(msg *msgUnparsed) error {
 	if err != nil {
 		return err
 	}
+	fields := make(map[string]string)
+	setField(fields, "mode", m.Payload.Mode)
+	setField(fields, "state", m.Payload.State)
+	setField(fields, "layer", m.Payload.Layer)
+	d.logEvent("info", *m.Label, m.Timestamp, fields, "", msg.t)
+
 	log.Info.Printf("Plantcube info, time %s, label '%s', mode '%s', state '%s', layer '%s'",
 		time.Unix(int64(*m.Timestamp), 0).String(),
 		*m.Label, *m.Payload.Mode, *m.Payload.State, *m.Payload.Layer)
-	// TODO: When we get an MCU_MODE_STATE, we should cancel the
-	// prior warning to the frontend about the door being open
+	if *m.Label == "MCU_MODE_STATE" && *m.Payload.Mode == "ECO_MODE" && *m.Payload.State == "0" {
+		d.clearDoorAlert(msg.t)
+	}
 
 	return nil
 }
@@ -2,6 +2,7 @@ package device
 
 import (
 	"bytes"
+	"fmt"
 	"time"
 )
 
@@ -32,7 +33,7 @@ func parseAglEventWarning(msg *msgUnparsed) (*msgAglEventWarning, error) {
 	var m msgAglEventWarning
 	// The warnings frequently contain newlines. Replace them.
 	stripped := bytes.ReplaceAll(msg.content, []byte{0x0a}, []byte{'_'})
-	err := pickyUnmarshal(stripped, &m)
+	err := unmarshalMsg(msg, stripped, &m)
 	if err != nil {
 		return nil, err
 	}
@@ -47,14 +48,30 @@ func (d *Device) processAglEventWarning(msg *msgUnparsed) error {
 	if err != nil {
 		return err
 	}
+	fields := make(map[string]string)
+	setField(fields, "error_log", m.Payload.ErrorLog)
+	setField(fields, "function_name", m.Payload.FunctionName)
+	setField(fields, "mode", m.Payload.Mode)
+	setField(fields, "state", m.Payload.State)
+	setField(fields, "layer", m.Payload.Layer)
+	raw := ""
+	if *m.Label != "NCU_SYS_LOG" && *m.Label != "MCU_MODE_STATE" {
+		raw = string(msg.content)
+	}
+	d.logEvent("warning", *m.Label, m.Timestamp, fields, raw, msg.t)
+
 	if *m.Label == "NCU_SYS_LOG" {
 		log.Warn.Printf("Plantcube syslog warning, time %s, label '%s', function '%s', log '%s'", time.Unix(int64(*m.Timestamp), 0).Local().String(), *m.Label, *m.Payload.FunctionName, *m.Payload.ErrorLog)
+		d.notify(NoticeFirmwareWarning, "", true, fmt.Sprintf("Plantcube reported '%s' in %s", *m.Payload.ErrorLog, *m.Payload.FunctionName))
 	} else if *m.Label == "MCU_MODE_STATE" {
-		// TODO: When we get an MCU_MODE_STATE, we should warn
-		// the frontend about the door being open
 		log.Warn.Printf("Plantcube mode warning, time %s, label '%s', mode '%s', state '%s', layer '%s'", time.Unix(int64(*m.Timestamp), 0).Local().String(), *m.Label, *m.Payload.Mode, *m.Payload.State, *m.Payload.Layer)
+		if *m.Payload.Mode == "ECO_MODE" && *m.Payload.State == "1" {
+			d.raiseDoorAlert(doorAlertSourceMCU, msg.t)
+		}
 	} else {
+		discover(DiscoveryLabel, msg.where(), *m.Label, msg.content, msg.t)
 		log.Error.Printf("Unknown Plantcube warning! time %s, label '%s', raw '%s'", time.Unix(int64(*m.Timestamp), 0).Local().String(), *m.Label, string(msg.content))
+		d.notify(NoticeFirmwareWarning, "", true, fmt.Sprintf("Plantcube sent unknown warning '%s'", *m.Label))
 	}
 
 	return nil
@@ -14,7 +14,7 @@ type msgAglMode struct {
 
 func parseAglMode(msg *msgUnparsed) (*msgAglMode, error) {
 	var m msgAglMode
-	err := pickyUnmarshal(msg.content, &m)
+	err := unmarshalMsg(msg, msg.content, &m)
 	if err != nil {
 		return nil, err
 	}
@@ -24,14 +24,27 @@ func parseAglMode(msg *msgUnparsed) (*msgAglMode, error) {
 		return nil, errors.New("no mode field")
 	} else if m.Trigger == nil {
 		return nil, errors.New("no trigger field")
-	} else if *m.PrevMode < ModeDefault || *m.PrevMode >= ModeOutOfRange {
-		return nil, fmt.Errorf("PrevMode %d is invalid", *m.PrevMode)
-	} else if *m.Mode < ModeDefault || *m.Mode >= ModeOutOfRange {
-		return nil, fmt.Errorf("Mode %d is invalid", *m.Mode)
-	} else if *m.Mode == *m.PrevMode {
+	}
+	if *m.PrevMode < ModeDefault || *m.PrevMode >= ModeOutOfRange {
+		err = unknownEnum(msg, "prev_mode", int(*m.PrevMode), "PrevMode %d is invalid")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *m.Mode < ModeDefault || *m.Mode >= ModeOutOfRange {
+		err = unknownEnum(msg, "mode", int(*m.Mode), "Mode %d is invalid")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if *m.Mode == *m.PrevMode {
 		return nil, fmt.Errorf("Mode %d is the same as previously", *m.Mode)
-	} else if *m.Trigger < ModeTriggerApp || *m.Trigger >= ModeTriggerOutOfRange {
-		return nil, fmt.Errorf("Trigger %d is invalid", *m.Trigger)
+	}
+	if *m.Trigger < ModeTriggerApp || *m.Trigger >= ModeTriggerOutOfRange {
+		err = unknownEnum(msg, "trigger", int(*m.Trigger), "Trigger %d is invalid")
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &m, nil
@@ -42,17 +55,21 @@ func (d *Device) processAglMode(msg *msgUnparsed) ([]msgReply, error) {
 	if err != nil {
 		return nil, err
 	}
+	if *m.Mode < ModeDefault || *m.Mode >= ModeOutOfRange {
+		// Only lenient parsing lets this through, having
+		// catalogued it. SetMode can't leave a mode we don't
+		// know, so we keep the one we had.
+		log.Warn.Printf("Device mode changed from %v to unknown mode %d, keeping %v", *m.PrevMode, int(*m.Mode), d.Reported.Mode.Value)
+		return nil, nil
+	}
 	if *m.PrevMode != d.Reported.Mode.Value {
 		log.Warn.Printf("Previous mode %v doesn't match our previous mode %v, accepting mode change anyway", *m.PrevMode, d.Reported.Mode.Value)
 	}
 	log.Info.Printf("Device mode changed from %v to %v, trigger %v", *m.PrevMode, *m.Mode, *m.Trigger)
+	prev := d.Reported.Mode.Value
 	d.Reported.Mode.update(*m.Mode, msg.t)
+	d.record(modeRecord(m, msg.t))
+	d.updateCleaning(prev, *m.Mode, *m.Trigger, msg.t)
 
-	reply := d.getAWSShadowUpdateAcceptedReply(msg.t, true)
-
-	// TODO : In response to some mode changes, we should display
-	// stuff for the end user (e.g. during cleaning, tank pumping,
-	// etc.)
-
-	return []msgReply{reply}, nil
+	return d.getAWSShadowUpdateReplies(msg.t, true)
 }
@@ -13,7 +13,7 @@ type msgAglRecipeGet struct {
 
 func parseAglRecipeGet(msg *msgUnparsed) (*msgAglRecipeGet, error) {
 	var m msgAglRecipeGet
-	err := pickyUnmarshal(msg.content, &m)
+	err := unmarshalMsg(msg, msg.content, &m)
 	if err != nil {
 		return nil, err
 	}
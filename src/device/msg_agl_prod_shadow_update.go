@@ -20,7 +20,7 @@ type msgAglShadowUpdate struct {
 
 func parseAglShadowUpdate(msg *msgUnparsed) (*msgAglShadowUpdate, error) {
 	var m msgAglShadowUpdate
-	err := pickyUnmarshal(msg.content, &m)
+	err := unmarshalMsg(msg, msg.content, &m)
 	if err != nil {
 		return nil, err
 	}
@@ -50,6 +50,6 @@ func (d *Device) processAglShadowUpdate(msg *msgUnparsed) ([]msgReply, error) {
 	if r.TankLevel != nil {
 		d.Reported.TankLevel.update(*r.TankLevel, msg.t)
 	}
-	reply := d.getAWSShadowUpdateAcceptedReply(msg.t, true)
-	return []msgReply{reply}, nil
+	d.recordTelemetry(msg.t)
+	return d.getAWSShadowUpdateReplies(msg.t, true)
 }
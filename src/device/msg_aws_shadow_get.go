@@ -12,7 +12,7 @@ type msgAWSShadowGet struct {
 
 func parseAWSShadowGet(msg *msgUnparsed) (*msgAWSShadowGet, error) {
 	var m msgAWSShadowGet
-	err := pickyUnmarshal(msg.content, &m)
+	err := unmarshalMsg(msg, msg.content, &m)
 	if err != nil {
 		return nil, err
 	}
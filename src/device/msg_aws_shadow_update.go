@@ -6,6 +6,10 @@ import (
 	"fmt"
 	"strconv"
 	"time"
+
+	"github.com/lupguo/go-render/render"
+
+	"github.com/Jon-Bright/plantprism/shadow"
 )
 
 const (
@@ -73,343 +77,432 @@ func (m *msgAWSShadowUpdateData) empty() bool {
 		m.TotalOffset == nil && m.Valve == nil && m.WifiLevel == nil
 }
 
-func (m *msgAWSShadowUpdateData) validate() error {
-	if m.empty() {
-		return errors.New("update is empty")
-	}
-	if m.FirmwareNCU != nil && *m.FirmwareNCU < EXPECTED_NCU_MCU_FW_VERSION {
-		return fmt.Errorf("NCU firmware too old: %d", *m.FirmwareNCU)
+// validate checks the update as a whole. If it's valid, any values
+// in it that can't be trusted are removed and returned. If that
+// leaves nothing, the first of them is also returned as the error.
+func (m *msgAWSShadowUpdateData) validate(ranges map[string]FieldRange) ([]*rejectError, error) {
+	if m.Mode != nil {
+		return nil, rejectErrorf(unexpectedField("mode"), "Unexpected mode in update")
 	}
-	if m.HumidA != nil && (*m.HumidA < 30 || *m.HumidA > 100) {
-		// 30% humidity isn't technically an error, but it
-		// sure would be surprising
-		return fmt.Errorf("humidity A out of range: %d", *m.HumidA)
+	if m.Connected != nil {
+		return nil, rejectErrorf(unexpectedField("connected"), "Unexpected connected in update")
 	}
-	if m.HumidB != nil && (*m.HumidB < 30 || *m.HumidB > 100) {
-		// 30% humidity isn't technically an error, but it
-		// sure would be surprising
-		return fmt.Errorf("humidity B out of range: %d", *m.HumidB)
-	}
-	if m.RecipeID != nil && *m.RecipeID != 1 && *m.RecipeID < 1680300000 {
-		// 1680300000 is 2023-04-01. The recipe shouldn't be that old.
-		// 1 is a flag value the Plantcube uses to request a recipe.
-		return fmt.Errorf("recipe ID invalid: %d", *m.RecipeID)
+	if m.EC != nil {
+		return nil, rejectErrorf(unexpectedField("ec"), "Unexpected ec in update")
 	}
-	if m.TankLevel != nil && (*m.TankLevel < 0 || *m.TankLevel > 2) {
-		return fmt.Errorf("tank level invalid: %d", *m.TankLevel)
-	}
-	if m.TankLevelRaw != nil && (*m.TankLevelRaw < 0 || *m.TankLevelRaw > 2) {
-		return fmt.Errorf("raw tank level invalid: %d", *m.TankLevelRaw)
-	}
-	if m.TempA != nil && (*m.TempA < 10.0 || *m.TempA > 40.0) {
-		return fmt.Errorf("temp A out of range: %.1f", *m.TempA)
-	}
-	if m.TempB != nil && (*m.TempB < 10.0 || *m.TempB > 40.0) {
-		return fmt.Errorf("temp B out of range: %.1f", *m.TempB)
-	}
-	if m.TempTank != nil && (*m.TempTank < 10.0 || *m.TempTank > 40.0) {
-		return fmt.Errorf("temp tank out of range: %.1f", *m.TempTank)
-	}
-	if m.TotalOffset != nil && (*m.TotalOffset < 0 || *m.TotalOffset > 86400) {
-		// 86400 = 1 day in seconds. Offset shouldn't exceed this.
-		return fmt.Errorf("total offset out of range: %d", *m.TotalOffset)
+	if m.empty() {
+		return nil, rejectErrorf(RejectEmpty, "update is empty")
 	}
-	if m.Valve != nil && *m.Valve != ValveOpenLayerB && *m.Valve != ValveOpenLayerA && *m.Valve != ValveClosed {
-		return fmt.Errorf("valve value invalid: %d", *m.Valve)
+	q := m.quarantine(ranges)
+	if m.empty() {
+		return q, q[0]
 	}
-	if m.WifiLevel != nil && (*m.WifiLevel < 0 || *m.WifiLevel > 2) {
-		return fmt.Errorf("wifi level invalid: %d", *m.WifiLevel)
+	return q, nil
+}
+
+// quarantine removes every value from the update that's invalid or
+// outside its range, returning why for each one.
+func (m *msgAWSShadowUpdateData) quarantine(ranges map[string]FieldRange) []*rejectError {
+	var q []*rejectError
+	add := func(e *rejectError) {
+		if e != nil {
+			q = append(q, e)
+		}
 	}
-	return nil
+	add(quarantineField(&m.FirmwareNCU, "firmware_ncu", func(v int) bool {
+		return v < EXPECTED_NCU_MCU_FW_VERSION
+	}, "NCU firmware too old: %d"))
+	add(quarantineField(&m.HumidA, "humid_a", outside[int](ranges, "humid_a"), "humidity A out of range: %d"))
+	add(quarantineField(&m.HumidB, "humid_b", outside[int](ranges, "humid_b"), "humidity B out of range: %d"))
+	add(quarantineField(&m.RecipeID, "recipe_id", func(v int) bool {
+		// 1680300000 is 2023-04-01. The recipe shouldn't be that old.
+		// 1 is a flag value the Plantcube uses to request a recipe.
+		return v != 1 && v < 1680300000
+	}, "recipe ID invalid: %d"))
+	add(quarantineField(&m.TankLevel, "tank_level", func(v int) bool {
+		return v < 0 || v > 2
+	}, "tank level invalid: %d"))
+	add(quarantineField(&m.TankLevelRaw, "tank_level_raw", func(v int) bool {
+		return v < 0 || v > 2
+	}, "raw tank level invalid: %d"))
+	add(quarantineField(&m.TempA, "temp_a", outside[floatDP](ranges, "temp_a"), "temp A out of range: %.1f"))
+	add(quarantineField(&m.TempB, "temp_b", outside[floatDP](ranges, "temp_b"), "temp B out of range: %.1f"))
+	add(quarantineField(&m.TempTank, "temp_tank", outside[floatDP](ranges, "temp_tank"), "temp tank out of range: %.1f"))
+	add(quarantineField(&m.TotalOffset, "total_offset", outside[int](ranges, "total_offset"), "total offset out of range: %d"))
+	add(quarantineField(&m.Valve, "valve", func(v ValveState) bool {
+		return v != ValveOpenLayerB && v != ValveOpenLayerA && v != ValveClosed
+	}, "valve value invalid: %d"))
+	add(quarantineField(&m.WifiLevel, "wifi_level", func(v int) bool {
+		return v < 0 || v > 2
+	}, "wifi level invalid: %d"))
+	return q
 }
 
-func parseAWSShadowUpdate(msg *msgUnparsed) (*msgAWSShadowUpdate, error) {
+// parseAWSShadowUpdate parses and validates an update, checking
+// values against the given ranges, or the defaults for any not
+// given. Values that fail are removed from the update and returned.
+func parseAWSShadowUpdate(msg *msgUnparsed, ranges map[string]FieldRange) (*msgAWSShadowUpdate, []*rejectError, error) {
 	var m msgAWSShadowUpdate
 	err := json.Unmarshal(msg.content, &m)
 	if err != nil {
-		return nil, err
+		return nil, nil, rejectErrorf(RejectMalformed, "%v", err)
+	}
+	if current().lenient {
+		// Unknown fields are ignored anyway, but it's useful
+		// to know about them
+		discoverFields(msg, msg.content, &m)
 	}
 	if m.ClientToken == nil {
-		return nil, errors.New("no ClientToken")
+		return nil, nil, rejectErrorf(RejectClientToken, "no ClientToken")
 	} else if len(*m.ClientToken) < 8 {
-		return nil, fmt.Errorf("ClientToken '%s' too short", *m.ClientToken)
+		return nil, nil, rejectErrorf(RejectClientToken, "ClientToken '%s' too short", *m.ClientToken)
 	}
-	err = m.State.Reported.validate()
+	q, err := m.State.Reported.validate(ranges)
 	if err != nil {
-		return nil, err
+		return nil, q, err
 	}
-	return &m, nil
+	return &m, q, nil
 }
 
 func (d *Device) processAWSShadowUpdate(msg *msgUnparsed) ([]msgReply, error) {
-	m, err := parseAWSShadowUpdate(msg)
+	req, serr := shadow.ParseRequest(msg.content)
+	if serr != nil {
+		return d.rejectAWSShadowUpdate(req, RejectMalformed, serr, msg.t), nil
+	}
+	if req.Desired != nil || req.ClearDesired || req.ClearReported {
+		return d.rejectAWSShadowUpdate(req, RejectDesired, badRequest("Only reported fields can be updated"), msg.t), nil
+	}
+	m, q, err := parseAWSShadowUpdate(msg, d.Ranges)
+	d.noteSuspicious(req.Reported, q, msg.t)
+	for _, e := range q {
+		if current().lenient && e.field == "valve" {
+			// The valve is the only enum in an update
+			discover(DiscoveryEnum, msg.where(), "valve="+string(req.Reported["valve"]), msg.content, msg.t)
+		}
+	}
 	if err != nil {
-		return nil, err
+		reason := RejectMalformed
+		var rerr *rejectError
+		if errors.As(err, &rerr) {
+			reason = rerr.reason
+		}
+		return d.rejectAWSShadowUpdate(req, reason, badRequest(err.Error()), msg.t), nil
 	}
 	if *m.ClientToken != d.ClientToken {
-		return nil, fmt.Errorf("clientToken '%s' received, but device clientToken is '%s'", *m.ClientToken, d.ClientToken)
+		text := fmt.Sprintf("clientToken '%s' received, but device clientToken is '%s'", *m.ClientToken, d.ClientToken)
+		return d.rejectAWSShadowUpdate(req, RejectClientToken, badRequest(text), msg.t), nil
 	}
 	r := &m.State.Reported
 	dr := &d.Reported
-	if r.Mode != nil {
-		return nil, errors.New("unexpected Mode reported in AWS update")
+	prevValve := dr.Valve.Value
+	dr.applyAWSUpdate(r, msg.t)
+	d.recordTelemetry(msg.t)
+	if r.Valve != nil {
+		d.record(d.valveChangeRecords(prevValve, msg.t)...)
 	}
-	if r.Connected != nil {
-		return nil, errors.New("unexpected Connected reported in AWS update")
+	// If the Plantcube reported a recipe ID other than the one
+	// we want it to have (typically 1, which is how it asks for
+	// a recipe), the shadow produces a delta to tell it.
+	replies, err := d.getAWSShadowUpdateReplies(msg.t, false)
+	if err != nil {
+		return nil, err
 	}
-	if r.EC != nil {
-		return nil, errors.New("unexpected EC reported in AWS update")
+	if dr.Valve.wasUpdatedAt(msg.t) && dr.Valve.Value != ValveClosed {
+		d.wateringTimer.Stop()
 	}
+	return replies, nil
+}
+
+// applyAWSUpdate sets every value present in the update, with the
+// given timestamp.
+func (dr *deviceReported) applyAWSUpdate(r *msgAWSShadowUpdateData, t time.Time) {
 	if r.Cooling != nil {
-		dr.Cooling.update(*r.Cooling, msg.t)
+		dr.Cooling.update(*r.Cooling, t)
 	}
 	if r.Door != nil {
-		dr.Door.update(*r.Door, msg.t)
+		dr.Door.update(*r.Door, t)
 	}
 	if r.FirmwareNCU != nil {
-		dr.FirmwareNCU.update(*r.FirmwareNCU, msg.t)
+		dr.FirmwareNCU.update(*r.FirmwareNCU, t)
 	}
 	if r.HumidA != nil {
-		dr.HumidA.update(*r.HumidA, msg.t)
+		dr.HumidA.update(*r.HumidA, t)
 	}
 	if r.HumidB != nil {
-		dr.HumidB.update(*r.HumidB, msg.t)
+		dr.HumidB.update(*r.HumidB, t)
 	}
 	if r.LightA != nil {
-		dr.LightA.update(*r.LightA, msg.t)
+		dr.LightA.update(*r.LightA, t)
 	}
 	if r.LightB != nil {
-		dr.LightB.update(*r.LightB, msg.t)
+		dr.LightB.update(*r.LightB, t)
 	}
 	if r.RecipeID != nil {
-		dr.RecipeID.update(*r.RecipeID, msg.t)
+		dr.RecipeID.update(*r.RecipeID, t)
 	}
 	if r.TankLevel != nil {
-		dr.TankLevel.update(*r.TankLevel, msg.t)
+		dr.TankLevel.update(*r.TankLevel, t)
 	}
 	if r.TankLevelRaw != nil {
-		dr.TankLevelRaw.update(*r.TankLevelRaw, msg.t)
+		dr.TankLevelRaw.update(*r.TankLevelRaw, t)
 	}
 	if r.TempA != nil {
-		dr.TempA.update(*r.TempA, msg.t)
+		dr.TempA.update(*r.TempA, t)
 	}
 	if r.TempB != nil {
-		dr.TempB.update(*r.TempB, msg.t)
+		dr.TempB.update(*r.TempB, t)
 	}
 	if r.TempTank != nil {
-		dr.TempTank.update(*r.TempTank, msg.t)
+		dr.TempTank.update(*r.TempTank, t)
 	}
 	if r.TotalOffset != nil {
-		dr.TotalOffset.update(*r.TotalOffset, msg.t)
+		dr.TotalOffset.update(*r.TotalOffset, t)
 	}
 	if r.Valve != nil {
-		dr.Valve.update(*r.Valve, msg.t)
+		dr.Valve.update(*r.Valve, t)
 	}
 	if r.WifiLevel != nil {
-		dr.WifiLevel.update(*r.WifiLevel, msg.t)
-	}
-	replies := []msgReply{
-		d.getAWSShadowUpdateAcceptedReply(msg.t, false),
+		dr.WifiLevel.update(*r.WifiLevel, t)
 	}
-	if dr.RecipeID.wasUpdatedAt(msg.t) && dr.RecipeID.Value != int(d.Recipe.ID) {
-		if log != nil {
-			log.Info.Printf("Seen recipe difference (%d!=%d), generating delta", dr.RecipeID.Value, d.Recipe.ID)
+}
+
+type msgAWSShadowUpdateAcceptedReply struct {
+	*shadow.Accepted
+}
+
+func (m *msgAWSShadowUpdateAcceptedReply) topic() string {
+	return MQTT_TOPIC_AWS_UPDATE_ACCEPTED
+}
+
+// Example: {"version":944757,"timestamp":1687710613,"state":{"recipe_id":1687710613},"metadata":{"recipe_id":{"timestamp":1687710613}}}
+type msgAWSShadowUpdateDeltaReply struct {
+	*shadow.Delta
+}
+
+func (m *msgAWSShadowUpdateDeltaReply) topic() string {
+	return MQTT_TOPIC_AWS_UPDATE_DELTA
+}
+
+type msgAWSShadowUpdateRejectedReply struct {
+	*shadow.Rejected
+}
+
+func (m *msgAWSShadowUpdateRejectedReply) topic() string {
+	return MQTT_TOPIC_AWS_UPDATE_REJECTED
+}
+
+// oneOffDesired are the desired fields that are only wanted until
+// the Plantcube reports them. After that, it's free to change them
+// itself, e.g. leaving cinema mode. The recipe stays desired, since
+// the Plantcube asks for it again by reporting recipe ID 1.
+var oneOffDesired = []string{"mode", "total_offset"}
+
+// shadowDocument returns the device's shadow. A device saved before
+// the shadow was kept gets one built from what it already has: its
+// version, the reported values with their timestamps, and its
+// recipe as the desired one.
+func (d *Device) shadowDocument() *shadow.Document {
+	if d.Shadow != nil {
+		return d.Shadow
+	}
+	doc := shadow.Document{
+		Version:  d.AWSVersion,
+		Reported: map[string]shadow.Value{},
+	}
+	seen := map[int64]bool{}
+	for _, t := range d.Reported.fieldTimes() {
+		if t.IsZero() || seen[t.UnixNano()] {
+			continue
 		}
-		// We need to generate a delta message that just
-		// covers the Recipe ID.  We therefore make a new
-		// Device with our current AWS version, update just
-		// the Recipe ID and generate a delta based on this.
-		deltaD := Device{
-			AWSVersion: d.AWSVersion,
+		seen[t.UnixNano()] = true
+		values, _ := d.reportedAt(t)
+		for k, v := range values {
+			doc.Reported[k] = shadow.Value{Value: v, Timestamp: t}
 		}
-		deltaT := time.Unix(int64(d.Recipe.ID), 0)
-		deltaD.Reported.RecipeID.update(int(d.Recipe.ID), deltaT)
-		replies = append(replies, deltaD.getAWSShadowUpdateDeltaReply(deltaT, msg.t))
 	}
-	if dr.Valve.wasUpdatedAt(msg.t) && dr.Valve.Value != ValveClosed {
-		d.wateringTimer.Stop()
+	if d.Recipe != nil {
+		doc.Desired = map[string]shadow.Value{
+			"recipe_id": {
+				Value:     jsonValue(int(d.Recipe.ID)),
+				Timestamp: time.Unix(int64(d.Recipe.ID), 0),
+			},
+		}
 	}
-	return replies, nil
+	d.Shadow = &doc
+	d.AWSVersion = 0
+	return d.Shadow
 }
 
-type msgAWSShadowUpdateMetadata struct {
-	Connected    *msgUpdTS `json:"connected,omitempty"`
-	Cooling      *msgUpdTS `json:"cooling,omitempty"`
-	Door         *msgUpdTS `json:"door,omitempty"`
-	EC           *msgUpdTS `json:"ec,omitempty"`
-	FirmwareNCU  *msgUpdTS `json:"firmware_ncu,omitempty"`
-	HumidA       *msgUpdTS `json:"humid_a,omitempty"`
-	HumidB       *msgUpdTS `json:"humid_b,omitempty"`
-	LightA       *msgUpdTS `json:"light_a,omitempty"`
-	LightB       *msgUpdTS `json:"light_b,omitempty"`
-	Mode         *msgUpdTS `json:"mode,omitempty"`
-	RecipeID     *msgUpdTS `json:"recipe_id,omitempty"`
-	TankLevel    *msgUpdTS `json:"tank_level,omitempty"`
-	TankLevelRaw *msgUpdTS `json:"tank_level_raw,omitempty"`
-	TempA        *msgUpdTS `json:"temp_a,omitempty"`
-	TempB        *msgUpdTS `json:"temp_b,omitempty"`
-	TempTank     *msgUpdTS `json:"temp_tank,omitempty"`
-	TotalOffset  *msgUpdTS `json:"total_offset,omitempty"`
-	Valve        *msgUpdTS `json:"valve,omitempty"`
-	WifiLevel    *msgUpdTS `json:"wifi_level,omitempty"`
-}
-type msgAWSShadowUpdateAcceptedMetadata struct {
-	Reported msgAWSShadowUpdateMetadata `json:"reported"`
-}
-type msgAWSShadowUpdateAcceptedReply struct {
-	State       msgAWSShadowUpdateState            `json:"state"`
-	Metadata    msgAWSShadowUpdateAcceptedMetadata `json:"metadata"`
-	Version     int                                `json:"version"`
-	Timestamp   int                                `json:"timestamp"`
-	ClientToken string                             `json:"clientToken,omitempty"`
+// updateShadow applies an update to the device's shadow. The delta
+// is nil if the update didn't leave any desired field it touched
+// different from its reported value.
+func (d *Device) updateShadow(req *shadow.Request, t time.Time) (msgReply, msgReply, error) {
+	doc := d.shadowDocument()
+	acc, delta, serr := doc.Update(req, t)
+	if serr != nil {
+		return nil, nil, fmt.Errorf("shadow update failed: %w", serr)
+	}
+	for _, k := range oneOffDesired {
+		if doc.Settle(k) {
+			log.Info.Printf("Device '%s' has desired %s %s", d.ID, k, doc.Reported[k].Value)
+		}
+	}
+	if delta == nil {
+		return &msgAWSShadowUpdateAcceptedReply{acc}, nil, nil
+	}
+	log.Info.Printf("Device '%s' shadow delta: %s", d.ID, render.Render(delta.State))
+	return &msgAWSShadowUpdateAcceptedReply{acc}, &msgAWSShadowUpdateDeltaReply{delta}, nil
 }
 
-func (m *msgAWSShadowUpdateAcceptedReply) topic() string {
-	return MQTT_TOPIC_AWS_UPDATE_ACCEPTED
+// dropDesired forgets any value we wanted a field to change to, for
+// when the Plantcube already has the value we now want.
+func (d *Device) dropDesired(field string) {
+	delete(d.shadowDocument().Desired, field)
 }
 
-// Construct a reply featuring all values reported at the given
+// Construct replies featuring all values reported at the given
 // timestamp, along with metadata for each of those values with the
-// timestamp.  /shadow/update to agl/prod _also_ triggers AWS updates,
-// as does agl/prod/.../mode, but these come without a client token
-// (possibly because they're making it into AWS's shadow via
-// Agrilution code, not via a client?), so allow generating these
-// without a client ID.
-func (d *Device) getAWSShadowUpdateAcceptedReply(t time.Time, omitClientToken bool) msgReply {
-	msg := msgAWSShadowUpdateAcceptedReply{}
-	r := &msg.State.Reported
-	m := &msg.Metadata.Reported
-
-	d.AWSVersion++
-	msg.Version = d.AWSVersion
-	msg.Timestamp = int(t.Unix())
+// timestamp, and a delta if needed.  /shadow/update to agl/prod
+// _also_ triggers AWS updates, as does agl/prod/.../mode, but these
+// come without a client token (possibly because they're making it
+// into AWS's shadow via Agrilution code, not via a client?), so
+// allow generating these without a client ID.
+func (d *Device) getAWSShadowUpdateReplies(t time.Time, omitClientToken bool) ([]msgReply, error) {
+	values, statusUpdated := d.reportedAt(t)
+	req := shadow.Request{Reported: values}
 	if !omitClientToken {
-		msg.ClientToken = d.ClientToken
+		req.ClientToken = d.ClientToken
+	}
+	acc, delta, err := d.updateShadow(&req, t)
+	if err != nil {
+		return nil, err
 	}
-	statusUpdated := d.fillAWSUpdateDataMetadata(t, r, m)
 	if statusUpdated {
 		d.streamStatusUpdate()
 	}
-	return &msg
+	if delta == nil {
+		return []msgReply{acc}, nil
+	}
+	return []msgReply{acc, delta}, nil
 }
 
-func (dev *Device) fillAWSUpdateDataMetadata(t time.Time, d *msgAWSShadowUpdateData, m *msgAWSShadowUpdateMetadata) bool {
+// sendDesired tells the Plantcube we want a field to have a new
+// value. The value stays desired, and saved, so any later report
+// that doesn't match it gets a delta too. The accepted reply to a
+// desired update goes to whoever made it, which is us, so only the
+// delta is sent, and only if the value isn't already what the
+// Plantcube reports.
+func (d *Device) sendDesired(field string, value any) error {
+	req := shadow.Request{
+		Desired: map[string]json.RawMessage{field: jsonValue(value)},
+	}
+	_, delta, err := d.updateShadow(&req, d.clock.Now())
+	if err != nil {
+		return err
+	}
+	d.QueueSave()
+	if delta == nil {
+		log.Info.Printf("Device '%s' already has %s %v, nothing to send", d.ID, field, value)
+		return nil
+	}
+	return d.sendReplies([]msgReply{delta})
+}
+
+// reportedAt returns every reported field that was updated at t,
+// keyed by its shadow name, and whether any of the fields in
+// StatusEvent was among them.
+func (d *Device) reportedAt(t time.Time) (map[string]json.RawMessage, bool) {
+	var r msgAWSShadowUpdateData
+	su := d.fillAWSUpdateData(t, &r)
+	b, err := json.Marshal(&r)
+	if err != nil {
+		// Only basic types in there, this can't happen
+		panic(fmt.Sprintf("failed marshalling reported fields: %v", err))
+	}
+	values := map[string]json.RawMessage{}
+	err = json.Unmarshal(b, &values)
+	if err != nil {
+		panic(fmt.Sprintf("failed unmarshalling reported fields: %v", err))
+	}
+	return values, su
+}
+
+func (dev *Device) fillAWSUpdateData(t time.Time, d *msgAWSShadowUpdateData) bool {
 	dr := &dev.Reported
 
 	su := false // whether any of the fields in StatusEvent was updated
 
-	ts := msgUpdTS{int(t.Unix())}
 	if dr.Connected.wasUpdatedAt(t) {
 		d.Connected = &dr.Connected.Value
-		m.Connected = &ts
+		su = true
 	}
 	if dr.Cooling.wasUpdatedAt(t) {
 		d.Cooling = &dr.Cooling.Value
-		m.Cooling = &ts
+		su = true
 	}
 	if dr.Door.wasUpdatedAt(t) {
 		d.Door = &dr.Door.Value
-		m.Door = &ts
 		su = true
 	}
 	if dr.EC.wasUpdatedAt(t) {
 		d.EC = &dr.EC.Value
-		m.EC = &ts
 		su = true
 	}
 	if dr.FirmwareNCU.wasUpdatedAt(t) {
 		d.FirmwareNCU = &dr.FirmwareNCU.Value
-		m.FirmwareNCU = &ts
 	}
 	if dr.HumidA.wasUpdatedAt(t) {
 		d.HumidA = &dr.HumidA.Value
-		m.HumidA = &ts
 		su = true
 	}
 	if dr.HumidB.wasUpdatedAt(t) {
 		d.HumidB = &dr.HumidB.Value
-		m.HumidB = &ts
 		su = true
 	}
 	if dr.LightA.wasUpdatedAt(t) {
 		d.LightA = &dr.LightA.Value
-		m.LightA = &ts
 		su = true
 	}
 	if dr.LightB.wasUpdatedAt(t) {
 		d.LightB = &dr.LightB.Value
-		m.LightB = &ts
 		su = true
 	}
 	if dr.Mode.wasUpdatedAt(t) {
 		d.Mode = &dr.Mode.Value
-		m.Mode = &ts
 		su = true
 	}
 	if dr.RecipeID.wasUpdatedAt(t) {
 		d.RecipeID = &dr.RecipeID.Value
-		m.RecipeID = &ts
 	}
 	if dr.TankLevel.wasUpdatedAt(t) {
 		d.TankLevel = &dr.TankLevel.Value
-		m.TankLevel = &ts
 		su = true
 	}
 	if dr.TankLevelRaw.wasUpdatedAt(t) {
 		d.TankLevelRaw = &dr.TankLevelRaw.Value
-		m.TankLevelRaw = &ts
 	}
 	if dr.TempA.wasUpdatedAt(t) {
 		d.TempA = &dr.TempA.Value
-		m.TempA = &ts
 		su = true
 	}
 	if dr.TempB.wasUpdatedAt(t) {
 		d.TempB = &dr.TempB.Value
-		m.TempB = &ts
 		su = true
 	}
 	if dr.TempTank.wasUpdatedAt(t) {
 		d.TempTank = &dr.TempTank.Value
-		m.TempTank = &ts
 		su = true
 	}
 	if dr.TotalOffset.wasUpdatedAt(t) {
 		d.TotalOffset = &dr.TotalOffset.Value
-		m.TotalOffset = &ts
 	}
 	if dr.Valve.wasUpdatedAt(t) {
 		d.Valve = &dr.Valve.Value
-		m.Valve = &ts
 		su = true
 	}
 	if dr.WifiLevel.wasUpdatedAt(t) {
 		d.WifiLevel = &dr.WifiLevel.Value
-		m.WifiLevel = &ts
+		su = true
 	}
 	return su
 }
-
-// Example: {"version":944757,"timestamp":1687710613,"state":{"recipe_id":1687710613},"metadata":{"recipe_id":{"timestamp":1687710613}}}
-type msgAWSShadowUpdateDeltaReply struct {
-	Version   int                        `json:"version"`
-	Timestamp int                        `json:"timestamp"`
-	State     msgAWSShadowUpdateData     `json:"state"`
-	Metadata  msgAWSShadowUpdateMetadata `json:"metadata"`
-}
-
-func (m *msgAWSShadowUpdateDeltaReply) topic() string {
-	return MQTT_TOPIC_AWS_UPDATE_DELTA
-}
-
-func (d *Device) getAWSShadowUpdateDeltaReply(deltaT, t time.Time) msgReply {
-	msg := msgAWSShadowUpdateDeltaReply{}
-	s := &msg.State
-	m := &msg.Metadata
-
-	msg.Version = d.AWSVersion
-	msg.Timestamp = int(t.Unix())
-	// Status won't be updated, ignore return.
-	_ = d.fillAWSUpdateDataMetadata(deltaT, s, m)
-	return &msg
-}
@@ -0,0 +1,106 @@
+package device
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/plant"
+)
+
+// NoticeType says what a Notice is about.
+type NoticeType string
+
+const (
+	NoticeOffline         NoticeType = "offline"
+	NoticeSensorStale     NoticeType = "sensor_stale"
+	NoticeDoorOpen        NoticeType = "door_open"
+	NoticeTankEmpty       NoticeType = "tank_empty"
+	NoticeNutrientWanted  NoticeType = "nutrient_wanted"
+	NoticeHarvestDue      NoticeType = "harvest_due"
+	NoticeFirmwareWarning NoticeType = "firmware_warning"
+	NoticeCleaningStuck   NoticeType = "cleaning_stuck"
+	NoticeCommandFailed   NoticeType = "command_failed"
+)
+
+// A Notice tells the user about something that's gone wrong with a
+// device (Active) or has stopped being wrong (!Active). Notices are
+// only sent when something changes, not repeatedly while a problem
+// persists.
+type Notice struct {
+	DeviceID string
+	Type     NoticeType
+	// Which slot, sensor or command the notice is about, for types
+	// that can have several active at once. Empty otherwise.
+	Subject string
+	Active  bool
+	Time    time.Time
+	Message string
+}
+
+var noticeHandler func(Notice)
+
+// SetNoticeHandler sets the function that's called for every
+// Notice. It's called from the device's processing goroutine, so it
+// shouldn't block for long.
+func SetNoticeHandler(h func(Notice)) {
+	noticeHandler = h
+}
+
+func (d *Device) notify(t NoticeType, subject string, active bool, msg string) {
+	if noticeHandler == nil {
+		return
+	}
+	noticeHandler(Notice{
+		DeviceID: d.ID,
+		Type:     t,
+		Subject:  subject,
+		Active:   active,
+		Time:     d.clock.Now(),
+		Message:  msg,
+	})
+}
+
+// checkConditions notifies about changes in conditions that we work
+// out from the device's state, rather than being told about them by
+// a specific message.
+func (d *Device) checkConditions() {
+	if d.conditions == nil {
+		d.conditions = make(map[string]bool)
+	}
+	d.checkCondition(string(NoticeTankEmpty), NoticeTankEmpty, "",
+		!d.Reported.TankLevel.Time.IsZero() && d.Reported.TankLevel.Value == 0,
+		"The water tank is empty", "The water tank has been refilled")
+	d.checkCondition(string(NoticeNutrientWanted), NoticeNutrientWanted, "",
+		d.WantNutrient > 0,
+		fmt.Sprintf("Please add %dml of nutrient", d.WantNutrient), "Nutrient has been added")
+
+	now := d.clock.Now()
+	for l, slots := range d.Slots {
+		for s, sl := range slots {
+			id := string(l) + strconv.Itoa(int(s))
+			due := sl.Plant != 0 && !sl.HarvestFrom.IsZero() && !now.Before(sl.HarvestFrom)
+			name := "The plant"
+			if due {
+				if p, err := plant.Get(sl.Plant); err == nil {
+					name = p.Names["de"] // TODO: language
+				}
+			}
+			d.checkCondition(string(NoticeHarvestDue)+" "+id, NoticeHarvestDue, id, due,
+				fmt.Sprintf("%s in slot %s can be harvested, at the latest by %s", name, id, sl.HarvestBy.Local().Format("2006-01-02")),
+				fmt.Sprintf("Slot %s has been harvested", id))
+		}
+	}
+}
+
+func (d *Device) checkCondition(key string, t NoticeType, subject string, active bool, activeMsg, resolvedMsg string) {
+	if d.conditions[key] == active {
+		return
+	}
+	d.conditions[key] = active
+	if active {
+		d.notify(t, subject, true, activeMsg)
+	} else {
+		d.notify(t, subject, false, resolvedMsg)
+	}
+}
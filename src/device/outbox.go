@@ -0,0 +1,169 @@
+package device
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/shadow"
+)
+
+// Everything we send a device goes through its outbox. Messages are
+// published in order, and one that can't be published stays in the
+// outbox, along with everything after it, until it can be. The outbox
+// is saved with the device, so nothing's lost across restarts.
+
+const (
+	// OUTBOX_RETRY_MIN is how long after a failed publish we
+	// first try again. It doubles with each failure, up to
+	// OUTBOX_RETRY_MAX.
+	OUTBOX_RETRY_MIN = 5 * time.Second
+	OUTBOX_RETRY_MAX = 5 * time.Minute
+
+	// OUTBOX_LIMIT is how many messages can be waiting. Past
+	// that, the oldest are dropped.
+	OUTBOX_LIMIT = 100
+)
+
+// msgReplySuperseding is a reply that makes any unsent earlier reply
+// with the same key pointless, so replaces it.
+type msgReplySuperseding interface {
+	msgReply
+	supersedes() string
+}
+
+// outboundMsg is a message that's waiting to be published.
+type outboundMsg struct {
+	Topic     string
+	Payload   []byte
+	Key       string `json:",omitempty"`
+	Queued    time.Time
+	Attempts  int    `json:",omitempty"`
+	LastError string `json:",omitempty"`
+}
+
+// OutboxStatus is what we tell the frontend about messages that
+// haven't been published yet.
+type OutboxStatus struct {
+	Pending   int
+	Oldest    time.Time
+	Attempts  int
+	LastError string
+}
+
+func (m *msgAWSShadowUpdateDeltaReply) supersedes() string {
+	return "delta:" + deltaFields(m.Delta)
+}
+
+func (m *msgAglShadowGetAccepted) supersedes() string {
+	return "agl-shadow-get"
+}
+
+func (m *msgAglRPCPut) supersedes() string {
+	return "rpc:" + m.Cmd
+}
+
+func (r *recipe) supersedes() string {
+	return "recipe"
+}
+
+// deltaFields lists the fields a delta is about, so that a delta
+// only replaces one about exactly the same fields.
+func deltaFields(d *shadow.Delta) string {
+	var l []string
+	for f := range d.State {
+		l = append(l, f)
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+// enqueue adds a message to the outbox, replacing any unsent message
+// it supersedes.
+func (d *Device) enqueue(topic string, payload []byte, key string) {
+	if key != "" {
+		for i, m := range d.Outbox {
+			if m.Key == key {
+				log.Info.Printf("Device '%s' unsent message to '%s' superseded", d.ID, m.Topic)
+				d.Outbox = append(d.Outbox[:i], d.Outbox[i+1:]...)
+				break
+			}
+		}
+	}
+	d.Outbox = append(d.Outbox, &outboundMsg{
+		Topic:   topic,
+		Payload: payload,
+		Key:     key,
+		Queued:  d.clock.Now(),
+	})
+	if len(d.Outbox) > OUTBOX_LIMIT {
+		m := d.Outbox[0]
+		log.Error.Printf("Device '%s' outbox full, dropping message to '%s' queued %v", d.ID, m.Topic, m.Queued)
+		d.Outbox = d.Outbox[1:]
+	}
+}
+
+// flushOutbox publishes everything in the outbox, stopping at the
+// first failure. If anything's left, a retry is scheduled.
+func (d *Device) flushOutbox() {
+	for len(d.Outbox) > 0 {
+		m := d.Outbox[0]
+		m.Attempts++
+		err := d.publisher.Publish(m.Topic, m.Payload)
+		if err != nil {
+			m.LastError = err.Error()
+			retry := OUTBOX_RETRY_MIN << (m.Attempts - 1)
+			if retry > OUTBOX_RETRY_MAX || retry <= 0 {
+				retry = OUTBOX_RETRY_MAX
+			}
+			log.Warn.Printf("Device '%s' failed publishing to '%s' (attempt %d), %d message(s) waiting, retrying in %v: %v", d.ID, m.Topic, m.Attempts, len(d.Outbox), retry, err)
+			d.outboxTimer.Reset(retry)
+			d.outboxStuck = true
+			d.QueueSave()
+			d.streamStatusUpdate()
+			return
+		}
+		if m.Attempts > 1 {
+			log.Info.Printf("Device '%s' published to '%s' after %d attempts, queued %v", d.ID, m.Topic, m.Attempts, m.Queued)
+		}
+		d.Outbox = d.Outbox[1:]
+	}
+	d.Outbox = nil
+	if d.outboxStuck {
+		d.outboxStuck = false
+		d.outboxTimer.Stop()
+		d.QueueSave()
+		d.streamStatusUpdate()
+	}
+}
+
+// initOutbox schedules sending anything that was waiting when the
+// device was saved.
+func (d *Device) initOutbox() {
+	if len(d.Outbox) > 0 {
+		log.Info.Printf("Device '%s' has %d unsent message(s), retrying", d.ID, len(d.Outbox))
+		d.outboxStuck = true
+		d.outboxTimer.Reset(0)
+	}
+}
+
+func (d *Device) getOutboxStatus() *OutboxStatus {
+	if len(d.Outbox) == 0 {
+		return nil
+	}
+	m := d.Outbox[0]
+	return &OutboxStatus{
+		Pending:   len(d.Outbox),
+		Oldest:    m.Queued,
+		Attempts:  m.Attempts,
+		LastError: m.LastError,
+	}
+}
+
+// RetryOutboxes tries again to publish every device's unsent
+// messages, for when the MQTT connection's back.
+func RetryOutboxes() {
+	for _, d := range loadedDevices() {
+		d.post(d.flushOutbox)
+	}
+}
@@ -0,0 +1,97 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+	"github.com/Jon-Bright/plantprism/shadow"
+)
+
+// flakyPublisher fails while it's down, and otherwise records what's
+// published.
+type flakyPublisher struct {
+	down   bool
+	topics []string
+}
+
+func (p *flakyPublisher) Publish(topic string, payload []byte) error {
+	if p.down {
+		return errors.New("not connected")
+	}
+	p.topics = append(p.topics, topic)
+	return nil
+}
+
+func TestOutbox(t *testing.T) {
+	log = logs.Discard()
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1687685000, 0))
+	p := &flakyPublisher{down: true}
+	d := Device{ID: "test", clock: mock, publisher: p}
+	d.saveTimer = mock.AfterFunc(time.Hour, func() {})
+	d.saveTimer.Stop()
+	d.outboxTimer = mock.AfterFunc(time.Hour, d.flushOutbox)
+	d.outboxTimer.Stop()
+
+	recipeDelta := func(id int) msgReply {
+		return &msgAWSShadowUpdateDeltaReply{&shadow.Delta{
+			State: map[string]json.RawMessage{"recipe_id": jsonValue(id)},
+		}}
+	}
+	for _, r := range []msgReply{recipeDelta(1), getAglRPCPutWatering(layerA), recipeDelta(2)} {
+		err := d.sendReplies([]msgReply{r})
+		if err != nil {
+			t.Fatalf("sendReplies failed: %v", err)
+		}
+	}
+	if len(p.topics) != 0 {
+		t.Fatalf("published %v while down", p.topics)
+	}
+	// The first recipe delta is superseded by the second
+	ob := d.getOutboxStatus()
+	if ob == nil || ob.Pending != 2 || ob.Attempts != 1 || ob.LastError != "not connected" {
+		t.Fatalf("got outbox status %+v, want 2 pending, 1 attempt, 'not connected'", ob)
+	}
+
+	// Unsent messages survive a save and restore
+	b, err := json.Marshal(&d)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var restored Device
+	err = json.Unmarshal(b, &restored)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(restored.Outbox) != len(d.Outbox) {
+		t.Fatalf("restored outbox %+v, want %+v", restored.Outbox, d.Outbox)
+	}
+	for i, got := range restored.Outbox {
+		// The time's location doesn't survive JSON, so it's
+		// compared separately.
+		want := *d.Outbox[i]
+		if !got.Queued.Equal(want.Queued) {
+			t.Errorf("restored message %d queued %v, want %v", i, got.Queued, want.Queued)
+		}
+		want.Queued = got.Queued
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("restored message %d %+v, want %+v", i, *got, want)
+		}
+	}
+
+	p.down = false
+	mock.Add(OUTBOX_RETRY_MAX)
+	want := []string{"agl/all/things/test/rpc/put", "$aws/things/test/shadow/update/delta"}
+	if !reflect.DeepEqual(p.topics, want) {
+		t.Errorf("published %v, want %v", p.topics, want)
+	}
+	if ob := d.getOutboxStatus(); ob != nil {
+		t.Errorf("got outbox status %+v after retry, want nothing pending", ob)
+	}
+}
@@ -545,7 +545,7 @@ func TestParseAWSShadowUpdate(t *testing.T) {
 	ts := time.Unix(1693243800, 0) // Any random timestamp will do
 	for _, tc := range tests {
 		msg := msgUnparsed{"", "", []byte(tc.input), ts}
-		got, err := parseAWSShadowUpdate(&msg)
+		got, _, err := parseAWSShadowUpdate(&msg, nil)
 		if tc.wantError != (err != nil) {
 			t.Fatalf("parsing '%s', wanted error %v, got %v", tc.input, tc.wantError, err)
 		}
@@ -0,0 +1,139 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// A single bad reading shouldn't cost us the rest of an update, so
+// values that are out of range are quarantined: they're left out of
+// the update, and kept in a list of suspicious readings for somebody
+// to look at.
+
+// maxSuspicious is how many suspicious readings we keep per device.
+// Older ones are dropped.
+const maxSuspicious = 100
+
+// FieldRange is the range of values, inclusive, that we believe for a
+// field.
+type FieldRange struct {
+	Min float64
+	Max float64
+}
+
+// defaultRanges are the ranges for fields a device doesn't have its
+// own range for. Only these fields can be configured.
+var defaultRanges = map[string]FieldRange{
+	// 30% humidity isn't technically an error, but it sure
+	// would be surprising
+	"humid_a":   {30, 100},
+	"humid_b":   {30, 100},
+	"temp_a":    {10, 40},
+	"temp_b":    {10, 40},
+	"temp_tank": {10, 40},
+	// 86400 = 1 day in seconds. Offset shouldn't exceed this.
+	"total_offset": {0, 86400},
+}
+
+func rangeFor(ranges map[string]FieldRange, field string) FieldRange {
+	if r, ok := ranges[field]; ok {
+		return r
+	}
+	return defaultRanges[field]
+}
+
+// outside returns a function saying whether a value is outside the
+// field's range.
+func outside[T int | floatDP](ranges map[string]FieldRange, field string) func(T) bool {
+	r := rangeFor(ranges, field)
+	return func(v T) bool {
+		return float64(v) < r.Min || float64(v) > r.Max
+	}
+}
+
+// quarantineField removes the value in *v if bad says it can't be
+// trusted, returning why.
+func quarantineField[T any](v **T, field string, bad func(T) bool, format string) *rejectError {
+	if *v == nil || !bad(**v) {
+		return nil
+	}
+	e := &rejectError{invalidValue(field), field, fmt.Sprintf(format, **v)}
+	*v = nil
+	return e
+}
+
+// SuspiciousReading is a value a device reported that we didn't
+// believe.
+type SuspiciousReading struct {
+	Field   string
+	Value   string // As the device sent it
+	Time    time.Time
+	Message string
+}
+
+// noteSuspicious adds quarantined values to the device's suspicious
+// readings. raw is the update's reported state, for the values as
+// they were sent.
+func (d *Device) noteSuspicious(raw map[string]json.RawMessage, q []*rejectError, t time.Time) {
+	if len(q) == 0 {
+		return
+	}
+	for _, e := range q {
+		sr := SuspiciousReading{
+			Field:   e.field,
+			Value:   string(raw[e.field]),
+			Time:    t,
+			Message: e.msg,
+		}
+		log.Warn.Printf("Device '%s' quarantined %s=%s: %s", d.ID, sr.Field, sr.Value, sr.Message)
+		d.suspicious = append(d.suspicious, sr)
+	}
+	if len(d.suspicious) > maxSuspicious {
+		d.suspicious = slices.Clone(d.suspicious[len(d.suspicious)-maxSuspicious:])
+	}
+	d.streamStatusUpdate()
+}
+
+// SuspiciousReadings returns the values the device reported that
+// were quarantined, oldest first.
+func (d *Device) SuspiciousReadings() []SuspiciousReading {
+	var l []SuspiciousReading
+	d.do(func() {
+		l = slices.Clone(d.suspicious)
+	})
+	return l
+}
+
+// SetFieldRange sets the range of values we believe for a field on
+// this device.
+func (d *Device) SetFieldRange(field string, r FieldRange) error {
+	if _, ok := defaultRanges[field]; !ok {
+		return fmt.Errorf("field '%s' has no configurable range", field)
+	}
+	if r.Min > r.Max {
+		return fmt.Errorf("range minimum %v is above maximum %v", r.Min, r.Max)
+	}
+	d.do(func() {
+		if d.Ranges == nil {
+			d.Ranges = make(map[string]FieldRange)
+		}
+		d.Ranges[field] = r
+		d.QueueSave()
+	})
+	return nil
+}
+
+// FieldRanges returns the range for every configurable field, whether
+// it's the default or the device's own.
+func (d *Device) FieldRanges() map[string]FieldRange {
+	rs := make(map[string]FieldRange, len(defaultRanges))
+	d.do(func() {
+		for f := range defaultRanges {
+			rs[f] = rangeFor(d.Ranges, f)
+		}
+	})
+	return rs
+}
@@ -0,0 +1,66 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestQuarantine(t *testing.T) {
+	log = logs.Discard()
+	t1 := time.Unix(1691777930, 0)
+	mock := clock.NewMock()
+	d := Device{ClientToken: "12345678"}
+	d.saveTimer = mock.AfterFunc(time.Hour, func() {})
+	d.saveTimer.Stop()
+
+	// One bad value doesn't lose the others
+	msg := `{"clientToken":"12345678","state":{"reported":{"humid_b":29,"temp_a":22.5,"door":true,"light_b":false}}}`
+	replies, err := d.processAWSShadowUpdate(&msgUnparsed{content: []byte(msg), t: t1})
+	if err != nil {
+		t.Fatalf("processAWSShadowUpdate failed: %v", err)
+	}
+	if len(replies) == 0 || replies[0].topic() != MQTT_TOPIC_AWS_UPDATE_ACCEPTED {
+		t.Errorf("got replies %+v, want accepted", replies)
+	}
+	dr := &d.Reported
+	if dr.TempA.Value != 22.5 || !dr.Door.Value || !dr.LightB.wasUpdatedAt(t1) || dr.HumidB.wasUpdatedAt(t1) {
+		t.Errorf("got reported %+v, want temp_a, door and light_b but not humid_b", dr)
+	}
+	want := []SuspiciousReading{{"humid_b", "29", t1, "humidity B out of range: 29"}}
+	if got := d.SuspiciousReadings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got suspicious readings %+v, want %+v", got, want)
+	}
+	if len(d.Rejections()) != 0 {
+		t.Errorf("got rejections %+v, want none", d.Rejections())
+	}
+
+	// With a wider range, the same value is believed
+	err = d.SetFieldRange("humid_b", FieldRange{20, 100})
+	if err != nil {
+		t.Fatalf("SetFieldRange failed: %v", err)
+	}
+	t2 := t1.Add(time.Minute)
+	msg = `{"clientToken":"12345678","state":{"reported":{"humid_b":29}}}`
+	_, err = d.processAWSShadowUpdate(&msgUnparsed{content: []byte(msg), t: t2})
+	if err != nil {
+		t.Fatalf("processAWSShadowUpdate failed: %v", err)
+	}
+	if dr.HumidB.Value != 29 || len(d.SuspiciousReadings()) != 1 {
+		t.Errorf("with a wider range, got humid_b %d, %d suspicious readings, want 29, 1", dr.HumidB.Value, len(d.SuspiciousReadings()))
+	}
+	if r := d.FieldRanges(); r["humid_b"] != (FieldRange{20, 100}) || r["humid_a"] != (FieldRange{30, 100}) {
+		t.Errorf("got ranges %+v", r)
+	}
+
+	if d.SetFieldRange("valve", FieldRange{0, 1}) == nil {
+		t.Errorf("set a range for a field that has none")
+	}
+	if d.SetFieldRange("temp_a", FieldRange{30, 20}) == nil {
+		t.Errorf("set an inverted range")
+	}
+}
@@ -0,0 +1,90 @@
+package device
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/shadow"
+	"golang.org/x/exp/maps"
+)
+
+// RejectReason says why a shadow update was rejected. Invalid values
+// and unexpected fields have a reason per field, so that a flaky
+// sensor can be told apart from a confused device.
+type RejectReason string
+
+const (
+	RejectMalformed   RejectReason = "malformed"
+	RejectEmpty       RejectReason = "empty"
+	RejectDesired     RejectReason = "desired_state"
+	RejectClientToken RejectReason = "client_token"
+)
+
+func invalidValue(field string) RejectReason {
+	return RejectReason("invalid_value:" + field)
+}
+
+func unexpectedField(field string) RejectReason {
+	return RejectReason("unexpected_field:" + field)
+}
+
+// rejectError is a reason to reject an update, with the message to
+// send back to the device.
+type rejectError struct {
+	reason RejectReason
+	field  string // If the reason is an invalid value
+	msg    string
+}
+
+func (e *rejectError) Error() string {
+	return e.msg
+}
+
+func rejectErrorf(reason RejectReason, format string, a ...any) error {
+	return &rejectError{reason, "", fmt.Sprintf(format, a...)}
+}
+
+func badRequest(msg string) *shadow.Error {
+	return &shadow.Error{Code: shadow.CodeBadRequest, Message: msg}
+}
+
+// RejectionStats counts the updates rejected for one reason.
+type RejectionStats struct {
+	Count       int
+	First       time.Time
+	Last        time.Time
+	LastMessage string
+}
+
+// rejectAWSShadowUpdate counts the rejection and returns the reply
+// for .../shadow/update/rejected.
+func (d *Device) rejectAWSShadowUpdate(req *shadow.Request, reason RejectReason, serr *shadow.Error, t time.Time) []msgReply {
+	log.Warn.Printf("Rejecting shadow update from device '%s' (%s): %v", d.ID, reason, serr)
+	if d.rejections == nil {
+		d.rejections = make(map[RejectReason]RejectionStats)
+	}
+	rs := d.rejections[reason]
+	if rs.Count == 0 {
+		rs.First = t
+	}
+	rs.Count++
+	rs.Last = t
+	rs.LastMessage = serr.Message
+	d.rejections[reason] = rs
+
+	clientToken := ""
+	if req != nil {
+		clientToken = req.ClientToken
+	}
+	return []msgReply{&msgAWSShadowUpdateRejectedReply{serr.Rejected(t, clientToken)}}
+}
+
+// Rejections returns how many shadow updates have been rejected since
+// startup, per reason.
+func (d *Device) Rejections() map[RejectReason]RejectionStats {
+	var rs map[RejectReason]RejectionStats
+	d.do(func() {
+		rs = maps.Clone(d.rejections)
+	})
+	return rs
+}
@@ -0,0 +1,52 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestRejectionStats(t *testing.T) {
+	log = logs.Discard()
+	t1 := time.Unix(1691777930, 0)
+	t2 := time.Unix(1691777990, 0)
+	tests := []struct {
+		msg        string
+		t          time.Time
+		wantReason RejectReason
+	}{
+		{`{"clientToken":"12345678","state":`, t1, RejectMalformed},
+		{`{"clientToken":"12345678","state":{"desired":{"mode":8}}}`, t1, RejectDesired},
+		{`{"clientToken":"12345678","state":{"reported":{"mode":8}}}`, t1, "unexpected_field:mode"},
+		{`{"clientToken":"12345678","state":{"reported":{"humid_b":29}}}`, t1, "invalid_value:humid_b"},
+		{`{"clientToken":"12345678","state":{"reported":{"humid_b":101}}}`, t2, "invalid_value:humid_b"},
+		{`{"clientToken":"1234","state":{"reported":{"temp_a":22.5}}}`, t2, RejectClientToken},
+		{`{"clientToken":"12345678","state":{"reported":{"unknown":1}}}`, t2, RejectEmpty},
+	}
+	d := Device{ClientToken: "12345678"}
+	for _, tc := range tests {
+		replies, err := d.processAWSShadowUpdate(&msgUnparsed{content: []byte(tc.msg), t: tc.t})
+		if err != nil {
+			t.Fatalf("'%s': processAWSShadowUpdate failed: %v", tc.msg, err)
+		}
+		if len(replies) != 1 || replies[0].topic() != MQTT_TOPIC_AWS_UPDATE_REJECTED {
+			t.Errorf("'%s': got replies %+v, want one rejection", tc.msg, replies)
+		}
+		if _, ok := d.Rejections()[tc.wantReason]; !ok {
+			t.Errorf("'%s': no rejection counted for %s", tc.msg, tc.wantReason)
+		}
+	}
+
+	rs := d.Rejections()
+	if len(rs) != 6 {
+		t.Errorf("got %d reasons, want 6: %+v", len(rs), rs)
+	}
+	want := RejectionStats{2, t1, t2, "humidity B out of range: 101"}
+	if got := rs["invalid_value:humid_b"]; got != want {
+		t.Errorf("got humid_b stats %+v, want %+v", got, want)
+	}
+	if d.Reported.TempA.Value != 0 || d.Reported.HumidB.Value != 0 {
+		t.Errorf("rejected updates changed temp_a to %v, humid_b to %v", d.Reported.TempA.Value, d.Reported.HumidB.Value)
+	}
+}
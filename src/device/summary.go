@@ -0,0 +1,129 @@
+package device
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Jon-Bright/plantprism/plant"
+)
+
+// maxNameLength is the longest friendly name a device can have, in
+// characters.
+const maxNameLength = 64
+
+// Harvest is a planted slot and when it can be harvested.
+type Harvest struct {
+	Slot        string
+	Plant       plant.PlantID
+	HarvestFrom time.Time
+	HarvestBy   time.Time
+}
+
+// Summary is the state of a device at a glance, for a page showing
+// several devices.
+type Summary struct {
+	ID string
+	// Set if the device couldn't be loaded, in which case only ID
+	// is too
+	Err      error
+	Name     string
+	Timezone string
+	// False if we've never heard from the device
+	Seen         bool
+	Online       bool
+	LastMessage  time.Time
+	Mode         DeviceMode
+	TankLevel    int
+	WantNutrient int
+	// Every planted slot, earliest harvest first
+	Harvests []Harvest
+}
+
+// Summaries returns a summary of every allowed device, in the order
+// they were allowed. Devices that haven't been loaded yet are loaded
+// first. One that can't be loaded still gets a summary, saying why,
+// so that it doesn't hide the others.
+func Summaries(p Publisher) []Summary {
+	var l []Summary
+	for _, id := range AllowedDevices() {
+		d, err := Get(id, p)
+		if err != nil {
+			log.Error.Printf("Failed to get device '%s' for summary: %v", id, err)
+			l = append(l, Summary{ID: id, Err: err})
+			continue
+		}
+		l = append(l, d.Summary())
+	}
+	return l
+}
+
+func (d *Device) Summary() Summary {
+	var s Summary
+	d.do(func() {
+		s = d.summary()
+	})
+	return s
+}
+
+func (d *Device) summary() Summary {
+	s := Summary{
+		ID:           d.ID,
+		Name:         d.Name,
+		Timezone:     d.Timezone,
+		Seen:         !d.live.lastMessage.IsZero(),
+		Online:       !d.live.offline,
+		LastMessage:  d.live.lastMessage,
+		Mode:         d.Reported.Mode.Value,
+		TankLevel:    d.Reported.TankLevel.Value,
+		WantNutrient: d.WantNutrient,
+	}
+	for layer, slots := range d.Slots {
+		for slotID, sl := range slots {
+			if sl.Plant == 0 {
+				continue
+			}
+			s.Harvests = append(s.Harvests, Harvest{
+				Slot:        fmt.Sprintf("%s%d", layer, slotID),
+				Plant:       sl.Plant,
+				HarvestFrom: sl.HarvestFrom,
+				HarvestBy:   sl.HarvestBy,
+			})
+		}
+	}
+	sort.Slice(s.Harvests, func(i, j int) bool {
+		hi, hj := s.Harvests[i], s.Harvests[j]
+		if !hi.HarvestFrom.Equal(hj.HarvestFrom) {
+			return hi.HarvestFrom.Before(hj.HarvestFrom)
+		}
+		return hi.Slot < hj.Slot
+	})
+	return s
+}
+
+// DisplayName is the device's friendly name, or its ID if it hasn't
+// got one.
+func (d *Device) DisplayName() string {
+	name := d.ID
+	d.do(func() {
+		if d.Name != "" {
+			name = d.Name
+		}
+	})
+	return name
+}
+
+// SetName sets the device's friendly name. An empty name removes it.
+func (d *Device) SetName(name string) error {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return fmt.Errorf("name is longer than %d characters", maxNameLength)
+	}
+	d.do(func() {
+		d.Name = name
+		d.QueueSave()
+	})
+	return nil
+}
@@ -0,0 +1,78 @@
+package device
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestSummary(t *testing.T) {
+	mock := clock.NewMock()
+	t1 := time.Unix(1691777930, 0)
+	d := Device{ID: "test", clock: mock}
+	d.saveTimer = mock.AfterFunc(time.Hour, func() {})
+	d.saveTimer.Stop()
+
+	s := d.Summary()
+	if s.Seen || s.Name != "" || len(s.Harvests) != 0 || d.DisplayName() != "test" {
+		t.Errorf("new device, got summary %+v, display name %s", s, d.DisplayName())
+	}
+
+	d.live.lastMessage = t1
+	d.WantNutrient = 15
+	d.Reported.TankLevel.update(2, t1)
+	d.Slots = map[layerID]map[slotID]slot{
+		layerA: {slot3: {Plant: 104, HarvestFrom: t1.Add(72 * time.Hour)}, slot4: {}},
+		layerB: {slot5: {Plant: 105, HarvestFrom: t1.Add(24 * time.Hour)}, slot1: {Plant: 104, HarvestFrom: t1.Add(72 * time.Hour)}},
+	}
+	err := d.SetName("  Kitchen ")
+	if err != nil {
+		t.Fatalf("SetName failed: %v", err)
+	}
+	s = d.Summary()
+	if !s.Seen || s.Name != "Kitchen" || s.TankLevel != 2 || s.WantNutrient != 15 || d.DisplayName() != "Kitchen" {
+		t.Errorf("got summary %+v", s)
+	}
+	var slots []string
+	for _, h := range s.Harvests {
+		slots = append(slots, h.Slot)
+	}
+	if got := strings.Join(slots, ","); got != "b5,a3,b1" {
+		t.Errorf("got harvests in order %s, want b5,a3,b1", got)
+	}
+
+	if d.SetName(strings.Repeat("x", 65)) == nil || d.Name != "Kitchen" {
+		t.Errorf("set an overlong name")
+	}
+}
+
+func TestSummariesFailedDevice(t *testing.T) {
+	log = logs.Discard()
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1691777930, 0))
+	prevClk, prevMap, prevAllowed, prevTestMode, prevDataDir := clk, deviceMap, allowedDevices, testMode, dataDir
+	defer func() {
+		clk, deviceMap, allowedDevices, testMode, dataDir = prevClk, prevMap, prevAllowed, prevTestMode, prevDataDir
+	}()
+	clk = mock
+	testMode = false
+	deviceMap = nil
+	dataDir = t.TempDir()
+	allowedDevices = deviceList{"broken", "fine"}
+	defer SetAllowedDevices(nil) // Stops fine
+	err := os.WriteFile(filepath.Join(dataDir, "plantcube-broken.json"), []byte("{"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	l := Summaries(&countingPublisher{})
+	if len(l) != 2 || l[0].ID != "broken" || l[0].Err == nil || l[1].ID != "fine" || l[1].Err != nil {
+		t.Errorf("got summaries %+v, want an error for broken and a summary for fine", l)
+	}
+}
@@ -0,0 +1,177 @@
+package device
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// MQTT messages arrive on the MQTT client's goroutine, which mustn't
+// wait on any one device. Each device queues its messages, and when
+// the queue is full, the oldest message is dropped to make room: the
+// Plantcube repeats itself often enough that the latest news is
+// worth more than the oldest. The processing loop is supervised: if
+// it panics, the panic is recorded and the loop restarted.
+
+// Metrics describes how a device's processing loop is keeping up.
+type Metrics struct {
+	QueueDepth    int
+	QueueCapacity int
+	Received      uint64
+	Dropped       uint64
+	Processed     uint64
+
+	// Latency is from a message being received to it having been
+	// processed.
+	LastLatency time.Duration
+	AvgLatency  time.Duration
+	MaxLatency  time.Duration
+
+	Restarts      int
+	LastPanic     string
+	LastPanicTime time.Time
+}
+
+// loopStats has its own lock, rather than belonging to the processing
+// loop, so that it can still be read when the loop is stuck.
+type loopStats struct {
+	mu           sync.Mutex
+	m            Metrics
+	totalLatency time.Duration
+}
+
+func (s *loopStats) received() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.Received++
+}
+
+func (s *loopStats) dropped() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.Dropped++
+}
+
+func (s *loopStats) processed(latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.Processed++
+	s.m.LastLatency = latency
+	s.totalLatency += latency
+	s.m.AvgLatency = s.totalLatency / time.Duration(s.m.Processed)
+	if latency > s.m.MaxLatency {
+		s.m.MaxLatency = latency
+	}
+}
+
+func (s *loopStats) panicked(p string, t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m.Restarts++
+	s.m.LastPanic = p
+	s.m.LastPanicTime = t
+}
+
+// Metrics returns how the device's processing loop is keeping up. It
+// doesn't need the loop, so works even if the loop is stuck.
+func (d *Device) Metrics() Metrics {
+	var m Metrics
+	if d.stats != nil {
+		d.stats.mu.Lock()
+		m = d.stats.m
+		d.stats.mu.Unlock()
+	}
+	m.QueueDepth = len(d.msgQueue)
+	m.QueueCapacity = cap(d.msgQueue)
+	return m
+}
+
+// AllMetrics returns the metrics of every device that's been loaded,
+// by device ID.
+func AllMetrics() map[string]Metrics {
+	l := loadedDevices()
+	m := make(map[string]Metrics, len(l))
+	for _, d := range l {
+		m[d.ID] = d.Metrics()
+	}
+	return m
+}
+
+// ProcessMessage queues a message for the processing loop. It never
+// waits: if the queue is full, the oldest queued message is dropped.
+func (d *Device) ProcessMessage(prefix string, event string, content []byte) {
+	msg := &msgUnparsed{prefix, event, content, d.clock.Now()}
+	d.stats.received()
+	for {
+		select {
+		case d.msgQueue <- msg:
+			return
+		default:
+		}
+		select {
+		case old := <-d.msgQueue:
+			d.stats.dropped()
+			log.Warn.Printf("Device '%s' queue full, dropped '%s' '%s' message received %v", d.ID, old.prefix, old.event, old.t)
+		default:
+			// The loop took one in the meantime
+		}
+	}
+}
+
+// supervise runs the processing loop, restarting it whenever it
+// panics.
+func (d *Device) supervise() {
+	for !d.runLoop() {
+	}
+}
+
+// stop ends the processing loop, first saving anything that's waiting
+// to be saved. Its timers are stopped too, so a stopped device doesn't
+// notify, retry commands or publish anything more. Whatever is handed
+// to it afterwards is dropped. A device without a processing loop
+// has nothing to stop.
+func (d *Device) stop() {
+	if d.actions == nil {
+		return
+	}
+	d.do(func() {
+		for _, t := range []*clock.Timer{d.recipeTimer, d.wateringTimer, d.livenessTimer, d.doorTimer, d.cleaningTimer, d.commandTimer, d.outboxTimer} {
+			t.Stop()
+		}
+		if d.saveTimer.Stop() {
+			d.queuedSave()
+		}
+		close(d.stopped)
+	})
+}
+
+// runLoop runs the processing loop until it panics, returning false
+// if it did.
+func (d *Device) runLoop() (ok bool) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		ps := fmt.Sprint(p)
+		d.stats.panicked(ps, d.clock.Now())
+		log.Error.Printf("Device '%s' processing loop panicked, restarting: %s\n%s", d.ID, ps, debug.Stack())
+	}()
+	d.processingLoop()
+	return true
+}
@@ -0,0 +1,64 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+func TestProcessMessageDropsOldest(t *testing.T) {
+	log = logs.Discard()
+	d := Device{
+		ID:       "drop-test",
+		clock:    clock.NewMock(),
+		msgQueue: make(chan *msgUnparsed, 2),
+		stats:    &loopStats{},
+	}
+	for _, e := range []string{"first", "second", "third"} {
+		d.ProcessMessage("agl/prod", e, nil)
+	}
+	m := d.Metrics()
+	if m.Received != 3 || m.Dropped != 1 || m.QueueDepth != 2 || m.QueueCapacity != 2 {
+		t.Errorf("got metrics %+v, want 3 received, 1 dropped, depth 2, capacity 2", m)
+	}
+	for _, want := range []string{"second", "third"} {
+		if got := (<-d.msgQueue).event; got != want {
+			t.Errorf("got queued event '%s', want '%s'", got, want)
+		}
+	}
+}
+
+func TestSupervision(t *testing.T) {
+	log = logs.Discard()
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1691777930, 0))
+	prevClk, prevMap, prevAllowed, prevTestMode := clk, deviceMap, allowedDevices, testMode
+	defer func() {
+		clk, deviceMap, allowedDevices, testMode = prevClk, prevMap, prevAllowed, prevTestMode
+	}()
+	clk = mock
+	testMode = true
+	deviceMap = nil
+	const id = "supervision-test"
+	allowedDevices = deviceList{id}
+
+	d, err := Get(id, &countingPublisher{})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	d.do(func() {
+		panic("boom")
+	})
+	// The restarted loop still works
+	d.SetName("Restarted")
+	if got := d.DisplayName(); got != "Restarted" {
+		t.Errorf("got name '%s' after restart, want 'Restarted'", got)
+	}
+	m := d.Metrics()
+	if m.Restarts != 1 || m.LastPanic != "boom" || !m.LastPanicTime.Equal(mock.Now()) {
+		t.Errorf("got restarts %d, last panic '%s' at %v, want 1, 'boom' at %v", m.Restarts, m.LastPanic, m.LastPanicTime, mock.Now())
+	}
+}
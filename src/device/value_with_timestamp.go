@@ -19,6 +19,10 @@ func (vwt valueWithTimestamp[T]) wasUpdatedAt(t time.Time) bool {
 	return vwt.Time == t
 }
 
+func (vwt valueWithTimestamp[T]) updatedAt() time.Time {
+	return vwt.Time
+}
+
 func (vwt valueWithTimestamp[T]) MarshalJSON() ([]byte, error) {
 	if vwt.Time.IsZero() {
 		return []byte("{}"), nil
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/broker"
+	"github.com/Jon-Bright/plantprism/device"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// TestEmbeddedBroker connects a Plantcube stand-in to the embedded
+// broker and checks that the device answers it.
+func TestEmbeddedBroker(t *testing.T) {
+	const id = "00000000-0000-4000-8000-0000000000bb"
+	prevAllowed, prevPublisher := device.AllowedDevices(), publisher
+	defer func() {
+		// This stops and forgets the device, so the next run
+		// loads it afresh, with the next run's publisher.
+		device.SetAllowedDevices(prevAllowed)
+		publisher = prevPublisher
+	}()
+	device.SetAllowedDevices(append(prevAllowed, id))
+
+	b := broker.New(log, broker.Options{
+		Handler: handleMessage,
+		OnSubscribe: func(string) {
+			device.RetryOutboxes()
+		},
+	})
+	publisher = b
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go b.Serve(ln)
+	defer b.Close()
+
+	opts := paho.NewClientOptions().
+		AddBroker("tcp://" + ln.Addr().String()).
+		SetClientID(id).
+		SetAutoReconnect(false)
+	cube := paho.NewClient(opts)
+	tok := cube.Connect()
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("Connect failed: %v", tok.Error())
+	}
+	defer cube.Disconnect(0)
+
+	replies := make(chan paho.Message, 5)
+	tok = cube.Subscribe("agl/all/things/"+id+"/shadow/get/accepted", 1, func(c paho.Client, m paho.Message) {
+		replies <- m
+	})
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("Subscribe failed: %v", tok.Error())
+	}
+	tok = cube.Publish("agl/all/things/"+id+"/shadow/get", 1, false, "")
+	if !tok.WaitTimeout(5*time.Second) || tok.Error() != nil {
+		t.Fatalf("Publish failed: %v", tok.Error())
+	}
+	select {
+	case m := <-replies:
+		if len(m.Payload()) == 0 {
+			t.Errorf("got empty shadow get reply")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no shadow get reply")
+	}
+}
@@ -0,0 +1,233 @@
+package eventlog
+
+// A persistent, per-device log of the events (warnings and infos)
+// that Plantcubes send us.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+	SeverityOutOfRange
+)
+
+var severityNames = []string{"info", "warning", "error"}
+
+func (s Severity) String() string {
+	if s < 0 || s >= SeverityOutOfRange {
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	if s < 0 || s >= SeverityOutOfRange {
+		return nil, fmt.Errorf("severity %d out of range", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+func (s *Severity) UnmarshalText(b []byte) error {
+	v, err := ParseSeverity(string(b))
+	if err != nil {
+		return err
+	}
+	*s = v
+	return nil
+}
+
+// ParseSeverity parses a severity name. An empty string is
+// SeverityInfo, i.e. everything.
+func ParseSeverity(s string) (Severity, error) {
+	if s == "" {
+		return SeverityInfo, nil
+	}
+	for i, n := range severityNames {
+		if n == s {
+			return Severity(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity '%s'", s)
+}
+
+// Entry is a single event sent by a Plantcube. Category is the kind
+// of message it came in ("warning" or "info"), Label the event's own
+// label (e.g. "NCU_SYS_LOG"). DeviceTime is the timestamp the
+// Plantcube put in the event, Received when we got it.
+type Entry struct {
+	Received   time.Time
+	DeviceTime time.Time
+	Category   string
+	Label      string
+	Severity   Severity
+	Fields     map[string]string `json:",omitempty"`
+	Raw        string            `json:",omitempty"`
+}
+
+// Known strings in the Plantcube's error logs, and how bad they
+// are. Anything that isn't known is a warning.
+var knownErrors = []struct {
+	prefix   string
+	severity Severity
+}{
+	// The Plantcube sent an update that the shadow service
+	// (i.e. we) rejected. Usually this is a bug in what we sent
+	// it earlier.
+	{"MGOS_SHADOW_UPDATE_REJECTED", SeverityError},
+}
+
+// Classify works out the severity of an event from its category,
+// label and fields.
+func Classify(category, label string, fields map[string]string) Severity {
+	switch label {
+	case "NCU_SYS_LOG":
+		for _, ke := range knownErrors {
+			if strings.HasPrefix(fields["error_log"], ke.prefix) {
+				return ke.severity
+			}
+		}
+		return SeverityWarning
+	case "MCU_MODE_STATE":
+		if fields["mode"] == "ECO_MODE" && fields["state"] == "1" {
+			// Door open too long
+			return SeverityWarning
+		}
+		return SeverityInfo
+	}
+	if category == "info" {
+		return SeverityInfo
+	}
+	return SeverityWarning
+}
+
+// Filter restricts the entries returned by Query. Zero times mean
+// unbounded, an empty Labels means every label.
+type Filter struct {
+	From        time.Time
+	To          time.Time
+	Labels      []string
+	MinSeverity Severity
+}
+
+func (f *Filter) Matches(e *Entry) bool {
+	if !f.From.IsZero() && e.Received.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.Received.Before(f.To) {
+		return false
+	}
+	if e.Severity < f.MinSeverity {
+		return false
+	}
+	if len(f.Labels) > 0 {
+		found := false
+		for _, l := range f.Labels {
+			if l == e.Label {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type Store struct {
+	dir   string
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+// New returns a Store keeping its files in the given directory.
+func New(dir string) *Store {
+	return &Store{
+		dir:   dir,
+		files: make(map[string]*os.File),
+	}
+}
+
+func (s *Store) fileName(deviceID string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("plantcube-%s-events.jsonl", deviceID))
+}
+
+// Append adds an entry to the device's event log.
+func (s *Store) Append(deviceID string, e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event %+v: %w", e, err)
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[deviceID]
+	if !ok {
+		fn := s.fileName(deviceID)
+		f, err = os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open '%s': %w", fn, err)
+		}
+		s.files[deviceID] = f
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		return fmt.Errorf("failed to append to event log for '%s': %w", deviceID, err)
+	}
+	return nil
+}
+
+// Query returns the device's entries matching the filter, newest
+// first. If limit is more than zero, at most that many are returned.
+func (s *Store) Query(deviceID string, f Filter, limit int) ([]Entry, error) {
+	fn := s.fileName(deviceID)
+	fh, err := os.Open(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %w", fn, err)
+	}
+	defer fh.Close()
+
+	var entries []Entry
+	sc := bufio.NewScanner(fh)
+	sc.Buffer(nil, 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var e Entry
+		err = json.Unmarshal(bytes.TrimSpace(sc.Bytes()), &e)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' line %d: %w", fn, line, err)
+		}
+		if f.Matches(&e) {
+			entries = append(entries, e)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading '%s': %w", fn, err)
+	}
+
+	// Entries are appended as they're received, so reversing
+	// gives us newest first.
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
@@ -0,0 +1,78 @@
+package eventlog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testDevice = "a8d39911-7955-47d3-981b-fbd9d52f9221"
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		category string
+		label    string
+		fields   map[string]string
+		want     Severity
+	}{
+		{"warning", "NCU_SYS_LOG", map[string]string{"error_log": "MGOS_SHADOW_UPDATE_REJECTED 400 Missing required node: state"}, SeverityError},
+		{"warning", "NCU_SYS_LOG", map[string]string{"error_log": "SOMETHING_NEW 1"}, SeverityWarning},
+		{"warning", "MCU_MODE_STATE", map[string]string{"mode": "ECO_MODE", "state": "1"}, SeverityWarning},
+		{"info", "MCU_MODE_STATE", map[string]string{"mode": "ECO_MODE", "state": "0"}, SeverityInfo},
+		{"warning", "NEVER_SEEN", nil, SeverityWarning},
+		{"info", "NEVER_SEEN", nil, SeverityInfo},
+	}
+	for _, tc := range tests {
+		got := Classify(tc.category, tc.label, tc.fields)
+		if got != tc.want {
+			t.Errorf("%s %s %v, got %v, want %v", tc.category, tc.label, tc.fields, got, tc.want)
+		}
+	}
+}
+
+func TestAppendQuery(t *testing.T) {
+	s := New(t.TempDir())
+	t1 := time.Unix(1687329836, 0)
+	entries := []Entry{
+		{Received: t1, DeviceTime: t1, Category: "warning", Label: "NCU_SYS_LOG", Severity: SeverityError,
+			Fields: map[string]string{"error_log": "MGOS_SHADOW_UPDATE_REJECTED 400", "function_name": "aws_shadow_grp_handler"}},
+		{Received: t1.Add(time.Hour), DeviceTime: t1.Add(time.Hour), Category: "warning", Label: "MCU_MODE_STATE", Severity: SeverityWarning,
+			Fields: map[string]string{"mode": "ECO_MODE", "state": "1", "layer": "APPLIANCE"}},
+		{Received: t1.Add(2 * time.Hour), DeviceTime: t1.Add(2 * time.Hour), Category: "info", Label: "MCU_MODE_STATE", Severity: SeverityInfo,
+			Fields: map[string]string{"mode": "ECO_MODE", "state": "0", "layer": "APPLIANCE"}},
+	}
+	for i := range entries {
+		err := s.Append(testDevice, &entries[i])
+		if err != nil {
+			t.Fatalf("append %d failed: %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		f     Filter
+		limit int
+		want  []int
+	}{
+		{f: Filter{}, want: []int{2, 1, 0}},
+		{f: Filter{}, limit: 1, want: []int{2}},
+		{f: Filter{MinSeverity: SeverityWarning}, want: []int{1, 0}},
+		{f: Filter{Labels: []string{"MCU_MODE_STATE"}}, want: []int{2, 1}},
+		{f: Filter{From: t1.Add(time.Hour), To: t1.Add(2 * time.Hour)}, want: []int{1}},
+	}
+	for i, tc := range tests {
+		got, err := s.Query(testDevice, tc.f, tc.limit)
+		if err != nil {
+			t.Fatalf("case %d: query failed: %v", i, err)
+		}
+		if len(got) != len(tc.want) {
+			t.Fatalf("case %d: got %d entries, want %d", i, len(got), len(tc.want))
+		}
+		for j, w := range tc.want {
+			want := entries[w]
+			if !got[j].Received.Equal(want.Received) || got[j].Label != want.Label ||
+				got[j].Severity != want.Severity || !reflect.DeepEqual(got[j].Fields, want.Fields) {
+				t.Errorf("case %d, entry %d: got %+v, want %+v", i, j, got[j], want)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Jon-Bright/plantprism/config"
+	"github.com/Jon-Bright/plantprism/history"
+)
+
+// dataDirFlags adds -data_dir and -config to a subcommand's flags. The
+// function it returns, called after parsing, gives the data directory:
+// -data_dir if it was given, otherwise the config file's data_dir.
+func dataDirFlags(fs *flag.FlagSet) func() (string, error) {
+	dir := fs.String("data_dir", ".", "Directory the history is kept in")
+	configFile := fs.String("config", "", "YAML config file to take data_dir from, unless -data_dir is given")
+	return func() (string, error) {
+		given := false
+		fs.Visit(func(f *flag.Flag) {
+			given = given || f.Name == "data_dir"
+		})
+		if given || *configFile == "" {
+			return *dir, nil
+		}
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			return "", err
+		}
+		if cfg.DataDir == "" {
+			return *dir, nil
+		}
+		return cfg.DataDir, nil
+	}
+}
+
+// exportMain implements "plantprism export", which writes a device's
+// history to stdout (or a file) without needing a running server.
+func exportMain(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	deviceID := fs.String("device", "", "Device ID to export history for")
+	from := fs.String("from", "", "Start of the export range (inclusive). Unix timestamp, RFC3339, or e.g. '2023-06-17' or '2023-06-17 12:00'")
+	to := fs.String("to", "", "End of the export range (exclusive, except that a plain date includes that whole day). Same formats as -from")
+	formatStr := fs.String("format", "csv", "Export format, 'csv' or 'jsonl'")
+	tz := fs.String("tz", "local", "Timezone for parsing -from/-to and writing timestamps: 'utc', 'local' or an IANA zone name")
+	kindsStr := fs.String("kinds", "", "Comma-separated kinds to export (telemetry, watering, mode, planting, harvest, nutrient). Default is all")
+	fieldsStr := fs.String("fields", "", "Comma-separated telemetry fields to export (e.g. 'ec,temp_tank'). Default is all")
+	out := fs.String("out", "", "File to write to. Default is stdout")
+	dataDir := dataDirFlags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *deviceID == "" {
+		fmt.Fprintln(os.Stderr, "export: -device is required")
+		return 2
+	}
+
+	format, err := history.ParseFormat(*formatStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 2
+	}
+	loc, err := history.ParseLocation(*tz)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 2
+	}
+	var f history.Filter
+	f.From, err = history.ParseTime(*from, loc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: -from: %v\n", err)
+		return 2
+	}
+	f.To, err = history.ParseRangeEnd(*to, loc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: -to: %v\n", err)
+		return 2
+	}
+	f.Kinds, err = history.ParseKinds(*kindsStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: -kinds: %v\n", err)
+		return 2
+	}
+	f.Fields = history.ParseFields(*fieldsStr)
+	dir, err := dataDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 2
+	}
+
+	recs, err := history.New(dir).Query(*deviceID, f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		fh, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export: %v\n", err)
+			return 1
+		}
+		defer fh.Close()
+		w = fh
+	}
+	err = history.Export(w, recs, format, loc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,194 @@
+package history
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatCSV   Format = "csv"
+	FormatJSONL Format = "jsonl"
+)
+
+// Formats accepted by ParseTime, tried in order. All but RFC3339
+// are interpreted in the location passed to ParseTime.
+var timeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"20060102",
+}
+
+func ParseFormat(f string) (Format, error) {
+	switch strings.ToLower(f) {
+	case "", "csv":
+		return FormatCSV, nil
+	case "jsonl", "json":
+		return FormatJSONL, nil
+	default:
+		return "", fmt.Errorf("unknown export format '%s'", f)
+	}
+}
+
+func (f Format) ContentType() string {
+	if f == FormatJSONL {
+		return "application/jsonl"
+	}
+	return "text/csv"
+}
+
+// ParseLocation accepts "utc", "local" (this machine's timezone) or
+// any IANA timezone name.
+func ParseLocation(tz string) (*time.Location, error) {
+	switch strings.ToLower(tz) {
+	case "utc":
+		return time.UTC, nil
+	case "", "local":
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load zone '%s': %w", tz, err)
+	}
+	return loc, nil
+}
+
+// ParseTime parses a time given on the command line or in a URL.
+// RFC3339 and a few shorter forms are accepted, which are taken to be
+// in the given location, as is a plain Unix timestamp. The forms are
+// tried first, so that "20230617" is a date, not a time in 1970.
+func ParseTime(s string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, f := range timeFormats {
+		t, err := time.ParseInLocation(f, s, loc)
+		if err == nil {
+			return t, nil
+		}
+	}
+	if u, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(u, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("unable to parse time '%s'", s)
+}
+
+// ParseRangeEnd parses the end of a time range in the same way as
+// ParseTime, except that a plain date means the end of that day, so
+// that "from 2023-06-17 to 2023-06-17" covers the whole day.
+func ParseRangeEnd(s string, loc *time.Location) (time.Time, error) {
+	for _, f := range []string{"2006-01-02", "20060102"} {
+		if t, err := time.ParseInLocation(f, s, loc); err == nil {
+			return t.AddDate(0, 0, 1), nil
+		}
+	}
+	return ParseTime(s, loc)
+}
+
+// ParseKinds parses a comma-separated list of kinds.
+func ParseKinds(s string) ([]Kind, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var kinds []Kind
+	for _, k := range strings.Split(s, ",") {
+		found := false
+		for _, ak := range AllKinds {
+			if Kind(k) == ak {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown kind '%s'", k)
+		}
+		kinds = append(kinds, Kind(k))
+	}
+	return kinds, nil
+}
+
+// ParseFields parses a comma-separated list of telemetry fields.
+func ParseFields(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+type exportRecord struct {
+	Time   string          `json:"time"`
+	Unix   int64           `json:"unix"`
+	Kind   Kind            `json:"kind"`
+	Field  string          `json:"field,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Detail string          `json:"detail,omitempty"`
+}
+
+// csvValue turns a JSON value into something more
+// spreadsheet-friendly: strings lose their quotes, everything else
+// is left as-is.
+func csvValue(v json.RawMessage) string {
+	var s string
+	if len(v) > 0 && v[0] == '"' && json.Unmarshal(v, &s) == nil {
+		return s
+	}
+	return string(v)
+}
+
+// Export writes the records in the given format. All timestamps are
+// written in the given location, plus as a Unix timestamp so that
+// there's no ambiguity around DST changes.
+func Export(w io.Writer, recs []Record, f Format, loc *time.Location) error {
+	switch f {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write([]string{"time", "unix", "kind", "field", "value", "detail"})
+		if err != nil {
+			return fmt.Errorf("failed writing CSV header: %w", err)
+		}
+		for _, r := range recs {
+			err = cw.Write([]string{
+				r.Time.In(loc).Format(time.RFC3339),
+				strconv.FormatInt(r.Time.Unix(), 10),
+				string(r.Kind),
+				r.Field,
+				csvValue(r.Value),
+				r.Detail,
+			})
+			if err != nil {
+				return fmt.Errorf("failed writing CSV record: %w", err)
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	case FormatJSONL:
+		e := json.NewEncoder(w)
+		for _, r := range recs {
+			er := exportRecord{
+				Time:   r.Time.In(loc).Format(time.RFC3339),
+				Unix:   r.Time.Unix(),
+				Kind:   r.Kind,
+				Field:  r.Field,
+				Value:  r.Value,
+				Detail: r.Detail,
+			}
+			err := e.Encode(&er)
+			if err != nil {
+				return fmt.Errorf("failed writing JSON record: %w", err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown export format '%s'", f)
+	}
+}
@@ -0,0 +1,217 @@
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Kind string
+
+const (
+	KindTelemetry Kind = "telemetry"
+	KindWatering  Kind = "watering"
+	KindMode      Kind = "mode"
+	KindPlanting  Kind = "planting"
+	KindHarvest   Kind = "harvest"
+	KindNutrient  Kind = "nutrient"
+	KindAlert     Kind = "alert"
+)
+
+var AllKinds = []Kind{KindTelemetry, KindWatering, KindMode, KindPlanting, KindHarvest, KindNutrient, KindAlert}
+
+// Record is a single entry in a device's history. For telemetry,
+// Field is the name of the reported value (as used by the Plantcube,
+// e.g. "temp_a") and Value is its JSON value. For everything else,
+// Field and Value are whatever identifies the event best (e.g. the
+// slot and plant ID for a planting).
+type Record struct {
+	Time   time.Time
+	Kind   Kind
+	Field  string          `json:",omitempty"`
+	Value  json.RawMessage `json:",omitempty"`
+	Detail string          `json:",omitempty"`
+}
+
+// Filter restricts the records returned by Query. Zero times mean
+// unbounded, empty Kinds/Fields mean everything.
+type Filter struct {
+	From   time.Time
+	To     time.Time
+	Kinds  []Kind
+	Fields []string
+}
+
+type Store struct {
+	dir   string
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+// New returns a Store keeping its files in the given directory.
+func New(dir string) *Store {
+	return &Store{
+		dir:   dir,
+		files: make(map[string]*os.File),
+	}
+}
+
+func (s *Store) fileName(deviceID string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("plantcube-%s-history.jsonl", deviceID))
+}
+
+// Append adds records to the device's history file.
+func (s *Store) Append(deviceID string, recs ...Record) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	for _, r := range recs {
+		err := e.Encode(&r)
+		if err != nil {
+			return fmt.Errorf("failed to marshal history record %+v: %w", r, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[deviceID]
+	if !ok {
+		var err error
+		fn := s.fileName(deviceID)
+		f, err = os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open '%s': %w", fn, err)
+		}
+		s.files[deviceID] = f
+	}
+	_, err := f.Write(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to append to history for '%s': %w", deviceID, err)
+	}
+	return nil
+}
+
+func (f *Filter) matches(r *Record) bool {
+	if !f.From.IsZero() && r.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !r.Time.Before(f.To) {
+		return false
+	}
+	if len(f.Kinds) > 0 {
+		found := false
+		for _, k := range f.Kinds {
+			if k == r.Kind {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Fields) > 0 && r.Kind == KindTelemetry {
+		found := false
+		for _, fld := range f.Fields {
+			if fld == r.Field {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Query returns all of the device's records matching the filter,
+// sorted by time.
+func (s *Store) Query(deviceID string, f Filter) ([]Record, error) {
+	fn := s.fileName(deviceID)
+	fh, err := os.Open(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %w", fn, err)
+	}
+	defer fh.Close()
+
+	var recs []Record
+	sc := bufio.NewScanner(fh)
+	sc.Buffer(nil, 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		var r Record
+		err = json.Unmarshal(sc.Bytes(), &r)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' line %d: %w", fn, line, err)
+		}
+		if f.matches(&r) {
+			recs = append(recs, r)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading '%s': %w", fn, err)
+	}
+
+	// Records are appended in the order they're received, which
+	// is nearly always time order - but not necessarily, so
+	// sort them. Stable, so that records from the same message
+	// keep their order.
+	sort.SliceStable(recs, func(i, j int) bool {
+		return recs[i].Time.Before(recs[j].Time)
+	})
+	return recs, nil
+}
+
+type dedupKey struct {
+	unix  int64
+	kind  Kind
+	field string
+	value string
+}
+
+func (r *Record) dedupKey(unix int64) dedupKey {
+	return dedupKey{unix, r.Kind, r.Field, string(r.Value)}
+}
+
+// Import appends those of the given records that aren't already in
+// the device's history, returning how many were appended. Records
+// count as duplicates if their kind, field and value match and their
+// times are within a second of each other: the same reading can
+// arrive via different routes (a live message, a pcap, the log) with
+// different timestamp precision.
+func (s *Store) Import(deviceID string, recs []Record) (int, error) {
+	existing, err := s.Query(deviceID, Filter{})
+	if err != nil {
+		return 0, fmt.Errorf("failed reading existing history: %w", err)
+	}
+	seen := make(map[dedupKey]bool, len(existing)+len(recs))
+	for i := range existing {
+		seen[existing[i].dedupKey(existing[i].Time.Unix())] = true
+	}
+	var add []Record
+	for i := range recs {
+		r := &recs[i]
+		u := r.Time.Unix()
+		if seen[r.dedupKey(u-1)] || seen[r.dedupKey(u)] || seen[r.dedupKey(u+1)] {
+			continue
+		}
+		seen[r.dedupKey(u)] = true
+		add = append(add, *r)
+	}
+	err = s.Append(deviceID, add...)
+	if err != nil {
+		return 0, err
+	}
+	return len(add), nil
+}
@@ -0,0 +1,213 @@
+package history
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testDevice = "a8d39911-7955-47d3-981b-fbd9d52f9221"
+
+func TestAppendQuery(t *testing.T) {
+	s := New(t.TempDir())
+	t1 := time.Unix(1687013649, 0)
+	t2 := time.Unix(1687013700, 0)
+	t3 := time.Unix(1687017000, 0)
+	recs := []Record{
+		{Time: t2, Kind: KindTelemetry, Field: "ec", Value: json.RawMessage(`1306`)},
+		{Time: t2, Kind: KindTelemetry, Field: "temp_tank", Value: json.RawMessage(`22.5`)},
+		// Out of order, as from an import
+		{Time: t1, Kind: KindMode, Field: "Cinema", Value: json.RawMessage(`8`), Detail: "from Default, trigger App"},
+		{Time: t3, Kind: KindPlanting, Field: "b3", Value: json.RawMessage(`42`)},
+	}
+	err := s.Append(testDevice, recs[:2]...)
+	if err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	err = s.Append(testDevice, recs[2:]...)
+	if err != nil {
+		t.Fatalf("second append failed: %v", err)
+	}
+
+	tests := []struct {
+		f    Filter
+		want []Record
+	}{
+		{ // Everything, sorted
+			f:    Filter{},
+			want: []Record{recs[2], recs[0], recs[1], recs[3]},
+		}, { // Time range, To is exclusive
+			f:    Filter{From: t2, To: t3},
+			want: []Record{recs[0], recs[1]},
+		}, { // Single kind
+			f:    Filter{Kinds: []Kind{KindMode}},
+			want: []Record{recs[2]},
+		}, { // Fields only restrict telemetry
+			f:    Filter{Fields: []string{"temp_tank"}},
+			want: []Record{recs[2], recs[1], recs[3]},
+		}, { // Nothing
+			f:    Filter{From: t3.Add(time.Second)},
+			want: nil,
+		},
+	}
+	for i, tc := range tests {
+		got, err := s.Query(testDevice, tc.f)
+		if err != nil {
+			t.Fatalf("case %d: query failed: %v", i, err)
+		}
+		if len(got) != len(tc.want) {
+			t.Fatalf("case %d: got %d records, want %d: %+v", i, len(got), len(tc.want), got)
+		}
+		for j := range got {
+			if !got[j].Time.Equal(tc.want[j].Time) || got[j].Kind != tc.want[j].Kind ||
+				got[j].Field != tc.want[j].Field || !bytes.Equal(got[j].Value, tc.want[j].Value) ||
+				got[j].Detail != tc.want[j].Detail {
+				t.Errorf("case %d, record %d: got %+v, want %+v", i, j, got[j], tc.want[j])
+			}
+		}
+	}
+
+	got, err := s.Query("no-such-device", Filter{})
+	if err != nil || got != nil {
+		t.Errorf("query for unknown device, got %v, %v, want nil, nil", got, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	recs := []Record{
+		{Time: time.Unix(1687013649, 0), Kind: KindTelemetry, Field: "ec", Value: json.RawMessage(`1306`)},
+		{Time: time.Unix(1687013700, 0), Kind: KindPlanting, Field: "b3", Value: json.RawMessage(`42`), Detail: "Basil, \"Genovese\""},
+		{Time: time.Unix(1687013800, 0), Kind: KindWatering, Field: "Open/LayerA", Value: json.RawMessage(`"x"`)},
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("failed loading location: %v", err)
+	}
+	tests := []struct {
+		f    Format
+		loc  *time.Location
+		want string
+	}{
+		{
+			f:   FormatCSV,
+			loc: time.UTC,
+			want: "time,unix,kind,field,value,detail\n" +
+				"2023-06-17T14:54:09Z,1687013649,telemetry,ec,1306,\n" +
+				"2023-06-17T14:55:00Z,1687013700,planting,b3,42,\"Basil, \"\"Genovese\"\"\"\n" +
+				"2023-06-17T14:56:40Z,1687013800,watering,Open/LayerA,x,\n",
+		}, {
+			f:   FormatJSONL,
+			loc: berlin,
+			want: `{"time":"2023-06-17T16:54:09+02:00","unix":1687013649,"kind":"telemetry","field":"ec","value":1306}` + "\n" +
+				`{"time":"2023-06-17T16:55:00+02:00","unix":1687013700,"kind":"planting","field":"b3","value":42,"detail":"Basil, \"Genovese\""}` + "\n" +
+				`{"time":"2023-06-17T16:56:40+02:00","unix":1687013800,"kind":"watering","field":"Open/LayerA","value":"x"}` + "\n",
+		},
+	}
+	for _, tc := range tests {
+		var b bytes.Buffer
+		err := Export(&b, recs, tc.f, tc.loc)
+		if err != nil {
+			t.Fatalf("export as %s failed: %v", tc.f, err)
+		}
+		if b.String() != tc.want {
+			t.Errorf("export as %s,\ngot:\n%s\nwant:\n%s", tc.f, b.String(), tc.want)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("failed loading location: %v", err)
+	}
+	tests := []struct {
+		in        string
+		end       bool
+		wantError bool
+		want      time.Time
+	}{
+		{in: "", want: time.Time{}},
+		{in: "1687013649", want: time.Unix(1687013649, 0)},
+		{in: "2023-06-17T16:54:09+02:00", want: time.Unix(1687013649, 0)},
+		{in: "2023-06-17 16:54:09", want: time.Unix(1687013649, 0)},
+		{in: "2023-06-17 16:54", want: time.Unix(1687013640, 0)},
+		{in: "2023-06-17", want: time.Date(2023, 6, 17, 0, 0, 0, 0, berlin)},
+		{in: "2023-06-17", end: true, want: time.Date(2023, 6, 18, 0, 0, 0, 0, berlin)},
+		{in: "20230617", want: time.Date(2023, 6, 17, 0, 0, 0, 0, berlin)},
+		{in: "20230617", end: true, want: time.Date(2023, 6, 18, 0, 0, 0, 0, berlin)},
+		{in: "2023-06-17 16:54", end: true, want: time.Unix(1687013640, 0)},
+		{in: "yesterday", wantError: true},
+	}
+	for _, tc := range tests {
+		var got time.Time
+		if tc.end {
+			got, err = ParseRangeEnd(tc.in, berlin)
+		} else {
+			got, err = ParseTime(tc.in, berlin)
+		}
+		if tc.wantError != (err != nil) {
+			t.Fatalf("parsing '%s', wanted error %v, got %v", tc.in, tc.wantError, err)
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("parsing '%s' (end %v), got %v, want %v", tc.in, tc.end, got, tc.want)
+		}
+	}
+}
+
+func TestParseKinds(t *testing.T) {
+	got, err := ParseKinds("planting,harvest")
+	if err != nil {
+		t.Fatalf("ParseKinds failed: %v", err)
+	}
+	want := []Kind{KindPlanting, KindHarvest}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	_, err = ParseKinds("planting,weeding")
+	if err == nil {
+		t.Errorf("ParseKinds with unknown kind succeeded")
+	}
+}
+
+func TestImport(t *testing.T) {
+	s := New(t.TempDir())
+	t1 := time.Unix(1687013649, 0)
+	err := s.Append(testDevice, Record{Time: t1.Add(300 * time.Millisecond), Kind: KindTelemetry, Field: "ec", Value: json.RawMessage(`1306`)})
+	if err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	recs := []Record{
+		// Same reading, seen with a different precision
+		{Time: t1.Add(time.Second), Kind: KindTelemetry, Field: "ec", Value: json.RawMessage(`1306`)},
+		// Same time, different value
+		{Time: t1, Kind: KindTelemetry, Field: "ec", Value: json.RawMessage(`1307`)},
+		// Duplicated within the import itself
+		{Time: t1, Kind: KindMode, Field: "Cinema", Value: json.RawMessage(`8`)},
+		{Time: t1, Kind: KindMode, Field: "Cinema", Value: json.RawMessage(`8`), Detail: "from Default, trigger App"},
+		// Too far apart to be the same
+		{Time: t1.Add(3 * time.Second), Kind: KindTelemetry, Field: "ec", Value: json.RawMessage(`1306`)},
+	}
+	added, err := s.Import(testDevice, recs)
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if added != 3 {
+		t.Errorf("first import, got %d added, want 3", added)
+	}
+	added, err = s.Import(testDevice, recs)
+	if err != nil {
+		t.Fatalf("second import failed: %v", err)
+	}
+	if added != 0 {
+		t.Errorf("second import, got %d added, want 0", added)
+	}
+	got, err := s.Query(testDevice, Filter{})
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if len(got) != 4 {
+		t.Errorf("got %d records after import, want 4: %+v", len(got), got)
+	}
+}
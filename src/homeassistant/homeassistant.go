@@ -0,0 +1,458 @@
+package homeassistant
+
+// Makes each device show up in Home Assistant, via its MQTT
+// discovery. Every device gets a state topic with all its values as
+// JSON, a discovery config for each entity reading from it, and
+// command topics for the entities that do something.
+//
+// Nothing's retained, so that a device that's been removed from
+// plantprism doesn't linger in Home Assistant. Instead, everything's
+// published again when Home Assistant says it's come online, and
+// whenever we connect to the broker.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/device"
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+const (
+	// BIRTH_PAYLOAD is what Home Assistant publishes to
+	// <discovery prefix>/status when it starts.
+	BIRTH_PAYLOAD = "online"
+
+	MANUFACTURER = "Agrilution"
+	MODEL        = "Plantcube"
+)
+
+type haFlags struct {
+	enabled         bool
+	discoveryPrefix string
+	topicPrefix     string
+}
+
+var (
+	log *logs.Loggers
+	hf  haFlags
+)
+
+func InitFlags() {
+	flag.BoolVar(&hf.enabled, "ha_discovery", false, "Publish Home Assistant MQTT discovery configs and state for each device, and accept commands from Home Assistant")
+	flag.StringVar(&hf.discoveryPrefix, "ha_discovery_prefix", "homeassistant", "Home Assistant's MQTT discovery prefix")
+	flag.StringVar(&hf.topicPrefix, "ha_topic_prefix", "plantprism/ha", "Prefix for the state and command topics used with Home Assistant")
+}
+
+// entity is one Home Assistant entity of a device. Its value is key
+// in the device's state, and if it has a command topic, that's named
+// after key too.
+type entity struct {
+	component   string
+	key         string
+	name        string
+	deviceClass string
+	unit        string
+	icon        string
+	// measured says a sensor's value is a measurement, so Home
+	// Assistant keeps statistics for it.
+	measured bool
+	command  bool
+	options  []string
+	pattern  string
+	// always says the entity's available even when the device is
+	// offline.
+	always bool
+}
+
+var entities = []entity{
+	{component: "sensor", key: "temp_a", name: "Temperature A", deviceClass: "temperature", unit: "°C", measured: true},
+	{component: "sensor", key: "temp_b", name: "Temperature B", deviceClass: "temperature", unit: "°C", measured: true},
+	{component: "sensor", key: "temp_tank", name: "Tank temperature", deviceClass: "temperature", unit: "°C", measured: true},
+	{component: "sensor", key: "humid_a", name: "Humidity A", deviceClass: "humidity", unit: "%", measured: true},
+	{component: "sensor", key: "humid_b", name: "Humidity B", deviceClass: "humidity", unit: "%", measured: true},
+	{component: "sensor", key: "ec", name: "EC", icon: "mdi:flask", measured: true},
+	{component: "sensor", key: "smoothed_ec", name: "Smoothed EC", icon: "mdi:flask", measured: true},
+	{component: "sensor", key: "tank_level", name: "Tank level", icon: "mdi:cup-water", measured: true},
+	{component: "sensor", key: "want_nutrient", name: "Nutrient wanted", unit: "ml", icon: "mdi:bottle-tonic-plus"},
+	{component: "sensor", key: "wifi_level", name: "WiFi level", icon: "mdi:wifi", measured: true},
+	{component: "binary_sensor", key: "door", name: "Door", deviceClass: "door"},
+	{component: "binary_sensor", key: "light_a", name: "Light A", deviceClass: "light"},
+	{component: "binary_sensor", key: "light_b", name: "Light B", deviceClass: "light"},
+	{component: "binary_sensor", key: "cooling", name: "Cooling", deviceClass: "cold"},
+	{component: "binary_sensor", key: "connected", name: "Connected", deviceClass: "connectivity", always: true},
+	{component: "select", key: "mode", name: "Mode", icon: "mdi:tune", command: true, options: modeOptions},
+	{component: "button", key: "watering", name: "Water now", icon: "mdi:watering-can", command: true},
+	{component: "button", key: "nutrient_reset", name: "Nutrient added", icon: "mdi:bottle-tonic-plus", command: true},
+	// Home Assistant has no MQTT time entity, so the sunrise is
+	// text, limited to times.
+	{component: "text", key: "sunrise", name: "Sunrise", icon: "mdi:weather-sunset-up", command: true, pattern: "^([01][0-9]|2[0-3]):[0-5][0-9]$"},
+}
+
+// modes are the modes that can be chosen from Home Assistant.
+var modes = map[string]device.DeviceMode{
+	"default": device.ModeDefault,
+	"silent":  device.ModeSilent,
+	"cinema":  device.ModeCinema,
+}
+
+// modeOptions are every mode the Plantcube can report, as the state
+// has them, since Home Assistant ignores a select's state if it isn't
+// an option. Only those in modes can be chosen: choosing another fails,
+// and the select stays at the reported mode.
+var modeOptions = func() []string {
+	var l []string
+	for m := device.ModeDefault; m < device.ModeOutOfRange; m++ {
+		l = append(l, strings.ToLower(m.String()))
+	}
+	return l
+}()
+
+// state is what's published to a device's state topic.
+type state struct {
+	Online       bool    `json:"online"`
+	Connected    bool    `json:"connected"`
+	TempA        float64 `json:"temp_a"`
+	TempB        float64 `json:"temp_b"`
+	TempTank     float64 `json:"temp_tank"`
+	HumidA       int     `json:"humid_a"`
+	HumidB       int     `json:"humid_b"`
+	EC           int     `json:"ec"`
+	SmoothedEC   float64 `json:"smoothed_ec"`
+	TankLevel    int     `json:"tank_level"`
+	WantNutrient int     `json:"want_nutrient"`
+	WifiLevel    int     `json:"wifi_level"`
+	Door         bool    `json:"door"`
+	LightA       bool    `json:"light_a"`
+	LightB       bool    `json:"light_b"`
+	Cooling      bool    `json:"cooling"`
+	Mode         string  `json:"mode"`
+	Sunrise      string  `json:"sunrise"` // HH:MM
+}
+
+func newState(se *device.StatusEvent) *state {
+	sunrise := time.Duration(se.Sunrise) * time.Second
+	return &state{
+		Online: se.Online,
+		// The Plantcube saying it's connected means nothing if
+		// we haven't heard from it lately.
+		Connected:    se.Online && se.Connected,
+		TempA:        se.TempA,
+		TempB:        se.TempB,
+		TempTank:     se.TempTank,
+		HumidA:       se.HumidA,
+		HumidB:       se.HumidB,
+		EC:           se.EC,
+		SmoothedEC:   se.SmoothedEC,
+		TankLevel:    se.TankLevel,
+		WantNutrient: se.WantNutrient,
+		WifiLevel:    se.WifiLevel,
+		Door:         se.Door,
+		LightA:       se.LightA,
+		LightB:       se.LightB,
+		Cooling:      se.Cooling,
+		Mode:         strings.ToLower(se.Mode.String()),
+		Sunrise:      fmt.Sprintf("%02d:%02d", sunrise/time.Hour, sunrise%time.Hour/time.Minute),
+	}
+}
+
+// haDevice is the device an entity belongs to, in a discovery config.
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// entityConfig is an entity's discovery config.
+type entityConfig struct {
+	Name                 string   `json:"name"`
+	UniqueID             string   `json:"unique_id"`
+	ObjectID             string   `json:"object_id"`
+	StateTopic           string   `json:"state_topic,omitempty"`
+	ValueTemplate        string   `json:"value_template,omitempty"`
+	CommandTopic         string   `json:"command_topic,omitempty"`
+	AvailabilityTopic    string   `json:"availability_topic,omitempty"`
+	AvailabilityTemplate string   `json:"availability_template,omitempty"`
+	DeviceClass          string   `json:"device_class,omitempty"`
+	StateClass           string   `json:"state_class,omitempty"`
+	Unit                 string   `json:"unit_of_measurement,omitempty"`
+	Icon                 string   `json:"icon,omitempty"`
+	Options              []string `json:"options,omitempty"`
+	Pattern              string   `json:"pattern,omitempty"`
+	Device               haDevice `json:"device"`
+}
+
+func stateTopic(id string) string {
+	return hf.topicPrefix + "/" + id + "/state"
+}
+
+func commandTopic(id, key string) string {
+	return hf.topicPrefix + "/" + id + "/" + key + "/set"
+}
+
+func configTopic(id string, e *entity) string {
+	return hf.discoveryPrefix + "/" + e.component + "/" + id + "/" + e.key + "/config"
+}
+
+func birthTopic() string {
+	return hf.discoveryPrefix + "/status"
+}
+
+func (e *entity) config(id, name string) *entityConfig {
+	uid := "plantprism_" + strings.ReplaceAll(id, "-", "") + "_" + e.key
+	c := entityConfig{
+		Name:        e.name,
+		UniqueID:    uid,
+		ObjectID:    uid,
+		DeviceClass: e.deviceClass,
+		Unit:        e.unit,
+		Icon:        e.icon,
+		Options:     e.options,
+		Pattern:     e.pattern,
+		Device: haDevice{
+			Identifiers:  []string{"plantprism_" + id},
+			Name:         name,
+			Manufacturer: MANUFACTURER,
+			Model:        MODEL,
+		},
+	}
+	if e.measured {
+		c.StateClass = "measurement"
+	}
+	if e.component != "button" {
+		c.StateTopic = stateTopic(id)
+		if e.component == "binary_sensor" {
+			c.ValueTemplate = fmt.Sprintf("{{ 'ON' if value_json.%s else 'OFF' }}", e.key)
+		} else {
+			c.ValueTemplate = fmt.Sprintf("{{ value_json.%s }}", e.key)
+		}
+	}
+	if e.command {
+		c.CommandTopic = commandTopic(id, e.key)
+	}
+	if !e.always {
+		c.AvailabilityTopic = stateTopic(id)
+		c.AvailabilityTemplate = "{{ 'online' if value_json.online else 'offline' }}"
+	}
+	return &c
+}
+
+// Bridge keeps Home Assistant up to date with every device.
+type Bridge struct {
+	publisher device.Publisher
+
+	mu       sync.Mutex
+	followed map[string]bool
+	states   map[string][]byte // Device ID to last state published
+	failing  bool
+}
+
+// Init creates a Bridge if -ha_discovery is set, and starts following
+// every allowed device. Otherwise, it returns nil.
+func Init(l *logs.Loggers, p device.Publisher) *Bridge {
+	log = l
+	if !hf.enabled {
+		return nil
+	}
+	b := New(p)
+	b.followDevices()
+	log.Info.Printf("Home Assistant discovery under '%s', topics under '%s'", hf.discoveryPrefix, hf.topicPrefix)
+	return b
+}
+
+// New creates a Bridge. It doesn't follow any devices until Announce
+// is called.
+func New(p device.Publisher) *Bridge {
+	return &Bridge{
+		publisher: p,
+		followed:  make(map[string]bool),
+		states:    make(map[string][]byte),
+	}
+}
+
+// followDevices starts following any allowed device that isn't
+// already followed, and returns the devices.
+func (b *Bridge) followDevices() []*device.Device {
+	var l []*device.Device
+	for _, id := range device.AllowedDevices() {
+		d, err := device.Get(id, b.publisher)
+		if err != nil {
+			log.Error.Printf("Home Assistant couldn't get device '%s': %v", id, err)
+			continue
+		}
+		l = append(l, d)
+		b.mu.Lock()
+		followed := b.followed[id]
+		b.followed[id] = true
+		b.mu.Unlock()
+		if !followed {
+			go b.follow(d)
+		}
+	}
+	return l
+}
+
+// follow publishes a device's state whenever its status changes.
+func (b *Bridge) follow(d *device.Device) {
+	d.Follow(func(l []device.Update) {
+		for _, u := range l {
+			if u.Status != nil {
+				b.publishState(d.ID, u.Status)
+			}
+		}
+	})
+}
+
+func (b *Bridge) publishState(id string, se *device.StatusEvent) {
+	payload, err := json.Marshal(newState(se))
+	if err != nil {
+		log.Error.Printf("Home Assistant state for device '%s' failed to marshal: %v", id, err)
+		return
+	}
+	b.mu.Lock()
+	same := bytes.Equal(b.states[id], payload)
+	b.states[id] = payload
+	b.mu.Unlock()
+	if same {
+		// Something we don't tell Home Assistant about changed
+		return
+	}
+	b.publish(stateTopic(id), payload)
+}
+
+// publish sends a message, logging failures. Home Assistant not
+// getting a message is nothing to worry about much: it gets
+// everything again when it or we reconnect. So only the first failure
+// in a row is a warning.
+func (b *Bridge) publish(topic string, payload []byte) {
+	err := b.publisher.Publish(topic, payload)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		if b.failing {
+			log.Info.Printf("Home Assistant publish to '%s' failed: %v", topic, err)
+		} else {
+			log.Warn.Printf("Home Assistant publish to '%s' failed: %v", topic, err)
+		}
+		b.failing = true
+		return
+	}
+	if b.failing {
+		log.Info.Printf("Home Assistant publishing again")
+		b.failing = false
+	}
+}
+
+// Announce publishes the discovery config and latest state of every
+// device.
+func (b *Bridge) Announce() {
+	if b == nil {
+		return
+	}
+	for _, d := range b.followDevices() {
+		name := d.DisplayName()
+		for i := range entities {
+			e := &entities[i]
+			payload, err := json.Marshal(e.config(d.ID, name))
+			if err != nil {
+				log.Error.Printf("Home Assistant config for '%s' failed to marshal: %v", e.key, err)
+				continue
+			}
+			b.publish(configTopic(d.ID, e), payload)
+		}
+		b.mu.Lock()
+		payload := b.states[d.ID]
+		b.mu.Unlock()
+		if payload != nil {
+			b.publish(stateTopic(d.ID), payload)
+		}
+	}
+	log.Info.Printf("Home Assistant discovery published")
+}
+
+// HandleMessage deals with a message on one of the bridge's topics,
+// returning false if the topic isn't one of them.
+func (b *Bridge) HandleMessage(topic string, payload []byte) bool {
+	if b == nil {
+		return false
+	}
+	if topic == birthTopic() {
+		if string(payload) == BIRTH_PAYLOAD {
+			log.Info.Printf("Home Assistant came online")
+			go b.Announce()
+		}
+		return true
+	}
+	if strings.HasPrefix(topic, hf.discoveryPrefix+"/") {
+		// Our own configs, or other things'
+		return true
+	}
+	rest, ok := strings.CutPrefix(topic, hf.topicPrefix+"/")
+	if !ok {
+		return false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 3 || parts[2] != "set" {
+		// Our own state, or something we don't know about,
+		// but it's ours either way.
+		return true
+	}
+	// Not on this goroutine: it's the one reading from the
+	// broker, and the command waits for its messages to the
+	// Plantcube to be acknowledged.
+	go b.handleCommand(parts[0], parts[1], strings.TrimSpace(string(payload)))
+	return true
+}
+
+// handleCommand carries out a command for a device, logging how it
+// went.
+func (b *Bridge) handleCommand(id, key, payload string) {
+	d, err := device.Get(id, b.publisher)
+	if err != nil {
+		log.Warn.Printf("Home Assistant command '%s' for invalid device '%s': %v", key, id, err)
+		return
+	}
+	err = command(d, key, payload)
+	if err != nil {
+		log.Warn.Printf("Home Assistant command '%s' with '%s' for device '%s' failed: %v", key, payload, id, err)
+		return
+	}
+	log.Info.Printf("Home Assistant command '%s' with '%s' for device '%s'", key, payload, id)
+}
+
+// command carries out a command from Home Assistant.
+func command(d *device.Device, key, payload string) error {
+	switch key {
+	case "mode":
+		m, ok := modes[payload]
+		if !ok {
+			return fmt.Errorf("unknown mode '%s'", payload)
+		}
+		// None of the modes Home Assistant can choose needs
+		// confirming.
+		return d.SetMode(m, false)
+	case "watering":
+		d.TriggerManualWatering()
+		return nil
+	case "nutrient_reset":
+		d.ResetNutrient()
+		return nil
+	case "sunrise":
+		t, err := time.Parse("15:04", payload)
+		if err != nil {
+			t, err = time.Parse("15:04:05", payload)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid sunrise, want HH:MM: %w", err)
+		}
+		return d.SetSunrise(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute)
+	}
+	return errors.New("unknown command")
+}
@@ -0,0 +1,255 @@
+package homeassistant
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/device"
+	"github.com/Jon-Bright/plantprism/logs"
+	"github.com/benbjohnson/clock"
+	"golang.org/x/exp/slices"
+)
+
+const testDevice = "00000000-0000-4000-8000-0000000000cc"
+
+func init() {
+	log = logs.Discard()
+	hf = haFlags{enabled: true, discoveryPrefix: "homeassistant", topicPrefix: "plantprism/ha"}
+	// For their defaults
+	device.InitFlags()
+}
+
+type testMsg struct {
+	topic   string
+	payload []byte
+}
+
+type recordingPublisher struct {
+	mu   sync.Mutex
+	msgs []testMsg
+	// If set, Publish waits for it to be closed, like a publish
+	// waiting for an acknowledgement.
+	blocked chan struct{}
+}
+
+func (p *recordingPublisher) Publish(topic string, payload []byte) error {
+	p.mu.Lock()
+	blocked := p.blocked
+	p.mu.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.msgs = append(p.msgs, testMsg{topic, payload})
+	return nil
+}
+
+// waitFor returns the first message on topic whose payload contains
+// want, waiting for it if necessary.
+func (p *recordingPublisher) waitFor(t *testing.T, topic, want string) []byte {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		for _, m := range p.msgs {
+			if m.topic == topic && bytes.Contains(m.payload, []byte(want)) {
+				p.mu.Unlock()
+				return m.payload
+			}
+		}
+		p.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("no message to '%s' containing '%s'", topic, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (p *recordingPublisher) count(topic string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, m := range p.msgs {
+		if m.topic == topic {
+			n++
+		}
+	}
+	return n
+}
+
+// testPub is shared by every test, since the device publishes to
+// whichever publisher it was first loaded with.
+var testPub = &recordingPublisher{}
+
+func setupDevice(t *testing.T) {
+	device.SetTestMode()
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1691777930, 0))
+	err := device.Init(log, mock)
+	if err != nil {
+		t.Fatalf("Failed to init devices: %v", err)
+	}
+	prev := device.AllowedDevices()
+	t.Cleanup(func() {
+		device.SetAllowedDevices(prev)
+	})
+	device.SetAllowedDevices([]string{testDevice})
+}
+
+func TestState(t *testing.T) {
+	se := &device.StatusEvent{
+		TempA:     21.5,
+		HumidB:    60,
+		Door:      true,
+		Connected: true,
+		Mode:      device.ModeSilent,
+		Sunrise:   6*3600 + 30*60,
+	}
+	b, err := json.Marshal(newState(se))
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	for _, want := range []string{`"online":false`, `"connected":false`, `"temp_a":21.5`, `"humid_b":60`, `"door":true`, `"mode":"silent"`, `"sunrise":"06:30"`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("state %s doesn't contain %s", b, want)
+		}
+	}
+	se.Online = true
+	if !newState(se).Connected {
+		t.Errorf("online device that says it's connected isn't connected")
+	}
+
+	// Every mode the Plantcube reports is one of the select's
+	// options, but only some can be chosen
+	for m := device.ModeDefault; m < device.ModeOutOfRange; m++ {
+		se.Mode = m
+		if st := newState(se); !slices.Contains(modeOptions, st.Mode) {
+			t.Errorf("mode %v is '%s', which isn't in the options %v", m, st.Mode, modeOptions)
+		}
+	}
+	if command(nil, "mode", "cleaning") == nil {
+		t.Errorf("chose cleaning mode, got no error")
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	setupDevice(t)
+	p := testPub
+	b := New(p)
+	b.Announce()
+
+	for i := range entities {
+		e := &entities[i]
+		topic := configTopic(testDevice, e)
+		var c map[string]any
+		err := json.Unmarshal(p.waitFor(t, topic, ""), &c)
+		if err != nil {
+			t.Fatalf("config for '%s' doesn't unmarshal: %v", e.key, err)
+		}
+		if c["unique_id"] != "plantprism_"+strings.ReplaceAll(testDevice, "-", "")+"_"+e.key {
+			t.Errorf("config for '%s' has unique ID %v", e.key, c["unique_id"])
+		}
+		_, hasCommand := c["command_topic"]
+		if hasCommand != e.command {
+			t.Errorf("config for '%s' has command topic %v, want %v", e.key, hasCommand, e.command)
+		}
+		_, hasState := c["state_topic"]
+		if hasState != (e.component != "button") {
+			t.Errorf("config for '%s' has state topic %v", e.key, hasState)
+		}
+	}
+	// Following the device publishes its state
+	p.waitFor(t, stateTopic(testDevice), `"mode":"default"`)
+
+	// Home Assistant coming online gets everything again
+	topic := configTopic(testDevice, &entities[0])
+	if !b.HandleMessage("homeassistant/status", []byte("online")) {
+		t.Errorf("birth message not handled")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p.count(topic) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("config not published again after birth message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleMessage(t *testing.T) {
+	setupDevice(t)
+	p := testPub
+	b := New(p)
+	b.followDevices()
+	st := stateTopic(testDevice)
+	p.waitFor(t, st, `"sunrise":"07:00"`)
+
+	tests := []struct {
+		topic   string
+		payload string
+		want    bool
+	}{
+		{"plantprism/ha/" + testDevice + "/sunrise/set", "06:30", true},
+		{"plantprism/ha/" + testDevice + "/sunrise/set", "25:00", true},
+		{"plantprism/ha/" + testDevice + "/mode/set", "debug", true},
+		{"plantprism/ha/" + testDevice + "/state", "{}", true},
+		{"plantprism/ha/11111111-0000-4000-8000-000000000000/mode/set", "silent", true},
+		{"homeassistant/sensor/" + testDevice + "/door/config", "{}", true},
+		{"homeassistant/status", "offline", true},
+		{"agl/prod/things/" + testDevice + "/mode", "{}", false},
+		{"plantprism/" + testDevice + "/state", "{}", false},
+	}
+	for _, tc := range tests {
+		if got := b.HandleMessage(tc.topic, []byte(tc.payload)); got != tc.want {
+			t.Errorf("HandleMessage('%s') got %v, want %v", tc.topic, got, tc.want)
+		}
+	}
+	p.waitFor(t, st, `"sunrise":"06:30"`)
+
+	// The mode goes to the Plantcube as a desired state
+	b.HandleMessage("plantprism/ha/"+testDevice+"/mode/set", []byte("silent"))
+	p.waitFor(t, "$aws/things/"+testDevice+"/shadow/update/delta", `"mode":7`)
+}
+
+// TestHandleMessageBlocking checks that a command doesn't hold up the
+// goroutine the message came in on, since the acknowledgement the
+// command's publish waits for would come in on it too.
+func TestHandleMessageBlocking(t *testing.T) {
+	setupDevice(t)
+	p := testPub
+	b := New(p)
+	b.followDevices()
+	p.waitFor(t, stateTopic(testDevice), `"sunrise"`)
+
+	blocked := make(chan struct{})
+	p.mu.Lock()
+	p.blocked = blocked
+	p.mu.Unlock()
+	handled := make(chan struct{})
+	go func() {
+		b.HandleMessage("plantprism/ha/"+testDevice+"/sunrise/set", []byte("05:15"))
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("HandleMessage waited for the publish")
+	}
+	p.mu.Lock()
+	p.blocked = nil
+	p.mu.Unlock()
+	close(blocked)
+	p.waitFor(t, stateTopic(testDevice), `"sunrise":"05:15"`)
+}
+
+func TestNilBridge(t *testing.T) {
+	var b *Bridge
+	if b.HandleMessage("homeassistant/status", []byte("online")) {
+		t.Errorf("nil bridge handled message")
+	}
+	b.Announce()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Jon-Bright/plantprism/device"
+	"github.com/Jon-Bright/plantprism/history"
+	"github.com/Jon-Bright/plantprism/pcapdump"
+)
+
+// importMain implements "plantprism import", which backfills the
+// history store from existing plantprism.log files and pcap dumps.
+func importMain(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: plantprism import [flags] file...\n\nFiles ending in .pcap or .pcapng are read as packet dumps, anything else as plantprism log files.\n\n")
+		fs.PrintDefaults()
+	}
+	deviceID := fs.String("device", "", "Device ID to attribute log lines to, until the log says which device it's talking about")
+	tz := fs.String("tz", "local", "Timezone of the timestamps in log files: 'utc', 'local' or an IANA zone name")
+	dryRun := fs.Bool("dry_run", false, "Only report what would be imported")
+	verbose := fs.Bool("verbose", false, "Report every message that couldn't be parsed")
+	dataDir := dataDirFlags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	loc, err := history.ParseLocation(*tz)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 2
+	}
+	dir, err := dataDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %v\n", err)
+		return 2
+	}
+
+	replayer := device.NewReplayer()
+	recs := make(map[string][]history.Record)
+	failures := 0
+	report := func(what string, err error) {
+		failures++
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "import: %s: %v\n", what, err)
+		}
+	}
+	for _, fn := range fs.Args() {
+		if strings.HasSuffix(fn, ".pcap") || strings.HasSuffix(fn, ".pcapng") {
+			err = pcapdump.Read(fn, func(p *pcapdump.Packet) error {
+				matches := topicIncomingRe.FindStringSubmatch(p.Publish.TopicName)
+				if matches == nil {
+					// Most likely something we (or
+					// AWS) sent
+					return nil
+				}
+				prefix := matches[topicIncomingRe.SubexpIndex(TOPIC_PREFIX_GRP)]
+				id := matches[topicIncomingRe.SubexpIndex(TOPIC_DEVICE_GRP)]
+				event := matches[topicIncomingRe.SubexpIndex(TOPIC_EVENT_GRP)]
+				r, err := replayer.Replay(id, prefix, event, p.Publish.Payload, p.Time)
+				if err != nil {
+					report(fmt.Sprintf("%s packet %d, topic '%s'", fn, p.Num, p.Publish.TopicName), err)
+					return nil
+				}
+				recs[id] = append(recs[id], r...)
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "import: reading '%s' failed: %v\n", fn, err)
+				return 1
+			}
+			continue
+		}
+
+		fh, err := os.Open(fn)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import: %v\n", err)
+			return 1
+		}
+		sc := bufio.NewScanner(fh)
+		sc.Buffer(nil, 1024*1024)
+		for line := 1; sc.Scan(); line++ {
+			id, r, err := replayer.ReplayLogLine(*deviceID, sc.Text(), loc)
+			if err != nil {
+				report(fmt.Sprintf("%s line %d", fn, line), err)
+				continue
+			}
+			if len(r) > 0 {
+				recs[id] = append(recs[id], r...)
+			}
+		}
+		err = sc.Err()
+		fh.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import: reading '%s' failed: %v\n", fn, err)
+			return 1
+		}
+	}
+	if failures > 0 {
+		fmt.Fprintf(os.Stderr, "import: %d messages/lines couldn't be parsed and were skipped\n", failures)
+	}
+
+	store := history.New(dir)
+	for id, r := range recs {
+		if *dryRun {
+			fmt.Printf("Device %s: %d records found\n", id, len(r))
+			continue
+		}
+		added, err := store.Import(id, r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import: device %s: %v\n", id, err)
+			return 1
+		}
+		fmt.Printf("Device %s: %d records found, %d new\n", id, len(r), added)
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/device"
+)
+
+// blockingPublisher holds up whoever publishes until it's released.
+type blockingPublisher struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p *blockingPublisher) Publish(topic string, payload []byte) error {
+	select {
+	case p.started <- struct{}{}:
+	default:
+	}
+	<-p.release
+	return nil
+}
+
+// TestIngestBackpressure checks that a device whose processing is
+// stuck doesn't hold up the MQTT client, and loses its oldest
+// messages rather than its newest.
+func TestIngestBackpressure(t *testing.T) {
+	const id = "00000000-0000-4000-8000-0000000000aa"
+	prevAllowed, prevPublisher := device.AllowedDevices(), publisher
+	defer func() {
+		// This stops and forgets the device, so the next run
+		// loads it afresh, with the next run's publisher.
+		device.SetAllowedDevices(prevAllowed)
+		publisher = prevPublisher
+	}()
+	device.SetAllowedDevices(append(prevAllowed, id))
+	bp := &blockingPublisher{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+	publisher = bp
+
+	// Every shadow get is answered, so the first holds up the
+	// device's processing until the publisher's released.
+	get := &testMessage{t, "agl/all/things/" + id + "/shadow/get", nil}
+	messageHandler(nil, get)
+	select {
+	case <-bp.started:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("device didn't start processing")
+	}
+
+	const extra = 10
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < device.MSG_QUEUE_BUFFER+extra; i++ {
+			messageHandler(nil, get)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		close(bp.release)
+		t.Fatalf("messageHandler blocked on a stuck device")
+	}
+
+	d, err := device.Get(id, publisher)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	m := d.Metrics()
+	if m.Received != device.MSG_QUEUE_BUFFER+extra+1 || m.Dropped != extra || m.QueueDepth != device.MSG_QUEUE_BUFFER {
+		t.Errorf("got metrics %+v, want %d received, %d dropped, depth %d", m, device.MSG_QUEUE_BUFFER+extra+1, extra, device.MSG_QUEUE_BUFFER)
+	}
+
+	close(bp.release)
+	deadline := time.Now().Add(2 * time.Second)
+	for d.Metrics().Processed != device.MSG_QUEUE_BUFFER+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got metrics %+v after release, want %d processed", d.Metrics(), device.MSG_QUEUE_BUFFER+1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
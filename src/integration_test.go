@@ -10,12 +10,10 @@ package main
 // Plantprism's output/reaction matches that of the real Agrilution/AWS service.
 
 import (
-	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	golog "log"
 	"math"
 	"os"
@@ -24,17 +22,16 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Jon-Bright/plantprism/device"
 	"github.com/Jon-Bright/plantprism/logs"
+	"github.com/Jon-Bright/plantprism/pcapdump"
 	"github.com/Jon-Bright/plantprism/plant"
 	"github.com/benbjohnson/clock"
 	pahopackets "github.com/eclipse/paho.mqtt.golang/packets"
-	"github.com/gopacket/gopacket"
-	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/pcapgo"
 	"github.com/nsf/jsondiff"
 )
 
@@ -44,6 +41,7 @@ const (
 	DumpDevice        = "a8d39911-7955-47d3-981b-fbd9d52f9221"
 	ManualActionsFile = "test-manual-actions.json"
 	DebugTSFmt        = "2006-01-02T15:04:05.999"
+	StartTime         = 1691777930 // Unix time, before the first dump
 )
 
 var (
@@ -51,23 +49,36 @@ var (
 	clk     *clock.Mock
 )
 
+// TestMain initializes the devices once for every test: Init changes
+// globals that loaded devices use. A test that needs a device afresh
+// drops it from the allowed devices first.
 func TestMain(m *testing.M) {
 	device.InitFlags()
 	flag.Set("device", DumpDevice)
 	flag.Parse()
-	os.Exit(m.Run())
-}
-
-func TestReplay(t *testing.T) {
 	clk = clock.NewMock()
-	log = initLogging(t)
-	initPublisher(t)
+	clk.Set(time.Unix(StartTime, 0))
+	log = initLogging()
 	device.SetTestMode()
 	err := device.Init(log, clk)
 	if err != nil {
-		log.Critical.Fatalf("Failed to init devices: %v", err)
+		fmt.Fprintf(os.Stderr, "Failed to init devices: %v\n", err)
+		os.Exit(1)
 	}
-	err = plant.LoadPlants()
+	os.Exit(m.Run())
+}
+
+func TestReplay(t *testing.T) {
+	logTo(t)
+	initPublisher(t)
+	// Every run replays the dumps from the start, so needs the
+	// device as it was then. Dropping it from the allowed devices
+	// forgets it, and it's loaded afresh when it's next used.
+	clk.Set(time.Unix(StartTime, 0))
+	allowed := device.AllowedDevices()
+	device.SetAllowedDevices(nil)
+	device.SetAllowedDevices(allowed)
+	err := plant.LoadPlants()
 	if err != nil {
 		log.Critical.Fatalf("Failed to load plants: %v", err)
 	}
@@ -93,25 +104,54 @@ func TestReplay(t *testing.T) {
 	}
 }
 
+// logTest is the test that log messages go to. With none, they're
+// discarded.
+var logTest struct {
+	mu sync.Mutex
+	t  *testing.T
+}
+
+// logTo sends log messages to t until it finishes.
+func logTo(t *testing.T) {
+	logTest.mu.Lock()
+	logTest.t = t
+	logTest.mu.Unlock()
+	t.Cleanup(func() {
+		logTest.mu.Lock()
+		logTest.t = nil
+		logTest.mu.Unlock()
+	})
+}
+
 type testLogWriter struct {
-	t   *testing.T
 	err bool
 }
 
-func (t *testLogWriter) Write(p []byte) (n int, err error) {
-	t.t.Log(string(p))
-	if t.err {
-		t.t.Fatalf("error message logged")
+func (w *testLogWriter) Write(p []byte) (n int, err error) {
+	logTest.mu.Lock()
+	t := logTest.t
+	logTest.mu.Unlock()
+	if t == nil {
+		return len(p), nil
+	}
+	t.Log(string(p))
+	if w.err {
+		t.Fatalf("error message logged")
 	}
 	return len(p), nil
 }
 
-func initLogging(t *testing.T) *logs.Loggers {
-	tlwOK := testLogWriter{t, false}
-	tlwError := testLogWriter{t, true}
+func initLogging() *logs.Loggers {
+	tlwOK := testLogWriter{false}
+	tlwError := testLogWriter{true}
 	testLogOK := golog.New(&tlwOK, "", golog.LstdFlags)
 	testLogError := golog.New(&tlwError, "", golog.LstdFlags)
-	return &logs.Loggers{testLogOK, testLogOK, testLogError, testLogError}
+	return &logs.Loggers{
+		Info:     testLogOK,
+		Warn:     testLogOK,
+		Error:    testLogError,
+		Critical: testLogError,
+	}
 }
 
 type pubMsg struct {
@@ -202,7 +242,6 @@ type dumpPacket struct {
 	awsToPC   bool
 	packetNum int
 	ts        time.Time
-	raw       []byte
 	parsed    *pahopackets.PublishPacket
 }
 
@@ -216,99 +255,33 @@ func (dp dumpPacket) String() string {
 	return fmt.Sprintf("[%d: %s %s (%d)]", dp.packetNum, dir, dp.ts.Local().Format(DebugTSFmt), dp.ts.Unix())
 }
 
-var (
-	stash []byte
-)
-
 func processPCAP(t *testing.T, name string, ma *manualActions) error {
 	t.Logf("Processing '%s'...", name)
-	f, err := os.Open(name)
-	if err != nil {
-		return fmt.Errorf("unable to open: %w", err)
-	}
-	defer f.Close()
-
-	r, err := pcapgo.NewNgReader(f, pcapgo.NgReaderOptions{
-		// We get zero packets if we don't specify this,
-		// probably(?) because the pcapng file (or a segment
-		// within it?) is specifying ethernet link type and
-		// our packets have LinuxSLL2 link type.
-		WantMixedLinkType: true,
-	})
-	if err != nil {
-		return fmt.Errorf("unable to create ng reader: %w", err)
-	}
-
-	ps := gopacket.NewPacketSource(r, layers.LinkTypeLinuxSLL2)
-	i := 0
-	for {
-		i++
-		p, err := ps.NextPacket()
-		if err == io.EOF {
-			t.Logf("'%s': complete after %d packets", name, i)
-			return nil
-		} else if err != nil {
-			return fmt.Errorf("error on packet %d NextPacket: %w", i, err)
-		}
-		if el := p.ErrorLayer(); el != nil {
-			return fmt.Errorf("packet %d decode error: %w", i, el.Error())
-		}
-		app := p.ApplicationLayer()
-		if app == nil || len(app.Payload()) == 0 {
-			continue
-		}
-		tl := p.TransportLayer()
-		if tl == nil {
-			return fmt.Errorf("packet %d has application layer but no transport layer", i)
-		}
-
-		if stash != nil || len(app.Payload()) >= 1024 {
-			stash = append(stash, app.Payload()...)
-			if len(app.Payload()) >= 1024 {
-				continue
-			}
-		}
-
-		dp := dumpPacket{}
-
-		// All our dump packets have AWS on port 8884
-		// and the Plantcube on a random other port.
-		dp.awsToPC = (tl.TransportFlow().Src().String() == DumpAWSPort)
-		dp.packetNum = i
-		dp.ts = p.Metadata().Timestamp
-		if stash != nil {
-			dp.raw = stash
-			stash = nil
-		} else {
-			dp.raw = app.Payload()
-		}
-
-		err = processPayload(t, &dp, ma)
+	n := 0
+	err := pcapdump.Read(name, func(p *pcapdump.Packet) error {
+		n++
+		dp := dumpPacket{
+			// All our dump packets have AWS on port 8884
+			// and the Plantcube on a random other port.
+			awsToPC:   (p.SrcPort == DumpAWSPort),
+			packetNum: p.Num,
+			ts:        p.Time,
+			parsed:    p.Publish,
+		}
+		err := processPublish(t, &dp, ma)
 		if err != nil {
-			return fmt.Errorf("packet %d payload error: %w", i, err)
+			return fmt.Errorf("processPublish: %w", err)
 		}
 		if t.Failed() {
 			time.Sleep(1 * time.Second)
 			t.FailNow()
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-}
-
-func processPayload(t *testing.T, dp *dumpPacket, ma *manualActions) error {
-	for r := bytes.NewReader(dp.raw); r.Len() > 0; {
-		cp, err := pahopackets.ReadPacket(r)
-		if err != nil {
-			return fmt.Errorf("ReadPacket: %w", err)
-		}
-		switch p := cp.(type) {
-		case *pahopackets.PublishPacket:
-			dp.parsed = p
-			err = processPublish(t, dp, ma)
-			if err != nil {
-				return fmt.Errorf("processPublish: %w", err)
-			}
-		}
-	}
+	t.Logf("'%s': complete after %d publishes", name, n)
 	return nil
 }
 
@@ -396,12 +369,19 @@ func processManualAction(t *testing.T, ma *manualAction, dp *dumpPacket) (bool,
 		pushVersionOK = ma.VersionOK
 		return true, nil
 	case "bumpAWSVersion":
-		d.AWSVersion++
+		d.UpdateAWSVersion(func(v int) (int, error) {
+			return v + 1, nil
+		})
 	case "setAWSVersion":
-		if ma.AWSVersion < d.AWSVersion {
-			return false, fmt.Errorf("new AWS version %d is older than previous %d", ma.AWSVersion, d.AWSVersion)
+		err = d.UpdateAWSVersion(func(v int) (int, error) {
+			if ma.AWSVersion < v {
+				return v, fmt.Errorf("new AWS version %d is older than previous %d", ma.AWSVersion, v)
+			}
+			return ma.AWSVersion, nil
+		})
+		if err != nil {
+			return false, err
 		}
-		d.AWSVersion = ma.AWSVersion
 	case "harvest":
 		err = d.HarvestPlant(ma.Slot)
 		if err != nil {
@@ -419,27 +399,27 @@ func processManualAction(t *testing.T, ma *manualAction, dp *dumpPacket) (bool,
 			return false, fmt.Errorf("sunrise %v failed: %w", sd, err)
 		}
 	case "defaultMode":
-		err = d.SetMode(device.ModeDefault)
+		err = d.SetMode(device.ModeDefault, true)
 		if err != nil {
 			return false, fmt.Errorf("default mode failed: %w", err)
 		}
 	case "silent":
-		err = d.SetMode(device.ModeSilent)
+		err = d.SetMode(device.ModeSilent, true)
 		if err != nil {
 			return false, fmt.Errorf("silent mode failed: %w", err)
 		}
 	case "cinema":
-		err = d.SetMode(device.ModeCinema)
+		err = d.SetMode(device.ModeCinema, true)
 		if err != nil {
 			return false, fmt.Errorf("cinema mode failed: %w", err)
 		}
 	case "cleaning":
-		err = d.SetMode(device.ModeCleaning)
+		err = d.SetMode(device.ModeCleaning, true)
 		if err != nil {
 			return false, fmt.Errorf("cleaning mode failed: %w", err)
 		}
 	case "drain":
-		err = d.SetMode(device.ModeTankDrainCleaning)
+		err = d.SetMode(device.ModeTankDrainCleaning, true)
 		if err != nil {
 			return false, fmt.Errorf("drain/cleaning mode failed: %w", err)
 		}
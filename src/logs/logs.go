@@ -2,6 +2,7 @@ package logs
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 )
@@ -11,18 +12,52 @@ type Loggers struct {
 	Warn     *log.Logger
 	Error    *log.Logger
 	Critical *log.Logger
+
+	out io.Writer
 }
 
+// Levels are the levels SetLevel accepts, from most to least verbose.
+var Levels = []string{"info", "warn", "error"}
+
 func New(logName string) *Loggers {
 	lf, err := os.OpenFile(logName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		panic(fmt.Sprintf("Unable to open log file: %v", err))
 	}
 
-	l := Loggers{}
+	l := Loggers{out: lf}
 	l.Info = log.New(lf, "INFO: ", log.LstdFlags)
 	l.Warn = log.New(lf, "WARN: ", log.LstdFlags)
 	l.Error = log.New(lf, "ERROR: ", log.LstdFlags)
 	l.Critical = log.New(lf, "CRIT: ", log.LstdFlags)
 	return &l
 }
+
+// Discard returns Loggers that discard everything, for tests that
+// don't care what's logged.
+func Discard() *Loggers {
+	dl := log.New(io.Discard, "", 0)
+	return &Loggers{Info: dl, Warn: dl, Error: dl, Critical: dl, out: io.Discard}
+}
+
+// SetLevel discards everything less severe than the given level.
+// Critical messages are never discarded.
+func (l *Loggers) SetLevel(level string) error {
+	var discard []*log.Logger
+	switch level {
+	case "info":
+	case "warn":
+		discard = []*log.Logger{l.Info}
+	case "error":
+		discard = []*log.Logger{l.Info, l.Warn}
+	default:
+		return fmt.Errorf("invalid log level '%s', want one of %v", level, Levels)
+	}
+	for _, lg := range []*log.Logger{l.Info, l.Warn, l.Error} {
+		lg.SetOutput(l.out)
+	}
+	for _, lg := range discard {
+		lg.SetOutput(io.Discard)
+	}
+	return nil
+}
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"os"
 	"regexp"
+	"strings"
 
+	"github.com/Jon-Bright/plantprism/broker"
+	"github.com/Jon-Bright/plantprism/config"
 	"github.com/Jon-Bright/plantprism/device"
+	"github.com/Jon-Bright/plantprism/eventlog"
+	"github.com/Jon-Bright/plantprism/history"
+	"github.com/Jon-Bright/plantprism/homeassistant"
 	"github.com/Jon-Bright/plantprism/logs"
 	"github.com/Jon-Bright/plantprism/mqtt"
+	"github.com/Jon-Bright/plantprism/mqttapi"
+	"github.com/Jon-Bright/plantprism/notify"
 	"github.com/Jon-Bright/plantprism/plant"
 	"github.com/Jon-Bright/plantprism/ui"
 	"github.com/benbjohnson/clock"
@@ -29,9 +40,16 @@ const (
 )
 
 var (
+	configName *string
+	logName    *string
+	logLevel   *string
+	dataDir    *string
+
 	log       *logs.Loggers
 	mq        *mqtt.MQTT
 	publisher device.Publisher
+	ha        *homeassistant.Bridge
+	api       *mqttapi.API
 
 	topicIncomingRe = regexp.MustCompile(TOPIC_INCOMING_REGEX)
 	topicOutgoingRe = regexp.MustCompile(TOPIC_OUTGOING_REGEX)
@@ -72,16 +90,33 @@ func connectHandler(c paho.Client) {
 		mh = nil
 	}
 	log.Info.Printf("Subscribed to %d topics", i)
+	device.RetryOutboxes()
+	go ha.Announce()
+	go api.Republish()
 }
 
 func messageHandler(c paho.Client, m paho.Message) {
-	matches := topicIncomingRe.FindStringSubmatch(m.Topic())
+	handleMessage(m.Topic(), m.Payload())
+}
+
+// handleMessage hands a message from MQTT, whether from the broker we
+// connect to or the embedded broker, to its device.
+func handleMessage(topic string, payload []byte) {
+	if ha.HandleMessage(topic, payload) || api.HandleMessage(topic, payload) {
+		return
+	}
+	matches := topicIncomingRe.FindStringSubmatch(topic)
 	if matches == nil {
-		if !topicOutgoingRe.MatchString(m.Topic()) {
-			log.Error.Printf("Message topic '%s' unknown, ignoring", m.Topic())
+		if !topicOutgoingRe.MatchString(topic) {
+			device.NoteUnknownTopic(topic, payload)
+			if device.Lenient() {
+				log.Warn.Printf("Message topic '%s' unknown, catalogued", topic)
+			} else {
+				log.Error.Printf("Message topic '%s' unknown, ignoring", topic)
+			}
 			return
 		}
-		log.Info.Printf("Outgoing topic '%s' seen", m.Topic())
+		log.Info.Printf("Outgoing topic '%s' seen", topic)
 		return
 	}
 	prefix := matches[topicIncomingRe.SubexpIndex(TOPIC_PREFIX_GRP)]
@@ -95,40 +130,140 @@ func messageHandler(c paho.Client, m paho.Message) {
 		return
 	}
 
-	device.ProcessMessage(prefix, event, m.Payload())
+	device.ProcessMessage(prefix, event, payload)
 }
 
-func main() {
+func registerFlags() {
 	device.InitFlags()
 	mqtt.InitFlags()
-	logName := flag.String("logfile", "plantprism.log", "Name of the log file to use")
+	broker.InitFlags()
+	notify.InitFlags()
+	homeassistant.InitFlags()
+	mqttapi.InitFlags()
+	ui.InitFlags()
+	configName = flag.String("config", "", "YAML config file. Flags given on the command line override its settings.")
+	logName = flag.String("logfile", "plantprism.log", "Name of the log file to use")
+	logLevel = flag.String("log_level", "info", "Least severe messages to log: "+strings.Join(logs.Levels, ", "))
+	dataDir = flag.String("data_dir", ".", "Directory for device files, history and event logs")
+}
 
+// loadConfig applies the config file named by -config, if any, to
+// the flags, and configures the devices it lists.
+func loadConfig(fs *flag.FlagSet) error {
+	if *configName == "" {
+		return nil
+	}
+	cfg, err := config.Load(*configName)
+	if err != nil {
+		return err
+	}
+	err = errors.Join(cfg.Validate(), cfg.Apply(fs))
+	if err != nil {
+		return fmt.Errorf("config '%s': %w", *configName, err)
+	}
+	for _, d := range cfg.Devices {
+		err = device.Configure(d.ID, device.DeviceConfig{
+			Name:     d.Name,
+			Timezone: d.Timezone,
+			Sunrise:  d.Sunrise,
+		})
+		if err != nil {
+			return fmt.Errorf("config '%s': %w", *configName, err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			os.Exit(exportMain(os.Args[2:]))
+		case "import":
+			os.Exit(importMain(os.Args[2:]))
+		case "config":
+			os.Exit(configMain(os.Args[2:]))
+		}
+	}
+
+	registerFlags()
 	flag.Parse()
+	clk := clock.New()
+	rl := newReloader(clk)
+	err := loadConfig(flag.CommandLine)
+	if err != nil {
+		// We can't log this: the log file might be in the
+		// config
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
 
 	log = logs.New(*logName)
+	err = log.SetLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
 	log.Info.Printf("Starting")
+	if *configName != "" {
+		log.Info.Printf("Loaded config '%s'", *configName)
+	}
 
-	clk := clock.New()
-
-	err := device.Init(log, clk)
+	err = device.Init(log, clk)
 	if err != nil {
 		log.Critical.Fatalf("Device flags: %v", err)
 	}
+	device.SetDataDir(*dataDir)
+	device.SetHistory(history.New(*dataDir))
+	device.SetEventLog(eventlog.New(*dataDir))
+	notifier, err := notify.Init(log, clk)
+	if err != nil {
+		log.Critical.Fatalf("Notification flags: %v", err)
+	}
+	rl.setNotifier(notifier)
+	device.SetNoticeHandler(rl.publish)
 	err = plant.LoadPlants()
 	if err != nil {
 		log.Critical.Fatalf("Failed to load plants: %v", err)
 	}
 
-	mq, err = mqtt.New(log, connectHandler)
+	if broker.Enabled() {
+		b, ln, err := broker.NewFromFlags(log, handleMessage, func(string) {
+			device.RetryOutboxes()
+		})
+		if err != nil {
+			log.Critical.Fatalf("Unable to start embedded broker: %v", err)
+		}
+		publisher = b
+		since := clk.Now()
+		ui.SetConnectionStatus(func() mqtt.Status {
+			return mqtt.Status{State: mqtt.StateEmbedded, Broker: ln.Addr().String(), Since: since}
+		})
+		go func() {
+			err := b.Serve(ln)
+			log.Critical.Fatalf("Embedded broker failed: %v", err)
+		}()
+	} else {
+		mq, err = mqtt.New(log, connectHandler)
+		if err != nil {
+			log.Critical.Fatalf("Unable to initialize MQTT: %v", err)
+		}
+		publisher = mq
+		ui.SetConnectionStatus(mq.Status)
+	}
+	ha = homeassistant.Init(log, publisher)
+	api, err = mqttapi.Init(log, publisher)
 	if err != nil {
-		log.Critical.Fatalf("Unable to initialize MQTT: %v", err)
+		log.Critical.Fatalf("Unable to initialize MQTT API: %v", err)
 	}
-	publisher = mq
-	ui.Init(log, mq, GitVersion)
+	ui.Init(log, publisher, GitVersion)
+	ui.SetReloader(func() (any, error) {
+		return rl.reload()
+	})
+	go rl.handleSIGHUP()
 
-	err = mq.Connect()
-	if err != nil {
-		log.Critical.Fatalf("Unable to connect MQTT: %v", err)
+	if mq != nil {
+		mq.Start()
 	}
 
 	log.Info.Printf("Initialization complete")
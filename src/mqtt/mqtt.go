@@ -1,12 +1,18 @@
 package mqtt
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Jon-Bright/plantprism/logs"
@@ -15,112 +21,353 @@ import (
 
 const (
 	MQTT_PUBLISH_TIMEOUT = 30 * time.Second
+
+	// BROKER_PASSWORD_ENV is an environment variable the broker
+	// password can be given in, rather than in a flag, which
+	// anyone can see with ps.
+	BROKER_PASSWORD_ENV = "PLANTPRISM_BROKER_PASSWORD"
 )
 
 type MQTT struct {
 	c   paho.Client
 	log *logs.Loggers
+
+	mu     sync.Mutex
+	status Status
 }
 
 type brokerFlags struct {
-	url         string
-	username    string
-	password    string
-	clientID    string
-	caCert      string
-	keepAlive   time.Duration
-	pingTimeout time.Duration
-	insecure    bool
+	url           string
+	failoverURLs  urlList
+	username      string
+	password      string
+	passwordFile  string
+	clientID      string
+	caCert        string
+	clientCert    string
+	clientKey     string
+	tlsMinVersion string
+	tlsCiphers    string
+	keepAlive     time.Duration
+	pingTimeout   time.Duration
+	maxReconnect  time.Duration
+	insecure      bool
+}
+
+type urlList []string
+
+func (l *urlList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *urlList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *urlList) Reset() {
+	*l = nil
 }
 
 var bf brokerFlags
 
 func InitFlags() {
 	flag.StringVar(&bf.url, "broker_url", "ssl://localhost:8883", "MQTT broker's URL, including protocol and port")
+	flag.Var(&bf.failoverURLs, "broker_failover_url", "URL of a broker to use when -broker_url can't be reached. Can be specified multiple times, and they're tried in order.")
 	flag.StringVar(&bf.username, "broker_username", "", "Username for MQTT broker")
-	flag.StringVar(&bf.password, "broker_password", "", "Password for MQTT broker")
+	flag.StringVar(&bf.password, "broker_password", "", "Password for MQTT broker. Visible to other users: prefer -broker_password_file or $"+BROKER_PASSWORD_ENV+".")
+	flag.StringVar(&bf.passwordFile, "broker_password_file", "", "File containing the password for MQTT broker")
 	flag.StringVar(&bf.clientID, "broker_client_id", "", "Client ID for MQTT broker")
 	flag.StringVar(&bf.caCert, "broker_ca_cert", "", "Filename of a custom CA cert to trust from the broker")
+	flag.StringVar(&bf.clientCert, "broker_client_cert", "", "Filename of a client cert to present to the broker")
+	flag.StringVar(&bf.clientKey, "broker_client_key", "", "Filename of the key for -broker_client_cert")
+	flag.StringVar(&bf.tlsMinVersion, "broker_tls_min_version", "1.2", "Minimum TLS version to use with the broker: "+strings.Join(tlsVersionNames(), ", "))
+	flag.StringVar(&bf.tlsCiphers, "broker_tls_ciphers", "", "Comma-separated TLS 1.2 cipher suites to offer the broker, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Empty means Go's defaults.")
 	flag.DurationVar(&bf.keepAlive, "broker_keep_alive", 60*time.Second, "Interval for sending keep-alive packets to the MQTT broker")
 	flag.DurationVar(&bf.pingTimeout, "broker_ping_timeout", 130*time.Second, "Timeout after which the connection to the MQTT broker is regarded as dead")
+	flag.DurationVar(&bf.maxReconnect, "broker_max_reconnect_interval", 2*time.Minute, "Longest wait between attempts to connect to the MQTT broker. The wait starts at a second, and doubles with each failure.")
 	flag.BoolVar(&bf.insecure, "broker_insecure", false, "Don't verify broker SSL cert. Use for testing only.")
 }
 
-func addCACert(opts *paho.ClientOptions, caCert string) (*paho.ClientOptions, error) {
-	// Get the SystemCertPool, continue with an empty pool on error
-	rootCAs, _ := x509.SystemCertPool()
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlsVersionNames() []string {
+	var l []string
+	for n := range tlsVersions {
+		l = append(l, n)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// password returns the broker password from whichever of the flag,
+// the file and the environment it's in. It's an error for it to be in
+// more than one.
+func password() (string, error) {
+	var sources []string
+	pw := bf.password
+	if bf.password != "" {
+		sources = append(sources, "-broker_password")
+	}
+	if bf.passwordFile != "" {
+		sources = append(sources, "-broker_password_file")
+		b, err := os.ReadFile(bf.passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read broker password: %w", err)
+		}
+		pw = strings.TrimRight(string(b), "\r\n")
+	}
+	if env := os.Getenv(BROKER_PASSWORD_ENV); env != "" {
+		sources = append(sources, "$"+BROKER_PASSWORD_ENV)
+		pw = env
+	}
+	if len(sources) > 1 {
+		return "", fmt.Errorf("broker password given in more than one way: %s", strings.Join(sources, ", "))
+	}
+	return pw, nil
+}
+
+// tlsConfig builds the TLS config for connecting to the broker.
+func tlsConfig() (*tls.Config, error) {
+	if bf.insecure && bf.caCert != "" {
+		return nil, fmt.Errorf("insecure and CA cert '%s' are both specified", bf.caCert)
+	}
+	minVersion, ok := tlsVersions[bf.tlsMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version '%s', want one of %v", bf.tlsMinVersion, tlsVersionNames())
+	}
+	config := &tls.Config{
+		MinVersion:         minVersion,
+		InsecureSkipVerify: bf.insecure,
 	}
+	if bf.tlsCiphers != "" {
+		byName := make(map[string]uint16)
+		for _, cs := range tls.CipherSuites() {
+			byName[cs.Name] = cs.ID
+		}
+		for _, name := range strings.Split(bf.tlsCiphers, ",") {
+			name = strings.TrimSpace(name)
+			id, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure TLS cipher suite '%s'", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	if bf.caCert != "" {
+		// Get the SystemCertPool, continue with an empty pool on error
+		rootCAs, _ := x509.SystemCertPool()
+		if rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+		certs, err := os.ReadFile(bf.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to append %q to root CAs: %w", bf.caCert, err)
+		}
+		if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
+			paho.WARN.Println("No certs appended, using system certs only")
+		}
+		config.RootCAs = rootCAs
+	}
+	if (bf.clientCert == "") != (bf.clientKey == "") {
+		return nil, errors.New("a client cert needs both -broker_client_cert and -broker_client_key")
+	}
+	if bf.clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(bf.clientCert, bf.clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// isTLS says whether a broker URL's scheme means TLS, as paho sees it.
+func isTLS(u *url.URL) bool {
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		return true
+	}
+	return false
+}
 
-	// Read in the cert file
-	certs, err := ioutil.ReadFile(caCert)
+// isTCP says whether a broker URL's scheme means unencrypted TCP.
+func isTCP(u *url.URL) bool {
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return true
+	}
+	return false
+}
+
+// checkURL checks a broker URL is one we can connect to, and says
+// whether it's TLS.
+func checkURL(us string) (bool, error) {
+	u, err := url.Parse(us)
 	if err != nil {
-		return nil, fmt.Errorf("failed to append %q to root CAs: %w", caCert, err)
+		return false, fmt.Errorf("invalid broker URL '%s': %w", us, err)
 	}
+	if isTLS(u) {
+		return true, nil
+	}
+	if !isTCP(u) {
+		return false, fmt.Errorf("broker URL '%s' has unsupported scheme '%s'", us, u.Scheme)
+	}
+	return false, nil
+}
 
-	// Append our cert to the system pool
-	if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-		paho.WARN.Println("No certs appended, using system certs only")
+// explainTLSError says which part of the TLS handshake failed, and
+// what to check.
+func explainTLSError(err error) error {
+	var (
+		uae x509.UnknownAuthorityError
+		he  x509.HostnameError
+		cie x509.CertificateInvalidError
+		rhe tls.RecordHeaderError
+		oe  *net.OpError
+	)
+	switch {
+	case errors.As(err, &uae):
+		return fmt.Errorf("broker's certificate isn't signed by a trusted CA, check -broker_ca_cert: %w", err)
+	case errors.As(err, &he):
+		return fmt.Errorf("broker's certificate isn't for the host in -broker_url: %w", err)
+	case errors.As(err, &cie):
+		return fmt.Errorf("broker's certificate isn't valid: %w", err)
+	case errors.As(err, &rhe):
+		return fmt.Errorf("broker didn't answer with TLS, check the scheme and port in -broker_url: %w", err)
+	case errors.As(err, &oe) && oe.Op == "remote error":
+		// The broker sent an alert. Go doesn't export the
+		// alert's type, only its text.
+		alert := oe.Err.Error()
+		switch {
+		case strings.Contains(alert, "certificate required"):
+			return fmt.Errorf("broker wants a client certificate, set -broker_client_cert and -broker_client_key: %w", err)
+		case strings.Contains(alert, "certificate"), strings.Contains(alert, "unknown certificate authority"):
+			return fmt.Errorf("broker rejected our client certificate: %w", err)
+		case strings.Contains(alert, "protocol version"):
+			return fmt.Errorf("broker supports no TLS version from -broker_tls_min_version up: %w", err)
+		case strings.Contains(alert, "handshake failure"), strings.Contains(alert, "insufficient security"):
+			return fmt.Errorf("broker and we have no TLS cipher suite in common, check -broker_tls_ciphers: %w", err)
+		}
+		return fmt.Errorf("broker aborted the TLS handshake: %w", err)
 	}
+	return fmt.Errorf("TLS handshake with broker failed: %w", err)
+}
 
-	// Trust the augmented cert pool in our client
-	config := &tls.Config{
-		RootCAs: rootCAs,
+// tlsConn explains alerts the broker sends after the handshake: with
+// TLS 1.3, a rejected client certificate only shows up when we first
+// read.
+type tlsConn struct {
+	*tls.Conn
+}
+
+func (c tlsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "remote error" {
+		err = explainTLSError(err)
 	}
-	return opts.SetTLSConfig(config), nil
+	return n, err
 }
 
+// dialTLS connects to the broker, so that a failure can be explained
+// before paho turns it into a string.
+func dialTLS(config *tls.Config, uri *url.URL, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.Dial("tcp", uri.Host)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't reach broker at %s: %w", uri.Host, err)
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = uri.Hostname()
+	}
+	tc := tls.Client(conn, config)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = tc.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, explainTLSError(err)
+	}
+	return tlsConn{tc}, nil
+}
+
+// pahoLogs makes sure paho's loggers, which are globals, are only
+// set once: an earlier client's goroutines might still be using them.
+var pahoLogs sync.Once
+
 func New(l *logs.Loggers, connectHandler paho.OnConnectHandler) (*MQTT, error) {
-	paho.DEBUG = l.Info
-	paho.WARN = l.Warn
-	paho.ERROR = l.Error
-	paho.CRITICAL = l.Critical
+	pahoLogs.Do(func() {
+		paho.DEBUG = l.Info
+		paho.WARN = l.Warn
+		paho.ERROR = l.Error
+		paho.CRITICAL = l.Critical
+	})
 
-	if bf.insecure && bf.caCert != "" {
-		return nil, fmt.Errorf("insecure and CA cert '%s' are both specified", bf.caCert)
+	m := MQTT{log: l}
+	m.status = Status{State: StateDisconnected, Since: time.Now()}
+	urls := append([]string{bf.url}, bf.failoverURLs...)
+	var config *tls.Config
+	opts := paho.NewClientOptions()
+	for _, us := range urls {
+		useTLS, err := checkURL(us)
+		if err != nil {
+			return nil, err
+		}
+		if useTLS && config == nil {
+			config, err = tlsConfig()
+			if err != nil {
+				return nil, err
+			}
+		}
+		opts = opts.AddBroker(us)
 	}
-
-	opts := paho.NewClientOptions().
-		AddBroker(bf.url).
+	if config == nil && (bf.caCert != "" || bf.clientCert != "" || bf.insecure) {
+		l.Warn.Printf("No broker URL is TLS, ignoring TLS settings")
+	}
+	pw, err := password()
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.
 		SetKeepAlive(bf.keepAlive).
 		SetPingTimeout(bf.pingTimeout).
-		SetOnConnectHandler(connectHandler)
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(bf.maxReconnect).
+		SetCustomOpenConnectionFn(func(uri *url.URL, o paho.ClientOptions) (net.Conn, error) {
+			return m.dial(config, uri, o.ConnectTimeout)
+		}).
+		SetOnConnectHandler(func(c paho.Client) {
+			m.connected()
+			connectHandler(c)
+		}).
+		SetConnectionLostHandler(m.connectionLost).
+		SetReconnectingHandler(func(paho.Client, *paho.ClientOptions) {
+			m.reconnecting()
+		})
 	if bf.username != "" {
 		opts = opts.SetUsername(bf.username)
 	}
-	if bf.password != "" {
-		opts = opts.SetPassword(bf.password)
+	if pw != "" {
+		opts = opts.SetPassword(pw)
 	}
 	if bf.clientID != "" {
 		opts = opts.SetClientID(bf.clientID)
 	}
-	if bf.caCert != "" {
-		var err error
-		opts, err = addCACert(opts, bf.caCert)
-		if err != nil {
-			return nil, err
-		}
-	} else if bf.insecure {
-		config := &tls.Config{
-			InsecureSkipVerify: true,
-		}
+	if config != nil {
 		opts = opts.SetTLSConfig(config)
 	}
 
-	c := paho.NewClient(opts)
-
-	m := MQTT{c, l}
+	m.c = paho.NewClient(opts)
 	return &m, nil
 }
 
-func (m *MQTT) Connect() error {
-	if token := m.c.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
-	}
-	return nil
-}
-
 func (m *MQTT) Subscribe(topic string, handler paho.MessageHandler) error {
 	token := m.c.Subscribe(topic, 1, handler)
 	token.Wait()
@@ -133,7 +380,22 @@ func (m *MQTT) Subscribe(topic string, handler paho.MessageHandler) error {
 }
 
 func (m *MQTT) Publish(topic string, payload []byte) error {
-	token := m.c.Publish(topic, 1, false, payload)
+	return m.publish(topic, payload, false)
+}
+
+// PublishRetained publishes a message the broker keeps for clients
+// that subscribe later.
+func (m *MQTT) PublishRetained(topic string, payload []byte) error {
+	return m.publish(topic, payload, true)
+}
+
+func (m *MQTT) publish(topic string, payload []byte, retained bool) error {
+	// Fail straight away rather than waiting for paho to time
+	// out: the outbox tries again once we're connected.
+	if st := m.Status(); st.State != StateConnected {
+		return fmt.Errorf("not connected to MQTT broker, %s", st.State)
+	}
+	token := m.c.Publish(topic, 1, retained, payload)
 	if !token.WaitTimeout(MQTT_PUBLISH_TIMEOUT) {
 		return errors.New("timeout publishing MQTT msg")
 	}
@@ -0,0 +1,378 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/broker"
+	"github.com/Jon-Bright/plantprism/logs"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestPassword(t *testing.T) {
+	prev := bf
+	defer func() {
+		bf = prev
+	}()
+	fn := filepath.Join(t.TempDir(), "password")
+	err := os.WriteFile(fn, []byte("from-file\n"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	tests := []struct {
+		name    string
+		flag    string
+		file    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "flag", flag: "from-flag", want: "from-flag"},
+		{name: "file", file: fn, want: "from-file"},
+		{name: "env", env: "from-env", want: "from-env"},
+		{name: "flag and env", flag: "from-flag", env: "from-env", wantErr: true},
+		{name: "file and env", file: fn, env: "from-env", wantErr: true},
+		{name: "missing file", file: fn + "-missing", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bf.password, bf.passwordFile = tc.flag, tc.file
+			t.Setenv(BROKER_PASSWORD_ENV, tc.env)
+			got, err := password()
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("got password '%s', want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("password failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("got password '%s', want '%s'", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	prev := bf
+	defer func() {
+		bf = prev
+	}()
+	bf = brokerFlags{tlsMinVersion: "1.3", tlsCiphers: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+	c, err := tlsConfig()
+	if err != nil {
+		t.Fatalf("tlsConfig failed: %v", err)
+	}
+	if c.MinVersion != tls.VersionTLS13 {
+		t.Errorf("got min version %x, want %x", c.MinVersion, tls.VersionTLS13)
+	}
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	if len(c.CipherSuites) != 2 || c.CipherSuites[0] != want[0] || c.CipherSuites[1] != want[1] {
+		t.Errorf("got cipher suites %v, want %v", c.CipherSuites, want)
+	}
+
+	for _, f := range []brokerFlags{
+		{tlsMinVersion: "1.4"},
+		{tlsMinVersion: "1.2", tlsCiphers: "TLS_RSA_WITH_RC4_128_SHA"},
+		{tlsMinVersion: "1.2", clientCert: "client.pem"},
+		{tlsMinVersion: "1.2", insecure: true, caCert: "ca.pem"},
+	} {
+		bf = f
+		_, err = tlsConfig()
+		if err == nil {
+			t.Errorf("tlsConfig with %+v succeeded, want error", f)
+		}
+	}
+}
+
+// newCert returns a cert for 127.0.0.1, signed by parent, or
+// self-signed if parent's nil.
+func newCert(t *testing.T, parent *tls.Certificate, isCA bool) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// serve accepts connections on a new listener, handing each to f.
+func serve(t *testing.T, f func(net.Conn)) *url.URL {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				f(conn)
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "ssl", Host: ln.Addr().String()}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	ca := newCert(t, nil, true)
+	server := newCert(t, &ca, false)
+	client := newCert(t, &ca, false)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	tlsServer := func(config *tls.Config) *url.URL {
+		config.Certificates = []tls.Certificate{server}
+		return serve(t, func(conn net.Conn) {
+			tc := tls.Server(conn, config)
+			if tc.Handshake() == nil {
+				tc.Write([]byte{0})
+			}
+		})
+	}
+	tests := []struct {
+		name   string
+		uri    *url.URL
+		config *tls.Config
+		want   string // Empty if the connection should work
+	}{
+		{
+			name:   "ok",
+			uri:    tlsServer(&tls.Config{}),
+			config: &tls.Config{RootCAs: roots},
+		}, {
+			name:   "untrusted",
+			uri:    tlsServer(&tls.Config{}),
+			config: &tls.Config{},
+			want:   "isn't signed by a trusted CA",
+		}, {
+			name:   "wrong host",
+			uri:    tlsServer(&tls.Config{}),
+			config: &tls.Config{RootCAs: roots, ServerName: "broker.example"},
+			want:   "isn't for the host",
+		}, {
+			name: "not TLS",
+			uri: serve(t, func(conn net.Conn) {
+				conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			}),
+			config: &tls.Config{RootCAs: roots},
+			want:   "didn't answer with TLS",
+		}, {
+			name:   "version",
+			uri:    tlsServer(&tls.Config{MaxVersion: tls.VersionTLS12}),
+			config: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS13},
+			want:   "no TLS version",
+		}, {
+			name:   "no client cert",
+			uri:    tlsServer(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: roots}),
+			config: &tls.Config{RootCAs: roots},
+			want:   "wants a client certificate",
+		}, {
+			name:   "client cert",
+			uri:    tlsServer(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: roots}),
+			config: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := dialTLS(tc.config, tc.uri, 5*time.Second)
+			if err == nil {
+				// A rejected client cert only shows up
+				// on reading, with TLS 1.3
+				_, err = conn.Read(make([]byte, 1))
+				conn.Close()
+			}
+			if tc.want == "" {
+				if err != nil {
+					t.Errorf("got error %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want one containing '%s'", err, tc.want)
+			}
+		})
+	}
+}
+
+// startBroker runs an embedded broker on addr, which can have port 0.
+func startBroker(t *testing.T, l *logs.Loggers, addr string) (*broker.Broker, string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	b := broker.New(l, broker.Options{})
+	go b.Serve(ln)
+	t.Cleanup(func() { b.Close() })
+	return b, ln.Addr().String()
+}
+
+// unusedAddr returns an address nothing's listening on.
+func unusedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func waitForState(t *testing.T, m *MQTT, want ConnState) Status {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		st := m.Status()
+		if st.State == want {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got state %+v, want '%s'", st, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnection(t *testing.T) {
+	l := logs.Discard()
+	prev, prevBackoff := bf, connectBackoffMin
+	defer func() {
+		bf, connectBackoffMin = prev, prevBackoff
+	}()
+	connectBackoffMin = 10 * time.Millisecond
+
+	// The first broker's never up, and the second isn't at first
+	dead, addr := unusedAddr(t), unusedAddr(t)
+	bf = brokerFlags{
+		url:          "tcp://" + dead,
+		failoverURLs: urlList{"tcp://" + addr},
+		keepAlive:    time.Minute,
+		pingTimeout:  time.Minute,
+		maxReconnect: 50 * time.Millisecond,
+	}
+	connects := make(chan struct{}, 10)
+	m, err := New(l, func(paho.Client) {
+		connects <- struct{}{}
+	})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	m.Start()
+	defer m.c.Disconnect(0)
+	deadline := time.Now().Add(10 * time.Second)
+	for m.Status().Attempts < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no retries, status %+v", m.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := m.Status(); st.State == StateConnected || st.LastError == "" {
+		t.Errorf("got status %+v with no broker, want not connected with an error", st)
+	}
+	err = m.Publish("a/b", []byte("x"))
+	if err == nil {
+		t.Errorf("Publish with no broker succeeded")
+	}
+
+	b, _ := startBroker(t, l, addr)
+	st := waitForState(t, m, StateConnected)
+	if want := "tcp://" + addr; st.Broker != want {
+		t.Errorf("connected to '%s', want '%s'", st.Broker, want)
+	}
+	if st.Attempts != 0 || st.LastError != "" {
+		t.Errorf("got status %+v once connected, want no attempts or error", st)
+	}
+	select {
+	case <-connects:
+	case <-time.After(5 * time.Second):
+		t.Errorf("connect handler not called")
+	}
+
+	b.Close()
+	deadline = time.Now().Add(10 * time.Second)
+	for m.Status().Lost == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection loss not noticed, status %+v", m.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := m.Status(); st.State == StateConnected {
+		t.Errorf("got status %+v after losing the broker, want not connected", st)
+	}
+	startBroker(t, l, addr)
+	waitForState(t, m, StateConnected)
+	select {
+	case <-connects:
+	case <-time.After(5 * time.Second):
+		t.Errorf("connect handler not called on reconnect")
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantTLS bool
+		wantErr bool
+	}{
+		{url: "ssl://broker:8883", wantTLS: true},
+		{url: "mqtts://broker:8883", wantTLS: true},
+		{url: "tcp://broker:1883"},
+		{url: "mqtt://broker:1883"},
+		{url: "http://broker:80", wantErr: true},
+		{url: "ws://broker:80", wantErr: true},
+		{url: "::", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := checkURL(tc.url)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("checkURL('%s') succeeded, want error", tc.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("checkURL('%s') failed: %v", tc.url, err)
+		} else if got != tc.wantTLS {
+			t.Errorf("checkURL('%s') got TLS %v, want %v", tc.url, got, tc.wantTLS)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ConnState is where the connection to the broker is at.
+type ConnState string
+
+const (
+	StateDisconnected ConnState = "disconnected"
+	StateConnecting   ConnState = "connecting"
+	StateConnected    ConnState = "connected"
+	StateReconnecting ConnState = "reconnecting"
+	// StateEmbedded means there's no connection to make, because
+	// plantprism is running the broker itself.
+	StateEmbedded ConnState = "embedded"
+)
+
+// Status is the state of the connection to the broker.
+type Status struct {
+	State ConnState
+	// Broker is the URL of the broker we're connected to, or the
+	// last one we tried.
+	Broker    string
+	Since     time.Time // When State last changed
+	LastError string
+	// Attempts is how many times in a row connecting has failed.
+	Attempts int
+	// Lost is how many times the connection's been lost.
+	Lost int
+}
+
+// connectBackoffMin is how long after failing to connect at startup
+// we try again. It doubles each time, up to
+// -broker_max_reconnect_interval. Once we've connected, paho
+// reconnects by itself, with the same backoff.
+var connectBackoffMin = time.Second
+
+func (m *MQTT) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+func (m *MQTT) setState(s ConnState) {
+	if m.status.State != s {
+		m.status.State = s
+		m.status.Since = time.Now()
+	}
+}
+
+// dial connects to a broker, noting which one we're trying.
+func (m *MQTT) dial(config *tls.Config, uri *url.URL, timeout time.Duration) (net.Conn, error) {
+	m.mu.Lock()
+	m.status.Broker = uri.String()
+	m.mu.Unlock()
+	var (
+		conn net.Conn
+		err  error
+	)
+	if isTLS(uri) {
+		conn, err = dialTLS(config, uri, timeout)
+	} else {
+		d := net.Dialer{Timeout: timeout}
+		conn, err = d.Dial("tcp", uri.Host)
+		if err != nil {
+			err = fmt.Errorf("couldn't reach broker at %s: %w", uri.Host, err)
+		}
+	}
+	if err != nil {
+		m.log.Warn.Printf("MQTT broker '%s' connection failed: %v", uri, err)
+		m.mu.Lock()
+		m.status.LastError = err.Error()
+		m.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (m *MQTT) connected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setState(StateConnected)
+	m.status.Attempts = 0
+	m.status.LastError = ""
+	m.log.Info.Printf("MQTT connected to '%s'", m.status.Broker)
+}
+
+func (m *MQTT) connectionLost(c paho.Client, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setState(StateDisconnected)
+	m.status.Lost++
+	m.status.LastError = err.Error()
+	m.log.Warn.Printf("MQTT connection to '%s' lost: %v", m.status.Broker, err)
+}
+
+func (m *MQTT) reconnecting() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setState(StateReconnecting)
+	m.status.Attempts++
+	m.log.Info.Printf("MQTT reconnecting, attempt %d", m.status.Attempts)
+}
+
+// Start connects to the broker in the background. A broker that's
+// down at startup isn't fatal: we keep trying until it's up.
+func (m *MQTT) Start() {
+	m.mu.Lock()
+	m.setState(StateConnecting)
+	m.mu.Unlock()
+	go func() {
+		wait := connectBackoffMin
+		for {
+			token := m.c.Connect()
+			token.Wait()
+			err := token.Error()
+			if err == nil {
+				return
+			}
+			m.mu.Lock()
+			m.setState(StateDisconnected)
+			m.status.Attempts++
+			attempts := m.status.Attempts
+			m.mu.Unlock()
+			m.log.Warn.Printf("MQTT connection failed (attempt %d), retrying in %v: %v", attempts, wait, err)
+			time.Sleep(wait)
+			wait *= 2
+			if wait > bf.maxReconnect {
+				wait = bf.maxReconnect
+			}
+			m.mu.Lock()
+			m.setState(StateConnecting)
+			m.mu.Unlock()
+		}
+	}()
+}
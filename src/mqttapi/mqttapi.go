@@ -0,0 +1,364 @@
+package mqttapi
+
+// A documented MQTT namespace for automation (Node-RED, scripts, ...).
+// Each device's state is published, retained, as JSON under
+// <prefix>/<device>/state/, and commands sent to
+// <prefix>/<device>/cmd/<command> are carried out, with the result
+// published to <prefix>/<device>/response. Only the commands in the
+// allowlist are accepted.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/device"
+	"github.com/Jon-Bright/plantprism/logs"
+	"github.com/Jon-Bright/plantprism/plant"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	CMD_PLANT          = "plant"
+	CMD_HARVEST        = "harvest"
+	CMD_MODE           = "mode"
+	CMD_WATERING       = "watering"
+	CMD_SUNRISE        = "sunrise"
+	CMD_NUTRIENT_RESET = "nutrient_reset"
+)
+
+// COMMANDS are all the commands there are, in the order they're
+// documented.
+var COMMANDS = []string{CMD_PLANT, CMD_HARVEST, CMD_MODE, CMD_WATERING, CMD_SUNRISE, CMD_NUTRIENT_RESET}
+
+type apiFlags struct {
+	enabled  bool
+	prefix   string
+	commands string
+}
+
+var (
+	log *logs.Loggers
+	af  apiFlags
+)
+
+func InitFlags() {
+	flag.BoolVar(&af.enabled, "mqtt_api", false, "Publish each device's state under -mqtt_api_prefix, and accept the commands in -mqtt_api_commands")
+	flag.StringVar(&af.prefix, "mqtt_api_prefix", "plantprism", "Prefix for the MQTT API's topics")
+	flag.StringVar(&af.commands, "mqtt_api_commands", "", "Comma-separated commands the MQTT API accepts, from "+strings.Join(COMMANDS, ", ")+". Empty means none.")
+}
+
+// retainingPublisher is a Publisher whose broker can keep messages for
+// clients that subscribe later.
+type retainingPublisher interface {
+	device.Publisher
+	PublishRetained(topic string, payload []byte) error
+}
+
+// Request is a command's payload. Every command can have an ID, which
+// is returned in the Response. Which of the other fields are needed
+// depends on the command.
+type Request struct {
+	ID      string `json:"id"`
+	Slot    string `json:"slot"`    // plant, harvest: e.g. "a1"
+	Plant   int    `json:"plant"`   // plant: the plant's ID in plants.json
+	Mode    string `json:"mode"`    // mode: "default", "silent" or "cinema"
+	Sunrise string `json:"sunrise"` // sunrise: "HH:MM"
+}
+
+// Response says how a command went.
+type Response struct {
+	ID      string `json:"id,omitempty"`
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// modes are the modes that can be set with the mode command. The
+// others have their own steps in the UI, and some need confirming.
+// Changing between these never does.
+var modes = map[string]device.DeviceMode{
+	"default": device.ModeDefault,
+	"silent":  device.ModeSilent,
+	"cinema":  device.ModeCinema,
+}
+
+// API publishes state and carries out commands for every device.
+type API struct {
+	publisher device.Publisher
+	prefix    string
+	allowed   []string
+
+	mu        sync.Mutex
+	followed  map[string]bool
+	published map[string][]byte // Topic to last payload published
+	failing   bool
+}
+
+func (a *API) statusTopic(id string) string {
+	return a.prefix + "/" + id + "/state/status"
+}
+
+func (a *API) slotsTopic(id string) string {
+	return a.prefix + "/" + id + "/state/slots"
+}
+
+func (a *API) responseTopic(id string) string {
+	return a.prefix + "/" + id + "/response"
+}
+
+// Init creates an API if -mqtt_api is set, and starts following every
+// allowed device. Otherwise, it returns nil.
+func Init(l *logs.Loggers, p device.Publisher) (*API, error) {
+	log = l
+	if !af.enabled {
+		return nil, nil
+	}
+	allowed, err := allowedCommands(af.commands)
+	if err != nil {
+		return nil, err
+	}
+	a := New(p, af.prefix, allowed)
+	a.followDevices()
+	if len(allowed) == 0 {
+		log.Info.Printf("MQTT API under '%s', accepting no commands", af.prefix)
+	} else {
+		log.Info.Printf("MQTT API under '%s', accepting %s", af.prefix, strings.Join(allowed, ", "))
+	}
+	return a, nil
+}
+
+// CheckFlags checks the mqtt_api* flags, without following any
+// devices.
+func CheckFlags() error {
+	_, err := allowedCommands(af.commands)
+	return err
+}
+
+// allowedCommands returns the commands in a -mqtt_api_commands list.
+func allowedCommands(commands string) ([]string, error) {
+	var allowed []string
+	for _, c := range strings.Split(commands, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !slices.Contains(COMMANDS, c) {
+			return nil, fmt.Errorf("unknown MQTT API command '%s', want one of %v", c, COMMANDS)
+		}
+		allowed = append(allowed, c)
+	}
+	return allowed, nil
+}
+
+// New creates an API with topics under prefix, accepting the allowed
+// commands. It doesn't follow any devices until Republish is called.
+func New(p device.Publisher, prefix string, allowed []string) *API {
+	return &API{
+		publisher: p,
+		prefix:    prefix,
+		allowed:   allowed,
+		followed:  make(map[string]bool),
+		published: make(map[string][]byte),
+	}
+}
+
+// followDevices starts following any allowed device that isn't
+// already followed.
+func (a *API) followDevices() {
+	for _, id := range device.AllowedDevices() {
+		a.mu.Lock()
+		followed := a.followed[id]
+		a.mu.Unlock()
+		if followed {
+			continue
+		}
+		d, err := device.Get(id, a.publisher)
+		if err != nil {
+			log.Error.Printf("MQTT API couldn't get device '%s': %v", id, err)
+			continue
+		}
+		a.mu.Lock()
+		a.followed[id] = true
+		a.mu.Unlock()
+		go a.follow(d)
+	}
+}
+
+// follow publishes a device's status and slots whenever they change.
+func (a *API) follow(d *device.Device) {
+	slots := make(map[string]*device.SlotEvent)
+	d.Follow(func(l []device.Update) {
+		slotsChanged := false
+		for _, u := range l {
+			if u.Slot != nil {
+				slots[fmt.Sprintf("%s%d", u.Slot.Layer, u.Slot.Slot)] = u.Slot
+				slotsChanged = true
+			}
+			if u.Status != nil {
+				a.publishState(a.statusTopic(d.ID), u.Status)
+			}
+		}
+		if slotsChanged {
+			a.publishState(a.slotsTopic(d.ID), slots)
+		}
+	})
+}
+
+// publishState publishes v as retained JSON, unless it's the same as
+// last time.
+func (a *API) publishState(topic string, v any) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Error.Printf("MQTT API state for '%s' failed to marshal: %v", topic, err)
+		return
+	}
+	a.mu.Lock()
+	same := bytes.Equal(a.published[topic], payload)
+	a.published[topic] = payload
+	a.mu.Unlock()
+	if same {
+		return
+	}
+	a.publish(topic, payload, true)
+}
+
+// publish sends a message, logging failures. Only the first failure
+// in a row is a warning: state is published again on reconnecting.
+func (a *API) publish(topic string, payload []byte, retained bool) {
+	var err error
+	if rp, ok := a.publisher.(retainingPublisher); ok && retained {
+		err = rp.PublishRetained(topic, payload)
+	} else {
+		err = a.publisher.Publish(topic, payload)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		if a.failing {
+			log.Info.Printf("MQTT API publish to '%s' failed: %v", topic, err)
+		} else {
+			log.Warn.Printf("MQTT API publish to '%s' failed: %v", topic, err)
+		}
+		a.failing = true
+		return
+	}
+	if a.failing {
+		log.Info.Printf("MQTT API publishing again")
+		a.failing = false
+	}
+}
+
+// Republish publishes every device's latest state again, for when the
+// broker might not have it: after reconnecting, or after a failure.
+func (a *API) Republish() {
+	if a == nil {
+		return
+	}
+	a.followDevices()
+	a.mu.Lock()
+	published := make(map[string][]byte, len(a.published))
+	for topic, payload := range a.published {
+		published[topic] = payload
+	}
+	a.mu.Unlock()
+	for topic, payload := range published {
+		a.publish(topic, payload, true)
+	}
+}
+
+// HandleMessage deals with a message on one of the API's topics,
+// returning false if the topic isn't one of them.
+func (a *API) HandleMessage(topic string, payload []byte) bool {
+	if a == nil {
+		return false
+	}
+	rest, ok := strings.CutPrefix(topic, a.prefix+"/")
+	if !ok {
+		return false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 3 || parts[1] != "cmd" {
+		// Our own state or responses, or something we don't
+		// know about, but it's ours either way.
+		return true
+	}
+	// Not on this goroutine: it's the one reading from the
+	// broker, and both the command and the response wait for
+	// their messages to be acknowledged.
+	go a.handleCommand(parts[0], parts[2], payload)
+	return true
+}
+
+// handleCommand carries out a command and publishes the response.
+func (a *API) handleCommand(id, cmd string, payload []byte) {
+	var req Request
+	err := json.Unmarshal(payload, &req)
+	if err != nil && len(bytes.TrimSpace(payload)) > 0 {
+		err = fmt.Errorf("invalid request: %w", err)
+	} else {
+		err = a.command(id, cmd, &req)
+	}
+	resp := Response{ID: req.ID, Command: cmd, OK: err == nil}
+	if err != nil {
+		log.Warn.Printf("MQTT API command '%s' for device '%s' failed: %v", cmd, id, err)
+		resp.Error = err.Error()
+	} else {
+		log.Info.Printf("MQTT API command '%s' for device '%s' done", cmd, id)
+	}
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		log.Error.Printf("MQTT API response failed to marshal: %v", err)
+		return
+	}
+	// Not to a device we don't know, so that nobody can make us
+	// publish to any topic they like.
+	if slices.Contains(device.AllowedDevices(), id) {
+		a.publish(a.responseTopic(id), b, false)
+	}
+}
+
+// command carries out a command for a device.
+func (a *API) command(id, cmd string, req *Request) error {
+	if !slices.Contains(COMMANDS, cmd) {
+		return fmt.Errorf("unknown command '%s'", cmd)
+	}
+	if !slices.Contains(a.allowed, cmd) {
+		return fmt.Errorf("command '%s' isn't allowed", cmd)
+	}
+	d, err := device.Get(id, a.publisher)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case CMD_PLANT:
+		if req.Plant == 0 {
+			return errors.New("no plant given")
+		}
+		return d.AddPlant(req.Slot, plant.PlantID(req.Plant))
+	case CMD_HARVEST:
+		return d.HarvestPlant(req.Slot)
+	case CMD_MODE:
+		m, ok := modes[req.Mode]
+		if !ok {
+			return fmt.Errorf("unknown mode '%s'", req.Mode)
+		}
+		return d.SetMode(m, false)
+	case CMD_WATERING:
+		d.TriggerManualWatering()
+	case CMD_SUNRISE:
+		t, err := time.Parse("15:04", req.Sunrise)
+		if err != nil {
+			return fmt.Errorf("invalid sunrise '%s', want HH:MM", req.Sunrise)
+		}
+		return d.SetSunrise(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute)
+	case CMD_NUTRIENT_RESET:
+		d.ResetNutrient()
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package mqttapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/device"
+	"github.com/Jon-Bright/plantprism/logs"
+	"github.com/benbjohnson/clock"
+	"golang.org/x/exp/slices"
+)
+
+const testDevice = "00000000-0000-4000-8000-0000000000dd"
+
+func init() {
+	log = logs.Discard()
+	// For their defaults
+	device.InitFlags()
+}
+
+type testMsg struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+type recordingPublisher struct {
+	mu   sync.Mutex
+	msgs []testMsg
+	// If set, publishing waits for it to be closed, like a
+	// publish waiting for an acknowledgement.
+	blocked chan struct{}
+}
+
+func (p *recordingPublisher) record(m testMsg) error {
+	p.mu.Lock()
+	blocked := p.blocked
+	p.mu.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.msgs = append(p.msgs, m)
+	return nil
+}
+
+func (p *recordingPublisher) Publish(topic string, payload []byte) error {
+	return p.record(testMsg{topic, payload, false})
+}
+
+func (p *recordingPublisher) PublishRetained(topic string, payload []byte) error {
+	return p.record(testMsg{topic, payload, true})
+}
+
+// waitFor returns the first message on topic whose payload contains
+// want, waiting for it if necessary.
+func (p *recordingPublisher) waitFor(t *testing.T, topic, want string) testMsg {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mu.Lock()
+		for _, m := range p.msgs {
+			if m.topic == topic && bytes.Contains(m.payload, []byte(want)) {
+				p.mu.Unlock()
+				return m
+			}
+		}
+		p.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("no message to '%s' containing '%s'", topic, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testPub is shared by every test, since the device publishes to
+// whichever publisher it was first loaded with.
+var testPub = &recordingPublisher{}
+
+func setupDevice(t *testing.T) {
+	device.SetTestMode()
+	mock := clock.NewMock()
+	mock.Set(time.Unix(1691777930, 0))
+	err := device.Init(log, mock)
+	if err != nil {
+		t.Fatalf("Failed to init devices: %v", err)
+	}
+	prev := device.AllowedDevices()
+	t.Cleanup(func() {
+		device.SetAllowedDevices(prev)
+	})
+	device.SetAllowedDevices([]string{testDevice})
+}
+
+func response(t *testing.T, m testMsg) Response {
+	t.Helper()
+	var r Response
+	err := json.Unmarshal(m.payload, &r)
+	if err != nil {
+		t.Fatalf("response '%s' doesn't unmarshal: %v", m.payload, err)
+	}
+	return r
+}
+
+func TestState(t *testing.T) {
+	setupDevice(t)
+	p := testPub
+	a := New(p, "plantprism", nil)
+	a.Republish()
+
+	m := p.waitFor(t, a.statusTopic(testDevice), `"Mode":0`)
+	if !m.retained {
+		t.Errorf("status wasn't retained")
+	}
+	var se device.StatusEvent
+	err := json.Unmarshal(m.payload, &se)
+	if err != nil {
+		t.Fatalf("status '%s' doesn't unmarshal: %v", m.payload, err)
+	}
+	if se.Sunrise != 7*3600 {
+		t.Errorf("status has sunrise %d, want %d", se.Sunrise, 7*3600)
+	}
+	m = p.waitFor(t, a.slotsTopic(testDevice), `"b9"`)
+	if !m.retained {
+		t.Errorf("slots weren't retained")
+	}
+}
+
+func TestHandleMessage(t *testing.T) {
+	setupDevice(t)
+	p := testPub
+	a := New(p, "plantprism", []string{CMD_PLANT, CMD_SUNRISE, CMD_MODE})
+	a.Republish()
+	cmd := "plantprism/" + testDevice + "/cmd/"
+	rt := a.responseTopic(testDevice)
+
+	tests := []struct {
+		topic   string
+		payload string
+		want    bool
+	}{
+		{"plantprism/" + testDevice + "/state/status", "{}", true},
+		{"plantprism/" + testDevice + "/response", "{}", true},
+		{"plantprism/ha/" + testDevice + "/mode/set", "silent", true},
+		{"agl/prod/things/" + testDevice + "/mode", "{}", false},
+		{"plantprismx/" + testDevice + "/cmd/mode", "{}", false},
+	}
+	for _, tc := range tests {
+		if got := a.HandleMessage(tc.topic, []byte(tc.payload)); got != tc.want {
+			t.Errorf("HandleMessage('%s') got %v, want %v", tc.topic, got, tc.want)
+		}
+	}
+
+	// Successful commands change state, and are correlated
+	a.HandleMessage(cmd+"sunrise", []byte(`{"id":"sun-1","sunrise":"06:30"}`))
+	r := response(t, p.waitFor(t, rt, `"sun-1"`))
+	if !r.OK || r.Command != CMD_SUNRISE || r.Error != "" {
+		t.Errorf("sunrise got response %+v", r)
+	}
+	p.waitFor(t, a.statusTopic(testDevice), `"Sunrise":23400`)
+
+	a.HandleMessage(cmd+"mode", []byte(`{"id":"mode-1","mode":"silent"}`))
+	r = response(t, p.waitFor(t, rt, `"mode-1"`))
+	if !r.OK {
+		t.Errorf("mode got response %+v", r)
+	}
+	p.waitFor(t, "$aws/things/"+testDevice+"/shadow/update/delta", `"mode":7`)
+
+	// Failures
+	failures := []struct {
+		command string
+		payload string
+	}{
+		{"harvest", `{"id":"fail-1","slot":"a1"}`},             // Not allowed
+		{"reboot", `{"id":"fail-2"}`},                          // Not a command
+		{"plant", `{"id":"fail-3","slot":"a1"}`},               // No plant
+		{"plant", `{"id":"fail-4","slot":"c1","plant":104}`},   // No such slot
+		{"sunrise", `{"id":"fail-5","sunrise":"25:00"}`},       // No such time
+		{"mode", `{"id":"fail-6","mode":"debug"}`},             // Not settable
+		{"mode", `{"id":"fail-7","mode":"silent","x":}`},       // Not JSON
+		{"sunrise", `{"id":"fail-8","sunrise":7}`},             // Wrong type
+		{"plant", `{"id":"fail-9","slot":"a2","plant":99999}`}, // No such plant
+	}
+	for _, f := range failures {
+		a.HandleMessage(cmd+f.command, []byte(f.payload))
+	}
+	for i, f := range failures {
+		if i == 6 || i == 7 {
+			// The ID isn't available from an invalid payload
+			continue
+		}
+		var want struct{ ID string }
+		json.Unmarshal([]byte(f.payload), &want)
+		r := response(t, p.waitFor(t, rt, `"`+want.ID+`"`))
+		if r.OK || r.Error == "" || r.Command != f.command {
+			t.Errorf("%s got response %+v", f.payload, r)
+		}
+	}
+	r = response(t, p.waitFor(t, rt, `invalid request`))
+	if r.OK {
+		t.Errorf("invalid request got response %+v", r)
+	}
+
+	// Commands for devices we don't know aren't answered. Handled
+	// directly, so the response would be there by now.
+	a.handleCommand("other", "sunrise", []byte(`{"id":"other"}`))
+	p.mu.Lock()
+	for _, m := range p.msgs {
+		if m.topic == a.responseTopic("other") {
+			t.Errorf("response published for unknown device")
+		}
+	}
+	p.mu.Unlock()
+}
+
+// TestHandleMessageBlocking checks that a command doesn't hold up the
+// goroutine the message came in on, since the acknowledgements the
+// command's publishes wait for would come in on it too.
+func TestHandleMessageBlocking(t *testing.T) {
+	setupDevice(t)
+	p := testPub
+	a := New(p, "plantprism", []string{CMD_SUNRISE})
+	a.Republish()
+	p.waitFor(t, a.statusTopic(testDevice), `"Sunrise"`)
+
+	blocked := make(chan struct{})
+	p.mu.Lock()
+	p.blocked = blocked
+	p.mu.Unlock()
+	handled := make(chan struct{})
+	go func() {
+		a.HandleMessage("plantprism/"+testDevice+"/cmd/sunrise", []byte(`{"id":"blocked-1","sunrise":"05:15"}`))
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Errorf("HandleMessage waited for the publish")
+	}
+	p.mu.Lock()
+	p.blocked = nil
+	p.mu.Unlock()
+	close(blocked)
+	r := response(t, p.waitFor(t, a.responseTopic(testDevice), `"blocked-1"`))
+	if !r.OK {
+		t.Errorf("sunrise got response %+v", r)
+	}
+}
+
+func TestNilAPI(t *testing.T) {
+	var a *API
+	if a.HandleMessage("plantprism/"+testDevice+"/cmd/mode", []byte("{}")) {
+		t.Errorf("nil API handled message")
+	}
+	a.Republish()
+}
+
+func TestAllowedCommands(t *testing.T) {
+	for _, tc := range []struct {
+		commands string
+		want     []string
+		wantErr  bool
+	}{
+		{"", nil, false},
+		{"mode, sunrise,", []string{CMD_MODE, CMD_SUNRISE}, false},
+		{"mode,reboot", nil, true},
+	} {
+		got, err := allowedCommands(tc.commands)
+		if (err != nil) != tc.wantErr || !slices.Equal(got, tc.want) {
+			t.Errorf("commands '%s', got %v, error %v, want %v, error %v", tc.commands, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
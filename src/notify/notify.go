@@ -0,0 +1,355 @@
+package notify
+
+// Delivers notifications about device events (door open, device
+// offline, nutrient wanted, ...) to the user, via one or more sinks.
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Jon-Bright/plantprism/logs"
+	"github.com/benbjohnson/clock"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// Enough to absorb a burst (e.g. every sensor going stale at
+	// once) without blocking the device.
+	QueueBuffer = 50
+
+	SendTimeout = 30 * time.Second
+)
+
+// An Event is something that happened to a device that the user
+// might want to know about. Active is false when a previously active
+// problem has been resolved.
+type Event struct {
+	Device string
+	Type   string
+	// Which instance of Type it's about, for types that can have
+	// several at once, e.g. the slot for harvest_due or the
+	// sensor for sensor_stale. Empty otherwise.
+	Subject string
+	Active  bool
+	Time    time.Time
+	Message string
+}
+
+// Title returns a short summary of the event, suitable for an email
+// subject or push notification title.
+func (e *Event) Title() string {
+	t := strings.ReplaceAll(e.Type, "_", " ")
+	if !e.Active {
+		t += " resolved"
+	}
+	return fmt.Sprintf("Plantcube %s: %s", shortDevice(e.Device), t)
+}
+
+// shortDevice returns the first block of a device ID, which is
+// plenty to tell devices apart and much more readable.
+func shortDevice(id string) string {
+	if i := strings.IndexByte(id, '-'); i > 0 {
+		return id[:i]
+	}
+	return id
+}
+
+// A Sink delivers events somewhere.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, e *Event) error
+}
+
+// A Notifier routes events to sinks, subject to rate limiting and
+// quiet hours.
+type Notifier struct {
+	clock  clock.Clock
+	sinks  []Sink
+	routes map[string][]string // Event type to sink names
+
+	rateLimit   time.Duration
+	lastSent    map[string]time.Time
+	quiet       *quietHours
+	quietExcept []string
+
+	queue chan *Event
+}
+
+type notifyFlags struct {
+	routes      routeList
+	rateLimit   time.Duration
+	quiet       string
+	quietExcept string
+
+	webhookURL string
+
+	smtpAddr     string
+	smtpFrom     string
+	smtpTo       string
+	smtpUsername string
+	smtpPassword string
+
+	pushURL   string
+	pushStyle string
+	pushToken string
+}
+
+type routeList []string
+
+var (
+	log *logs.Loggers
+	nf  notifyFlags
+)
+
+func (l *routeList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *routeList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *routeList) Reset() {
+	*l = nil
+}
+
+func InitFlags() {
+	// flag.Var doesn't set a default, unlike the others
+	nf.routes.Reset()
+	flag.Var(&nf.routes, "notify_route", "Route for an event type, as 'type:sink,sink'. Can be specified multiple times. Types without a route go to every sink. Sinks are 'webhook', 'smtp' and 'push', an empty list drops the type.")
+	flag.DurationVar(&nf.rateLimit, "notify_rate_limit", 30*time.Minute, "Minimum time between notifications of the same type, about the same slot or sensor, for the same device on the same sink")
+	flag.StringVar(&nf.quiet, "notify_quiet", "", "Quiet hours in local time, as 'HH:MM-HH:MM'. Notifications during quiet hours are dropped.")
+	flag.StringVar(&nf.quietExcept, "notify_quiet_except", "", "Comma-separated event types that are delivered even during quiet hours")
+
+	flag.StringVar(&nf.webhookURL, "notify_webhook_url", "", "URL to POST JSON notifications to")
+
+	flag.StringVar(&nf.smtpAddr, "notify_smtp_addr", "", "SMTP server for email notifications, as host:port")
+	flag.StringVar(&nf.smtpFrom, "notify_smtp_from", "", "Sender address for email notifications")
+	flag.StringVar(&nf.smtpTo, "notify_smtp_to", "", "Comma-separated recipient addresses for email notifications")
+	flag.StringVar(&nf.smtpUsername, "notify_smtp_username", "", "Username for the SMTP server, if it needs authentication")
+	flag.StringVar(&nf.smtpPassword, "notify_smtp_password", "", "Password for the SMTP server")
+
+	flag.StringVar(&nf.pushURL, "notify_push_url", "", "URL for push notifications: an ntfy topic URL or a Gotify server URL")
+	flag.StringVar(&nf.pushStyle, "notify_push_style", "ntfy", "Push server type: 'ntfy' or 'gotify'")
+	flag.StringVar(&nf.pushToken, "notify_push_token", "", "Access token for the push server (required for Gotify)")
+}
+
+// Init creates a Notifier from the flags and starts delivering events
+// to it. If no sinks are configured, the Notifier drops everything.
+func Init(l *logs.Loggers, c clock.Clock) (*Notifier, error) {
+	log = l
+
+	var sinks []Sink
+	if nf.webhookURL != "" {
+		sinks = append(sinks, NewWebhookSink(nf.webhookURL))
+	}
+	if nf.smtpAddr != "" {
+		if nf.smtpFrom == "" || nf.smtpTo == "" {
+			return nil, errors.New("SMTP notifications need both a sender and recipients")
+		}
+		sinks = append(sinks, NewSMTPSink(nf.smtpAddr, nf.smtpFrom, splitList(nf.smtpTo), nf.smtpUsername, nf.smtpPassword))
+	}
+	if nf.pushURL != "" {
+		ps, err := NewPushSink(nf.pushURL, nf.pushStyle, nf.pushToken)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, ps)
+	}
+
+	n, err := New(c, sinks, nf.routes, nf.rateLimit, nf.quiet, splitList(nf.quietExcept))
+	if err != nil {
+		return nil, err
+	}
+	if len(sinks) == 0 {
+		log.Info.Printf("No notification sinks configured")
+	} else {
+		names := make([]string, len(sinks))
+		for i, s := range sinks {
+			names[i] = s.Name()
+		}
+		log.Info.Printf("Notifications go to %s", strings.Join(names, ", "))
+	}
+	go n.run()
+	return n, nil
+}
+
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// New creates a Notifier. routes are in the format of the
+// -notify_route flag, quiet in the format of -notify_quiet. The
+// Notifier doesn't deliver anything queued with Publish until run()
+// is started.
+func New(c clock.Clock, sinks []Sink, routes []string, rateLimit time.Duration, quiet string, quietExcept []string) (*Notifier, error) {
+	n := Notifier{
+		clock:       c,
+		sinks:       sinks,
+		routes:      make(map[string][]string),
+		rateLimit:   rateLimit,
+		lastSent:    make(map[string]time.Time),
+		quietExcept: quietExcept,
+		queue:       make(chan *Event, QueueBuffer),
+	}
+	for _, r := range routes {
+		typ, names, ok := strings.Cut(r, ":")
+		if !ok || typ == "" {
+			return nil, fmt.Errorf("invalid route '%s', want 'type:sink,sink'", r)
+		}
+		sn := splitList(names)
+		for _, name := range sn {
+			if n.sink(name) == nil {
+				return nil, fmt.Errorf("route '%s' names sink '%s', which isn't configured", r, name)
+			}
+		}
+		n.routes[typ] = sn
+	}
+	if quiet != "" {
+		var err error
+		n.quiet, err = parseQuietHours(quiet)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &n, nil
+}
+
+func (n *Notifier) sink(name string) Sink {
+	for _, s := range n.sinks {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Publish queues an event for delivery. It never blocks: if the
+// queue is full, the event is dropped.
+func (n *Notifier) Publish(e Event) {
+	select {
+	case n.queue <- &e:
+	default:
+		log.Warn.Printf("Notification queue full, dropping %s notification for device '%s'", e.Type, e.Device)
+	}
+}
+
+// Close stops the Notifier once it's delivered everything already
+// queued. Nothing may be published after Close.
+func (n *Notifier) Close() {
+	close(n.queue)
+}
+
+func (n *Notifier) run() {
+	for e := range n.queue {
+		n.deliver(e)
+	}
+}
+
+// route returns the sinks an event of the given type should go to.
+func (n *Notifier) route(typ string) []Sink {
+	names, ok := n.routes[typ]
+	if !ok {
+		return n.sinks
+	}
+	var sinks []Sink
+	for _, name := range names {
+		sinks = append(sinks, n.sink(name))
+	}
+	return sinks
+}
+
+// deliver sends an event to every sink it's routed to, unless it's
+// quiet time or the sink has had the same notification too
+// recently. It returns the names of the sinks that were sent to.
+func (n *Notifier) deliver(e *Event) []string {
+	now := n.clock.Now()
+	// Anything sent longer ago than that no longer limits anything
+	for key, last := range n.lastSent {
+		if now.Sub(last) >= n.rateLimit {
+			delete(n.lastSent, key)
+		}
+	}
+	if n.quiet != nil && n.quiet.contains(now) && !slices.Contains(n.quietExcept, e.Type) {
+		log.Info.Printf("Quiet hours, not sending %s notification for device '%s': %s", e.Type, e.Device, e.Message)
+		return nil
+	}
+	var sent []string
+	for _, s := range n.route(e.Type) {
+		// Resolutions are limited separately, otherwise a
+		// problem that's resolved quickly would never be
+		// reported as resolved. So is each subject, otherwise
+		// a second stale sensor would be hidden by the first.
+		key := fmt.Sprintf("%s %s %s %q %v", s.Name(), e.Device, e.Type, e.Subject, e.Active)
+		if last, ok := n.lastSent[key]; ok && now.Sub(last) < n.rateLimit {
+			log.Info.Printf("Rate limited %s notification for device '%s' to %s", e.Type, e.Device, s.Name())
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), SendTimeout)
+		err := s.Send(ctx, e)
+		cancel()
+		if err != nil {
+			log.Warn.Printf("Failed sending %s notification for device '%s' to %s: %v", e.Type, e.Device, s.Name(), err)
+			continue
+		}
+		n.lastSent[key] = now
+		sent = append(sent, s.Name())
+	}
+	return sent
+}
+
+// quietHours is a daily period, in local time. end may be before
+// start, in which case the period spans midnight.
+type quietHours struct {
+	start time.Duration
+	end   time.Duration
+}
+
+func parseQuietHours(s string) (*quietHours, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid quiet hours '%s', want 'HH:MM-HH:MM'", s)
+	}
+	var (
+		q   quietHours
+		err error
+	)
+	q.start, err = parseTimeOfDay(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours start: %w", err)
+	}
+	q.end, err = parseTimeOfDay(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid quiet hours end: %w", err)
+	}
+	return &q, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse time of day '%s': %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+	t = t.Local()
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if q.start <= q.end {
+		return tod >= q.start && tod < q.end
+	}
+	return tod >= q.start || tod < q.end
+}
@@ -0,0 +1,339 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"github.com/Jon-Bright/plantprism/logs"
+)
+
+const testDevice = "a8d39911-7955-47d3-981b-fbd9d52f9221"
+
+func init() {
+	log = logs.Discard()
+}
+
+func testEvent() *Event {
+	return &Event{
+		Device:  testDevice,
+		Type:    "door_open",
+		Active:  true,
+		Time:    time.Unix(1687685966, 0),
+		Message: "The door has been open too long",
+	}
+}
+
+type fakeSink struct {
+	name string
+	got  []Event
+}
+
+func (s *fakeSink) Name() string {
+	return s.name
+}
+
+func (s *fakeSink) Send(ctx context.Context, e *Event) error {
+	s.got = append(s.got, *e)
+	return nil
+}
+
+func TestDeliver(t *testing.T) {
+	mock := clock.NewMock()
+	// Local time, so that the quiet hours are predictable
+	// whatever the test machine's timezone
+	mock.Set(time.Date(2023, 6, 17, 12, 0, 0, 0, time.Local))
+	a := &fakeSink{name: "webhook"}
+	b := &fakeSink{name: "push"}
+	n, err := New(mock, []Sink{a, b}, []string{"door_open:push", "harvest_due:"}, 30*time.Minute, "22:00-07:00", []string{"offline"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	tests := []struct {
+		advance time.Duration
+		typ     string
+		subject string
+		active  bool
+		want    []string
+	}{
+		{typ: "offline", active: true, want: []string{"webhook", "push"}},
+		{typ: "door_open", active: true, want: []string{"push"}},               // Routed
+		{typ: "harvest_due", active: true, want: nil},                          // Dropped
+		{advance: 10 * time.Minute, typ: "door_open", active: true, want: nil}, // Rate limited
+		{typ: "door_open", active: false, want: []string{"push"}},              // Resolution isn't
+		{advance: 30 * time.Minute, typ: "door_open", active: true, want: []string{"push"}},
+		{advance: 10 * time.Hour, typ: "nutrient_wanted", active: true, want: nil}, // Quiet, 22:40
+		{typ: "offline", active: false, want: []string{"webhook", "push"}},         // Not quiet
+		{advance: 9 * time.Hour, typ: "nutrient_wanted", active: true, want: []string{"webhook", "push"}},
+		{typ: "sensor_stale", subject: "temp_a", active: true, want: []string{"webhook", "push"}},
+		{typ: "sensor_stale", subject: "temp_b", active: true, want: []string{"webhook", "push"}}, // Another sensor isn't limited
+		{typ: "sensor_stale", subject: "temp_a", active: true, want: nil},                         // The same one is
+	}
+	for i, tc := range tests {
+		mock.Add(tc.advance)
+		e := testEvent()
+		e.Type = tc.typ
+		e.Subject = tc.subject
+		e.Active = tc.active
+		got := n.deliver(e)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("case %d (%s %v at %s), got sinks %v, want %v", i, tc.typ, tc.active, mock.Now().Format("15:04"), got, tc.want)
+		}
+	}
+
+	// Only what's still rate limited is remembered
+	mock.Add(30 * time.Minute)
+	n.deliver(testEvent())
+	if len(n.lastSent) != 1 {
+		t.Errorf("after the rate limit, remembered %v, want only the last door_open", n.lastSent)
+	}
+
+	_, err = New(mock, []Sink{a}, []string{"door_open:smtp"}, 0, "", nil)
+	if err == nil {
+		t.Errorf("New with route to unconfigured sink succeeded")
+	}
+	_, err = New(mock, []Sink{a}, nil, 0, "22:00", nil)
+	if err == nil {
+		t.Errorf("New with invalid quiet hours succeeded")
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got webhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got content type '%s', want application/json", r.Header.Get("Content-Type"))
+		}
+		err := json.NewDecoder(r.Body).Decode(&got)
+		if err != nil {
+			t.Errorf("failed decoding webhook body: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	e := testEvent()
+	e.Subject = "a1"
+	err := NewWebhookSink(srv.URL).Send(context.Background(), e)
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	want := webhookPayload{
+		Device:  testDevice,
+		Type:    "door_open",
+		Subject: "a1",
+		Active:  true,
+		Time:    e.Time,
+		Title:   "Plantcube a8d39911: door open",
+		Message: e.Message,
+	}
+	if !got.Time.Equal(want.Time) {
+		t.Errorf("got time %v, want %v", got.Time, want.Time)
+	}
+	got.Time = want.Time
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	err = NewWebhookSink(failing.URL).Send(context.Background(), e)
+	if err == nil {
+		t.Errorf("Send to failing server succeeded")
+	}
+}
+
+func TestPushSink(t *testing.T) {
+	tests := []struct {
+		style      string
+		token      string
+		wantPath   string
+		wantQuery  string
+		wantHeader map[string]string
+		wantBody   string
+	}{
+		{
+			style:    PushStyleNtfy,
+			wantPath: "/plantprism",
+			wantHeader: map[string]string{
+				"Title":    "Plantcube a8d39911: door open",
+				"Priority": "4",
+				"Tags":     "seedling,door_open",
+			},
+			wantBody: "The door has been open too long",
+		}, {
+			style:      PushStyleGotify,
+			token:      "s3cret",
+			wantPath:   "/plantprism/message",
+			wantQuery:  "token=s3cret",
+			wantHeader: map[string]string{"Content-Type": "application/json"},
+			wantBody:   `{"title":"Plantcube a8d39911: door open","message":"The door has been open too long","priority":8}`,
+		},
+	}
+	for _, tc := range tests {
+		var (
+			gotReq  *http.Request
+			gotBody []byte
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotReq = r
+			gotBody, _ = io.ReadAll(r.Body)
+		}))
+		ps, err := NewPushSink(srv.URL+"/plantprism", tc.style, tc.token)
+		if err != nil {
+			t.Fatalf("NewPushSink(%s) failed: %v", tc.style, err)
+		}
+		err = ps.Send(context.Background(), testEvent())
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%s Send failed: %v", tc.style, err)
+		}
+		if gotReq.URL.Path != tc.wantPath || gotReq.URL.RawQuery != tc.wantQuery {
+			t.Errorf("%s, got URL %s, want path %s, query %s", tc.style, gotReq.URL, tc.wantPath, tc.wantQuery)
+		}
+		for h, v := range tc.wantHeader {
+			if gotReq.Header.Get(h) != v {
+				t.Errorf("%s, got header %s '%s', want '%s'", tc.style, h, gotReq.Header.Get(h), v)
+			}
+		}
+		if string(gotBody) != tc.wantBody {
+			t.Errorf("%s, got body '%s', want '%s'", tc.style, gotBody, tc.wantBody)
+		}
+	}
+
+	_, err := NewPushSink("http://localhost", PushStyleGotify, "")
+	if err == nil {
+		t.Errorf("NewPushSink for gotify without token succeeded")
+	}
+	_, err = NewPushSink("http://localhost", "pigeon", "")
+	if err == nil {
+		t.Errorf("NewPushSink with unknown style succeeded")
+	}
+}
+
+// fakeSMTP is just enough of an SMTP server to receive one mail.
+type fakeSMTP struct {
+	l    net.Listener
+	auth string
+	from string
+	to   []string
+	data string
+	done chan struct{}
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed listening: %v", err)
+	}
+	s := &fakeSMTP{l: l, done: make(chan struct{})}
+	go s.serve(t)
+	return s
+}
+
+func (s *fakeSMTP) serve(t *testing.T) {
+	defer close(s.done)
+	conn, err := s.l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(l string) {
+		conn.Write([]byte(l + "\r\n"))
+	}
+	reply("220 localhost fake SMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			parts := strings.Fields(line)
+			b, _ := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+			s.auth = string(b)
+			reply("235 OK")
+		case "MAIL":
+			s.from = line
+			reply("250 OK")
+		case "RCPT":
+			s.to = append(s.to, line)
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+			var b strings.Builder
+			for {
+				dl, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dl == ".\r\n" {
+					break
+				}
+				b.WriteString(dl)
+			}
+			s.data = b.String()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			t.Errorf("fake SMTP got unexpected command '%s'", line)
+			reply("500 What?")
+		}
+	}
+}
+
+func TestSMTPSink(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.l.Close()
+
+	_, port, _ := net.SplitHostPort(srv.l.Addr().String())
+	s := NewSMTPSink("localhost:"+port, "plantprism@example.com", []string{"a@example.com", "b@example.com"}, "user", "pass")
+	e := testEvent()
+	err := s.Send(context.Background(), e)
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	<-srv.done
+
+	if srv.auth != "\x00user\x00pass" {
+		t.Errorf("got auth %q, want %q", srv.auth, "\x00user\x00pass")
+	}
+	if srv.from != "MAIL FROM:<plantprism@example.com>" {
+		t.Errorf("got '%s', want MAIL FROM plantprism@example.com", srv.from)
+	}
+	wantTo := []string{"RCPT TO:<a@example.com>", "RCPT TO:<b@example.com>"}
+	if !reflect.DeepEqual(srv.to, wantTo) {
+		t.Errorf("got recipients %v, want %v", srv.to, wantTo)
+	}
+	for _, want := range []string{
+		"Subject: Plantcube a8d39911: door open\r\n",
+		"To: a@example.com, b@example.com\r\n",
+		"\r\n\r\nThe door has been open too long\r\n",
+		"Device: " + testDevice + "\r\n",
+	} {
+		if !strings.Contains(srv.data, want) {
+			t.Errorf("mail doesn't contain %q:\n%s", want, srv.data)
+		}
+	}
+}
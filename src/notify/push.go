@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	PushStyleNtfy   = "ntfy"
+	PushStyleGotify = "gotify"
+)
+
+// PushSink sends events to an ntfy topic or a Gotify server.
+type PushSink struct {
+	url    string
+	style  string
+	token  string
+	client *http.Client
+}
+
+func NewPushSink(url, style, token string) (*PushSink, error) {
+	switch style {
+	case PushStyleNtfy:
+	case PushStyleGotify:
+		if token == "" {
+			return nil, fmt.Errorf("gotify push needs an application token")
+		}
+	default:
+		return nil, fmt.Errorf("unknown push style '%s', want '%s' or '%s'", style, PushStyleNtfy, PushStyleGotify)
+	}
+	return &PushSink{
+		url:    url,
+		style:  style,
+		token:  token,
+		client: http.DefaultClient,
+	}, nil
+}
+
+func (s *PushSink) Name() string {
+	return "push"
+}
+
+// priority returns the ntfy priority (1-5) for an event. Gotify's
+// scale is 0-10, so it gets doubled there.
+func priority(e *Event) int {
+	if e.Active {
+		return 4
+	}
+	return 2
+}
+
+func (s *PushSink) Send(ctx context.Context, e *Event) error {
+	var (
+		req *http.Request
+		err error
+	)
+	if s.style == PushStyleNtfy {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(e.Message))
+		if err != nil {
+			return fmt.Errorf("failed creating ntfy request: %w", err)
+		}
+		req.Header.Set("Title", e.Title())
+		req.Header.Set("Priority", fmt.Sprint(priority(e)))
+		req.Header.Set("Tags", "seedling,"+e.Type)
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+	} else {
+		b, err := json.Marshal(struct {
+			Title    string `json:"title"`
+			Message  string `json:"message"`
+			Priority int    `json:"priority"`
+		}{e.Title(), e.Message, priority(e) * 2})
+		if err != nil {
+			return fmt.Errorf("failed marshalling gotify message: %w", err)
+		}
+		u := strings.TrimSuffix(s.url, "/") + "/message?token=" + url.QueryEscape(s.token)
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+		if err != nil {
+			return fmt.Errorf("failed creating gotify request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return doRequest(s.client, req)
+}
@@ -0,0 +1,108 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPSink emails each event. If a username is given, it
+// authenticates with PLAIN auth, which net/smtp only allows over TLS
+// or to localhost.
+type SMTPSink struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func NewSMTPSink(addr, from string, to []string, username, password string) *SMTPSink {
+	return &SMTPSink{
+		addr:     addr,
+		from:     from,
+		to:       to,
+		username: username,
+		password: password,
+	}
+}
+
+func (s *SMTPSink) Name() string {
+	return "smtp"
+}
+
+func (s *SMTPSink) message(e *Event) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", e.Title())
+	fmt.Fprintf(&b, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "%s\r\n\r\nDevice: %s\r\nTime: %s\r\n", e.Message, e.Device, e.Time.Local().Format(time.RFC1123))
+	return b.Bytes()
+}
+
+func (s *SMTPSink) Send(ctx context.Context, e *Event) error {
+	// net/smtp has no context support, so we only use the
+	// context's deadline for the connection.
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed connecting to SMTP server: %w", err)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	host, _, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("invalid SMTP address '%s': %w", s.addr, err)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed starting SMTP session: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if s.username != "" {
+		err = c.Auth(smtp.PlainAuth("", s.username, s.password, host))
+		if err != nil {
+			return fmt.Errorf("SMTP auth failed: %w", err)
+		}
+	}
+	err = c.Mail(s.from)
+	if err != nil {
+		return fmt.Errorf("SMTP MAIL failed: %w", err)
+	}
+	for _, to := range s.to {
+		err = c.Rcpt(to)
+		if err != nil {
+			return fmt.Errorf("SMTP RCPT for '%s' failed: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA failed: %w", err)
+	}
+	_, err = w.Write(s.message(e))
+	if err != nil {
+		return fmt.Errorf("failed writing mail: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed finishing mail: %w", err)
+	}
+	return c.Quit()
+}
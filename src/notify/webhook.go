@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// WebhookSink POSTs each event as a JSON object to a URL.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+type webhookPayload struct {
+	Device  string    `json:"device"`
+	Type    string    `json:"type"`
+	Subject string    `json:"subject,omitempty"`
+	Active  bool      `json:"active"`
+	Time    time.Time `json:"time"`
+	Title   string    `json:"title"`
+	Message string    `json:"message"`
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		url:    url,
+		client: http.DefaultClient,
+	}
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Send(ctx context.Context, e *Event) error {
+	b, err := json.Marshal(webhookPayload{
+		Device:  e.Device,
+		Type:    e.Type,
+		Subject: e.Subject,
+		Active:  e.Active,
+		Time:    e.Time,
+		Title:   e.Title(),
+		Message: e.Message,
+	})
+	if err != nil {
+		return fmt.Errorf("failed marshalling webhook payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed creating webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doRequest(s.client, req)
+}
+
+// doRequest sends req and checks that the response was a success.
+func doRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server returned %s: %s", resp.Status, body)
+	}
+	return nil
+}
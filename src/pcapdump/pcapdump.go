@@ -0,0 +1,113 @@
+package pcapdump
+
+// Reads MQTT publish packets out of pcap files captured from real
+// Plantcube MQTT comms (see dumps/README.md).
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	pahopackets "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+type Packet struct {
+	Num     int // Number of the TCP packet within the dump
+	Time    time.Time
+	SrcPort string
+	DstPort string
+	Publish *pahopackets.PublishPacket
+}
+
+// Handler is called for every MQTT publish found in the dump. If
+// it returns an error, reading stops and Read returns that error.
+type Handler func(p *Packet) error
+
+// Read reads the given pcapng file and calls h for each MQTT publish
+// packet in it, in order.
+func Read(name string, h Handler) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("unable to open: %w", err)
+	}
+	defer f.Close()
+
+	r, err := pcapgo.NewNgReader(f, pcapgo.NgReaderOptions{
+		// We get zero packets if we don't specify this,
+		// probably(?) because the pcapng file (or a segment
+		// within it?) is specifying ethernet link type and
+		// our packets have LinuxSLL2 link type.
+		WantMixedLinkType: true,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create ng reader: %w", err)
+	}
+
+	var stash []byte
+	ps := gopacket.NewPacketSource(r, layers.LinkTypeLinuxSLL2)
+	i := 0
+	for {
+		i++
+		p, err := ps.NextPacket()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error on packet %d NextPacket: %w", i, err)
+		}
+		if el := p.ErrorLayer(); el != nil {
+			return fmt.Errorf("packet %d decode error: %w", i, el.Error())
+		}
+		app := p.ApplicationLayer()
+		if app == nil || len(app.Payload()) == 0 {
+			continue
+		}
+		tl := p.TransportLayer()
+		if tl == nil {
+			return fmt.Errorf("packet %d has application layer but no transport layer", i)
+		}
+
+		// Large MQTT packets are split over several TCP
+		// packets. We don't do proper reassembly, we just
+		// assume that anything of 1024 bytes or more is
+		// continued in the next packet.
+		if stash != nil || len(app.Payload()) >= 1024 {
+			stash = append(stash, app.Payload()...)
+			if len(app.Payload()) >= 1024 {
+				continue
+			}
+		}
+		var raw []byte
+		if stash != nil {
+			raw = stash
+			stash = nil
+		} else {
+			raw = app.Payload()
+		}
+
+		for br := bytes.NewReader(raw); br.Len() > 0; {
+			cp, err := pahopackets.ReadPacket(br)
+			if err != nil {
+				return fmt.Errorf("packet %d ReadPacket: %w", i, err)
+			}
+			pp, ok := cp.(*pahopackets.PublishPacket)
+			if !ok {
+				continue
+			}
+			err = h(&Packet{
+				Num:     i,
+				Time:    p.Metadata().Timestamp,
+				SrcPort: tl.TransportFlow().Src().String(),
+				DstPort: tl.TransportFlow().Dst().String(),
+				Publish: pp,
+			})
+			if err != nil {
+				return fmt.Errorf("packet %d: %w", i, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Jon-Bright/plantprism/config"
+	"github.com/Jon-Bright/plantprism/device"
+	"github.com/Jon-Bright/plantprism/notify"
+	"github.com/benbjohnson/clock"
+)
+
+// reloader re-reads the config file on SIGHUP or when the UI asks it
+// to, and applies what it can to the running server.
+type reloader struct {
+	mu      sync.Mutex
+	clk     clock.Clock
+	cmdline map[string]bool // Flags given on the command line
+
+	notifierMu sync.RWMutex
+	notifier   *notify.Notifier
+}
+
+// newReloader must be called after the flags are parsed, but before
+// the config file is applied to them.
+func newReloader(clk clock.Clock) *reloader {
+	r := reloader{clk: clk, cmdline: make(map[string]bool)}
+	flag.Visit(func(f *flag.Flag) {
+		r.cmdline[f.Name] = true
+	})
+	return &r
+}
+
+// publish passes a device notice to the current notifier.
+func (r *reloader) publish(n device.Notice) {
+	r.notifierMu.RLock()
+	defer r.notifierMu.RUnlock()
+	r.notifier.Publish(notify.Event{
+		Device:  n.DeviceID,
+		Type:    string(n.Type),
+		Subject: n.Subject,
+		Active:  n.Active,
+		Time:    n.Time,
+		Message: n.Message,
+	})
+}
+
+func (r *reloader) setNotifier(n *notify.Notifier) {
+	r.notifierMu.Lock()
+	old := r.notifier
+	r.notifier = n
+	r.notifierMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+func (r *reloader) handleSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		log.Info.Printf("SIGHUP received")
+		r.reload()
+	}
+}
+
+// needsRestart says whether a flag only takes effect at startup.
+func needsRestart(name string) bool {
+	return strings.HasPrefix(name, "broker_") || strings.HasPrefix(name, "ha_") || strings.HasPrefix(name, "mqtt_api") || name == "http_listen" || name == "data_dir" || name == "logfile"
+}
+
+// saveFlag returns a function that puts a flag back to its current
+// value.
+func saveFlag(name string) func() {
+	v := reflect.ValueOf(flag.Lookup(name).Value).Elem()
+	saved := reflect.New(v.Type()).Elem()
+	saved.Set(v)
+	return func() {
+		v.Set(saved)
+	}
+}
+
+// reload re-reads the config file and applies it. Settings that need
+// a restart are reported, but not changed. If anything in the file is
+// invalid, nothing is changed.
+func (r *reloader) reload() (*config.ReloadReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rep, err := r.apply()
+	if err != nil {
+		log.Error.Printf("Config reload failed: %v", err)
+		return nil, err
+	}
+	log.Info.Printf("Config reloaded, applied %v, reconfigured devices %v", rep.Applied, rep.Devices)
+	if len(rep.NeedRestart) > 0 {
+		log.Warn.Printf("Config changes need a restart to take effect: %v", rep.NeedRestart)
+	}
+	return rep, nil
+}
+
+func (r *reloader) apply() (*config.ReloadReport, error) {
+	if *configName == "" {
+		return nil, errors.New("no config file to reload, plantprism was started without -config")
+	}
+	cfg, err := config.Load(*configName)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := cfg.Changes(flag.CommandLine, r.cmdline)
+	err = errors.Join(cfg.Validate(), err)
+	if err != nil {
+		return nil, fmt.Errorf("config '%s': %w", *configName, err)
+	}
+
+	configs := make(map[string]device.DeviceConfig)
+	for _, d := range cfg.Devices {
+		configs[d.ID] = device.DeviceConfig{
+			Name:     d.Name,
+			Timezone: d.Timezone,
+			Sunrise:  d.Sunrise,
+		}
+	}
+	// Everything that can fail is done before anything the running
+	// server uses is changed, so that a failure changes nothing.
+	err = device.CheckConfigs(configs)
+	if err != nil {
+		return nil, fmt.Errorf("config '%s': %w", *configName, err)
+	}
+
+	var rep config.ReloadReport
+	var restore []func()
+	undo := func() {
+		for _, f := range restore {
+			f()
+		}
+	}
+	changed := make(map[string]bool)
+	var allowed []string
+	for _, ch := range changes {
+		if needsRestart(ch.Flag) {
+			rep.NeedRestart = append(rep.NeedRestart, ch.String())
+			continue
+		}
+		rep.Applied = append(rep.Applied, ch.String())
+		changed[ch.Flag] = true
+		if ch.Flag == "device" {
+			// The device package changes this under its
+			// own lock, below.
+			allowed = ch.Values
+			continue
+		}
+		restore = append(restore, saveFlag(ch.Flag))
+		err = config.SetFlag(flag.CommandLine, ch)
+		if err != nil {
+			undo()
+			return nil, fmt.Errorf("config '%s': %w", *configName, err)
+		}
+	}
+
+	var n *notify.Notifier
+	for f := range changed {
+		if strings.HasPrefix(f, "notify_") {
+			n, err = notify.Init(log, r.clk)
+			if err != nil {
+				undo()
+				return nil, fmt.Errorf("notification settings: %w", err)
+			}
+			break
+		}
+	}
+
+	// The device package only sees its flags' new values once
+	// it's told, so that devices don't read them as they change.
+	// If they're refused, it keeps the old ones.
+	if len(changed) > 0 {
+		err = device.ReloadFlags()
+		if err != nil {
+			undo()
+			if n != nil {
+				n.Close()
+			}
+			return nil, fmt.Errorf("device defaults: %w", err)
+		}
+	}
+
+	// Nothing below should fail: Validate and CheckConfigs have
+	// checked it all.
+	if n != nil {
+		r.setNotifier(n)
+	}
+	if changed["log_level"] {
+		err = log.SetLevel(*logLevel)
+		if err != nil {
+			log.Error.Printf("Failed to set log level: %v", err)
+		}
+	}
+	if changed["device"] {
+		device.SetAllowedDevices(allowed)
+	}
+	rep.Devices, err = device.Reconfigure(configs)
+	if err != nil {
+		log.Error.Printf("Failed to reconfigure devices: %v", err)
+	}
+	return &rep, nil
+}
@@ -36,22 +36,50 @@ var startCleaningClick = function( event ) {
 	confirmCleaningDialog.dialog("open");
 };
 
+// postMode requests a mode change. If the server wants it confirmed,
+// we ask the user and try again.
+function postMode(endpoint, data) {
+    $.post(endpoint, data).fail(function(xhr) {
+	if (xhr.status != 409) {
+	    return;
+	}
+	var conf = xhr.responseJSON ? xhr.responseJSON["Confirm"] : undefined;
+	if (conf === undefined) {
+	    alert(xhr.responseText);
+	} else if (confirm(conf+". Continue anyway?")) {
+	    postMode(endpoint, data+"&confirmed=true");
+	}
+    });
+}
+
 var modeSilentClick = function( event ) {
     event.preventDefault();
     $( this ).parent().find("#id").val(deviceID);
-    $.post("silentMode", $( this ).parent().serialize());
+    postMode("silentMode", $( this ).parent().serialize());
 };
 
 var modeCinemaClick = function( event ) {
     event.preventDefault();
     $( this ).parent().find("#id").val(deviceID);
-    $.post("cinemaMode", $( this ).parent().serialize());
+    postMode("cinemaMode", $( this ).parent().serialize());
 };
 
 var modeDefaultClick = function( event ) {
     event.preventDefault();
     $( this ).parent().find("#id").val(deviceID);
-    $.post("defaultMode", $( this ).parent().serialize());
+    postMode("defaultMode", $( this ).parent().serialize());
+};
+
+var setNameClick = function( event ) {
+    event.preventDefault();
+    var name = $("#deviceName").val();
+    $.post("setName", {id: deviceID, name: name}, function() {
+	var shown = name.trim() || deviceID;
+	$("#deviceHeading").text(shown);
+	document.title = "Plantprism - "+shown;
+    }).fail(function(xhr) {
+	alert(xhr.responseText);
+    });
 };
 
 function processPlantDB(data) {
@@ -179,9 +207,8 @@ function InitUI() {
 	dialogClass: "no-close",
         buttons: {
             "All done": function() {
-		$.post("startCleaning", $( this ).find("form").serialize());
-		cleaningUnderwayDialog.find("#id").val(deviceID);
-		cleaningUnderwayDialog.dialog("open");
+		// The server tells us when cleaning's underway
+		postMode("startCleaning", $( this ).find("form").serialize());
 		$( this ).dialog( "option", "hide", {effect: "explode", duration: 1000});
 		$( this ).dialog( "close" );
             },
@@ -209,9 +236,8 @@ function InitUI() {
 	dialogClass: "no-close",
         buttons: {
             "All done": function() {
-		$.post("startDraining", $( this ).find("form").serialize());
-		cleaningDrainDialog.find("#id").val(deviceID);
-		cleaningDrainDialog.dialog("open");
+		// The server tells us when draining's started
+		postMode("startDraining", $( this ).find("form").serialize());
 		$( this ).dialog( "option", "hide", {effect: "explode", duration: 1000});
 		$( this ).dialog( "close" );
             },
@@ -239,6 +265,7 @@ function InitUI() {
 	dialogClass: "no-close",
         buttons: {
             "All done": function() {
+		$.post("finishCleaning", $( this ).find("form").serialize());
 		$( this ).dialog( "option", "hide", {effect: "explode", duration: 1000});
 		$( this ).dialog( "close" );
             },
@@ -277,7 +304,84 @@ function InitUI() {
     $("#modeSilent").on("click", modeSilentClick);
     $("#modeCinema").on("click", modeCinemaClick);
     $("#modeDefault").on("click", modeDefaultClick);
+    $("#setNameButton").on("click", setNameClick);
     $("#tabs").tabs();
+    $("#eventsFilter :input").on("change", loadEvents);
+    loadEvents();
+    $("#discoveryRefresh").on("click", loadDiscovery);
+    loadDiscovery();
+}
+
+var severities = ["info", "warning", "error"];
+
+function eventRow(ev) {
+    var details = [];
+    $.each(ev["Fields"] || {}, function(k, v) {
+	details.push(k+": "+v);
+    });
+    if (ev["Raw"]) {
+	details.push(ev["Raw"]);
+    }
+    var tr = $("<tr>").attr("class", "event-"+ev["Severity"]);
+    tr.append($("<td>").text(new Date(ev["Received"]).toLocaleString()));
+    tr.append($("<td>").text(ev["Severity"]));
+    tr.append($("<td>").text(ev["Label"]));
+    tr.append($("<td>").text(details.join(", ")));
+    return tr;
+}
+
+function eventMatchesFilter(ev) {
+    var minSev = $("#eventsSeverity").val();
+    if (minSev && severities.indexOf(ev["Severity"]) < severities.indexOf(minSev)) {
+	return false;
+    }
+    var labels = $("#eventsLabels").val();
+    if (labels && labels.split(",").map(function(l) { return l.trim(); }).indexOf(ev["Label"]) < 0) {
+	return false;
+    }
+    return true;
+}
+
+function loadEvents() {
+    $.getJSON("events?id="+deviceID+"&"+$("#eventsFilter").serialize(), function(data) {
+	var tbody = $("#eventsTable tbody");
+	tbody.empty();
+	$.each(data, function(i, ev) {
+	    tbody.append(eventRow(ev));
+	});
+    });
+}
+
+function loadDiscovery() {
+    $.getJSON("discovery", function(data) {
+	$("#discoveryMode").text(data["Lenient"] ?
+	    "Lenient mode: messages with unknown fields or values are processed, and the unknowns catalogued here." :
+	    "Strict mode: messages with unknown fields or values are rejected. Only unknown topics and warning labels are catalogued here.");
+	var tbody = $("#discoveryTable tbody");
+	tbody.empty();
+	$.each(data["Discoveries"] || [], function(i, dc) {
+	    var tr = $("<tr>");
+	    tr.append($("<td>").text(dc["Kind"]));
+	    tr.append($("<td>").text(dc["Where"]));
+	    tr.append($("<td>").text(dc["Key"]));
+	    tr.append($("<td>").text(dc["Count"]));
+	    tr.append($("<td>").text(new Date(dc["FirstSeen"]*1000).toLocaleString()));
+	    tr.append($("<td>").text(new Date(dc["LastSeen"]*1000).toLocaleString()));
+	    var samples = $("<td>");
+	    $.each(dc["Samples"] || [], function(j, s) {
+		samples.append($("<pre>").text(s));
+	    });
+	    tr.append(samples);
+	    tbody.append(tr);
+	});
+    });
+}
+
+function eventEvent(e) {
+    var ev = jQuery.parseJSON(e.data);
+    if (eventMatchesFilter(ev)) {
+	$("#eventsTable tbody").prepend(eventRow(ev));
+    }
 }
 
 function slotEvent(e) {
@@ -306,8 +410,123 @@ function slotEvent(e) {
     }
 }
 
+function updateLiveness(data) {
+    var lv = $("#liveness");
+    if (!data["Online"]) {
+	var since = "ever";
+	if (data["LastMessage"] > 0) {
+	    since = new Date(data["LastMessage"]*1000).toLocaleString();
+	}
+	lv.attr("class", "liveness offline");
+	lv.text("Plantcube offline: no message since "+since);
+    } else if (data["StaleFields"] && data["StaleFields"].length > 0) {
+	lv.attr("class", "liveness stale");
+	lv.text("Stale sensors: "+data["StaleFields"].join(", "));
+    } else {
+	lv.attr("class", "liveness");
+	lv.text("");
+    }
+}
+
+function updateDoorAlert(data) {
+    var da = $("#doorAlert");
+    if (data["DoorAlert"]) {
+	var since = new Date(data["DoorOpenTime"]*1000).toLocaleTimeString();
+	da.attr("class", "liveness stale");
+	da.text("Door open since "+since+", please close it");
+    } else {
+	da.attr("class", "liveness");
+	da.text("");
+    }
+}
+
+function updateCommands(data) {
+    var cm = $("#commands");
+    var cmds = data["Commands"] || [];
+    var failed = cmds.filter(function(c) { return c["Failed"]; });
+    if (failed.length > 0) {
+	cm.attr("class", "liveness offline");
+	cm.text("Not acted on by the Plantcube: "+failed.map(function(c) {
+	    return c["Description"]+" ("+c["Attempts"]+" attempts)";
+	}).join(", "));
+    } else if (cmds.length > 0) {
+	cm.attr("class", "liveness stale");
+	cm.text("Waiting for the Plantcube: "+cmds.map(function(c) {
+	    var s = c["Description"];
+	    if (c["Attempts"] > 1) {
+		s += " (attempt "+c["Attempts"]+")";
+	    }
+	    return s;
+	}).join(", "));
+    } else {
+	cm.attr("class", "liveness");
+	cm.text("");
+    }
+}
+
+function updateOutbox(data) {
+    var ob = $("#outbox");
+    var o = data["Outbox"];
+    if (o) {
+	var since = new Date(o["Oldest"]*1000).toLocaleTimeString();
+	ob.attr("class", "liveness offline");
+	ob.text(o["Pending"]+" message(s) not yet sent to the Plantcube, waiting since "+since+" ("+o["Attempts"]+" attempts, last error: "+o["LastError"]+")");
+    } else {
+	ob.attr("class", "liveness");
+	ob.text("");
+    }
+}
+
+function updateBroker(data) {
+    var br = $("#broker");
+    switch (data["State"]) {
+    case "connected":
+    case "embedded":
+	br.attr("class", "liveness");
+	br.text("");
+	break;
+    case "connecting":
+    case "reconnecting":
+	br.attr("class", "liveness stale");
+	br.text("Connecting to MQTT broker "+data["Broker"]+" (attempt "+(data["Attempts"]+1)+", last error: "+data["LastError"]+")");
+	break;
+    default:
+	var since = new Date(data["Since"]*1000).toLocaleTimeString();
+	br.attr("class", "liveness offline");
+	br.text("Not connected to MQTT broker since "+since+" (last error: "+data["LastError"]+")");
+    }
+}
+
+function FetchBroker() {
+    $.getJSON("broker", updateBroker);
+}
+
+function updateSuspicious(data) {
+    var sp = $("#suspicious");
+    // Only the last day's, the full list is at /suspicious
+    var dayAgo = Date.now()/1000 - 86400;
+    var srs = (data["Suspicious"] || []).filter(function(sr) {
+	return sr["Time"] > dayAgo;
+    }).slice(-5);
+    if (srs.length > 0) {
+	sp.attr("class", "liveness stale");
+	sp.text("Suspicious readings: "+srs.map(function(sr) {
+	    var at = new Date(sr["Time"]*1000).toLocaleString();
+	    return sr["Field"]+"="+sr["Value"]+" at "+at;
+	}).join(", "));
+    } else {
+	sp.attr("class", "liveness");
+	sp.text("");
+    }
+}
+
 function statusEvent(e) {
     var data = jQuery.parseJSON(e.data);
+    updateLiveness(data);
+    updateDoorAlert(data);
+    updateCommands(data);
+    updateOutbox(data);
+    updateSuspicious(data);
     $("#tempA").text(data["TempA"]);
     $("#tempB").text(data["TempB"]);
     $("#tempTank").text(data["TempTank"]);
@@ -393,36 +612,48 @@ function statusEvent(e) {
     }
     $("#pump").text(pump);
 
-    if (cleaningUnderwayDialog.dialog("isOpen")) {
+    updateCleaning(data, pump);
+}
+
+function updateCleaning(data, pump) {
+    var cl = data["Cleaning"];
+    var stage = cl ? cl["Stage"] : "idle";
+    var dialogs = {
+	"rinsing": cleaningUnderwayDialog,
+	"rinse_done": cleaningRinseDoneDialog,
+	"draining": cleaningDrainDialog,
+	"finished": cleaningFinalDialog
+    };
+    $.each(dialogs, function(s, dlg) {
+	if (s != stage && dlg.dialog("isOpen")) {
+	    dlg.dialog("close");
+	}
+    });
+    if (!cl) {
+	return;
+    }
+    var dlg = dialogs[stage];
+    var ul = dlg.find("ul.cleaningInstructions");
+    ul.empty();
+    $.each(cl["Instructions"], function(i, ins) {
+	ul.append($("<li>").text(ins));
+    });
+    if (cl["Stuck"]) {
+	var since = new Date(cl["StageStarted"]*1000).toLocaleTimeString();
+	dlg.find(".cleaningStuck").text("This has been going on since "+since+", longer than expected.");
+    } else {
+	dlg.find(".cleaningStuck").text("");
+    }
+    if (stage == "rinsing") {
 	if (data["Valve"]!=4) {
 	    $("#cleaningStatus").text(pump);
 	} else {
 	    $("#cleaningStatus").text("Waiting for water");
 	}
-	if (data["Mode"]==2) {
-	    // Rinsing is done
-	    cleaningUnderwayDialog.dialog("close");
-	    cleaningRinseDoneDialog.find("#id").val(deviceID);
-	    cleaningRinseDoneDialog.dialog("open");
-	}
-    } else if (data["Mode"]==5) {
-	cleaningUnderwayDialog.find("#id").val(deviceID);
-	cleaningUnderwayDialog.dialog("open");
-    }
-    if (cleaningDrainDialog.dialog("isOpen")) {
-	if (data["Mode"]==0) {
-	    // Draining is done
-	    cleaningDrainDialog.dialog("close");
-	    cleaningFinalDialog.find("#id").val(deviceID);
-	    cleaningFinalDialog.dialog("open");
-	}
-    } else if (data["Mode"]==3) {
-	cleaningDrainDialog.find("#id").val(deviceID);
-	cleaningDrainDialog.dialog("open");
     }
-    if (data["Mode"]==2 && !cleaningRinseDoneDialog.dialog("isOpen")) {
-	cleaningRinseDoneDialog.find("#id").val(deviceID);
-	cleaningRinseDoneDialog.dialog("open");
+    if (!dlg.dialog("isOpen")) {
+	dlg.find("#id").val(deviceID);
+	dlg.dialog("open");
     }
 }
 
@@ -434,4 +665,7 @@ function StartStream() {
     var stream = new EventSource('/stream?id='+deviceID);
     stream.addEventListener('slot', slotEvent, false);
     stream.addEventListener('status', statusEvent, false);
+    stream.addEventListener('event', eventEvent, false);
+    FetchBroker();
+    setInterval(FetchBroker, 15000);
 }
@@ -0,0 +1,330 @@
+package shadow
+
+// An emulation of the parts of AWS IoT's device shadow service that
+// a Plantcube uses: a document with desired and reported state,
+// versioned, with a timestamp for every field, and the accepted,
+// delta and rejected messages that an update produces.
+//
+// Unlike AWS, state is flat: a value that's itself an object is
+// replaced as a whole rather than merged. The Plantcube never sends
+// nested state.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const (
+	// MaxRequestSize is the largest update request we accept, in
+	// bytes. AWS's limit is the same.
+	MaxRequestSize = 8192
+	// MaxDepth is the deepest nesting of JSON objects we accept
+	// in a request, counting the request itself.
+	MaxDepth = 6
+	// MaxClientTokenLength is the longest client token we accept.
+	MaxClientTokenLength = 64
+)
+
+// AWS-style error codes, sent in rejected messages.
+const (
+	CodeBadRequest          = 400
+	CodeUnauthorized        = 401
+	CodeForbidden           = 403
+	CodeNotFound            = 404
+	CodeConflict            = 409
+	CodePayloadTooLarge     = 413
+	CodeUnsupportedEncoding = 415
+	CodeTooManyRequests     = 429
+	CodeInternalError       = 500
+)
+
+// Error is an update that the shadow refused. It becomes a rejected
+// message.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+func errorf(code int, format string, a ...any) *Error {
+	return &Error{code, fmt.Sprintf(format, a...)}
+}
+
+// Rejected is the message sent on .../shadow/update/rejected.
+type Rejected struct {
+	Code        int    `json:"code"`
+	Message     string `json:"message"`
+	Timestamp   int64  `json:"timestamp"`
+	ClientToken string `json:"clientToken,omitempty"`
+}
+
+// Rejected makes the message telling the client about the error.
+func (e *Error) Rejected(t time.Time, clientToken string) *Rejected {
+	return &Rejected{
+		Code:        e.Code,
+		Message:     e.Message,
+		Timestamp:   t.Unix(),
+		ClientToken: clientToken,
+	}
+}
+
+// Value is a single field of state, with when it was last set.
+type Value struct {
+	Value     json.RawMessage
+	Timestamp time.Time
+}
+
+// Document is a shadow: the desired and reported state of a device.
+type Document struct {
+	Version  int
+	Desired  map[string]Value
+	Reported map[string]Value
+}
+
+// Request is a parsed update request. A nil Desired or Reported map
+// means the section wasn't in the request, unless the matching Clear
+// flag is set, which means the section was null and all its fields
+// are to be deleted. A field whose value is null is deleted.
+type Request struct {
+	Desired       map[string]json.RawMessage
+	Reported      map[string]json.RawMessage
+	ClearDesired  bool
+	ClearReported bool
+	ClientToken   string
+	// If non-zero, the update is only applied if the document
+	// has this version.
+	Version int
+}
+
+// ParseRequest parses and validates the JSON of an update request.
+// The returned Request is non-nil whenever the client token could be
+// parsed, even if there's an error, so that the rejected message can
+// include it.
+func ParseRequest(b []byte) (*Request, *Error) {
+	if len(b) > MaxRequestSize {
+		return nil, errorf(CodePayloadTooLarge, "The payload exceeds the maximum size allowed")
+	}
+	var top map[string]json.RawMessage
+	err := json.Unmarshal(b, &top)
+	if err != nil || top == nil {
+		return nil, errorf(CodeBadRequest, "Invalid JSON")
+	}
+	var req Request
+	if ct, ok := top["clientToken"]; ok {
+		err = json.Unmarshal(ct, &req.ClientToken)
+		if err != nil || len(req.ClientToken) > MaxClientTokenLength {
+			return nil, errorf(CodeBadRequest, "Invalid clientToken")
+		}
+	}
+	if depth(b) > MaxDepth {
+		return &req, errorf(CodeBadRequest, "JSON contains too many levels of nesting; maximum is %d", MaxDepth)
+	}
+	for k, v := range top {
+		switch k {
+		case "clientToken":
+		case "version":
+			err = json.Unmarshal(v, &req.Version)
+			if err != nil || req.Version < 0 {
+				return &req, errorf(CodeBadRequest, "Invalid version")
+			}
+		case "state":
+		default:
+			return &req, errorf(CodeBadRequest, "Unexpected node: %s", k)
+		}
+	}
+	rawState, ok := top["state"]
+	if !ok {
+		return &req, errorf(CodeBadRequest, "Missing required node: state")
+	}
+	var state map[string]json.RawMessage
+	err = json.Unmarshal(rawState, &state)
+	if err != nil || state == nil {
+		return &req, errorf(CodeBadRequest, "State node must be an object")
+	}
+	for k, v := range state {
+		var section *map[string]json.RawMessage
+		var clear *bool
+		switch k {
+		case "desired":
+			section, clear = &req.Desired, &req.ClearDesired
+		case "reported":
+			section, clear = &req.Reported, &req.ClearReported
+		default:
+			return &req, errorf(CodeBadRequest, "State contains an invalid node: %s", k)
+		}
+		if isNull(v) {
+			*clear = true
+			continue
+		}
+		err = json.Unmarshal(v, section)
+		if err != nil {
+			return &req, errorf(CodeBadRequest, "%s node must be an object", k)
+		}
+	}
+	if len(req.Desired) == 0 && len(req.Reported) == 0 && !req.ClearDesired && !req.ClearReported {
+		return &req, errorf(CodeBadRequest, "State contains no desired or reported state")
+	}
+	return &req, nil
+}
+
+// depth returns how deeply objects and arrays are nested in valid
+// JSON.
+func depth(b []byte) int {
+	d, max := 0, 0
+	inString, escaped := false, false
+	for _, c := range b {
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			d++
+			if d > max {
+				max = d
+			}
+		case c == '}' || c == ']':
+			d--
+		}
+	}
+	return max
+}
+
+func isNull(v json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(v), []byte("null"))
+}
+
+// equal says whether two values are the same JSON, regardless of
+// formatting: 22 and 22.0 are equal.
+func equal(a, b json.RawMessage) bool {
+	var av, bv any
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// Timestamp is the metadata for a single field.
+type Timestamp struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Accepted is the message sent on .../shadow/update/accepted. It
+// echoes the request's state, with metadata for every field in it.
+type Accepted struct {
+	State       map[string]map[string]json.RawMessage `json:"state"`
+	Metadata    map[string]map[string]Timestamp       `json:"metadata"`
+	Version     int                                   `json:"version"`
+	Timestamp   int64                                 `json:"timestamp"`
+	ClientToken string                                `json:"clientToken,omitempty"`
+}
+
+// Delta is the message sent on .../shadow/update/delta: every
+// desired field that's different from its reported value, with the
+// time it was desired.
+type Delta struct {
+	Version   int                        `json:"version"`
+	Timestamp int64                      `json:"timestamp"`
+	State     map[string]json.RawMessage `json:"state"`
+	Metadata  map[string]Timestamp       `json:"metadata"`
+}
+
+// Update applies a request to the document at time t. If the update
+// is accepted, the version is incremented and the accepted message
+// returned. If the update leaves any desired field it touched
+// different from its reported value, the delta message is returned
+// too, otherwise the delta is nil. Only fields the request touched
+// can appear in the delta, so a device that keeps reporting a value
+// that doesn't match a desired one gets a delta every time, but an
+// unrelated report doesn't produce one.
+func (doc *Document) Update(req *Request, t time.Time) (*Accepted, *Delta, *Error) {
+	if req.Version != 0 && req.Version != doc.Version {
+		return nil, nil, errorf(CodeConflict, "Version conflict")
+	}
+	acc := Accepted{
+		State:       map[string]map[string]json.RawMessage{},
+		Metadata:    map[string]map[string]Timestamp{},
+		Timestamp:   t.Unix(),
+		ClientToken: req.ClientToken,
+	}
+	touched := map[string]bool{}
+	apply := func(name string, section *map[string]Value, values map[string]json.RawMessage, clear bool) {
+		if clear {
+			for k := range *section {
+				touched[k] = true
+			}
+			*section = nil
+			acc.State[name] = nil
+			return
+		}
+		if values == nil {
+			return
+		}
+		if *section == nil {
+			*section = map[string]Value{}
+		}
+		acc.State[name] = map[string]json.RawMessage{}
+		acc.Metadata[name] = map[string]Timestamp{}
+		for k, v := range values {
+			touched[k] = true
+			acc.State[name][k] = v
+			acc.Metadata[name][k] = Timestamp{t.Unix()}
+			if isNull(v) {
+				delete(*section, k)
+			} else {
+				(*section)[k] = Value{v, t}
+			}
+		}
+	}
+	apply("desired", &doc.Desired, req.Desired, req.ClearDesired)
+	apply("reported", &doc.Reported, req.Reported, req.ClearReported)
+	doc.Version++
+	acc.Version = doc.Version
+
+	var delta *Delta
+	for k := range touched {
+		want, ok := doc.Desired[k]
+		if !ok {
+			continue
+		}
+		if have, ok := doc.Reported[k]; ok && equal(want.Value, have.Value) {
+			continue
+		}
+		if delta == nil {
+			delta = &Delta{
+				Version:   doc.Version,
+				Timestamp: t.Unix(),
+				State:     map[string]json.RawMessage{},
+				Metadata:  map[string]Timestamp{},
+			}
+		}
+		delta.State[k] = want.Value
+		delta.Metadata[k] = Timestamp{want.Timestamp.Unix()}
+	}
+	return &acc, delta, nil
+}
+
+// Settle removes a desired field whose value has been reported,
+// returning whether it did. It's for desired values that are
+// one-off requests rather than state to keep. Unlike an update, it
+// doesn't change the version: nobody's told about it.
+func (doc *Document) Settle(key string) bool {
+	want, ok := doc.Desired[key]
+	if !ok {
+		return false
+	}
+	if have, ok := doc.Reported[key]; !ok || !equal(want.Value, have.Value) {
+		return false
+	}
+	delete(doc.Desired, key)
+	return true
+}
@@ -0,0 +1,156 @@
+package shadow
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantCode int
+		wantMsg  string
+	}{
+		{`{"clientToken":"5975bc44","state":{"reported":{"temp_a":22.99}}}`, 0, ""},
+		{`{"state":{"desired":{"mode":8},"reported":null}}`, 0, ""},
+		{`{"state":{"desired":null}}`, 0, ""},
+		{`{"clientToken":"5975bc44"}`, CodeBadRequest, "Missing required node: state"},
+		{`{"state":{}}`, CodeBadRequest, "State contains no desired or reported state"},
+		{`{"state":[]}`, CodeBadRequest, "State node must be an object"},
+		{`{"state":{"reported":5}}`, CodeBadRequest, "reported node must be an object"},
+		{`{"state":{"delta":{"mode":8}}}`, CodeBadRequest, "State contains an invalid node: delta"},
+		{`{"state":{"reported":{"a":1}},"metadata":{}}`, CodeBadRequest, "Unexpected node: metadata"},
+		{`{"state":{"reported":{"a":1}},"version":"x"}`, CodeBadRequest, "Invalid version"},
+		{`{"state":{"reported":{"a":1}},"clientToken":"` + strings.Repeat("x", 65) + `"}`, CodeBadRequest, "Invalid clientToken"},
+		{`{"state":{"reported":{"a":{"b":{"c":{"d":{"e":1}}}}}}}`, CodeBadRequest, "JSON contains too many levels of nesting; maximum is 6"},
+		{`{"state":{"reported":{"a":"{{{{{{{{"}}}`, 0, ""},
+		{`{"state":`, CodeBadRequest, "Invalid JSON"},
+		{`{"state":{"reported":{"a":"` + strings.Repeat("x", MaxRequestSize) + `"}}}`, CodePayloadTooLarge, "The payload exceeds the maximum size allowed"},
+	}
+	for _, tc := range tests {
+		_, err := ParseRequest([]byte(tc.in))
+		if tc.wantCode == 0 {
+			if err != nil {
+				t.Errorf("'%.60s': got error %v, want none", tc.in, err)
+			}
+			continue
+		}
+		if err == nil || err.Code != tc.wantCode || err.Message != tc.wantMsg {
+			t.Errorf("'%.60s': got error %v, want %d %s", tc.in, err, tc.wantCode, tc.wantMsg)
+		}
+	}
+
+	req, err := ParseRequest([]byte(`{"clientToken":"5975bc44","state":{"desired":null,"reported":{"mode":8,"door":null}}}`))
+	if err != nil {
+		t.Fatalf("ParseRequest failed: %v", err)
+	}
+	if req.ClientToken != "5975bc44" || !req.ClearDesired || req.ClearReported || req.Desired != nil ||
+		string(req.Reported["mode"]) != "8" || string(req.Reported["door"]) != "null" {
+		t.Errorf("got request %+v", req)
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	return string(b)
+}
+
+func TestUpdate(t *testing.T) {
+	t1 := time.Unix(1687012151, 0)
+	t2 := time.Unix(1687012160, 0)
+	t3 := time.Unix(1687012170, 0)
+	doc := Document{Version: 100}
+
+	// The device reports a value: accepted, nothing desired, so no
+	// delta
+	acc, delta, err := doc.Update(&Request{
+		Reported:    map[string]json.RawMessage{"recipe_id": json.RawMessage("1687012151"), "temp_a": json.RawMessage("22.0")},
+		ClientToken: "5975bc44",
+	}, t1)
+	if err != nil {
+		t.Fatalf("update 1 failed: %v", err)
+	}
+	want := `{"state":{"reported":{"recipe_id":1687012151,"temp_a":22.0}},` +
+		`"metadata":{"reported":{"recipe_id":{"timestamp":1687012151},"temp_a":{"timestamp":1687012151}}},` +
+		`"version":101,"timestamp":1687012151,"clientToken":"5975bc44"}`
+	if got := mustJSON(t, acc); got != want || delta != nil {
+		t.Errorf("update 1, got accepted '%s', delta %+v, want '%s' and no delta", got, delta, want)
+	}
+
+	// We want a different recipe and mode: delta for both
+	acc, delta, err = doc.Update(&Request{
+		Desired: map[string]json.RawMessage{"recipe_id": json.RawMessage("1687012160"), "mode": json.RawMessage("8")},
+	}, t2)
+	if err != nil {
+		t.Fatalf("update 2 failed: %v", err)
+	}
+	want = `{"version":102,"timestamp":1687012160,"state":{"mode":8,"recipe_id":1687012160},` +
+		`"metadata":{"mode":{"timestamp":1687012160},"recipe_id":{"timestamp":1687012160}}}`
+	if got := mustJSON(t, delta); got != want || acc.Version != 102 {
+		t.Errorf("update 2, got delta '%s', version %d, want '%s', 102", got, acc.Version, want)
+	}
+
+	// The device reports the mode, in a different format: no delta
+	// for it, and unrelated fields don't get one either. Then it
+	// reports an unrelated field: no delta at all.
+	_, delta, err = doc.Update(&Request{Reported: map[string]json.RawMessage{"mode": json.RawMessage("8.0")}}, t3)
+	if err != nil || delta != nil {
+		t.Errorf("update 3, got delta %+v, error %v, want neither", delta, err)
+	}
+	_, delta, err = doc.Update(&Request{Reported: map[string]json.RawMessage{"temp_a": json.RawMessage("23.5")}}, t3)
+	if err != nil || delta != nil {
+		t.Errorf("update 4, got delta %+v, error %v, want neither", delta, err)
+	}
+
+	// The mode's settled, the recipe isn't, and nothing changes
+	// version
+	if doc.Settle("recipe_id") || !doc.Settle("mode") || doc.Settle("mode") || doc.Version != 104 {
+		t.Errorf("settling, got document %+v, want only mode settled, version 104", doc)
+	}
+	if _, ok := doc.Desired["mode"]; ok {
+		t.Errorf("settled mode still desired")
+	}
+
+	// The device asks for a recipe: the delta has the desired
+	// value, its timestamp, and the new version
+	_, delta, err = doc.Update(&Request{Reported: map[string]json.RawMessage{"recipe_id": json.RawMessage("1")}}, t3)
+	if err != nil {
+		t.Fatalf("update 5 failed: %v", err)
+	}
+	want = `{"version":105,"timestamp":1687012170,"state":{"recipe_id":1687012160},` +
+		`"metadata":{"recipe_id":{"timestamp":1687012160}}}`
+	if got := mustJSON(t, delta); got != want {
+		t.Errorf("update 5, got delta '%s', want '%s'", got, want)
+	}
+
+	// Version conflict
+	_, _, err = doc.Update(&Request{Reported: map[string]json.RawMessage{"mode": json.RawMessage("0")}, Version: 104}, t3)
+	if err == nil || err.Code != CodeConflict || doc.Version != 105 {
+		t.Errorf("update with old version, got error %v, version %d, want 409, 105", err, doc.Version)
+	}
+	rej := mustJSON(t, err.Rejected(t3, "5975bc44"))
+	want = `{"code":409,"message":"Version conflict","timestamp":1687012170,"clientToken":"5975bc44"}`
+	if rej != want {
+		t.Errorf("got rejected '%s', want '%s'", rej, want)
+	}
+
+	// Deleting a field and clearing desired
+	acc, delta, err = doc.Update(&Request{Reported: map[string]json.RawMessage{"temp_a": json.RawMessage("null")}, ClearDesired: true, Version: 105}, t3)
+	if err != nil || delta != nil {
+		t.Fatalf("update 6, got delta %+v, error %v, want neither", delta, err)
+	}
+	want = `{"state":{"desired":null,"reported":{"temp_a":null}},` +
+		`"metadata":{"reported":{"temp_a":{"timestamp":1687012170}}},"version":106,"timestamp":1687012170}`
+	if got := mustJSON(t, acc); got != want {
+		t.Errorf("update 6, got accepted '%s', want '%s'", got, want)
+	}
+	if _, ok := doc.Reported["temp_a"]; ok || doc.Desired != nil || len(doc.Reported) != 2 {
+		t.Errorf("update 6, got document %+v, want temp_a and desired gone", doc)
+	}
+}
@@ -1,14 +1,21 @@
 package ui
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/Jon-Bright/plantprism/device"
+	"github.com/Jon-Bright/plantprism/eventlog"
+	"github.com/Jon-Bright/plantprism/history"
 	"github.com/Jon-Bright/plantprism/logs"
+	"github.com/Jon-Bright/plantprism/mqtt"
 	"github.com/Jon-Bright/plantprism/plant"
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 )
 
@@ -16,8 +23,16 @@ var (
 	log       *logs.Loggers
 	publisher device.Publisher
 	version   string
+	reloader  func() (any, error)
+	brokerSt  func() mqtt.Status
+
+	listenAddr string
 )
 
+func InitFlags() {
+	flag.StringVar(&listenAddr, "http_listen", ":3000", "Address for the web UI to listen on, as host:port")
+}
+
 func getDevice(c *gin.Context, isGet bool, reqName string) *device.Device {
 	var (
 		id  string
@@ -43,46 +58,153 @@ func getDevice(c *gin.Context, isGet bool, reqName string) *device.Device {
 }
 
 func indexHandler(c *gin.Context) {
+	if _, set := c.GetQuery("id"); !set {
+		dashboardHandler(c)
+		return
+	}
 	d := getDevice(c, true, "Index")
 	if d == nil {
 		// Error, already handled
 		return
 	}
 	vd := struct {
-		DeviceID string
-		Version  string
+		DeviceID   string
+		DeviceName string
+		Version    string
 	}{
-		DeviceID: d.ID,
-		Version:  version,
+		DeviceID:   d.ID,
+		DeviceName: d.DisplayName(),
+		Version:    version,
 	}
 
 	c.HTML(http.StatusOK, "index.templ.html", vd)
 }
 
+// maxDashboardHarvests is how many upcoming harvests the dashboard
+// shows per device.
+const maxDashboardHarvests = 3
+
+type dashboardDevice struct {
+	ID           string
+	Name         string
+	Status       string
+	Online       bool
+	Mode         string
+	TankLevel    string
+	WantNutrient int
+	Harvests     []string
+	MoreHarvests int
+}
+
+func dashboardHandler(c *gin.Context) {
+	var dds []dashboardDevice
+	for _, s := range device.Summaries(publisher) {
+		if s.Err != nil {
+			dds = append(dds, dashboardDevice{
+				ID:        s.ID,
+				Name:      s.ID,
+				Status:    "Failed to load",
+				Mode:      "-",
+				TankLevel: "-",
+			})
+			continue
+		}
+		dd := dashboardDevice{
+			ID:           s.ID,
+			Name:         s.Name,
+			Online:       s.Online,
+			Mode:         s.Mode.String(),
+			TankLevel:    fmt.Sprintf("%d/2", s.TankLevel),
+			WantNutrient: s.WantNutrient,
+		}
+		if dd.Name == "" {
+			dd.Name = s.ID
+		}
+		switch {
+		case !s.Seen:
+			dd.Status = "Never seen"
+		case s.Online:
+			dd.Status = "Online"
+		default:
+			dd.Status = "Offline since " + s.LastMessage.Local().Format("2 Jan 15:04")
+		}
+		for i, h := range s.Harvests {
+			if i == maxDashboardHarvests {
+				dd.MoreHarvests = len(s.Harvests) - i
+				break
+			}
+			name := fmt.Sprintf("plant %d", h.Plant)
+			if p, err := plant.Get(h.Plant); err == nil {
+				name = p.Names["de"] // TODO: language
+			}
+			dd.Harvests = append(dd.Harvests, fmt.Sprintf("%s (%s) from %s", name, h.Slot, h.HarvestFrom.Local().Format("2 Jan")))
+		}
+		dds = append(dds, dd)
+	}
+	vd := struct {
+		Devices []dashboardDevice
+		Version string
+	}{
+		Devices: dds,
+		Version: version,
+	}
+	c.HTML(http.StatusOK, "dashboard.templ.html", vd)
+}
+
+func setNameHandler(c *gin.Context) {
+	d := getDevice(c, false, "SetName")
+	if d == nil {
+		// Error, already handled
+		return
+	}
+	name, set := c.GetPostForm("name")
+	if !set {
+		log.Warn.Printf("setName request with no name received")
+		c.String(http.StatusBadRequest, "No name specified")
+		return
+	}
+	err := d.SetName(name)
+	if err != nil {
+		log.Warn.Printf("setName '%s' failed: %v", name, err)
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
 func plantDBHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, plant.GetDB())
 }
 
-func sendSlotUpdate(c *gin.Context, d *device.Device, se *device.SlotEvent) bool {
-	slot := d.Slots[se.Layer][se.Slot]
+// sendEvent sends a server-sent event with an ID, which the browser
+// sends back as Last-Event-ID when it reconnects.
+func sendEvent(c *gin.Context, id uint64, name string, data any) {
+	c.Render(-1, sse.Event{
+		Id:    strconv.FormatUint(id, 10),
+		Event: name,
+		Data:  data,
+	})
+}
+
+func sendSlotUpdate(c *gin.Context, id uint64, se *device.SlotEvent) bool {
 	slotID := string(se.Layer) + strconv.Itoa(int(se.Slot))
-	planted := (slot.Plant != 0)
+	planted := (se.Plant != 0)
 	if planted {
-		p, err := plant.Get(slot.Plant)
+		p, err := plant.Get(se.Plant)
 		if err != nil {
-			log.Error.Printf("couldn't get plant for ID '%v': %v", slot.Plant, err)
+			log.Error.Printf("couldn't get plant for ID '%v': %v", se.Plant, err)
 			return false
 		}
-		c.SSEvent("slot", gin.H{
+		sendEvent(c, id, "slot", gin.H{
 			"Slot":         slotID,
 			"Planted":      true,
 			"PlantName":    p.Names["de"], // TODO: language
-			"PlantingTime": slot.PlantingTime.Unix(),
-			"HarvestFrom":  slot.HarvestFrom.Unix(),
-			"HarvestBy":    slot.HarvestBy.Unix(),
+			"PlantingTime": se.PlantingTime.Unix(),
+			"HarvestFrom":  se.HarvestFrom.Unix(),
+			"HarvestBy":    se.HarvestBy.Unix(),
 		})
 	} else {
-		c.SSEvent("slot", gin.H{
+		sendEvent(c, id, "slot", gin.H{
 			"Slot":    slotID,
 			"Planted": false,
 		})
@@ -90,8 +212,8 @@ func sendSlotUpdate(c *gin.Context, d *device.Device, se *device.SlotEvent) bool
 	return true
 }
 
-func sendStatusUpdate(c *gin.Context, d *device.Device, se *device.StatusEvent) bool {
-	c.SSEvent("status", gin.H{
+func sendStatusUpdate(c *gin.Context, id uint64, se *device.StatusEvent) bool {
+	sendEvent(c, id, "status", gin.H{
 		"TempA":        se.TempA,
 		"TempB":        se.TempB,
 		"TempTank":     se.TempTank,
@@ -106,33 +228,115 @@ func sendStatusUpdate(c *gin.Context, d *device.Device, se *device.StatusEvent)
 		"EC":           se.EC,
 		"SmoothedEC":   se.SmoothedEC,
 		"WantNutrient": se.WantNutrient,
+		"Online":       se.Online,
+		"LastMessage":  se.LastMessage.Unix(),
+		"StaleFields":  se.StaleFields,
+		"DoorAlert":    se.DoorAlert,
+		"DoorOpenTime": se.DoorOpenTime.Unix(),
+		"Cleaning":     cleaningStatus(se.Cleaning),
+		"Commands":     commandStatus(se.Commands),
+		"Outbox":       outboxStatus(se.Outbox),
+		"Suspicious":   suspiciousReadings(se.Suspicious),
 	})
 	return true
 }
 
+func cleaningStatus(cs *device.CleaningStatus) gin.H {
+	if cs == nil {
+		return nil
+	}
+	return gin.H{
+		"Stage":        cs.Stage.String(),
+		"Instructions": cs.Instructions,
+		"Started":      cs.Started.Unix(),
+		"StageStarted": cs.StageStarted.Unix(),
+		"Stuck":        cs.Stuck,
+	}
+}
+
+func commandStatus(cs []device.CommandStatus) []gin.H {
+	var l []gin.H
+	for _, c := range cs {
+		l = append(l, gin.H{
+			"Kind":        c.Kind.String(),
+			"Description": c.Description,
+			"Sent":        c.Sent.Unix(),
+			"Attempts":    c.Attempts,
+			"Failed":      c.Failed,
+		})
+	}
+	return l
+}
+
+func outboxStatus(ob *device.OutboxStatus) gin.H {
+	if ob == nil {
+		return nil
+	}
+	return gin.H{
+		"Pending":   ob.Pending,
+		"Oldest":    ob.Oldest.Unix(),
+		"Attempts":  ob.Attempts,
+		"LastError": ob.LastError,
+	}
+}
+
+func suspiciousReadings(srs []device.SuspiciousReading) []gin.H {
+	var l []gin.H
+	for _, sr := range srs {
+		l = append(l, gin.H{
+			"Field":   sr.Field,
+			"Value":   sr.Value,
+			"Time":    sr.Time.Unix(),
+			"Message": sr.Message,
+		})
+	}
+	return l
+}
+
 func streamHandler(c *gin.Context) {
 	d := getDevice(c, true, "Stream")
 	if d == nil {
 		// Error, already handled
 		return
 	}
-	slotChan := d.GetSlotChan()
-	statusChan := d.GetStatusChan()
-	defer func() {
-		d.DropSlotChan(slotChan)
-		d.DropStatusChan(statusChan)
-	}()
+	// An unparseable or missing ID just means we start afresh
+	lastID, _ := strconv.ParseUint(c.GetHeader("Last-Event-ID"), 10, 64)
+	sub := d.Subscribe(lastID)
+	defer d.Unsubscribe(sub)
+	if lastID != 0 {
+		log.Info.Printf("Stream for device '%s' reconnected from %d, resumed %v", d.ID, lastID, sub.Resumed())
+	}
 	c.Stream(func(w io.Writer) bool {
 		select {
-		case se := <-slotChan:
-			return sendSlotUpdate(c, d, se)
-		case se := <-statusChan:
-			return sendStatusUpdate(c, d, se)
+		case <-sub.Ready():
+			for _, u := range sub.Take() {
+				if !sendUpdate(c, u) {
+					return false
+				}
+			}
+			return true
+		case <-sub.Evicted():
+			// The browser will reconnect and resume
+			log.Warn.Printf("Stream for device '%s' fell behind, closing", d.ID)
+			return false
+		case <-c.Request.Context().Done():
+			return false
 		}
-		return false
 	})
 }
 
+func sendUpdate(c *gin.Context, u device.Update) bool {
+	switch {
+	case u.Slot != nil:
+		return sendSlotUpdate(c, u.ID, u.Slot)
+	case u.Status != nil:
+		return sendStatusUpdate(c, u.ID, u.Status)
+	case u.Event != nil:
+		sendEvent(c, u.ID, "event", u.Event)
+	}
+	return true
+}
+
 func addPlantHandler(c *gin.Context) {
 	d := getDevice(c, false, "AddPlant")
 	if d == nil {
@@ -207,106 +411,403 @@ func triggerWateringHandler(c *gin.Context) {
 	c.JSON(http.StatusNoContent, nil)
 }
 
-func startCleaningHandler(c *gin.Context) {
-	d := getDevice(c, false, "StartCleaning")
+// setMode handles all the mode change requests. A mode change that
+// isn't possible right now, or that needs confirming, is a conflict.
+// For the latter, we tell the frontend why, so that it can ask the
+// user and repeat the request with "confirmed" set.
+func setMode(c *gin.Context, reqName string, mode device.DeviceMode) {
+	d := getDevice(c, false, reqName)
 	if d == nil {
 		// Error, already handled
 		return
 	}
-	err := d.SetMode(device.ModeCleaning)
-	if err != nil {
-		log.Warn.Printf("startCleaning failed: %v", err)
-		c.String(http.StatusInternalServerError, "StartCleaning failed")
+	confirmed := c.PostForm("confirmed") == "true"
+	err := d.SetMode(mode, confirmed)
+	var changeErr *device.ModeChangeError
+	var confirmErr *device.ModeConfirmationError
+	if errors.As(err, &changeErr) {
+		log.Warn.Printf("%s failed: %v", reqName, err)
+		c.String(http.StatusConflict, "Can't change from %v mode to %v mode", changeErr.From, changeErr.To)
+		return
+	} else if errors.As(err, &confirmErr) {
+		log.Info.Printf("%s needs confirmation: %v", reqName, err)
+		c.JSON(http.StatusConflict, gin.H{"Confirm": confirmErr.Reason})
+		return
+	} else if err != nil {
+		log.Warn.Printf("%s failed: %v", reqName, err)
+		c.String(http.StatusInternalServerError, "%s failed", reqName)
 		return
 	}
 	c.JSON(http.StatusNoContent, nil)
 }
 
+func startCleaningHandler(c *gin.Context) {
+	setMode(c, "StartCleaning", device.ModeCleaning)
+}
+
 func startDrainingHandler(c *gin.Context) {
-	d := getDevice(c, false, "StartDraining")
+	setMode(c, "StartDraining", device.ModeTankDrainCleaning)
+}
+
+func finishCleaningHandler(c *gin.Context) {
+	d := getDevice(c, false, "FinishCleaning")
 	if d == nil {
 		// Error, already handled
 		return
 	}
-	err := d.SetMode(device.ModeTankDrainCleaning)
-	if err != nil {
-		log.Warn.Printf("startDraining failed: %v", err)
-		c.String(http.StatusInternalServerError, "StartDraining failed")
+	err := d.FinishCleaning()
+	if errors.Is(err, device.ErrCleaningNotFinished) {
+		log.Warn.Printf("finishCleaning failed: %v", err)
+		c.String(http.StatusConflict, "Cleaning isn't finished")
+		return
+	} else if err != nil {
+		log.Warn.Printf("finishCleaning failed: %v", err)
+		c.String(http.StatusInternalServerError, "FinishCleaning failed")
 		return
 	}
 	c.JSON(http.StatusNoContent, nil)
 }
 
 func defaultModeHandler(c *gin.Context) {
-	d := getDevice(c, false, "DefaultMode")
+	setMode(c, "DefaultMode", device.ModeDefault)
+}
+
+func silentModeHandler(c *gin.Context) {
+	setMode(c, "SilentMode", device.ModeSilent)
+}
+
+func cinemaModeHandler(c *gin.Context) {
+	setMode(c, "CinemaMode", device.ModeCinema)
+}
+
+func setSunriseHandler(c *gin.Context) {
+	d := getDevice(c, false, "SetSunrise")
 	if d == nil {
 		// Error, already handled
 		return
 	}
-	err := d.SetMode(device.ModeDefault)
+	sunrise, set := c.GetPostForm("seconds")
+	if !set {
+		log.Warn.Printf("setSunrise request with no seconds received")
+		c.String(http.StatusBadRequest, "No seconds specified")
+		return
+	}
+	sunriseI, err := strconv.Atoi(sunrise)
+	if err != nil {
+		log.Warn.Printf("setSunrise seconds '%s' not numeric: %v", sunrise, err)
+		c.String(http.StatusBadRequest, "Invalid seconds specified")
+		return
+	}
+	err = d.SetSunrise(time.Duration(sunriseI) * time.Second)
 	if err != nil {
-		log.Warn.Printf("defaultMode failed: %v", err)
-		c.String(http.StatusInternalServerError, "DefaultMode failed")
+		log.Warn.Printf("setSunrise seconds '%s' failed: %v", sunrise, err)
+		c.String(http.StatusInternalServerError, "SetSunrise failed")
 		return
 	}
 	c.JSON(http.StatusNoContent, nil)
 }
 
-func silentModeHandler(c *gin.Context) {
-	d := getDevice(c, false, "SilentMode")
+func livenessHandler(c *gin.Context) {
+	d := getDevice(c, true, "Liveness")
 	if d == nil {
 		// Error, already handled
 		return
 	}
-	err := d.SetMode(device.ModeSilent)
+	ls := d.Liveness()
+	lastSeen := make(map[string]int64, len(ls.LastSeen))
+	for k, t := range ls.LastSeen {
+		lastSeen[k] = t.Unix()
+	}
+	expected := make(map[string]float64, len(ls.Expected))
+	for f, e := range ls.Expected {
+		expected[f] = e.Seconds()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"Online":      ls.Online,
+		"LastMessage": ls.LastMessage.Unix(),
+		"LastSeen":    lastSeen,
+		"Expected":    expected,
+		"StaleFields": ls.StaleFields,
+	})
+}
+
+func rejectionsHandler(c *gin.Context) {
+	d := getDevice(c, true, "Rejections")
+	if d == nil {
+		// Error, already handled
+		return
+	}
+	rs := d.Rejections()
+	out := make(map[device.RejectReason]gin.H, len(rs))
+	for reason, r := range rs {
+		out[reason] = gin.H{
+			"Count":       r.Count,
+			"First":       r.First.Unix(),
+			"Last":        r.Last.Unix(),
+			"LastMessage": r.LastMessage,
+		}
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func suspiciousHandler(c *gin.Context) {
+	d := getDevice(c, true, "Suspicious")
+	if d == nil {
+		// Error, already handled
+		return
+	}
+	c.JSON(http.StatusOK, suspiciousReadings(d.SuspiciousReadings()))
+}
+
+func rangesHandler(c *gin.Context) {
+	d := getDevice(c, true, "Ranges")
+	if d == nil {
+		// Error, already handled
+		return
+	}
+	c.JSON(http.StatusOK, d.FieldRanges())
+}
+
+func setRangeHandler(c *gin.Context) {
+	d := getDevice(c, false, "SetRange")
+	if d == nil {
+		// Error, already handled
+		return
+	}
+	field := c.PostForm("field")
+	minS, minSet := c.GetPostForm("min")
+	maxS, maxSet := c.GetPostForm("max")
+	if field == "" || !minSet || !maxSet {
+		log.Warn.Printf("setRange request without field, min or max received")
+		c.String(http.StatusBadRequest, "Field, min and max must be specified")
+		return
+	}
+	min, err := strconv.ParseFloat(minS, 64)
+	if err != nil {
+		log.Warn.Printf("setRange min '%s' not numeric: %v", minS, err)
+		c.String(http.StatusBadRequest, "Invalid min specified")
+		return
+	}
+	max, err := strconv.ParseFloat(maxS, 64)
 	if err != nil {
-		log.Warn.Printf("silentMode failed: %v", err)
-		c.String(http.StatusInternalServerError, "SilentMode failed")
+		log.Warn.Printf("setRange max '%s' not numeric: %v", maxS, err)
+		c.String(http.StatusBadRequest, "Invalid max specified")
+		return
+	}
+	err = d.SetFieldRange(field, device.FieldRange{Min: min, Max: max})
+	if err != nil {
+		log.Warn.Printf("setRange for '%s' failed: %v", field, err)
+		c.String(http.StatusBadRequest, err.Error())
 		return
 	}
 	c.JSON(http.StatusNoContent, nil)
 }
 
-func cinemaModeHandler(c *gin.Context) {
-	d := getDevice(c, false, "CinemaMode")
+func discoveryHandler(c *gin.Context) {
+	var l []gin.H
+	for _, dc := range device.Discoveries() {
+		l = append(l, gin.H{
+			"Kind":      dc.Kind,
+			"Where":     dc.Where,
+			"Key":       dc.Key,
+			"Count":     dc.Count,
+			"FirstSeen": dc.FirstSeen.Unix(),
+			"LastSeen":  dc.LastSeen.Unix(),
+			"Samples":   dc.Samples,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"Lenient":     device.Lenient(),
+		"Discoveries": l,
+	})
+}
+
+// SetConnectionStatus sets where GET /broker and GET /metrics get the
+// state of the broker connection from.
+func SetConnectionStatus(f func() mqtt.Status) {
+	brokerSt = f
+}
+
+func brokerStatus() gin.H {
+	if brokerSt == nil {
+		return nil
+	}
+	st := brokerSt()
+	return gin.H{
+		"State":     st.State,
+		"Broker":    st.Broker,
+		"Since":     st.Since.Unix(),
+		"LastError": st.LastError,
+		"Attempts":  st.Attempts,
+		"Lost":      st.Lost,
+	}
+}
+
+func brokerHandler(c *gin.Context) {
+	st := brokerStatus()
+	if st == nil {
+		c.String(http.StatusNotFound, "No broker status available")
+		return
+	}
+	c.JSON(http.StatusOK, st)
+}
+
+func metricsHandler(c *gin.Context) {
+	out := make(map[string]gin.H)
+	for id, m := range device.AllMetrics() {
+		h := gin.H{
+			"QueueDepth":    m.QueueDepth,
+			"QueueCapacity": m.QueueCapacity,
+			"Received":      m.Received,
+			"Dropped":       m.Dropped,
+			"Processed":     m.Processed,
+			"LastLatency":   m.LastLatency.Seconds(),
+			"AvgLatency":    m.AvgLatency.Seconds(),
+			"MaxLatency":    m.MaxLatency.Seconds(),
+			"Restarts":      m.Restarts,
+		}
+		if m.Restarts > 0 {
+			h["LastPanic"] = m.LastPanic
+			h["LastPanicTime"] = m.LastPanicTime.Unix()
+		}
+		out[id] = h
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"Broker":  brokerStatus(),
+		"Devices": out,
+	})
+}
+
+func eventsHandler(c *gin.Context) {
+	d := getDevice(c, true, "Events")
 	if d == nil {
 		// Error, already handled
 		return
 	}
-	err := d.SetMode(device.ModeCinema)
+	loc, err := history.ParseLocation(d.Summary().Timezone)
+	if err != nil {
+		log.Error.Printf("device '%s' has invalid timezone: %v", d.ID, err)
+		loc = time.Local
+	}
+	var f eventlog.Filter
+	f.From, err = history.ParseTime(c.Query("from"), loc)
 	if err != nil {
-		log.Warn.Printf("cinemaMode failed: %v", err)
-		c.String(http.StatusInternalServerError, "CinemaMode failed")
+		log.Warn.Printf("events request with invalid from: %v", err)
+		c.String(http.StatusBadRequest, "Invalid from specified")
 		return
 	}
-	c.JSON(http.StatusNoContent, nil)
+	f.To, err = history.ParseRangeEnd(c.Query("to"), loc)
+	if err != nil {
+		log.Warn.Printf("events request with invalid to: %v", err)
+		c.String(http.StatusBadRequest, "Invalid to specified")
+		return
+	}
+	f.MinSeverity, err = eventlog.ParseSeverity(c.Query("severity"))
+	if err != nil {
+		log.Warn.Printf("events request with invalid severity: %v", err)
+		c.String(http.StatusBadRequest, "Invalid severity specified")
+		return
+	}
+	f.Labels = history.ParseFields(c.Query("labels"))
+	limit := 200
+	if ls, set := c.GetQuery("limit"); set {
+		limit, err = strconv.Atoi(ls)
+		if err != nil || limit < 0 {
+			log.Warn.Printf("events request with invalid limit '%s'", ls)
+			c.String(http.StatusBadRequest, "Invalid limit specified")
+			return
+		}
+	}
+	entries, err := d.Events(f, limit)
+	if err != nil {
+		log.Error.Printf("events query failed: %v", err)
+		c.String(http.StatusInternalServerError, "Events query failed")
+		return
+	}
+	if entries == nil {
+		entries = []eventlog.Entry{}
+	}
+	c.JSON(http.StatusOK, entries)
 }
 
-func setSunriseHandler(c *gin.Context) {
-	d := getDevice(c, false, "SetSunrise")
+func exportHandler(c *gin.Context) {
+	d := getDevice(c, true, "Export")
 	if d == nil {
 		// Error, already handled
 		return
 	}
-	sunrise, set := c.GetPostForm("seconds")
+	format, err := history.ParseFormat(c.Query("format"))
+	if err != nil {
+		log.Warn.Printf("export request with invalid format: %v", err)
+		c.String(http.StatusBadRequest, "Invalid format specified")
+		return
+	}
+	// By default, times are in the device's timezone, which is
+	// probably what the person looking at the cube expects.
+	tz, set := c.GetQuery("tz")
 	if !set {
-		log.Warn.Printf("setSunrise request with no seconds received")
-		c.String(http.StatusBadRequest, "No seconds specified")
+		tz = d.Summary().Timezone
+	}
+	loc, err := history.ParseLocation(tz)
+	if err != nil {
+		log.Warn.Printf("export request with invalid timezone: %v", err)
+		c.String(http.StatusBadRequest, "Invalid tz specified")
 		return
 	}
-	sunriseI, err := strconv.Atoi(sunrise)
+	var f history.Filter
+	f.From, err = history.ParseTime(c.Query("from"), loc)
 	if err != nil {
-		log.Warn.Printf("setSunrise seconds '%s' not numeric: %v", sunrise, err)
-		c.String(http.StatusBadRequest, "Invalid seconds specified")
+		log.Warn.Printf("export request with invalid from: %v", err)
+		c.String(http.StatusBadRequest, "Invalid from specified")
 		return
 	}
-	err = d.SetSunrise(time.Duration(sunriseI) * time.Second)
+	f.To, err = history.ParseRangeEnd(c.Query("to"), loc)
 	if err != nil {
-		log.Warn.Printf("setSunrise seconds '%s' failed: %v", sunrise, err)
-		c.String(http.StatusInternalServerError, "SetSunrise failed")
+		log.Warn.Printf("export request with invalid to: %v", err)
+		c.String(http.StatusBadRequest, "Invalid to specified")
 		return
 	}
-	c.JSON(http.StatusNoContent, nil)
+	f.Kinds, err = history.ParseKinds(c.Query("kinds"))
+	if err != nil {
+		log.Warn.Printf("export request with invalid kinds: %v", err)
+		c.String(http.StatusBadRequest, "Invalid kinds specified")
+		return
+	}
+	f.Fields = history.ParseFields(c.Query("fields"))
+	recs, err := d.History(f)
+	if err != nil {
+		log.Error.Printf("export history query failed: %v", err)
+		c.String(http.StatusInternalServerError, "Export failed")
+		return
+	}
+	fn := fmt.Sprintf("plantcube-%s-history.%s", d.ID, format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fn))
+	c.Header("Content-Type", format.ContentType())
+	err = history.Export(c.Writer, recs, format, loc)
+	if err != nil {
+		// Too late to change the status at this point
+		log.Error.Printf("export writing failed: %v", err)
+	}
+}
+
+// SetReloader sets what POST /admin/reload calls to reload the
+// configuration. What it returns is sent as JSON.
+func SetReloader(f func() (any, error)) {
+	reloader = f
+}
+
+func reloadHandler(c *gin.Context) {
+	if reloader == nil {
+		c.String(http.StatusNotFound, "Reloading isn't available")
+		return
+	}
+	rep, err := reloader()
+	if err != nil {
+		log.Warn.Printf("Config reload from %s failed: %v", c.ClientIP(), err)
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, rep)
 }
 
 func Init(l *logs.Loggers, p device.Publisher, v string) {
@@ -320,18 +821,31 @@ func Init(l *logs.Loggers, p device.Publisher, v string) {
 	r.GET("/", indexHandler)
 	r.GET("/plantdb.json", plantDBHandler)
 	r.GET("/stream", streamHandler)
+	r.GET("/export", exportHandler)
+	r.GET("/liveness", livenessHandler)
+	r.GET("/rejections", rejectionsHandler)
+	r.GET("/suspicious", suspiciousHandler)
+	r.GET("/ranges", rangesHandler)
+	r.GET("/discovery", discoveryHandler)
+	r.GET("/events", eventsHandler)
+	r.GET("/metrics", metricsHandler)
+	r.GET("/broker", brokerHandler)
 	r.POST("/addPlant", addPlantHandler)
 	r.POST("/harvestPlant", harvestPlantHandler)
 	r.POST("/resetNutrient", resetNutrientHandler)
 	r.POST("/triggerWatering", triggerWateringHandler)
 	r.POST("/startCleaning", startCleaningHandler)
 	r.POST("/startDraining", startDrainingHandler)
+	r.POST("/finishCleaning", finishCleaningHandler)
 	r.POST("/defaultMode", defaultModeHandler)
 	r.POST("/silentMode", silentModeHandler)
 	r.POST("/cinemaMode", cinemaModeHandler)
 	r.POST("/setSunrise", setSunriseHandler)
+	r.POST("/setRange", setRangeHandler)
+	r.POST("/setName", setNameHandler)
+	r.POST("/admin/reload", reloadHandler)
 	go func() {
-		err := r.Run(":3000")
+		err := r.Run(listenAddr)
 		log.Critical.Fatalf("gin Run() returned, error %v", err)
 	}()
 }